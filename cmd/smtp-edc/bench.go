@@ -0,0 +1,25 @@
+package main
+
+import "fmt"
+
+// runBench sends count messages over pooled connections and reports throughput
+func runBench(inv *invocation) error {
+	v := inv.settings
+	if v.GetString("server") == "" {
+		return fmt.Errorf("server is required")
+	}
+	msg, err := buildMessage(inv)
+	if err != nil {
+		return err
+	}
+	if err := checkRecipientCap(v, msg); err != nil {
+		return err
+	}
+	if err := inv.diags.check(v.GetBool("fail_on_warning")); err != nil {
+		return err
+	}
+	if err := confirmSend(inv, msg, v.GetInt("count")); err != nil {
+		return err
+	}
+	return sendRepeated(inv, msg, v.GetInt("count"))
+}
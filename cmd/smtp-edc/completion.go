@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	// Registered here because the completion script is generated from the commands list
+	commands = append(commands, &command{
+		name:    "completion",
+		summary: "Print a shell completion script (bash, zsh or fish)",
+		args:    "bash|zsh|fish",
+		flags:   func(fs *pflag.FlagSet) {},
+		run:     runCompletion,
+	})
+}
+
+// runCompletion writes the completion script for the requested shell
+func runCompletion(inv *invocation) error {
+	if inv.flags.NArg() != 1 {
+		return fmt.Errorf("completion requires exactly one shell: bash, zsh or fish")
+	}
+	return writeCompletion(inv.out, inv.flags.Arg(0))
+}
+
+// writeCompletion generates the completion script for shell from the subcommand flag sets
+func writeCompletion(w io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		return writeBashCompletion(w)
+	case "zsh":
+		// zsh can load bash completion functions through bashcompinit
+		fmt.Fprintln(w, "#compdef smtp-edc")
+		fmt.Fprintln(w, "autoload -U +X bashcompinit && bashcompinit")
+		return writeBashCompletion(w)
+	case "fish":
+		return writeFishCompletion(w)
+	default:
+		return fmt.Errorf("unsupported shell %q: expected bash, zsh or fish", shell)
+	}
+}
+
+// commandNames returns the names of all subcommands
+func commandNames() []string {
+	names := make([]string, 0, len(commands))
+	for _, cmd := range commands {
+		names = append(names, cmd.name)
+	}
+	return names
+}
+
+// flagWords returns the long and short flag spellings accepted by a subcommand
+func flagWords(cmd *command) []string {
+	var words []string
+	newFlagSet(cmd).VisitAll(func(f *pflag.Flag) {
+		words = append(words, "--"+flagName(f))
+		if f.Shorthand != "" {
+			words = append(words, "-"+f.Shorthand)
+		}
+	})
+	return words
+}
+
+// flagName returns the documented, hyphenated spelling of a flag
+func flagName(f *pflag.Flag) string {
+	return strings.ReplaceAll(f.Name, "_", "-")
+}
+
+// writeBashCompletion writes a bash completion function for smtp-edc
+func writeBashCompletion(w io.Writer) error {
+	names := strings.Join(commandNames(), " ")
+
+	fmt.Fprintln(w, "# bash completion for smtp-edc")
+	fmt.Fprintln(w, "_smtp_edc() {")
+	fmt.Fprintln(w, `    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}" cmd="" i`)
+	fmt.Fprintln(w, `    for ((i = 1; i < COMP_CWORD; i++)); do`)
+	fmt.Fprintf(w, "        case \"${COMP_WORDS[i]}\" in %s) cmd=\"${COMP_WORDS[i]}\"; break ;; esac\n", strings.Join(commandNames(), "|"))
+	fmt.Fprintln(w, "    done")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `    case "$prev" in`)
+	fmt.Fprintf(w, "        --auth-type|--auth_type|-a) COMPREPLY=($(compgen -W %q -- \"$cur\")); return ;;\n", strings.Join(authTypes, " "))
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `    if [[ -z "$cmd" && "$cur" != -* ]]; then`)
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", names)
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "    local flags")
+	fmt.Fprintln(w, `    case "$cmd" in`)
+	for _, cmd := range commands {
+		pattern := cmd.name
+		if cmd.name == defaultCommand {
+			pattern += `|""`
+		}
+		fmt.Fprintf(w, "        %s) flags=%q ;;\n", pattern, strings.Join(flagWords(cmd), " "))
+	}
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, `    COMPREPLY=($(compgen -W "$flags" -- "$cur"))`)
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -o default -F _smtp_edc smtp-edc")
+	return nil
+}
+
+// writeFishCompletion writes fish completions for smtp-edc
+func writeFishCompletion(w io.Writer) error {
+	fmt.Fprintln(w, "# fish completion for smtp-edc")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "complete -c smtp-edc -f -n __fish_use_subcommand -a %s -d %s\n", cmd.name, fishQuote(cmd.summary))
+	}
+	for _, cmd := range commands {
+		condition := "__fish_seen_subcommand_from " + cmd.name
+		if cmd.name == defaultCommand {
+			condition = "__fish_use_subcommand; or " + condition
+		}
+		newFlagSet(cmd).VisitAll(func(f *pflag.Flag) {
+			line := fmt.Sprintf("complete -c smtp-edc -n %s -l %s", fishQuote(condition), flagName(f))
+			if f.Shorthand != "" {
+				line += " -s " + f.Shorthand
+			}
+			if f.Name == "auth_type" {
+				line += " -x -a " + fishQuote(strings.Join(authTypes, " "))
+			}
+			fmt.Fprintf(w, "%s -d %s\n", line, fishQuote(f.Usage))
+		})
+	}
+	return nil
+}
+
+// fishQuote single-quotes s for a fish script
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
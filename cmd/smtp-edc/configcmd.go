@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/asachs/smtp-edc/internal/config"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	commands = append(commands,
+		&command{
+			name:    "config-init",
+			summary: "Write a commented template config file (to stdout if no path is given)",
+			args:    "[path]",
+			flags: func(fs *pflag.FlagSet) {
+				fs.String("format", "yaml", "Template format (yaml, json)")
+				fs.Bool("force", false, "Overwrite an existing file")
+			},
+			run: runConfigInit,
+		},
+		&command{
+			name:    "config-schema",
+			summary: "Print the JSON Schema for the config file",
+			flags:   func(fs *pflag.FlagSet) {},
+			run:     runConfigSchema,
+		},
+	)
+}
+
+// runConfigInit writes a template config file
+func runConfigInit(inv *invocation) error {
+	if inv.flags.NArg() > 1 {
+		return fmt.Errorf("config-init takes at most one path")
+	}
+	data, err := config.Template(inv.settings.GetString("format"))
+	if err != nil {
+		return err
+	}
+
+	path := inv.flags.Arg(0)
+	if path == "" {
+		_, err = inv.out.Write(data)
+		return err
+	}
+	if _, err := os.Stat(path); err == nil && !inv.settings.GetBool("force") {
+		return fmt.Errorf("%s already exists; use --force to overwrite it", path)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write config file: %v", err)
+	}
+	fmt.Fprintf(inv.out, "Wrote %s\n", path)
+	return nil
+}
+
+// runConfigSchema prints the JSON Schema for the config file
+func runConfigSchema(inv *invocation) error {
+	data, err := config.Schema()
+	if err != nil {
+		return err
+	}
+	_, err = inv.out.Write(data)
+	return err
+}
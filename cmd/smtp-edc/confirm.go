@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/asachs/smtp-edc/internal/message"
+)
+
+// stdin is where the answer to a confirmation prompt is read from
+var stdin io.Reader = os.Stdin
+
+// stdinIsTerminal reports whether stdin is interactive, so that a prompt can be answered
+var stdinIsTerminal = func() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirmSend asks the user to confirm a send of count copies of msg to a
+// server that is not on this machine or to more recipients than
+// --confirm-threshold. Nothing is asked when --yes is set or stdin is not a
+// terminal; an answer other than yes aborts the send.
+func confirmSend(inv *invocation, msg *message.Message, count int) error {
+	v := inv.settings
+	if v.GetBool("yes") || !stdinIsTerminal() {
+		return nil
+	}
+
+	var reasons []string
+	server := v.GetString("server")
+	if !isLocalServer(server) {
+		reasons = append(reasons, fmt.Sprintf("%s is not a local server", server))
+	}
+	threshold := v.GetInt("confirm_threshold")
+	if n := len(msg.Recipients()); threshold > 0 && n > threshold {
+		reasons = append(reasons, fmt.Sprintf("%d recipients is more than --confirm-threshold %d", n, threshold))
+	}
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "About to send %d message(s) to %d recipient(s) via %s:%d (%s).\nContinue? [y/N] ",
+		count, len(msg.Recipients()), server, v.GetInt("port"), strings.Join(reasons, "; "))
+	answer, err := bufio.NewReader(stdin).ReadString('\n')
+	if err != nil && answer == "" {
+		return fmt.Errorf("send not confirmed: %v", err)
+	}
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("send not confirmed")
+}
+
+// isLocalServer reports whether server names this machine
+func isLocalServer(server string) bool {
+	host := strings.ToLower(strings.TrimSuffix(server, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(strings.Trim(host, "[]"))
+	return ip != nil && ip.IsLoopback()
+}
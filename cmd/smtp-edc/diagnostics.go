@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Warning codes, stable so that CI can gate on them
+const (
+	warnDisposableDomain  = "disposable-domain"
+	warnNoTLS             = "no-tls"
+	warnSkippedAttachment = "skipped-attachment"
+	warnKeyLog            = "tls-keylog"
+	warnCACerts           = "ca-certs"
+	warnSizeNotAdvertised = "size-not-advertised"
+	warnSizeOverLimit     = "size-over-limit"
+	warnDSNNotAdvertised  = "dsn-not-advertised"
+	warnMetricsWrite      = "metrics-write"
+)
+
+// diagnostic is a warning in machine-readable form, as listed under
+// "warnings" with --output json
+type diagnostic struct {
+	Code     string `json:"code"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// diagnostics collects the warnings of a run. Pooled connections are dialed
+// concurrently, so it is safe for concurrent use. A nil *diagnostics only
+// prints the warnings.
+type diagnostics struct {
+	mu   sync.Mutex
+	list []diagnostic
+}
+
+// warn prints a warning to stderr and records it, once for each code and message
+func (d *diagnostics) warn(code, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if d != nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, seen := range d.list {
+			if seen.Code == code && seen.Message == msg {
+				return
+			}
+		}
+		d.list = append(d.list, diagnostic{Code: code, Severity: "warning", Message: msg})
+	}
+	fmt.Fprintf(os.Stderr, "WARNING: %s\n", msg)
+}
+
+// all returns the warnings recorded so far
+func (d *diagnostics) all() []diagnostic {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]diagnostic(nil), d.list...)
+}
+
+// check fails, naming the warning codes, if failOnWarning is set and any
+// warning has been recorded
+func (d *diagnostics) check(failOnWarning bool) error {
+	warnings := d.all()
+	if !failOnWarning || len(warnings) == 0 {
+		return nil
+	}
+	var codes []string
+	for _, w := range warnings {
+		codes = append(codes, w.Code)
+	}
+	return fmt.Errorf("%d warning(s) with --fail-on-warning: %s", len(warnings), strings.Join(codes, ", "))
+}
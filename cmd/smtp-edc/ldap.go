@@ -0,0 +1,81 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/asachs/smtp-edc/internal/message"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/spf13/viper"
+)
+
+// ldapTimeout bounds connecting to the directory and each request sent to it
+const ldapTimeout = 30 * time.Second
+
+// ldapRecipients returns the addresses in the mail attribute of the directory
+// entries matching --ldap-filter, in the order the server returned them
+func ldapRecipients(v *viper.Viper) ([]string, error) {
+	serverURL := v.GetString("ldap_url")
+	baseDN := v.GetString("ldap_base_dn")
+	if serverURL == "" || baseDN == "" {
+		return nil, fmt.Errorf("--ldap-filter requires --ldap-url and --ldap-base-dn")
+	}
+	attr := v.GetString("ldap_mail_attr")
+	filter := v.GetString("ldap_filter")
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: v.GetBool("ldap_skip_verify")}
+	conn, err := ldap.DialURL(serverURL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %v", err)
+	}
+	defer conn.Close()
+	conn.SetTimeout(ldapTimeout)
+
+	if v.GetBool("ldap_starttls") {
+		// Verify the certificate against the host named in the URL
+		if u, err := url.Parse(serverURL); err == nil {
+			tlsConfig.ServerName = u.Hostname()
+		}
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			return nil, fmt.Errorf("LDAP StartTLS failed: %v", err)
+		}
+	}
+	if bindDN := v.GetString("ldap_bind_dn"); bindDN != "" {
+		if err := conn.Bind(bindDN, v.GetString("ldap_password")); err != nil {
+			return nil, fmt.Errorf("LDAP bind as %s failed: %v", bindDN, err)
+		}
+	}
+
+	result, err := conn.Search(ldap.NewSearchRequest(baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, 0, false, filter, []string{attr}, nil))
+	if err != nil {
+		return nil, fmt.Errorf("LDAP search failed: %v", err)
+	}
+
+	var addresses []string
+	seen := make(map[string]bool)
+	for _, entry := range result.Entries {
+		for _, value := range entry.GetEqualFoldAttributeValues(attr) {
+			addr := message.NormalizeAddress(value)
+			if addr == "" || seen[addr] {
+				continue
+			}
+			seen[addr] = true
+			addresses = append(addresses, addr)
+		}
+	}
+	if len(addresses) == 0 {
+		if len(result.Referrals) > 0 {
+			return nil, fmt.Errorf("LDAP filter %q matched no entries with a %s attribute; the server referred the search to %s",
+				filter, attr, strings.Join(result.Referrals, ", "))
+		}
+		return nil, fmt.Errorf("LDAP filter %q matched no entries with a %s attribute", filter, attr)
+	}
+	return addresses, nil
+}
@@ -1,13 +1,18 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"regexp"
 	"strings"
 	"time"
 
+	"github.com/asachs/smtp-edc/internal/auth"
 	"github.com/asachs/smtp-edc/internal/client"
 	"github.com/asachs/smtp-edc/internal/config"
 	"github.com/asachs/smtp-edc/internal/message"
@@ -19,70 +24,406 @@ var (
 	cfg *config.SMTPConfig
 )
 
-func init() {
-	// Set default values
-	viper.SetDefault("port", 25)
-	viper.SetDefault("retries", 3)
-	viper.SetDefault("timeout", 30)
-	viper.SetDefault("starttls", false)
-	viper.SetDefault("skip_verify", false)
-	viper.SetDefault("debug", false)
-	viper.SetDefault("validate_mx", false)
+// authTypes lists the values accepted by --auth-type
+var authTypes = append([]string{client.AuthAuto}, auth.Types...)
+
+// command describes a subcommand and the flags it accepts
+type command struct {
+	name    string
+	summary string
+	// args describes the positional arguments; commands without it accept none
+	args  string
+	flags func(fs *pflag.FlagSet)
+	run   func(inv *invocation) error
+}
+
+// invocation holds the resolved settings and output for a single command run
+type invocation struct {
+	// ctx is cancelled when the user interrupts the run
+	ctx      context.Context
+	settings *viper.Viper
+	flags    *pflag.FlagSet
+	out      io.Writer
+	// skipped lists attachments left out by --skip-missing-attachments
+	skipped []string
+	// deduped lists attachments left out by --dedupe-attachments, and
+	// dedupeSaved the bytes that saved
+	deduped     []message.DuplicateAttachment
+	dedupeSaved int
+	// redact hides recipient addresses in output when --anonymize-recipients is set
+	redact func(string) string
+	// diags collects the warnings of the run
+	diags *diagnostics
+}
+
+// redactingWriter rewrites everything written through it with redact
+type redactingWriter struct {
+	w      io.Writer
+	redact func(string) string
+}
+
+// Write writes the redacted form of p
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, r.redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redactedError is an error whose message has been redacted
+type redactedError struct {
+	err error
+	msg string
+}
+
+// Error returns the redacted message
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+// Unwrap returns the original error
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// defaultCommand runs when no subcommand is given, so existing invocations keep working
+const defaultCommand = "send"
+
+// commands lists the available subcommands
+var commands = []*command{
+	{
+		name:    "send",
+		summary: "Send a message (default)",
+		flags: func(fs *pflag.FlagSet) {
+			connectionFlags(fs)
+			messageFlags(fs)
+			fs.IntP("count", "n", 1, "Number of messages to send")
+			fs.Bool("unique", false, "Give each message a unique Message-ID and a random token in the subject and body")
+			fs.Int("thread_depth", 1, "Send this many messages as a thread, each a reply to the one before with In-Reply-To and References")
+			fs.Float64("per_domain_rate", 0, "Maximum messages per second to any one recipient domain (0 for no limit)")
+			fs.String("metrics_file", "", "Write Prometheus metrics for the sends to this file, for the node_exporter textfile collector")
+			fs.Bool("no_temp_files", false, "Never create temporary files; the metrics file is overwritten in place, for read-only filesystems with a writable metrics file")
+			fs.String("expect_response", "", "Fail unless the server's final reply to each message matches this regular expression, e.g. \"queued as [A-Z0-9]+\"")
+			safetyFlags(fs)
+			fs.Bool("dry_run", false, "Build the message and print its summary without connecting")
+			fs.String("dump_envelope", "", "Write the MAIL FROM and RCPT TO envelope to this file as JSON")
+			fs.String("save_eml", "", "Write the message content sent after DATA to this file")
+			fs.String("manifest", "", "YAML file listing messages, each with its own from, to, subject, body, attachments or template, to send in turn over the same connections")
+		},
+		run: runSend,
+	},
+	{
+		name:    "probe",
+		summary: "Connect to the server and report its capabilities",
+		flags: func(fs *pflag.FlagSet) {
+			connectionFlags(fs)
+			fs.Bool("help_command", false, "Also send the SMTP HELP command and print the server's reply")
+			fs.String("help_topic", "", "Topic to pass to the SMTP HELP command")
+			fs.Bool("check_starttls", false, "Warn if STARTTLS is not advertised, a sign of STARTTLS stripping")
+			fs.String("baseline", "", "Known-good capability file, one EHLO extension per line; warn about any the server no longer advertises")
+			fs.Bool("paranoid", false, "Fail instead of warning when a downgrade is suspected")
+			fs.String("expect_caps", "", "File of required capabilities, one per line (e.g. STARTTLS, AUTH LOGIN, SIZE>=10485760); fail if any is not met")
+			fs.Bool("cipher_scan", false, "Find which TLS 1.2 cipher suites the server accepts, from --tls-ciphers or all those supported, and whether it applies its own order")
+			fs.String("bad_sni", "", "Run STARTTLS presenting this server name, which the certificate should not cover, and fail unless verification rejects it")
+		},
+		run: runProbe,
+	},
+	{
+		name:    "relay-test",
+		summary: "Check whether the server relays mail between outside domains",
+		flags: func(fs *pflag.FlagSet) {
+			connectionFlags(fs)
+			fs.String("relay_from", "relay-test@example.org", "Sender at an outside domain, one the server does not handle")
+			fs.String("relay_to", "", "Recipient at an outside domain that you control, which receives the test message if the server relays it")
+			fs.Bool("dry_relay", false, "Stop before DATA and reset, so that nothing is delivered even if the server would relay")
+		},
+		run: runRelayTest,
+	},
+	{
+		name:    "validate",
+		summary: "Check addresses and message options without connecting",
+		flags:   messageFlags,
+		run:     runValidate,
+	},
+	{
+		name:    "render",
+		summary: "Print the message that would be sent",
+		flags:   messageFlags,
+		run:     runRender,
+	},
+	{
+		name:    "bench",
+		summary: "Send repeated messages and report throughput",
+		flags: func(fs *pflag.FlagSet) {
+			connectionFlags(fs)
+			messageFlags(fs)
+			fs.IntP("count", "n", 10, "Number of messages to send")
+			fs.Bool("unique", true, "Give each message a unique Message-ID and a random token in the subject and body")
+			fs.Float64("per_domain_rate", 0, "Maximum messages per second to any one recipient domain (0 for no limit)")
+			fs.String("metrics_file", "", "Write Prometheus metrics for the sends to this file, for the node_exporter textfile collector")
+			fs.Bool("no_temp_files", false, "Never create temporary files; the metrics file is overwritten in place, for read-only filesystems with a writable metrics file")
+			fs.String("expect_response", "", "Fail each message whose final server reply does not match this regular expression")
+			safetyFlags(fs)
+		},
+		run: runBench,
+	},
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	err := runContext(ctx, os.Args[1:], os.Stdout)
+	stop()
+	if err != nil {
+		if errors.Is(err, pflag.ErrHelp) {
+			return
+		}
+		log.Fatal(err)
+	}
+}
+
+// run dispatches the command line to the matching subcommand
+func run(args []string, out io.Writer) error {
+	return runContext(context.Background(), args, out)
+}
+
+// runContext is run with a context that is cancelled to interrupt the command
+func runContext(ctx context.Context, args []string, out io.Writer) error {
+	cmd, args, err := commandFor(args)
+	if err != nil {
+		printUsage(os.Stderr)
+		return err
+	}
+
+	fs := newFlagSet(cmd)
+	v := viper.New()
+	if err := loadSettings(v, fs, args); err != nil {
+		return err
+	}
+	if cmd.args == "" && fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	switch output := v.GetString("output"); output {
+	case "text", "json":
+	default:
+		return fmt.Errorf("invalid output format %q: expected text or json", output)
+	}
+
+	// --version works with any command and skips running it
+	if v.GetBool("version") {
+		return writeVersion(out, v.GetString("output"))
+	}
+
+	inv := &invocation{ctx: ctx, settings: v, flags: fs, out: out, diags: &diagnostics{}}
+	err = cmd.run(inv)
+	if err != nil && inv.redact != nil {
+		// Errors name rejected recipients and quote the server's replies
+		err = &redactedError{err: err, msg: inv.redact(err.Error())}
+	}
+	return err
+}
+
+// commandFor returns the subcommand named by the first argument and the
+// remaining arguments. Without a subcommand the arguments go to send.
+func commandFor(args []string) (*command, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return lookupCommand(defaultCommand), args, nil
+	}
+	if cmd := lookupCommand(args[0]); cmd != nil {
+		return cmd, args[1:], nil
+	}
+	return nil, nil, fmt.Errorf("unknown command %q", args[0])
+}
+
+// lookupCommand returns the subcommand with the given name, or nil
+func lookupCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// printUsage prints the list of subcommands
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: smtp-edc [command] [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'smtp-edc <command> --help' for the flags of a command.")
+}
+
+// newFlagSet creates the flag set for a subcommand, including the global flags
+func newFlagSet(cmd *command) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(cmd.name, pflag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: smtp-edc %s [flags] %s\n\n%s\n\nFlags:\n", cmd.name, cmd.args, cmd.summary)
+		fmt.Fprint(os.Stderr, fs.FlagUsages())
+	}
+
+	// Accept both --flag-name and --flag_name spellings
+	fs.SetNormalizeFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+		return pflag.NormalizedName(strings.ReplaceAll(name, "-", "_"))
+	})
+
+	fs.StringP("config", "c", "", "Path to config file (JSON or YAML)")
+	fs.BoolP("debug", "D", false, "Enable debug output")
+	fs.String("output", "text", "Output format (text, json)")
+	fs.Bool("version", false, "Print version and build information and exit")
+	cmd.flags(fs)
+	return fs
+}
 
+// connectionFlags registers the flags used to connect and authenticate to a server
+func connectionFlags(fs *pflag.FlagSet) {
+	fs.StringP("server", "s", "", "SMTP server address")
+	fs.IntP("port", "p", 25, "SMTP server port")
+	fs.StringP("auth_type", "a", "", "Authentication type ("+strings.Join(authTypes, ", ")+"); auto picks the strongest the server advertises")
+	fs.Int("max_auth_attempts", 2, "Most mechanisms to try when the server rejects one, falling back to the next strongest advertised (0 for no limit)")
+	fs.StringP("username", "u", "", "Authentication username")
+	fs.StringP("password", "P", "", "Authentication password")
+	fs.String("oauth_token", "", "OAuth2 access token for XOAUTH2 authentication, as required by Gmail and Office 365 (implies --auth-type xoauth2)")
+	fs.BoolP("starttls", "l", false, "Use STARTTLS")
+	fs.Bool("smtps", false, "Use implicit TLS (SMTPS): start TLS on connect, before the greeting, as on port 465 (the default port with this flag)")
+	fs.Bool("auto_tls", false, "Try implicit TLS on connect and fall back to plaintext with STARTTLS if offered, for ports where either may be in use")
+	fs.BoolP("skip_verify", "k", false, "Skip TLS certificate verification")
+	fs.String("tls_servername", "", "Server name for TLS SNI and certificate verification (defaults to --server)")
+	fs.String("keylog_file", "", "Append TLS session secrets to this file so captures can be decrypted, e.g. in Wireshark; SSLKEYLOGFILE is used instead with --debug")
+	fs.String("ca_cert", "", "PEM file of root CAs to verify the server certificate against")
+	fs.String("ca_dir", "", "Directory of PEM root CA files to verify the server certificate against")
+	fs.String("tls_ciphers", "", "Comma-separated TLS 1.2 cipher suites to offer, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256; limits TLS to version 1.2, as TLS 1.3 suites cannot be chosen")
+	fs.String("client_cert", "", "PEM client certificate to present during the TLS handshake, for servers that require mutual TLS (needs --client-key)")
+	fs.String("client_key", "", "PEM private key for --client-cert")
+	fs.IntP("retries", "r", 3, "Number of attempts for operations that fail with a connection error or a transient (4xx) reply; permanent (5xx) rejections are not retried")
+	fs.IntP("timeout", "o", 30, "Connect and I/O timeout in seconds (overridden by --connect-timeout and --io-timeout)")
+	fs.Duration("connect_timeout", 0, "Timeout for establishing the connection, e.g. 5s (defaults to --timeout)")
+	fs.Duration("io_timeout", 0, "Timeout for each server response, e.g. 2m (defaults to --timeout)")
+	fs.String("mail_auth", "", "Submitter identity for the MAIL FROM AUTH= parameter (RFC 4954), or \"<>\" if unknown")
+	fs.String("dsn_notify", "", "Request delivery status notifications (RFC 3461) for each recipient: NEVER, or a comma-separated list of SUCCESS, FAILURE and DELAY; sent only if the server advertises DSN")
+	fs.String("dsn_return", "", "What a delivery status notification returns of the message: FULL or HDRS")
+	fs.String("dsn_envid", "", "Envelope id (ENVID) that delivery status notifications refer to")
+	fs.String("legacy_command", "", "Send the obsolete RFC 821 SEND, SOML or SAML command instead of MAIL, without ESMTP parameters; only for testing legacy devices")
+	fs.StringArray("rcpt_param", nil, "ESMTP parameter to add to each RCPT TO, as a template that can use the recipient, e.g. 'ORCPT=rfc822;{{xtext .Recipient}}' (repeatable)")
+	fs.Int64("declared_size", 0, "Declare this size in bytes with SIZE= on MAIL FROM instead of the real one, to test size rejection")
+	fs.String("ehlo_fallback_names", "", "Comma-separated EHLO names to try in turn if the server rejects the default name with a policy error")
+	fs.String("xclient", "", "Send Postfix XCLIENT with these comma-separated attributes (e.g. ADDR=192.0.2.10,NAME=client.example.com,LOGIN=alice); for testing from a trusted relay")
+	fs.Bool("handle_greylist", false, "When a message is greylisted, wait and retry it once")
+	fs.Duration("greylist_delay", 5*time.Minute, "How long to wait before retrying a greylisted message when the server does not say")
+	fs.Int("max_line_length", client.DefaultMaxLineLength, "Longest server response line to accept, in bytes (0 for no limit)")
+	fs.Bool("no_pipelining", false, "Do not use pipelining even if the server advertises it")
+	fs.Bool("no_chunking", false, "Send the message with DATA instead of BDAT even if the server advertises CHUNKING")
+	fs.Duration("post_send_delay", 0, "After each message is sent, keep the connection open and idle this long before it is reused or closed with QUIT, e.g. to test per-connection limits")
+	fs.Duration("keepalive", 0, "Send NOOP at this interval while --post-send-delay holds the connection (0 keeps it silent)")
+	fs.Duration("pool_max_idle", 30*time.Second, "Close pooled connections idle for longer than this (0 disables)")
+	fs.Duration("pool_max_lifetime", 5*time.Minute, "Close pooled connections older than this (0 disables)")
+	fs.Int("max_connections", 0, "Most connections to keep open to the server at once; sends wait for a free one (0 for no limit)")
+}
+
+// safetyFlags registers the flags that guard against sending to more recipients
+// or to a different server than intended
+func safetyFlags(fs *pflag.FlagSet) {
+	fs.Int("max_recipients", 100, "Abort before sending if the message has more recipients than this, after aliases are expanded (0 for no limit)")
+	fs.Int("confirm_threshold", 10, "Ask for confirmation before sending to more recipients than this (0 to only ask for servers that are not local)")
+	fs.BoolP("yes", "y", false, "Send without asking for confirmation, even if the recipient count exceeds --max-recipients")
+	fs.Bool("fail_on_warning", false, "Refuse to send when there is any warning, such as a disposable recipient domain or a connection without TLS")
+}
+
+// messageFlags registers the flags that describe the message
+func messageFlags(fs *pflag.FlagSet) {
+	fs.StringP("from", "f", "", "Sender email address")
+	fs.String("from_name", "", "Sender display name for the From header, e.g. \"Support Team\"")
+	fs.StringP("to", "t", "", "Recipient email addresses (comma-separated)")
+	fs.StringArray("to_name", nil, "Display name for the To address in the same position (repeatable)")
+	fs.StringP("cc", "C", "", "CC recipient email addresses (comma-separated)")
+	fs.StringP("bcc", "B", "", "BCC recipient email addresses (comma-separated)")
+	fs.Bool("anonymize_recipients", false, "Replace recipient addresses in all output, including the --debug transcript, with a stable hash; mail still goes to the real addresses")
+	fs.String("ldap_filter", "", "LDAP search filter, e.g. \"(memberOf=cn=staff,ou=groups,dc=example,dc=com)\"; the matching entries' addresses are added to the To recipients")
+	fs.String("ldap_url", "", "LDAP server URL for --ldap-filter (ldap://host or ldaps://host)")
+	fs.String("ldap_base_dn", "", "Base DN to search below for --ldap-filter")
+	fs.String("ldap_bind_dn", "", "DN to bind as for --ldap-filter (anonymous if unset)")
+	fs.String("ldap_password", "", "Password for --ldap-bind-dn")
+	fs.String("ldap_mail_attr", "mail", "Attribute holding the address of an LDAP entry")
+	fs.Bool("ldap_starttls", false, "Upgrade the ldap:// connection for --ldap-filter with StartTLS before binding")
+	fs.Bool("ldap_skip_verify", false, "Skip verification of the LDAP server's TLS certificate (ldaps:// or --ldap-starttls)")
+	fs.String("aliases", "", "Aliases file mapping group names to addresses (\"team@local: a@example.com, b@example.com\"), expanded in to, cc and bcc")
+	fs.StringP("subject", "S", "", "Email subject")
+	fs.StringP("subject_template", "T", "", "Email subject template")
+	fs.StringP("body", "b", "", "Email body text")
+	fs.StringP("body_file", "F", "", "File containing email body text")
+	fs.StringP("html", "H", "", "Email HTML body")
+	fs.StringP("html_file", "L", "", "File containing email HTML body")
+	fs.StringP("template", "e", "", "Path to email template file")
+	fs.String("html_template", "", "Path to HTML email template file; use {{cid \"name\"}} to reference inline attachments")
+	fs.String("eml", "", "Saved message (.eml) to relay as it is; the envelope defaults to its From, To and Cc headers")
+	fs.Bool("preserve_trace", false, "With --eml, keep the message's Received and Return-Path trace headers byte for byte instead of removing them")
+	fs.String("message_file", "", "Message file with YAML front-matter (from, to, cc, bcc, subject, headers) followed by a body template")
+	fs.StringP("template_data", "d", "", "JSON data for template (format: '{\"key\":\"value\"}')")
+	fs.StringP("attachments", "A", "", "Comma-separated list of files to attach, each optionally as file=name to set the name shown to the recipient")
+	fs.StringArray("attach_message", nil, "Email message file (.eml) to attach as a message/rfc822 part, as when forwarding (repeatable)")
+	fs.Bool("skip_missing_attachments", false, "Warn about and leave out attachments that cannot be read instead of failing")
+	fs.Bool("dedupe_attachments", false, "Attach content only once when several attachments are the same file, comparing SHA-256 hashes rather than names, and report the bytes saved")
+	fs.String("inline", "", "Comma-separated list of files to embed in the HTML body, each optionally as file=content-id")
+	fs.Bool("auto_body", false, "Add a \"See attached.\" text part when sending attachments without a body")
+	fs.StringP("headers", "h", "", "Custom headers (format: 'Key1: Value1, Key2: Value2'; quote or backslash-escape values containing ', Key:')")
+	fs.StringArray("header", nil, "Custom header in 'Key: Value' format (repeatable)")
+	fs.String("headers_file", "", "File containing custom headers, one \"Key: Value\" per line")
+	fs.Bool("preserve_header_case", false, "Emit custom header names exactly as given instead of canonicalizing them")
+	fs.String("date_format", "", "Go time layout for the Date header, e.g. \"Mon, 2 Jan 2006 15:04:05 -0700 (MST)\" (default RFC 1123 with a numeric zone); must give an RFC 5322 date")
+	fs.Bool("keep_line_endings", false, "Send the text and HTML bodies with their line endings as given instead of converting LF and CR to CRLF")
+	fs.Bool("strict_rfc5322", false, "Check the built message against RFC 5322 (header line length and syntax, required and duplicate headers, the Date and addresses) and refuse to send it if it does not conform")
+	fs.Bool("test_dot_termination", false, "Add a line holding only a dot to the body, followed by a line that goes missing if the dot is not escaped, to check that the message arrives intact")
+	fs.Bool("shuffle_headers", false, "Put the Message-ID and custom headers in a random order after From, To, Cc, Subject and Date, to test receivers that fingerprint header order")
+	fs.Int64("shuffle_seed", 0, "Seed for --shuffle-headers, to repeat an order (default: a random seed, which is printed)")
+	fs.Bool("minimal_headers", false, "Send only From, To, Cc, Subject, Date and the given headers, without the Message-ID, MIME-Version, Content-Type for plain text or X-Trace-Id added automatically")
+	fs.String("message_id", "", "Message-ID to send instead of a generated one, e.g. for reproducible output; angle brackets are added if missing")
+	fs.String("trace_id", "", "Correlation id for the X-Trace-Id header and the output (default: a generated UUID)")
+	fs.Bool("add_received", false, "Add a synthetic Received: trace header for this client as the topmost header")
+	fs.BoolP("validate_mx", "m", false, "Validate email addresses by checking MX records")
+}
+
+// loadSettings parses the command line and layers the configuration sources.
+// Precedence, from highest to lowest, is: flags given on the command line,
+// SMTP_* environment variables, the config file, and the defaults from the
+// flag definitions. A flag that is not passed explicitly never overrides a
+// lower layer with its default value.
+func loadSettings(v *viper.Viper, fs *pflag.FlagSet, args []string) error {
 	// Bind environment variables
-	viper.BindEnv("server", "SMTP_SERVER")
-	viper.BindEnv("port", "SMTP_PORT")
-	viper.BindEnv("username", "SMTP_USERNAME")
-	viper.BindEnv("password", "SMTP_PASSWORD")
-	viper.BindEnv("from", "SMTP_FROM")
-	viper.BindEnv("to", "SMTP_TO")
-	viper.BindEnv("cc", "SMTP_CC")
-	viper.BindEnv("bcc", "SMTP_BCC")
-	viper.BindEnv("subject", "SMTP_SUBJECT")
-	viper.BindEnv("auth_type", "SMTP_AUTH_TYPE")
-	viper.BindEnv("starttls", "SMTP_STARTTLS")
-	viper.BindEnv("skip_verify", "SMTP_SKIP_VERIFY")
-	viper.BindEnv("debug", "SMTP_DEBUG")
-
-	// Define flags
-	pflag.StringP("config", "c", "", "Path to config file (JSON or YAML)")
-	pflag.StringP("server", "s", "", "SMTP server address")
-	pflag.IntP("port", "p", 25, "SMTP server port")
-	pflag.StringP("from", "f", "", "Sender email address")
-	pflag.StringP("to", "t", "", "Recipient email addresses (comma-separated)")
-	pflag.StringP("cc", "C", "", "CC recipient email addresses (comma-separated)")
-	pflag.StringP("bcc", "B", "", "BCC recipient email addresses (comma-separated)")
-	pflag.StringP("subject", "S", "", "Email subject")
-	pflag.StringP("subject_template", "T", "", "Email subject template")
-	pflag.StringP("body", "b", "", "Email body text")
-	pflag.StringP("body_file", "F", "", "File containing email body text")
-	pflag.StringP("html", "H", "", "Email HTML body")
-	pflag.StringP("html_file", "L", "", "File containing email HTML body")
-	pflag.StringP("template", "e", "", "Path to email template file")
-	pflag.StringP("template_data", "d", "", "JSON data for template (format: '{\"key\":\"value\"}')")
-	pflag.StringP("auth_type", "a", "", "Authentication type (plain, login, cram-md5)")
-	pflag.StringP("username", "u", "", "Authentication username")
-	pflag.StringP("password", "P", "", "Authentication password")
-	pflag.BoolP("starttls", "l", false, "Use STARTTLS")
-	pflag.BoolP("skip_verify", "k", false, "Skip TLS certificate verification")
-	pflag.BoolP("debug", "D", false, "Enable debug output")
-	pflag.StringP("attachments", "A", "", "Comma-separated list of files to attach")
-	pflag.StringP("headers", "h", "", "Custom headers (format: 'Key1: Value1, Key2: Value2')")
-	pflag.IntP("retries", "r", 3, "Number of retry attempts for failed operations")
-	pflag.IntP("timeout", "o", 30, "Connection timeout in seconds")
-	pflag.BoolP("validate_mx", "m", false, "Validate email addresses by checking MX records")
-
-	// Bind flags to Viper
-	pflag.Parse()
-	viper.BindPFlags(pflag.CommandLine)
+	v.BindEnv("server", "SMTP_SERVER")
+	v.BindEnv("port", "SMTP_PORT")
+	v.BindEnv("username", "SMTP_USERNAME")
+	v.BindEnv("password", "SMTP_PASSWORD")
+	v.BindEnv("oauth_token", "SMTP_OAUTH_TOKEN")
+	v.BindEnv("from", "SMTP_FROM")
+	v.BindEnv("from_name", "SMTP_FROM_NAME")
+	v.BindEnv("to", "SMTP_TO")
+	v.BindEnv("cc", "SMTP_CC")
+	v.BindEnv("bcc", "SMTP_BCC")
+	v.BindEnv("subject", "SMTP_SUBJECT")
+	v.BindEnv("auth_type", "SMTP_AUTH_TYPE")
+	v.BindEnv("starttls", "SMTP_STARTTLS")
+	v.BindEnv("skip_verify", "SMTP_SKIP_VERIFY")
+	v.BindEnv("debug", "SMTP_DEBUG")
+	v.BindEnv("ldap_password", "SMTP_LDAP_PASSWORD")
+
+	// Bind flags to Viper; only flags that were changed take precedence
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := v.BindPFlags(fs); err != nil {
+		return fmt.Errorf("failed to bind flags: %v", err)
+	}
 
 	// Set config file
-	if configFile := viper.GetString("config"); configFile != "" {
-		viper.SetConfigFile(configFile)
-		if err := viper.ReadInConfig(); err != nil {
-			log.Fatalf("Failed to read config file: %v", err)
+	if configFile := v.GetString("config"); configFile != "" {
+		v.SetConfigFile(configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return fmt.Errorf("failed to read config file: %v", err)
 		}
 	}
+	return nil
 }
 
 // parseAddressList splits a comma-separated list of email addresses
@@ -98,17 +439,41 @@ func parseAddressList(list string) []string {
 	return addresses
 }
 
-// parseHeaders parses the custom headers string into a map
+// headerStartRegex matches the start of a "Key: Value" pair following a separator comma
+var headerStartRegex = regexp.MustCompile(`^\s*[A-Za-z0-9_-]+:(\s|$)`)
+
+// parseHeaders parses the custom headers string into a map. Pairs are separated
+// by commas, but a comma only starts a new pair when it is followed by another
+// "Key: Value", so values such as URLs and lists survive intact. Values can
+// also be double-quoted, and a backslash escapes the next character.
 func parseHeaders(headerStr string) map[string]string {
 	headers := make(map[string]string)
 	if headerStr == "" {
 		return headers
 	}
 
-	// Split header pairs
-	pairs := strings.Split(headerStr, ",")
+	var pairs []string
+	var current strings.Builder
+	quoted := false
+	for i := 0; i < len(headerStr); i++ {
+		ch := headerStr[i]
+		switch {
+		case ch == '\\' && i+1 < len(headerStr):
+			i++
+			current.WriteByte(headerStr[i])
+		case ch == '"':
+			quoted = !quoted
+		case ch == ',' && !quoted && headerStartRegex.MatchString(headerStr[i+1:]):
+			pairs = append(pairs, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(ch)
+		}
+	}
+	pairs = append(pairs, current.String())
+
 	for _, pair := range pairs {
-		// Split key and value
+		// Split key and value on the first colon only
 		parts := strings.SplitN(pair, ":", 2)
 		if len(parts) == 2 {
 			key := strings.TrimSpace(parts[0])
@@ -119,6 +484,70 @@ func parseHeaders(headerStr string) map[string]string {
 	return headers
 }
 
+// addressList returns the addresses for a setting that may be given either as
+// a comma-separated string (flags and environment) or as a list in the config
+// file, with each address normalized
+func addressList(v *viper.Viper, key string) []string {
+	if list, ok := v.Get(key).([]interface{}); ok {
+		addresses := make([]string, 0, len(list))
+		for _, item := range list {
+			if addr := message.NormalizeAddress(fmt.Sprint(item)); addr != "" {
+				addresses = append(addresses, addr)
+			}
+		}
+		return addresses
+	}
+	return normalizeAddresses(parseAddressList(v.GetString(key)))
+}
+
+// joinErrors combines validation failures into one error. A single failure is
+// returned as is; several are listed one per line so they can all be fixed in
+// one pass.
+func joinErrors(errs []error) error {
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	lines := make([]string, len(errs))
+	for i, err := range errs {
+		lines[i] = "  - " + err.Error()
+	}
+	return fmt.Errorf("%d problems found:\n%s", len(errs), strings.Join(lines, "\n"))
+}
+
+// normalizeAddresses normalizes each address in place and returns the list
+func normalizeAddresses(addresses []string) []string {
+	for i := range addresses {
+		addresses[i] = message.NormalizeAddress(addresses[i])
+	}
+	return addresses
+}
+
+// parseXClient parses comma-separated NAME=VALUE XCLIENT attributes
+func parseXClient(list string) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for _, pair := range parseAddressList(list) {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid XCLIENT attribute %q: expected NAME=VALUE", pair)
+		}
+		attrs[strings.ToUpper(strings.TrimSpace(name))] = strings.TrimSpace(value)
+	}
+	return attrs, nil
+}
+
+// parseHeaderArgs parses repeated --header values, splitting each on the first colon only
+func parseHeaderArgs(values []string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, value := range values {
+		parts := strings.SplitN(value, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid header %q: expected 'Key: Value'", value)
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return headers, nil
+}
+
 // readFile reads the contents of a file
 func readFile(filename string) (string, error) {
 	if filename == "" {
@@ -131,162 +560,216 @@ func readFile(filename string) (string, error) {
 	return string(content), nil
 }
 
-func main() {
-	// Validate required fields
-	server := viper.GetString("server")
-	from := viper.GetString("from")
-	to := viper.GetString("to")
-	cc := viper.GetString("cc")
-	bcc := viper.GetString("bcc")
+// ehloName is the hostname announced in EHLO
+const ehloName = "localhost"
 
-	if server == "" || from == "" || (to == "" && cc == "" && bcc == "") {
-		fmt.Println("Error: server, from, and at least one recipient (to, cc, or bcc) are required")
-		fmt.Println("Current values:")
-		fmt.Printf("  Server: %s\n", server)
-		fmt.Printf("  From: %s\n", from)
-		fmt.Printf("  To: %s\n", to)
-		fmt.Printf("  CC: %s\n", cc)
-		fmt.Printf("  BCC: %s\n", bcc)
-		pflag.Usage()
-		os.Exit(1)
-	}
+// retryDelay is the pause between retry attempts
+const retryDelay = 2 * time.Second
 
-	// Validate email addresses
-	if err := message.ValidateEmail(from); err != nil {
-		log.Fatalf("Invalid sender address: %v", err)
+// dialSession connects to the server in the resolved settings and runs EHLO,
+// STARTTLS and AUTH, recording any warnings in diags
+func dialSession(v *viper.Viper, diags *diagnostics) (*client.SMTPClient, error) {
+	if v.GetBool("auto_tls") && (v.GetBool("starttls") || v.GetBool("smtps")) {
+		return nil, fmt.Errorf("--auto-tls chooses between implicit TLS and STARTTLS itself and cannot be combined with --starttls or --smtps")
+	}
+	if v.GetBool("smtps") && v.GetBool("starttls") {
+		return nil, fmt.Errorf("--smtps starts TLS on connect and cannot be combined with --starttls")
+	}
+	certFile, keyFile := v.GetString("client_cert"), v.GetString("client_key")
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("--client-cert and --client-key must be given together")
 	}
 
-	toAddrs := parseAddressList(to)
-	ccAddrs := parseAddressList(cc)
-	bccAddrs := parseAddressList(bcc)
-
-	if err := message.ValidateAddressList(toAddrs, viper.GetBool("validate_mx")); err != nil {
-		log.Fatalf("Invalid To address: %v", err)
+	// Create SMTP client
+	c := client.NewSMTPClient(ehloName, v.GetBool("debug"))
+	// Keep the transcript out of JSON written to stdout
+	if v.GetString("output") == "json" {
+		c.SetDebugOutput(os.Stderr)
 	}
-	if err := message.ValidateAddressList(ccAddrs, viper.GetBool("validate_mx")); err != nil {
-		log.Fatalf("Invalid Cc address: %v", err)
+	c.SetRetryConfig(v.GetInt("retries"), retryDelay)
+	c.SetTimeout(time.Duration(v.GetInt("timeout")) * time.Second)
+	if d := v.GetDuration("connect_timeout"); d > 0 {
+		c.SetConnectTimeout(d)
 	}
-	if err := message.ValidateAddressList(bccAddrs, viper.GetBool("validate_mx")); err != nil {
-		log.Fatalf("Invalid Bcc address: %v", err)
+	if d := v.GetDuration("io_timeout"); d > 0 {
+		c.SetIOTimeout(d)
 	}
-
-	var msg *message.Message
-
-	// Handle templates
-	if templateFile := viper.GetString("template"); templateFile != "" {
-		// Parse template data
-		var data map[string]interface{}
-		if templateData := viper.GetString("template_data"); templateData != "" {
-			if err := json.Unmarshal([]byte(templateData), &data); err != nil {
-				log.Fatalf("Failed to parse template data: %v", err)
-			}
-		}
-
-		// Load template
-		tmpl, err := message.LoadTemplate(viper.GetString("subject_template"), templateFile, "")
+	c.SetPipelining(!v.GetBool("no_pipelining"))
+	c.SetChunking(!v.GetBool("no_chunking"))
+	c.SetPostSendDelay(v.GetDuration("post_send_delay"))
+	c.SetKeepalive(v.GetDuration("keepalive"))
+	c.SetMaxLineLength(v.GetInt("max_line_length"))
+	c.SetMailAuth(v.GetString("mail_auth"))
+	c.SetDeclaredSize(v.GetInt64("declared_size"))
+	if name := v.GetString("legacy_command"); name != "" {
+		command, err := client.ParseLegacyCommand(name)
 		if err != nil {
-			log.Fatalf("Failed to load template: %v", err)
+			return nil, err
 		}
-
-		// Execute template
-		msg, err = tmpl.Execute(&message.TemplateData{
-			From:    viper.GetString("from"),
-			To:      toAddrs,
-			Cc:      ccAddrs,
-			Bcc:     bccAddrs,
-			Subject: viper.GetString("subject"),
-			Data:    data,
-		})
-		if err != nil {
-			log.Fatalf("Failed to execute template: %v", err)
+		c.SetLegacyCommand(command)
+	}
+	dsn, err := dsnOptions(v)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDSN(dsn)
+	if err := c.SetRecipientParameters(v.GetStringSlice("rcpt_param")); err != nil {
+		return nil, err
+	}
+	if v.GetBool("handle_greylist") {
+		c.SetGreylistRetry(v.GetDuration("greylist_delay"))
+	}
+	c.SetEhloFallbackNames(parseAddressList(v.GetString("ehlo_fallback_names")))
+	c.SetTLSServerName(v.GetString("tls_servername"))
+	c.SetSkipVerify(v.GetBool("skip_verify"))
+	// SSLKEYLOGFILE is often set for browsers, so it is only honored when debugging
+	keyLog := v.GetString("keylog_file")
+	if keyLog == "" && v.GetBool("debug") {
+		keyLog = os.Getenv("SSLKEYLOGFILE")
+	}
+	if keyLog != "" {
+		diags.warn(warnKeyLog, "writing TLS session secrets to %s; anyone who can read it can decrypt the session, credentials included", keyLog)
+		c.SetKeyLogFile(keyLog)
+	}
+	if caFile, caDir := v.GetString("ca_cert"), v.GetString("ca_dir"); caFile != "" || caDir != "" {
+		pool, warnings, err := client.LoadRootCAs(caFile, caDir)
+		for _, warning := range warnings {
+			diags.warn(warnCACerts, "%s", warning)
 		}
-	} else {
-		// Create message without template
-		msg = message.NewMessage(viper.GetString("from"), toAddrs, viper.GetString("subject"), viper.GetString("body"))
-		msg.Cc = ccAddrs
-		msg.Bcc = bccAddrs
-
-		// Read body from file if specified
-		if bodyFile := viper.GetString("body_file"); bodyFile != "" {
-			body, err := readFile(bodyFile)
-			if err != nil {
-				log.Fatal(err)
-			}
-			msg.Body = body
+		if err != nil {
+			return nil, err
 		}
-
-		// Read HTML body from file if specified
-		if htmlFile := viper.GetString("html_file"); htmlFile != "" {
-			htmlBody, err := readFile(htmlFile)
-			if err != nil {
-				log.Fatal(err)
-			}
-			msg.HTMLBody = htmlBody
+		c.SetRootCAs(pool)
+	}
+	if certFile != "" {
+		if err := c.SetClientCertificate(certFile, keyFile); err != nil {
+			return nil, err
 		}
 	}
-
-	// Add custom headers
-	for key, value := range parseHeaders(viper.GetString("headers")) {
-		msg.AddHeader(key, value)
+	if names := v.GetString("tls_ciphers"); names != "" {
+		suites, err := client.ParseCipherSuites(parseAddressList(names))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --tls-ciphers: %v", err)
+		}
+		c.SetCipherSuites(suites)
 	}
 
-	// Add attachments
-	if attachments := viper.GetString("attachments"); attachments != "" {
-		for _, attachment := range parseAddressList(attachments) {
-			if _, err := message.ReadFileAttachment(attachment); err != nil {
-				log.Fatalf("Failed to read attachment %s: %v", attachment, err)
-			}
-			msg.AddAttachment(attachment)
+	// Connect to server, with TLS straight away or detecting whether it expects that if asked
+	connect := c.Connect
+	port := v.GetInt("port")
+	switch {
+	case v.GetBool("smtps"):
+		connect = c.ConnectTLS
+		if !v.IsSet("port") {
+			port = 465
 		}
+	case v.GetBool("auto_tls"):
+		connect = c.ConnectAuto
 	}
-
-	// Create SMTP client
-	client := client.NewSMTPClient("localhost", viper.GetBool("debug"))
-	client.SetRetryConfig(viper.GetInt("retries"), time.Duration(viper.GetInt("timeout"))*time.Second)
-
-	// Connect to server
-	if err := client.Connect(viper.GetString("server"), viper.GetInt("port")); err != nil {
-		log.Fatalf("Failed to connect: %v", err)
+	if err := connect(v.GetString("server"), port); err != nil {
+		// The error already names the server and includes any reply
+		return nil, err
 	}
-	defer client.Close()
 
 	// Send EHLO
-	if err := client.Ehlo(); err != nil {
-		log.Fatalf("Failed to send EHLO: %v", err)
+	if err := c.Ehlo(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to send EHLO: %v", err)
 	}
 
-	// Start TLS if requested
-	if viper.GetBool("starttls") {
-		if err := client.StartTLS(); err != nil {
-			log.Fatalf("Failed to start TLS: %v", err)
+	// Start TLS if requested, or if offered on a plaintext --auto-tls connection
+	autoSTARTTLS := v.GetBool("auto_tls") && !c.Session().TLS && c.Capabilities().StartTLS
+	if v.GetBool("starttls") || autoSTARTTLS {
+		if err := c.StartTLS(); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to start TLS: %v", err)
 		}
 		// Send EHLO again after STARTTLS
-		if err := client.Ehlo(); err != nil {
-			log.Fatalf("Failed to send EHLO after STARTTLS: %v", err)
+		if err := c.Ehlo(); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to send EHLO after STARTTLS: %v", err)
 		}
 	}
 
-	// Authenticate if requested
-	if authType := viper.GetString("auth_type"); authType != "" {
-		username := viper.GetString("username")
-		password := viper.GetString("password")
-		if username == "" || password == "" {
-			log.Fatal("Username and password are required for authentication")
+	// Present different client details to the server, for trusted-relay testing
+	if list := v.GetString("xclient"); list != "" {
+		attrs, err := parseXClient(list)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if err := c.XClient(attrs); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("XCLIENT failed: %v", err)
 		}
-		if err := client.Authenticate(authType, username, password); err != nil {
-			log.Fatalf("Authentication failed: %v", err)
+		if err := c.Ehlo(); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("failed to send EHLO after XCLIENT: %v", err)
 		}
 	}
 
-	// Send message
-	if err := client.SendMessage(msg); err != nil {
-		log.Fatalf("Failed to send message: %v", err)
+	// Authenticate if requested; an OAuth2 access token implies XOAUTH2
+	authType := v.GetString("auth_type")
+	if authType == "" && v.GetString("oauth_token") != "" {
+		authType = "xoauth2"
+	}
+	if authType != "" {
+		username := v.GetString("username")
+		password := v.GetString("password")
+		if authType == "xoauth2" {
+			password = v.GetString("oauth_token")
+			if username == "" || password == "" {
+				c.Close()
+				return nil, fmt.Errorf("username and --oauth-token are required for XOAUTH2 authentication")
+			}
+		}
+		if username == "" || password == "" {
+			c.Close()
+			return nil, fmt.Errorf("username and password are required for authentication")
+		}
+		c.SetMaxAuthAttempts(v.GetInt("max_auth_attempts"))
+		if err := c.Authenticate(authType, username, password); err != nil {
+			c.Close()
+			return nil, err
+		}
 	}
 
-	// Quit
-	if err := client.Quit(); err != nil {
-		log.Fatalf("Failed to quit: %v", err)
+	// Say what a declared size should lead to, as the server only sees it on MAIL FROM
+	if size := v.GetInt64("declared_size"); size > 0 {
+		caps := c.Capabilities()
+		switch {
+		case !caps.Has("SIZE"):
+			diags.warn(warnSizeNotAdvertised, "server does not advertise SIZE; the declared size is not sent")
+		case caps.Size > 0 && size > int64(caps.Size):
+			diags.warn(warnSizeOverLimit, "declared size %d exceeds the server limit of %d; expect MAIL FROM to be rejected", size, caps.Size)
+		}
+	}
+	if dsn.Return != "" || dsn.EnvID != "" || len(dsn.Notify) > 0 {
+		if !c.Capabilities().DSN {
+			diags.warn(warnDSNNotAdvertised, "server does not advertise DSN; no delivery status notifications are requested")
+		}
+	}
+	if !c.Session().TLS {
+		diags.warn(warnNoTLS, "the connection to %s is not encrypted; use --starttls or --smtps", v.GetString("server"))
+	}
+	if err := diags.check(v.GetBool("fail_on_warning")); err != nil {
+		c.Close()
+		return nil, err
 	}
 
-	fmt.Println("Message sent successfully")
+	return c, nil
+}
+
+// dsnOptions returns the delivery status notifications asked for with
+// --dsn-notify, --dsn-return and --dsn-envid
+func dsnOptions(v *viper.Viper) (client.DSNOptions, error) {
+	opts := client.DSNOptions{
+		Notify: parseAddressList(v.GetString("dsn_notify")),
+		Return: v.GetString("dsn_return"),
+		EnvID:  v.GetString("dsn_envid"),
+	}
+	if err := opts.Validate(); err != nil {
+		return client.DSNOptions{}, fmt.Errorf("invalid DSN request: %v", err)
+	}
+	return opts, nil
 }
@@ -0,0 +1,1694 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asachs/smtp-edc/internal/client"
+	"github.com/asachs/smtp-edc/internal/message"
+	"github.com/asachs/smtp-edc/pkg/smtptest"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/spf13/viper"
+)
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  map[string]string
+	}{
+		{
+			name:  "empty",
+			input: "",
+			want:  map[string]string{},
+		},
+		{
+			name:  "simple pairs",
+			input: "X-A: 1, X-B: 2",
+			want:  map[string]string{"X-A": "1", "X-B": "2"},
+		},
+		{
+			name:  "value with colons",
+			input: "X-URL: http://example.com:8080/path, X-Time: 12:30:00",
+			want:  map[string]string{"X-URL": "http://example.com:8080/path", "X-Time": "12:30:00"},
+		},
+		{
+			name:  "value with commas",
+			input: "X-URL: http://example.com/a,b, X-List: one, two, three",
+			want:  map[string]string{"X-URL": "http://example.com/a,b", "X-List": "one, two, three"},
+		},
+		{
+			name:  "value with spaces",
+			input: "X-Note:   hello   world  ",
+			want:  map[string]string{"X-Note": "hello   world"},
+		},
+		{
+			name:  "quoted value",
+			input: `X-Quoted: "a, X-Not: header", X-B: 2`,
+			want:  map[string]string{"X-Quoted": "a, X-Not: header", "X-B": "2"},
+		},
+		{
+			name:  "escaped comma",
+			input: `X-Escaped: a\, X-Not: header`,
+			want:  map[string]string{"X-Escaped": "a, X-Not: header"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseHeaders(tt.input)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseHeaders(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRepeatableHeaderFlag(t *testing.T) {
+	fs := newFlagSet(lookupCommand("send"))
+	args := []string{
+		"--header", "X-A: 1",
+		"--header", "X-URL: http://example.com/a,b",
+		"--header", "X-List: one, Two: three",
+	}
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	values, err := fs.GetStringArray("header")
+	if err != nil {
+		t.Fatalf("GetStringArray() error = %v", err)
+	}
+	headers, err := parseHeaderArgs(values)
+	if err != nil {
+		t.Fatalf("parseHeaderArgs() error = %v", err)
+	}
+
+	msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+	for key, value := range headers {
+		msg.AddHeader(key, value)
+	}
+	built, err := msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	for _, want := range []string{"X-A: 1\r\n", "X-URL: http://example.com/a,b\r\n", "X-List: one, Two: three\r\n"} {
+		if !strings.Contains(built, want) {
+			t.Errorf("Expected %q in built message, got:\n%s", want, built)
+		}
+	}
+}
+
+func TestParseHeaderArgsInvalid(t *testing.T) {
+	if _, err := parseHeaderArgs([]string{"no colon here"}); err == nil {
+		t.Error("parseHeaderArgs() expected an error for a value without a colon")
+	}
+}
+
+func TestLoadSettingsPrecedence(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "smtp-edc.yaml")
+	if err := os.WriteFile(configFile, []byte("server: config.example.com\nport: 587\n"), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		env      string
+		wantPort int
+	}{
+		{name: "default", args: nil, wantPort: 25},
+		{name: "config file beats unset flag default", args: []string{"--config", configFile}, wantPort: 587},
+		{name: "env beats config file", args: []string{"--config", configFile}, env: "2600", wantPort: 2600},
+		{name: "explicit flag beats env and config file", args: []string{"--config", configFile, "--port", "2525"}, env: "2600", wantPort: 2525},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("SMTP_PORT", tt.env)
+			}
+			v := viper.New()
+			fs := newFlagSet(lookupCommand("send"))
+
+			if err := loadSettings(v, fs, tt.args); err != nil {
+				t.Fatalf("loadSettings() error = %v", err)
+			}
+			if got := v.GetInt("port"); got != tt.wantPort {
+				t.Errorf("port = %d, want %d", got, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestConfigFilePortUsedForConnection(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	accepted := make(chan struct{}, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		accepted <- struct{}{}
+		r := bufio.NewReader(conn)
+		fmt.Fprint(conn, "220 ready\r\n")
+		r.ReadString('\n') // EHLO
+		fmt.Fprint(conn, "250 OK\r\n")
+		r.ReadString('\n') // QUIT
+		fmt.Fprint(conn, "221 Bye\r\n")
+	}()
+
+	configFile := filepath.Join(t.TempDir(), "smtp-edc.yaml")
+	config := fmt.Sprintf("server: 127.0.0.1\nport: %d\nretries: 1\nto:\n  - one@example.com\n  - two@example.com\n", port)
+	if err := os.WriteFile(configFile, []byte(config), 0644); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+
+	v := viper.New()
+	fs := newFlagSet(lookupCommand("send"))
+	if err := loadSettings(v, fs, []string{"--config", configFile}); err != nil {
+		t.Fatalf("loadSettings() error = %v", err)
+	}
+
+	c, err := dialSession(v, nil)
+	if err != nil {
+		t.Fatalf("dialSession() error = %v", err)
+	}
+	defer c.Close()
+	c.Quit()
+
+	select {
+	case <-accepted:
+	default:
+		t.Errorf("Expected a connection on config file port %d", port)
+	}
+
+	if got := addressList(v, "to"); !reflect.DeepEqual(got, []string{"one@example.com", "two@example.com"}) {
+		t.Errorf("addressList(to) = %v, want both config file recipients", got)
+	}
+}
+
+func TestCommandFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantCmd  string
+		wantArgs []string
+		wantErr  bool
+	}{
+		{name: "no arguments", args: nil, wantCmd: "send"},
+		{name: "bare flags", args: []string{"--server", "mx"}, wantCmd: "send", wantArgs: []string{"--server", "mx"}},
+		{name: "send", args: []string{"send", "-s", "mx"}, wantCmd: "send", wantArgs: []string{"-s", "mx"}},
+		{name: "probe", args: []string{"probe"}, wantCmd: "probe", wantArgs: []string{}},
+		{name: "validate", args: []string{"validate", "--to", "a@example.com"}, wantCmd: "validate", wantArgs: []string{"--to", "a@example.com"}},
+		{name: "render", args: []string{"render"}, wantCmd: "render", wantArgs: []string{}},
+		{name: "bench", args: []string{"bench"}, wantCmd: "bench", wantArgs: []string{}},
+		{name: "unknown", args: []string{"frobnicate"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, args, err := commandFor(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("commandFor(%v) error = %v, wantErr %v", tt.args, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if cmd.name != tt.wantCmd {
+				t.Errorf("commandFor(%v) = %s, want %s", tt.args, cmd.name, tt.wantCmd)
+			}
+			if len(args) != len(tt.wantArgs) || (len(args) > 0 && !reflect.DeepEqual(args, tt.wantArgs)) {
+				t.Errorf("commandFor(%v) args = %v, want %v", tt.args, args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestSubcommandFlags(t *testing.T) {
+	// Connection flags are not accepted by commands that never connect
+	if err := run([]string{"render", "--server", "mx.example.com"}, &bytes.Buffer{}); err == nil {
+		t.Error("render accepted --server, want an unknown flag error")
+	}
+
+	// bench defaults to several messages while send defaults to one
+	for name, want := range map[string]int{"send": 1, "bench": 10} {
+		fs := newFlagSet(lookupCommand(name))
+		if got, _ := fs.GetInt("count"); got != want {
+			t.Errorf("%s --count default = %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestRunRenderAndValidate(t *testing.T) {
+	args := []string{"--from", "from@example.com", "--to", "to@example.com", "--subject", "Routed", "--body", "Hello"}
+
+	var out bytes.Buffer
+	if err := run(append([]string{"render"}, args...), &out); err != nil {
+		t.Fatalf("render error = %v", err)
+	}
+	for _, want := range []string{"Subject: Routed\r\n", "Hello"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("render output missing %q:\n%s", want, out.String())
+		}
+	}
+
+	out.Reset()
+	if err := run(append([]string{"validate"}, args...), &out); err != nil {
+		t.Fatalf("validate error = %v", err)
+	}
+	if !strings.Contains(out.String(), "Message is valid") {
+		t.Errorf("validate output = %q, want a valid result", out.String())
+	}
+
+	if err := run([]string{"validate", "--from", "not-an-address", "--to", "to@example.com"}, &out); err == nil {
+		t.Error("validate accepted an invalid sender address")
+	}
+
+	err := run([]string{"validate", "--from", "not-an-address", "--to", "to@example.com,bad", "--subject", "Routed"}, &out)
+	if err == nil {
+		t.Fatal("validate accepted invalid addresses")
+	}
+	for _, want := range []string{"2 problems found", "invalid sender address", "invalid To address: invalid email address bad"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validate error missing %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestCompletionBash(t *testing.T) {
+	var out bytes.Buffer
+	if err := run([]string{"completion", "bash"}, &out); err != nil {
+		t.Fatalf("completion bash error = %v", err)
+	}
+	script := out.String()
+	if script == "" {
+		t.Fatal("completion bash produced an empty script")
+	}
+	for _, want := range []string{"--server", "--auth-type", "--help-command", "--headers-file", "cram-md5", "probe", "complete -o default -F _smtp_edc smtp-edc"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("bash completion script missing %q", want)
+		}
+	}
+
+	for _, shell := range []string{"zsh", "fish"} {
+		out.Reset()
+		if err := run([]string{"completion", shell}, &out); err != nil || !strings.Contains(out.String(), "auth-type") {
+			t.Errorf("completion %s error = %v, want a script containing auth-type", shell, err)
+		}
+	}
+	if err := run([]string{"completion", "tcsh"}, &out); err == nil {
+		t.Error("completion accepted an unsupported shell")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	oldVersion, oldCommit, oldDate := version, commit, date
+	version, commit, date = "v1.2.3", "abc1234", "2025-01-02T03:04:05Z"
+	defer func() { version, commit, date = oldVersion, oldCommit, oldDate }()
+
+	for _, args := range [][]string{{"--version"}, {"version"}, {"render", "--version"}} {
+		var out bytes.Buffer
+		if err := run(args, &out); err != nil {
+			t.Fatalf("run(%v) error = %v", args, err)
+		}
+		for _, want := range []string{"v1.2.3", "abc1234", "2025-01-02T03:04:05Z", runtime.Version()} {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("run(%v) output missing %q:\n%s", args, want, out.String())
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := run([]string{"version", "--output", "json"}, &out); err != nil {
+		t.Fatalf("version --output json error = %v", err)
+	}
+	var info versionInfo
+	if err := json.Unmarshal(out.Bytes(), &info); err != nil {
+		t.Fatalf("version JSON did not parse: %v\n%s", err, out.String())
+	}
+	want := versionInfo{Version: "v1.2.3", Commit: "abc1234", Date: "2025-01-02T03:04:05Z", GoVersion: runtime.Version()}
+	if info != want {
+		t.Errorf("version JSON = %+v, want %+v", info, want)
+	}
+
+	if err := run([]string{"version", "--output", "xml"}, &out); err == nil {
+		t.Error("run accepted an unknown output format")
+	}
+}
+
+func TestSendSummary(t *testing.T) {
+	dir := t.TempDir()
+	var attachments []string
+	for _, name := range []string{"a.txt", "b.bin"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("attachment "+name), 0644); err != nil {
+			t.Fatalf("Failed to write attachment: %v", err)
+		}
+		attachments = append(attachments, path)
+	}
+
+	var out bytes.Buffer
+	args := []string{"send", "--dry-run", "--output", "json",
+		"--from", "from@example.com",
+		"--to", "one@example.com,two@example.com",
+		"--cc", "three@example.com",
+		"--bcc", "one@example.com",
+		"--subject", "Files",
+		"--body", "See the files.",
+		"--attachments", strings.Join(attachments, ","),
+	}
+	if err := run(args, &out); err != nil {
+		t.Fatalf("send --dry-run error = %v", err)
+	}
+
+	var summary sendSummary
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+		t.Fatalf("summary JSON did not parse: %v\n%s", err, out.String())
+	}
+	if summary.Status != "dry-run" || summary.Attachments != 2 || summary.Parts != 3 || summary.Recipients != 3 {
+		t.Errorf("summary = %+v, want dry-run with 2 attachments, 3 parts and 3 recipients", summary)
+	}
+	if summary.Size == 0 {
+		t.Error("summary size = 0, want the built message size")
+	}
+
+	out.Reset()
+	if err := run([]string{"send", "--dry-run"}, &out); err == nil {
+		t.Error("send --dry-run without a sender should fail")
+	}
+}
+
+// fakeSMTPServer starts a minimal SMTP server that advertises the given EHLO
+// extensions, accepts every message and every other command, returning its port
+func fakeSMTPServer(t *testing.T, extensions []string) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprint(conn, "220 fake ESMTP\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					verb := strings.ToUpper(strings.TrimSpace(line))
+					if i := strings.IndexByte(verb, ' '); i >= 0 {
+						verb = verb[:i]
+					}
+					switch verb {
+					case "EHLO":
+						lines := append([]string{"fake"}, extensions...)
+						for i, ext := range lines {
+							sep := "-"
+							if i == len(lines)-1 {
+								sep = " "
+							}
+							fmt.Fprintf(conn, "250%s%s\r\n", sep, ext)
+						}
+					case "DATA":
+						fmt.Fprint(conn, "354 Go ahead\r\n")
+						for line != ".\r\n" {
+							if line, err = r.ReadString('\n'); err != nil {
+								return
+							}
+						}
+						fmt.Fprint(conn, "250 OK\r\n")
+					case "QUIT":
+						fmt.Fprint(conn, "221 Bye\r\n")
+						return
+					default:
+						fmt.Fprint(conn, "250 OK\r\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestProbeDowngradeDetection(t *testing.T) {
+	port := fakeSMTPServer(t, []string{"PIPELINING", "SIZE 1000"})
+	baseline := filepath.Join(t.TempDir(), "baseline.txt")
+	if err := os.WriteFile(baseline, []byte("# known good\nPIPELINING\nSTARTTLS\nAUTH PLAIN LOGIN\n"), 0644); err != nil {
+		t.Fatalf("Failed to write baseline: %v", err)
+	}
+	args := []string{"probe", "--server", "127.0.0.1", "--port", fmt.Sprint(port), "--retries", "1", "--baseline", baseline}
+
+	var out bytes.Buffer
+	if err := run(args, &out); err != nil {
+		t.Fatalf("probe error = %v", err)
+	}
+	for _, want := range []string{"WARNING: server did not advertise STARTTLS", "WARNING: server did not advertise AUTH"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("probe output missing %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "PIPELINING, which") {
+		t.Errorf("probe warned about an advertised extension:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := run(append(args, "--paranoid"), &out); err == nil || !strings.Contains(err.Error(), "downgrade") {
+		t.Errorf("probe --paranoid error = %v, want a downgrade failure", err)
+	}
+
+	// A server that still advertises everything raises no warnings
+	port = fakeSMTPServer(t, []string{"PIPELINING", "STARTTLS", "AUTH PLAIN LOGIN"})
+	out.Reset()
+	args[4] = fmt.Sprint(port)
+	if err := run(append(args, "--paranoid"), &out); err != nil {
+		t.Errorf("probe --paranoid against a complete server error = %v\n%s", err, out.String())
+	}
+}
+
+func TestConfigInit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smtp-edc.yaml")
+	var out bytes.Buffer
+	if err := run([]string{"config-init", path}, &out); err != nil {
+		t.Fatalf("config-init error = %v", err)
+	}
+
+	// The generated file is accepted as --config
+	v := viper.New()
+	if err := loadSettings(v, newFlagSet(lookupCommand("send")), []string{"--config", path}); err != nil {
+		t.Fatalf("loadSettings() with generated config error = %v", err)
+	}
+	if got := v.GetString("server"); got != "smtp.example.com" {
+		t.Errorf("server = %q, want the template default", got)
+	}
+
+	if err := run([]string{"config-init", path}, &out); err == nil {
+		t.Error("config-init overwrote an existing file without --force")
+	}
+	if err := run([]string{"config-init", "--force", "--format", "json", path}, &out); err != nil {
+		t.Errorf("config-init --force error = %v", err)
+	}
+}
+
+func TestSendBatchInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var sent []int
+	result := sendBatch(ctx, 10, time.Second, func(i int) error {
+		if i == 2 {
+			// Interrupt while this send is in flight; it should still complete
+			cancel()
+			time.Sleep(10 * time.Millisecond)
+		}
+		sent = append(sent, i)
+		return nil
+	}, func(i int, err error) {
+		t.Errorf("message %d failed: %v", i, err)
+	})
+
+	if !result.Interrupted {
+		t.Error("result not marked interrupted")
+	}
+	if result.Attempted != 3 || len(sent) != 3 {
+		t.Errorf("attempted %d, sent %v; want messages 0-2 only", result.Attempted, sent)
+	}
+
+	// A send that outlives the grace period is counted as failed
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	release := make(chan struct{})
+	defer close(release)
+	var failed int
+	result = sendBatch(ctx, 10, 10*time.Millisecond, func(i int) error {
+		cancel()
+		<-release
+		return nil
+	}, func(i int, err error) { failed++ })
+	if !result.Interrupted || result.Attempted != 1 || failed != 1 {
+		t.Errorf("result = %+v with %d failure(s), want one failed interrupted send", result, failed)
+	}
+}
+
+func TestTraceID(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    string
+		pattern string
+	}{
+		{name: "given", args: []string{"--trace-id", "run-42"}, want: "run-42"},
+		{name: "generated", pattern: `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := lookupCommand("send")
+			fs := newFlagSet(cmd)
+			v := viper.New()
+			args := append([]string{"--from", "from@example.com", "--to", "to@example.com", "--subject", "s", "--body", "b"}, tt.args...)
+			if err := loadSettings(v, fs, args); err != nil {
+				t.Fatalf("loadSettings() error = %v", err)
+			}
+			msg, err := buildMessage(&invocation{ctx: context.Background(), settings: v, flags: fs, out: io.Discard})
+			if err != nil {
+				t.Fatalf("buildMessage() error = %v", err)
+			}
+
+			built, err := msg.Build()
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			parsed, err := mail.ReadMessage(strings.NewReader(built))
+			if err != nil {
+				t.Fatalf("built message did not parse: %v", err)
+			}
+			header := parsed.Header.Get("X-Trace-Id")
+
+			summary, err := newSummary("sent", msg, client.SessionInfo{})
+			if err != nil {
+				t.Fatalf("newSummary() error = %v", err)
+			}
+			data, err := json.Marshal(summary)
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			var fields map[string]interface{}
+			if err := json.Unmarshal(data, &fields); err != nil {
+				t.Fatalf("Unmarshal() error = %v", err)
+			}
+
+			if fields["trace_id"] != header {
+				t.Errorf("JSON trace_id = %v, X-Trace-Id header = %q; want the same id", fields["trace_id"], header)
+			}
+			if tt.want != "" && header != tt.want {
+				t.Errorf("X-Trace-Id = %q, want %q", header, tt.want)
+			}
+			if tt.pattern != "" && !regexp.MustCompile(tt.pattern).MatchString(header) {
+				t.Errorf("X-Trace-Id = %q, want a generated UUID", header)
+			}
+		})
+	}
+}
+
+func TestSkipMissingAttachments(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "present.txt")
+	if err := os.WriteFile(present, []byte("here"), 0644); err != nil {
+		t.Fatalf("Failed to write attachment: %v", err)
+	}
+	missing := filepath.Join(dir, "missing.txt")
+
+	args := []string{"send", "--dry-run", "--output", "json",
+		"--from", "from@example.com", "--to", "to@example.com",
+		"--subject", "Files", "--body", "Body",
+		"--attachments", present + "," + missing,
+	}
+	if err := run(args, io.Discard); err == nil {
+		t.Error("send with a missing attachment succeeded without --skip-missing-attachments")
+	}
+
+	var out bytes.Buffer
+	if err := run(append(args, "--skip-missing-attachments"), &out); err != nil {
+		t.Fatalf("send --skip-missing-attachments error = %v", err)
+	}
+	var summary sendSummary
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+		t.Fatalf("summary JSON did not parse: %v\n%s", err, out.String())
+	}
+	if summary.Attachments != 1 {
+		t.Errorf("attachments = %d, want the present file only", summary.Attachments)
+	}
+	if !reflect.DeepEqual(summary.Skipped, []string{missing}) {
+		t.Errorf("skipped = %v, want [%s]", summary.Skipped, missing)
+	}
+}
+
+func TestProbeExpectCaps(t *testing.T) {
+	port := fakeSMTPServer(t, []string{"PIPELINING", "SIZE 1000"})
+	expected := filepath.Join(t.TempDir(), "caps.txt")
+	if err := os.WriteFile(expected, []byte("PIPELINING\nSTARTTLS\nSIZE>=10485760\n"), 0644); err != nil {
+		t.Fatalf("Failed to write expected capabilities: %v", err)
+	}
+
+	var out bytes.Buffer
+	args := []string{"probe", "--server", "127.0.0.1", "--port", fmt.Sprint(port), "--retries", "1", "--expect-caps", expected}
+	if err := run(args, &out); err == nil {
+		t.Fatal("probe --expect-caps succeeded against a server missing capabilities")
+	}
+	for _, want := range []string{"- STARTTLS: not advertised", "- SIZE>=10485760: server advertises SIZE 1000"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("probe output missing %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "- PIPELINING") {
+		t.Errorf("probe reported an advertised capability:\n%s", out.String())
+	}
+}
+
+func TestDumpEnvelope(t *testing.T) {
+	port := fakeSMTPServer(t, []string{"AUTH PLAIN"})
+	dir := t.TempDir()
+	envelopeFile := filepath.Join(dir, "envelope.json")
+	emlFile := filepath.Join(dir, "message.eml")
+	args := []string{"send", "--server", "127.0.0.1", "--port", fmt.Sprint(port), "--retries", "1",
+		"--from", "sender@example.com", "--to", "a@example.com,b@example.com", "--cc", "A@EXAMPLE.COM",
+		"--subject", "Replay", "--body", "Hello", "--mail-auth", "submitter@example.com",
+		"--dump-envelope", envelopeFile, "--save-eml", emlFile}
+
+	var out bytes.Buffer
+	if err := run(args, &out); err != nil {
+		t.Fatalf("send error = %v", err)
+	}
+
+	data, err := os.ReadFile(envelopeFile)
+	if err != nil {
+		t.Fatalf("Failed to read envelope: %v", err)
+	}
+	var got envelopeDump
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	want := envelopeDump{
+		MailFrom:   "sender@example.com",
+		Parameters: []string{"AUTH=submitter@example.com"},
+		RcptTo:     []string{"a@example.com", "b@example.com", "A@example.com"},
+		Commands: []string{
+			"MAIL FROM:<sender@example.com> AUTH=submitter@example.com",
+			"RCPT TO:<a@example.com>",
+			"RCPT TO:<b@example.com>",
+			"RCPT TO:<A@example.com>",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("envelope = %+v, want %+v", got, want)
+	}
+
+	eml, err := os.ReadFile(emlFile)
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	for _, want := range []string{"Subject: Replay\r\n", "Message-ID: <", "Hello"} {
+		if !strings.Contains(string(eml), want) {
+			t.Errorf("saved message missing %q:\n%s", want, eml)
+		}
+	}
+
+	if err := run([]string{"send", "--dry-run", "--from", "sender@example.com", "--to", "a@example.com", "--count", "2", "--save-eml", emlFile}, &out); err == nil {
+		t.Error("--save-eml was accepted with --count 2")
+	}
+}
+
+func TestAnonymizeRecipients(t *testing.T) {
+	port := fakeSMTPServer(t, []string{"SIZE 1000"})
+	args := []string{"send", "--server", "127.0.0.1", "--port", fmt.Sprint(port), "--retries", "1", "--debug",
+		"--anonymize-recipients", "--output", "json",
+		"--from", "sender@example.com", "--to", "alice@example.com", "--cc", "Bob@Example.COM", "--subject", "Private", "--body", "Hi"}
+
+	// With JSON output the session transcript goes to stderr
+	stderr := os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	os.Stderr = w
+	var out bytes.Buffer
+	runErr := run(args, &out)
+	os.Stderr = stderr
+	w.Close()
+	transcript, _ := io.ReadAll(r)
+	if runErr != nil {
+		t.Fatalf("send error = %v", runErr)
+	}
+	if !strings.Contains(string(transcript), "MAIL FROM:") {
+		t.Errorf("stderr holds no session transcript:\n%s", transcript)
+	}
+
+	captured := out.String() + string(transcript)
+	for _, addr := range []string{"alice@example.com", "Bob@example.com", "Bob@Example.COM"} {
+		if strings.Contains(captured, addr) {
+			t.Errorf("output contains %s:\n%s", addr, captured)
+		}
+	}
+	for _, addr := range []string{"alice@example.com", "Bob@Example.COM"} {
+		anon := message.AnonymizeAddress(addr)
+		if n := strings.Count(string(transcript), anon); n < 2 {
+			t.Errorf("transcript has %s %d time(s), want it for both RCPT TO and the headers:\n%s", anon, n, transcript)
+		}
+	}
+	if anon := message.AnonymizeAddress("bob@example.com"); anon != message.AnonymizeAddress("Bob@Example.COM") {
+		t.Errorf("AnonymizeAddress is not stable across case: %s", anon)
+	}
+	if !strings.Contains(captured, "sender@example.com") {
+		t.Error("output does not contain the sender, which is not anonymized")
+	}
+}
+
+func TestMetricsFile(t *testing.T) {
+	port := fakeSMTPServer(t, []string{"PIPELINING"})
+	path := filepath.Join(t.TempDir(), "smtp_edc.prom")
+	args := []string{"bench", "--server", "127.0.0.1", "--port", fmt.Sprint(port), "--retries", "1",
+		"--from", "from@example.com", "--to", "to@example.com", "--subject", "Load", "--body", "Hello",
+		"--count", "3", "--metrics-file", path}
+
+	var out bytes.Buffer
+	if err := run(args, &out); err != nil {
+		t.Fatalf("bench error = %v\n%s", err, out.String())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	for _, want := range []string{
+		"# TYPE smtp_edc_sends_total counter",
+		"smtp_edc_sends_total 3\n",
+		"# TYPE smtp_edc_failures_total counter",
+		"# TYPE smtp_edc_send_duration_seconds histogram",
+		"smtp_edc_send_duration_seconds_bucket{le=\"+Inf\"} 3\n",
+		"smtp_edc_send_duration_seconds_count 3\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("metrics missing %q:\n%s", want, data)
+		}
+	}
+	if strings.Contains(string(data), "smtp_edc_failures_total{") {
+		t.Errorf("metrics report failures for a clean batch:\n%s", data)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("metrics directory holds %d files, want only the metrics file", len(entries))
+	}
+
+	// Without temporary files the same file is rewritten rather than replaced
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat metrics: %v", err)
+	}
+	if err := run(append(args, "--no-temp-files"), io.Discard); err != nil {
+		t.Fatalf("bench --no-temp-files error = %v", err)
+	}
+	if after, err := os.Stat(path); err != nil || !os.SameFile(before, after) {
+		t.Errorf("--no-temp-files replaced the metrics file instead of overwriting it (stat error %v)", err)
+	}
+
+	// Failures are counted by reply code
+	metrics := newBatchMetrics(path, false)
+	metrics.observe(time.Millisecond, nil)
+	metrics.observe(time.Millisecond, &client.Error{Kind: client.ErrRecipient, Err: &client.SMTPError{Code: 550}})
+	metrics.observe(time.Millisecond, &client.Error{Kind: client.ErrMessage, Err: &client.SMTPError{Code: 452}})
+	metrics.observe(time.Millisecond, errors.New("connection reset"))
+	for _, want := range []string{
+		"smtp_edc_sends_total 4\n",
+		"smtp_edc_failures_total{code=\"452\"} 1\nsmtp_edc_failures_total{code=\"550\"} 1\nsmtp_edc_failures_total{code=\"none\"} 1\n",
+		"smtp_edc_send_duration_seconds_bucket{le=\"0.05\"} 4\n",
+	} {
+		if got := metrics.format(); !strings.Contains(got, want) {
+			t.Errorf("format() missing %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestLDAPFilterRequiresServer(t *testing.T) {
+	args := []string{"render", "--from", "sender@example.com", "--subject", "Hi", "--body", "Hi",
+		"--ldap-filter", "(objectClass=person)"}
+	err := run(args, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "--ldap-url") {
+		t.Fatalf("render error = %v, want it to ask for --ldap-url", err)
+	}
+}
+
+// startLDAPServer serves one connection: it answers a bind with bindCode and
+// a search with an entry for each address followed by SearchResultDone
+func startLDAPServer(t *testing.T, bindCode int64, addresses []string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reply := func(id int64, op *ber.Packet) {
+			envelope := ber.NewSequence("LDAPMessage")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+			envelope.AppendChild(op)
+			conn.Write(envelope.Bytes())
+		}
+		result := func(tag ber.Tag, code int64) *ber.Packet {
+			op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+			op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+			op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+			op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+			return op
+		}
+		for {
+			packet, err := ber.ReadPacket(conn)
+			if err != nil || len(packet.Children) < 2 {
+				return
+			}
+			id, _ := packet.Children[0].Value.(int64)
+			switch packet.Children[1].Tag {
+			case ldap.ApplicationBindRequest:
+				reply(id, result(ldap.ApplicationBindResponse, bindCode))
+			case ldap.ApplicationSearchRequest:
+				for _, addr := range addresses {
+					entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+					dn := "uid=" + strings.Split(addr, "@")[0] + ",ou=people,dc=example,dc=com"
+					entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+					attrs := ber.NewSequence("Attributes")
+					attr := ber.NewSequence("Attribute")
+					attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "mail", "Type"))
+					values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+					values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, addr, "Value"))
+					attr.AppendChild(values)
+					attrs.AppendChild(attr)
+					entry.AppendChild(attrs)
+					reply(id, entry)
+				}
+				reply(id, result(ldap.ApplicationSearchResultDone, 0))
+			case ldap.ApplicationUnbindRequest:
+				return
+			}
+		}
+	}()
+
+	return "ldap://" + ln.Addr().String()
+}
+
+func TestLDAPRecipients(t *testing.T) {
+	tests := []struct {
+		name     string
+		bindCode int64
+		wantTo   []string
+		wantErr  string
+	}{
+		{name: "two mail entries", wantTo: []string{"alice@example.com", "bob@example.com"}},
+		{name: "bind rejected", bindCode: ldap.LDAPResultInvalidCredentials, wantErr: "LDAP bind as cn=reader,dc=example,dc=com failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url := startLDAPServer(t, tt.bindCode, []string{"alice@example.com", "bob@example.com"})
+			args := []string{"render", "--from", "sender@example.com", "--subject", "Hi", "--body", "Hi",
+				"--ldap-url", url, "--ldap-base-dn", "ou=people,dc=example,dc=com", "--ldap-filter", "(objectClass=person)",
+				"--ldap-bind-dn", "cn=reader,dc=example,dc=com", "--ldap-password", "secret"}
+			var out bytes.Buffer
+			err := run(args, &out)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("render error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("render error = %v", err)
+			}
+			parsed, err := mail.ReadMessage(&out)
+			if err != nil {
+				t.Fatalf("rendered message does not parse: %v", err)
+			}
+			addrs, err := parsed.Header.AddressList("To")
+			if err != nil {
+				t.Fatalf("To does not parse: %v", err)
+			}
+			var got []string
+			for _, addr := range addrs {
+				got = append(got, addr.Address)
+			}
+			if !reflect.DeepEqual(got, tt.wantTo) {
+				t.Errorf("To = %v, want %v", got, tt.wantTo)
+			}
+		})
+	}
+}
+
+func TestMaxRecipients(t *testing.T) {
+	recipients := make([]string, 101)
+	for i := range recipients {
+		recipients[i] = fmt.Sprintf("user%d@example.com", i)
+	}
+	port := fakeSMTPServer(t, nil)
+	base := []string{"send", "--server", "127.0.0.1", "--port", fmt.Sprint(port), "--retries", "1",
+		"--from", "sender@example.com", "--to", strings.Join(recipients, ","), "--subject", "Hi", "--body", "Hi"}
+
+	err := run(base, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "101 recipients") {
+		t.Fatalf("send error = %v, want the default cap of 100 to abort it", err)
+	}
+	if err := run(append(base, "--yes"), io.Discard); err != nil {
+		t.Errorf("send with --yes error = %v", err)
+	}
+	if err := run(append(base, "--max-recipients", "200", "--confirm-threshold", "0"), io.Discard); err != nil {
+		t.Errorf("send with a higher cap error = %v", err)
+	}
+}
+
+func TestConfirmSend(t *testing.T) {
+	origStdin, origTerminal := stdin, stdinIsTerminal
+	t.Cleanup(func() { stdin, stdinIsTerminal = origStdin, origTerminal })
+	stdinIsTerminal = func() bool { return true }
+
+	recipients := make([]string, 11)
+	for i := range recipients {
+		recipients[i] = fmt.Sprintf("user%d@example.com", i)
+	}
+	port := fakeSMTPServer(t, nil)
+	base := []string{"send", "--server", "127.0.0.1", "--port", fmt.Sprint(port), "--retries", "1",
+		"--from", "sender@example.com", "--to", strings.Join(recipients, ","), "--subject", "Hi", "--body", "Hi"}
+
+	tests := []struct {
+		name    string
+		extra   []string
+		answer  string
+		wantErr bool
+	}{
+		{name: "declined", answer: "n\n", wantErr: true},
+		{name: "no answer", answer: "", wantErr: true},
+		{name: "confirmed", answer: "yes\n"},
+		{name: "yes flag", extra: []string{"--yes"}, answer: "n\n"},
+		{name: "under threshold", extra: []string{"--confirm-threshold", "20"}, answer: "n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdin = strings.NewReader(tt.answer)
+			err := run(append(append([]string{}, base...), tt.extra...), io.Discard)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("send error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "not confirmed") {
+				t.Errorf("send error = %v, want it to report the send was not confirmed", err)
+			}
+		})
+	}
+
+	for server, want := range map[string]bool{
+		"localhost": true, "mail.localhost": true, "127.0.0.1": true, "::1": true,
+		"smtp.example.com": false, "192.0.2.1": false,
+	} {
+		if got := isLocalServer(server); got != want {
+			t.Errorf("isLocalServer(%q) = %v, want %v", server, got, want)
+		}
+	}
+}
+
+func TestThreadDepth(t *testing.T) {
+	port := fakeSMTPServer(t, nil)
+	args := []string{"send", "--server", "127.0.0.1", "--port", fmt.Sprint(port), "--retries", "1",
+		"--from", "sender@example.com", "--to", "rcpt@example.com", "--subject", "Hi", "--body", "Hi", "--thread-depth", "3"}
+
+	var out bytes.Buffer
+	if err := run(args, &out); err != nil {
+		t.Fatalf("send error = %v", err)
+	}
+	if n := strings.Count(out.String(), " sent: <"); n != 3 {
+		t.Errorf("output reports %d sent messages, want 3:\n%s", n, out.String())
+	}
+	if err := run(append(args, "--count", "2"), io.Discard); err == nil {
+		t.Error("--thread-depth was accepted with --count")
+	}
+}
+
+func TestPooledSessionsAuthenticateOnce(t *testing.T) {
+	tests := []struct {
+		name      string
+		reject    []string
+		wantSent  int
+		wantError bool
+	}{
+		{name: "accepted", wantSent: 3},
+		// A rejected message is reset rather than ending the authenticated session
+		{name: "rejected", reject: []string{"to@example.com"}, wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := smtptest.NewServer(&smtptest.Config{
+				Users:            map[string]string{"user": "secret"},
+				RejectRecipients: tt.reject,
+			})
+			defer srv.Close()
+			args := []string{"bench", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1",
+				"--auth-type", "plain", "--username", "user", "--password", "secret",
+				"--from", "from@example.com", "--to", "to@example.com", "--subject", "Load", "--body", "Hello", "--count", "3"}
+
+			err := run(args, io.Discard)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("bench error = %v, wantError %v", err, tt.wantError)
+			}
+			// The server refuses a second AUTH on a connection, so each connection authenticated once
+			if n := srv.Connections(); n != 1 {
+				t.Errorf("server saw %d connections (and AUTH exchanges) for 3 messages, want 1", n)
+			}
+			if n := len(srv.Messages()); n != tt.wantSent {
+				t.Errorf("server received %d messages, want %d", n, tt.wantSent)
+			}
+		})
+	}
+}
+
+func TestStrictRFC5322(t *testing.T) {
+	base := []string{"send", "--dry-run", "--from", "from@example.com", "--to", "to@example.com"}
+	content := []string{"--subject", "Test", "--body", "Hello"}
+	// A relayed message is sent as it is, so its header lines are not folded
+	eml := filepath.Join(t.TempDir(), "long.eml")
+	if err := os.WriteFile(eml, []byte("From: from@example.com\r\nTo: to@example.com\r\nSubject: Test\r\n"+
+		"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\nX-Long: "+strings.Repeat("a", 1000)+"\r\n\r\nHello\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "conforming", args: append([]string{"--strict-rfc5322"}, content...)},
+		{name: "long header folded to fit", args: append([]string{"--strict-rfc5322", "--header", "X-Long: " + strings.Repeat("a", 1000)}, content...)},
+		{name: "not checked without the flag", args: []string{"--eml", eml}},
+		{name: "long header line", args: []string{"--strict-rfc5322", "--eml", eml}, wantErr: "over the limit of 998"},
+		{name: "duplicate subject", args: append([]string{"--strict-rfc5322", "--header", "Subject: Again"}, content...), wantErr: "Subject header appears 2 times"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := run(append(append([]string{}, base...), tt.args...), io.Discard)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("send error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("send error = %v, want it to contain %q", err, tt.wantErr)
+			}
+			if !strings.Contains(err.Error(), "does not conform to RFC 5322") {
+				t.Errorf("send error = %v, want an RFC 5322 violation", err)
+			}
+		})
+	}
+}
+
+func TestDotTermination(t *testing.T) {
+	srv := smtptest.NewServer(nil)
+	defer srv.Close()
+	args := []string{"send", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1",
+		"--from", "from@example.com", "--to", "to@example.com", "--subject", "Test", "--body", "Hello",
+		"--test-dot-termination"}
+	if err := run(args, io.Discard); err != nil {
+		t.Fatalf("send error = %v", err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("server received %d messages, want 1", len(msgs))
+	}
+	data := string(msgs[0].Data)
+	if !strings.HasSuffix(data, "\r\n\r\nHello\r\n.\r\nThis line follows a line holding only a dot.\r\n") {
+		t.Errorf("message body was not preserved: %q", data)
+	}
+}
+
+func TestSendUniqueCount(t *testing.T) {
+	srv := smtptest.NewServer(nil)
+	defer srv.Close()
+	args := []string{"send", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1",
+		"--from", "from@example.com", "--to", "to@example.com", "--subject", "Test", "--body", "Hello",
+		"--count", "3", "--unique"}
+	if err := run(args, io.Discard); err != nil {
+		t.Fatalf("send error = %v", err)
+	}
+
+	msgs := srv.Messages()
+	if len(msgs) != 3 {
+		t.Fatalf("server received %d messages, want 3", len(msgs))
+	}
+	ids := make(map[string]bool)
+	for _, msg := range msgs {
+		parsed, err := mail.ReadMessage(bytes.NewReader(msg.Data))
+		if err != nil {
+			t.Fatalf("received message does not parse: %v", err)
+		}
+		id := parsed.Header.Get("Message-ID")
+		if id == "" {
+			t.Errorf("received message has no Message-ID:\n%s", msg.Data)
+		}
+		ids[id] = true
+	}
+	if len(ids) != 3 {
+		t.Errorf("received %d distinct Message-IDs, want 3: %v", len(ids), ids)
+	}
+}
+
+func TestDSNFlags(t *testing.T) {
+	srv := smtptest.NewServer(&smtptest.Config{Extensions: []string{"DSN"}})
+	defer srv.Close()
+	base := []string{"send", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1",
+		"--from", "from@example.com", "--to", "to@example.com", "--subject", "Test", "--body", "Hello"}
+
+	args := append(append([]string{}, base...), "--dsn-notify", "failure,delay", "--dsn-return", "hdrs", "--dsn-envid", "batch-7")
+	if err := run(args, io.Discard); err != nil {
+		t.Fatalf("send error = %v", err)
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("server received %d messages, want 1", len(msgs))
+	}
+	if got, want := msgs[0].MailParameters, []string{"RET=HDRS", "ENVID=batch-7"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("MAIL FROM parameters = %q, want %q", got, want)
+	}
+	if got, want := msgs[0].RcptParameters["to@example.com"], []string{"NOTIFY=FAILURE,DELAY", "ORCPT=rfc822;to@example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("RCPT TO parameters = %q, want %q", got, want)
+	}
+
+	err := run(append(append([]string{}, base...), "--dsn-notify", "never,failure"), io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "invalid DSN request") {
+		t.Errorf("send error = %v, want an invalid DSN request", err)
+	}
+}
+
+func TestRcptParamFlag(t *testing.T) {
+	srv := smtptest.NewServer(&smtptest.Config{Extensions: []string{"DSN"}})
+	defer srv.Close()
+	args := []string{"send", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1",
+		"--from", "from@example.com", "--to", "a@example.com,b+x@example.com", "--subject", "Test", "--body", "Hello",
+		"--rcpt-param", "NOTIFY=SUCCESS,FAILURE", "--rcpt-param", "ORCPT=rfc822;{{xtext .Recipient}}"}
+	if err := run(args, io.Discard); err != nil {
+		t.Fatalf("send error = %v", err)
+	}
+	msgs := srv.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("server received %d messages, want 1", len(msgs))
+	}
+	for recipient, orcpt := range map[string]string{"a@example.com": "a@example.com", "b+x@example.com": "b+2Bx@example.com"} {
+		want := []string{"NOTIFY=SUCCESS,FAILURE", "ORCPT=rfc822;" + orcpt}
+		if got := msgs[0].RcptParameters[recipient]; !reflect.DeepEqual(got, want) {
+			t.Errorf("RCPT TO parameters for %s = %q, want %q", recipient, got, want)
+		}
+	}
+
+	err := run(append(args[:len(args)-1], "ORCPT={{.Address}}"), io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "invalid RCPT TO parameter") {
+		t.Errorf("send error = %v, want an invalid RCPT TO parameter", err)
+	}
+}
+
+func TestExpectResponse(t *testing.T) {
+	srv := smtptest.NewServer(nil)
+	defer srv.Close()
+	base := []string{"send", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1",
+		"--from", "from@example.com", "--to", "to@example.com", "--subject", "Test", "--body", "Hello"}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "no expectation"},
+		{name: "matching queue id", args: []string{"--expect-response", `^250 2\.0\.0 .*queued as [0-9]+$`}},
+		{name: "mismatch", args: []string{"--expect-response", "queued as [A-Z]+$"}, wantErr: "does not match --expect-response"},
+		{name: "mismatch in a batch", args: []string{"--count", "2", "--expect-response", "^451"}, wantErr: "2 of 2 messages failed"},
+		{name: "invalid pattern", args: []string{"--expect-response", "queued as ("}, wantErr: "invalid --expect-response pattern"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			args := append(append([]string{}, base...), "--output", "json")
+			err := run(append(args, tt.args...), &out)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("send error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("send error = %v", err)
+			}
+			var summary sendSummary
+			if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+				t.Fatalf("invalid JSON summary %q: %v", out.String(), err)
+			}
+			if !strings.HasPrefix(summary.Response, "250 2.0.0 OK queued as ") {
+				t.Errorf("summary response = %q, want the final DATA reply", summary.Response)
+			}
+			if summary.QueueID == "" || !strings.HasSuffix(summary.Response, " "+summary.QueueID) {
+				t.Errorf("summary queue id = %q, want the id from %q", summary.QueueID, summary.Response)
+			}
+		})
+	}
+}
+
+func TestClientCertificateFlags(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	accepted := make(chan struct{}, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			accepted <- struct{}{}
+			conn.Close()
+		}
+	}()
+	port := fmt.Sprint(ln.Addr().(*net.TCPAddr).Port)
+
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{name: "certificate only", args: []string{"--client-cert", "client.crt"}},
+		{name: "key only", args: []string{"--client-key", "client.key"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"send", "--server", "127.0.0.1", "--port", port, "--retries", "1",
+				"--from", "from@example.com", "--to", "to@example.com", "--subject", "Test", "--body", "Hello"}, tt.args...)
+			err := run(args, io.Discard)
+			if err == nil || !strings.Contains(err.Error(), "--client-cert and --client-key must be given together") {
+				t.Fatalf("send error = %v, want both files to be required", err)
+			}
+		})
+	}
+	select {
+	case <-accepted:
+		t.Error("connected to the server before checking the client certificate flags")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSessionSummary(t *testing.T) {
+	srv := smtptest.NewServer(&smtptest.Config{
+		Extensions: []string{"PIPELINING"},
+		Users:      map[string]string{"user": "secret"},
+		StartTLS:   true,
+	})
+	defer srv.Close()
+
+	var out bytes.Buffer
+	args := []string{"send", "--output", "json", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1",
+		"--starttls", "--skip-verify", "--auth-type", "plain", "--username", "user", "--password", "secret",
+		"--from", "from@example.com", "--to", "one@example.com,two@example.com", "--subject", "Test", "--body", "Hello"}
+	if err := run(args, &out); err != nil {
+		t.Fatalf("send error = %v", err)
+	}
+	if lines := strings.Count(out.String(), "\n"); lines != 1 {
+		t.Errorf("summary is %d lines, want a single JSON line:\n%s", lines, out.String())
+	}
+	var summary sendSummary
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+		t.Fatalf("summary JSON did not parse: %v\n%s", err, out.String())
+	}
+
+	if summary.Server != srv.Host() || summary.Port != srv.Port() {
+		t.Errorf("summary server = %s:%d, want %s:%d", summary.Server, summary.Port, srv.Host(), srv.Port())
+	}
+	if !summary.TLS || summary.TLSMode != "STARTTLS" || !strings.HasPrefix(summary.TLSVersion, "TLS 1.") || summary.Cipher == "" {
+		t.Errorf("summary TLS = %v %q %q %q, want STARTTLS with a version and cipher", summary.TLS, summary.TLSMode, summary.TLSVersion, summary.Cipher)
+	}
+	if summary.Auth != "PLAIN" || !summary.Pipelining {
+		t.Errorf("summary auth = %q, pipelining = %v, want PLAIN with pipelining", summary.Auth, summary.Pipelining)
+	}
+	if summary.Size == 0 || summary.Recipients != 2 || summary.Accepted != 2 || summary.Rejected != 0 {
+		t.Errorf("summary size = %d, recipients = %d (%d accepted, %d rejected), want 2 accepted", summary.Size, summary.Recipients, summary.Accepted, summary.Rejected)
+	}
+	if !strings.HasPrefix(summary.Response, "250 ") || summary.QueueID == "" {
+		t.Errorf("summary response = %q, queue id %q, want the final reply", summary.Response, summary.QueueID)
+	}
+	if summary.Duration <= 0 {
+		t.Errorf("summary duration = %v, want the time the send took", summary.Duration)
+	}
+
+	// Without TLS the summary says the session was in plaintext
+	out.Reset()
+	plain := smtptest.NewServer(nil)
+	defer plain.Close()
+	args = []string{"send", "--server", plain.Host(), "--port", fmt.Sprint(plain.Port()), "--retries", "1",
+		"--from", "from@example.com", "--to", "one@example.com", "--subject", "Test", "--body", "Hello"}
+	if err := run(args, &out); err != nil {
+		t.Fatalf("send error = %v", err)
+	}
+	for _, want := range []string{"Recipients: 1 (1 accepted, 0 rejected)", "Server: " + plain.Host(), "TLS: none"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("text summary does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestSMTPS(t *testing.T) {
+	srv := smtptest.NewServer(&smtptest.Config{ImplicitTLS: true})
+	defer srv.Close()
+	base := []string{"send", "--output", "json", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1",
+		"--from", "from@example.com", "--to", "to@example.com", "--subject", "Test", "--body", "Hello"}
+
+	var out bytes.Buffer
+	if err := run(append(append([]string{}, base...), "--smtps", "--skip-verify"), &out); err != nil {
+		t.Fatalf("send --smtps error = %v", err)
+	}
+	var summary sendSummary
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+		t.Fatalf("summary JSON did not parse: %v\n%s", err, out.String())
+	}
+	if summary.TLSMode != "implicit TLS" || len(srv.Messages()) != 1 || !srv.Messages()[0].TLS {
+		t.Errorf("summary TLS mode = %q with %d messages, want one sent with implicit TLS", summary.TLSMode, len(srv.Messages()))
+	}
+
+	// The self-signed certificate is refused without --skip-verify
+	err := run(append(append([]string{}, base...), "--smtps"), io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "certificate verification failed") {
+		t.Errorf("send --smtps error = %v, want the certificate rejected", err)
+	}
+
+	for _, conflict := range []string{"--starttls", "--auto-tls"} {
+		err := run(append(append([]string{}, base...), "--smtps", conflict), io.Discard)
+		if err == nil || !strings.Contains(err.Error(), "cannot be combined") {
+			t.Errorf("send --smtps %s error = %v, want a conflict", conflict, err)
+		}
+	}
+}
+
+func TestRelayTest(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    *smtptest.Config
+		args      []string
+		wantErr   bool
+		wantOut   string
+		wantSaved int
+	}{
+		{name: "open relay", wantErr: true, wantOut: "OPEN RELAY: the server accepted the message", wantSaved: 1},
+		{name: "open relay, dry", args: []string{"--dry-relay"}, wantErr: true, wantOut: "OPEN RELAY: the server accepted the recipient"},
+		{
+			name:    "recipient rejected",
+			config:  &smtptest.Config{RejectRecipients: []string{"victim@example.net"}},
+			wantOut: "Not an open relay: recipient rejected with 550",
+		},
+		{
+			name:    "recipient rejected, dry",
+			config:  &smtptest.Config{RejectRecipients: []string{"victim@example.net"}},
+			args:    []string{"--dry-relay"},
+			wantOut: "Not an open relay: recipient rejected with 550",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := smtptest.NewServer(tt.config)
+			defer srv.Close()
+			args := []string{"relay-test", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1",
+				"--relay-to", "victim@example.net"}
+			var out bytes.Buffer
+			err := run(append(args, tt.args...), &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("relay-test error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !strings.Contains(out.String(), tt.wantOut) {
+				t.Errorf("Expected %q in output, got %q", tt.wantOut, out.String())
+			}
+			if got := len(srv.Messages()); got != tt.wantSaved {
+				t.Errorf("server received %d messages, want %d", got, tt.wantSaved)
+			}
+		})
+	}
+
+	if err := run([]string{"relay-test", "--server", "localhost"}, io.Discard); err == nil || !strings.Contains(err.Error(), "--relay-to is required") {
+		t.Errorf("relay-test error = %v, want --relay-to to be required", err)
+	}
+}
+
+func TestProbeCipherScan(t *testing.T) {
+	srv := smtptest.NewServer(&smtptest.Config{StartTLS: true})
+	defer srv.Close()
+	args := []string{"probe", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1",
+		"--starttls", "--skip-verify", "--cipher-scan",
+		"--tls-ciphers", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+
+	var out bytes.Buffer
+	if err := run(args, &out); err != nil {
+		t.Fatalf("probe error = %v\n%s", err, out.String())
+	}
+	for _, want := range []string{
+		"TLS: TLS 1.2, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		"Cipher suites (1 of 2 accepted)",
+		"accepted: TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+		"rejected: TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+		"Server preference: not tested",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("probe output missing %q:\n%s", want, out.String())
+		}
+	}
+
+	err := run([]string{"probe", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--tls-ciphers", "TLS_AES_128_GCM_SHA256"}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "invalid --tls-ciphers") {
+		t.Errorf("probe error = %v, want TLS 1.3 suites refused", err)
+	}
+}
+
+func TestWarningDiagnostics(t *testing.T) {
+	base := []string{"send", "--dry-run", "--output", "json", "--from", "from@example.com", "--to", "someone@mailinator.com", "--subject", "Test", "--body", "Hello"}
+
+	var out bytes.Buffer
+	if err := run(base, &out); err != nil {
+		t.Fatalf("send error = %v", err)
+	}
+	var summary sendSummary
+	if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+		t.Fatalf("summary JSON did not parse: %v\n%s", err, out.String())
+	}
+	want := diagnostic{Code: "disposable-domain", Severity: "warning", Message: "recipient domain mailinator.com is a disposable mailbox provider"}
+	if len(summary.Warnings) != 1 || summary.Warnings[0] != want {
+		t.Errorf("warnings = %+v, want [%+v]", summary.Warnings, want)
+	}
+
+	err := run(append(append([]string{}, base...), "--fail-on-warning"), io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "--fail-on-warning: disposable-domain") {
+		t.Errorf("send --fail-on-warning error = %v, want the disposable-domain warning", err)
+	}
+
+	// Connection warnings stop the send before the message goes out
+	srv := smtptest.NewServer(nil)
+	defer srv.Close()
+	err = run([]string{"send", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1", "--fail-on-warning",
+		"--from", "from@example.com", "--to", "to@example.com", "--subject", "Test", "--body", "Hello"}, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "no-tls") {
+		t.Errorf("send --fail-on-warning error = %v, want the no-tls warning", err)
+	}
+	if n := len(srv.Messages()); n != 0 {
+		t.Errorf("server received %d messages, want none", n)
+	}
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.txt"), []byte("quarterly numbers\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	good := `messages:
+  - name: welcome
+    to: [alice@example.com]
+    subject: Welcome
+    body: Hello Alice
+  - name: report
+    from: reports@example.com
+    to: [bob@example.com, carol@example.com]
+    subject: Report
+    body: See attached
+    attachments: [report.txt]
+    headers:
+      X-Campaign: q3
+`
+	tests := []struct {
+		name     string
+		manifest string
+		wantErr  bool
+		wantOut  []string
+		wantSent int
+	}{
+		{
+			name:     "two messages",
+			manifest: good,
+			wantOut:  []string{"Message 1/2 (welcome) sent", "Message 2/2 (report) sent"},
+			wantSent: 2,
+		},
+		{
+			name: "bad entry sends nothing",
+			manifest: `messages:
+  - to: [alice@example.com]
+    subject: Fine
+    body: Hello
+  - to: [bob@example.com]
+    subject: Broken
+    body_file: missing.txt
+`,
+			wantErr: true,
+		},
+		{name: "unknown field", manifest: "messages:\n  - too: [alice@example.com]\n", wantErr: true},
+		{name: "empty", manifest: "messages: []\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := smtptest.NewServer(nil)
+			defer srv.Close()
+			path := filepath.Join(dir, "manifest.yaml")
+			if err := os.WriteFile(path, []byte(tt.manifest), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			err := run([]string{"send", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1",
+				"--from", "sender@example.com", "--manifest", path}, &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("send error = %v, wantErr %t", err, tt.wantErr)
+			}
+			for _, want := range tt.wantOut {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("Expected %q in output, got %q", want, out.String())
+				}
+			}
+			msgs := srv.Messages()
+			if len(msgs) != tt.wantSent {
+				t.Fatalf("server received %d messages, want %d", len(msgs), tt.wantSent)
+			}
+			if tt.wantSent == 0 {
+				return
+			}
+			if msgs[0].From != "sender@example.com" || !reflect.DeepEqual(msgs[0].To, []string{"alice@example.com"}) {
+				t.Errorf("first message envelope = %s -> %v", msgs[0].From, msgs[0].To)
+			}
+			second := string(msgs[1].Data)
+			if msgs[1].From != "reports@example.com" || len(msgs[1].To) != 2 {
+				t.Errorf("second message envelope = %s -> %v", msgs[1].From, msgs[1].To)
+			}
+			for _, want := range []string{"Subject: Report", "X-Campaign: q3", "filename=report.txt"} {
+				if !strings.Contains(second, want) {
+					t.Errorf("Expected %q in second message, got:\n%s", want, second)
+				}
+			}
+		})
+	}
+}
+
+func TestRelayEML(t *testing.T) {
+	trace := "Received: from mx1.example.org (mx1.example.org [192.0.2.1])\r\n" +
+		"\tby mx2.example.net; Mon, 1 Jul 2024 10:00:01 +0000\r\n" +
+		"Received: from client.example.org by mx1.example.org; Mon, 1 Jul 2024 10:00:00 +0000\r\n"
+	rest := "From: sender@example.org\r\nTo: recipient@example.net\r\nSubject: Relayed\r\n\r\nBody\r\n"
+	path := filepath.Join(t.TempDir(), "saved.eml")
+	if err := os.WriteFile(path, []byte(trace+rest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr bool
+		want    string
+	}{
+		{name: "trace removed", want: rest},
+		{name: "trace preserved", args: []string{"--preserve-trace"}, want: trace + rest},
+		{name: "content flag", args: []string{"--subject", "Other"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := smtptest.NewServer(nil)
+			defer srv.Close()
+			args := []string{"send", "--server", srv.Host(), "--port", fmt.Sprint(srv.Port()), "--retries", "1", "--eml", path}
+			var out bytes.Buffer
+			err := run(append(args, tt.args...), &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("send error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			msgs := srv.Messages()
+			if len(msgs) != 1 {
+				t.Fatalf("server received %d messages, want 1", len(msgs))
+			}
+			if msgs[0].From != "sender@example.org" || !reflect.DeepEqual(msgs[0].To, []string{"recipient@example.net"}) {
+				t.Errorf("envelope = %s -> %v", msgs[0].From, msgs[0].To)
+			}
+			if got := string(msgs[0].Data); got != tt.want {
+				t.Errorf("server received %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDedupeAttachments(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"report.pdf", "copy.pdf"} {
+		if err := os.WriteFile(filepath.Join(dir, name), bytes.Repeat([]byte("quarterly numbers\n"), 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	attachments := filepath.Join(dir, "report.pdf") + "," + filepath.Join(dir, "copy.pdf")
+
+	tests := []struct {
+		name            string
+		args            []string
+		wantAttachments int
+		wantDeduped     []dedupedAttachment
+	}{
+		{name: "kept by default", wantAttachments: 2},
+		{
+			name:            "deduplicated",
+			args:            []string{"--dedupe-attachments"},
+			wantAttachments: 1,
+			wantDeduped:     []dedupedAttachment{{Filename: "copy.pdf", Of: "report.pdf"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := []string{"send", "--dry-run", "--output", "json", "--from", "sender@example.com", "--to", "recipient@example.com",
+				"--subject", "Report", "--body", "See attached", "--attachments", attachments}
+			var out bytes.Buffer
+			if err := run(append(args, tt.args...), &out); err != nil {
+				t.Fatalf("send error = %v", err)
+			}
+			var summary sendSummary
+			if err := json.Unmarshal(out.Bytes(), &summary); err != nil {
+				t.Fatalf("invalid JSON summary %q: %v", out.String(), err)
+			}
+			if summary.Attachments != tt.wantAttachments {
+				t.Errorf("attachments = %d, want %d", summary.Attachments, tt.wantAttachments)
+			}
+			if !reflect.DeepEqual(summary.Deduplicated, tt.wantDeduped) {
+				t.Errorf("deduplicated = %+v, want %+v", summary.Deduplicated, tt.wantDeduped)
+			}
+			if tt.wantDeduped != nil && summary.DedupeSaved < 1800 {
+				t.Errorf("dedupe_saved_bytes = %d, want at least the attachment's size", summary.DedupeSaved)
+			}
+		})
+	}
+}
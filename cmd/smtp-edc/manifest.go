@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/asachs/smtp-edc/internal/message"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// manifest is a --manifest file: messages sent in turn over the same connections
+type manifest struct {
+	Messages []manifestEntry `yaml:"messages"`
+}
+
+// manifestEntry describes one message of a manifest. Fields left out take
+// their value from the command line or config file; paths are relative to the
+// manifest.
+type manifestEntry struct {
+	Name         string                 `yaml:"name"`
+	From         string                 `yaml:"from"`
+	To           []string               `yaml:"to"`
+	Cc           []string               `yaml:"cc"`
+	Bcc          []string               `yaml:"bcc"`
+	Subject      string                 `yaml:"subject"`
+	Body         string                 `yaml:"body"`
+	BodyFile     string                 `yaml:"body_file"`
+	HTML         string                 `yaml:"html"`
+	HTMLFile     string                 `yaml:"html_file"`
+	Template     string                 `yaml:"template"`
+	HTMLTemplate string                 `yaml:"html_template"`
+	TemplateData map[string]interface{} `yaml:"template_data"`
+	Attachments  []string               `yaml:"attachments"`
+	Headers      map[string]string      `yaml:"headers"`
+}
+
+// manifestResult reports how one message of a manifest went
+type manifestResult struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	MessageID  string `json:"message_id,omitempty"`
+	Recipients int    `json:"recipients"`
+	Response   string `json:"response,omitempty"`
+	QueueID    string `json:"queue_id,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// readManifest reads and parses a manifest file, rejecting unknown fields
+func readManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %v", err)
+	}
+	decoder := yaml.NewDecoder(strings.NewReader(string(data)))
+	decoder.KnownFields(true)
+	var m manifest
+	if err := decoder.Decode(&m); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid manifest %s: %v", path, err)
+	}
+	if len(m.Messages) == 0 {
+		return nil, fmt.Errorf("manifest %s lists no messages", path)
+	}
+	return &m, nil
+}
+
+// settings returns the resolved settings of inv with the entry's fields
+// applied. Settings left unset keep their flag defaults, so that IsSet
+// reports the same as for the command line.
+func (e manifestEntry) settings(inv *invocation, dir string) (*viper.Viper, error) {
+	v := viper.New()
+	if err := v.BindPFlags(inv.flags); err != nil {
+		return nil, fmt.Errorf("failed to bind flags: %v", err)
+	}
+	for _, key := range inv.settings.AllKeys() {
+		if inv.settings.IsSet(key) {
+			v.Set(key, inv.settings.Get(key))
+		}
+	}
+
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	path := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	set("from", e.From)
+	set("to", strings.Join(e.To, ","))
+	set("cc", strings.Join(e.Cc, ","))
+	set("bcc", strings.Join(e.Bcc, ","))
+	set("subject", e.Subject)
+	set("body", e.Body)
+	set("body_file", path(e.BodyFile))
+	set("html", e.HTML)
+	set("html_file", path(e.HTMLFile))
+	set("template", path(e.Template))
+	set("html_template", path(e.HTMLTemplate))
+	if len(e.Attachments) > 0 {
+		attachments := make([]string, len(e.Attachments))
+		for i, attachment := range e.Attachments {
+			file, name, named := strings.Cut(attachment, "=")
+			attachments[i] = path(file)
+			if named {
+				attachments[i] += "=" + name
+			}
+		}
+		v.Set("attachments", strings.Join(attachments, ","))
+	}
+	if e.TemplateData != nil {
+		data, err := json.Marshal(e.TemplateData)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template data: %v", err)
+		}
+		v.Set("template_data", string(data))
+	}
+	return v, nil
+}
+
+// runManifest builds every message of the --manifest file, then sends them in
+// turn over pooled connections and reports each one
+func runManifest(inv *invocation) error {
+	v := inv.settings
+	for _, flag := range []string{"count", "thread_depth", "dump_envelope", "save_eml", "eml"} {
+		if v.IsSet(flag) {
+			return fmt.Errorf("--manifest cannot be combined with --%s", strings.ReplaceAll(flag, "_", "-"))
+		}
+	}
+	path := v.GetString("manifest")
+	m, err := readManifest(path)
+	if err != nil {
+		return err
+	}
+	expect, err := expectedResponse(v)
+	if err != nil {
+		return err
+	}
+
+	// Build every message first, so that a bad entry stops the run before anything is sent
+	msgs := make([]*message.Message, len(m.Messages))
+	results := make([]manifestResult, len(m.Messages))
+	for i, entry := range m.Messages {
+		name := entry.Name
+		if name == "" {
+			name = fmt.Sprintf("message %d", i+1)
+		}
+		settings, err := entry.settings(inv, filepath.Dir(path))
+		if err != nil {
+			return fmt.Errorf("manifest %s: %v", name, err)
+		}
+		entryInv := *inv
+		entryInv.settings = settings
+		msg, err := buildMessage(&entryInv)
+		if err != nil {
+			return fmt.Errorf("manifest %s: %v", name, err)
+		}
+		for key, value := range entry.Headers {
+			if err := message.ValidateHeader(key, value); err != nil {
+				return fmt.Errorf("manifest %s: invalid header: %v", name, err)
+			}
+			msg.AddHeader(key, value)
+		}
+		if err := checkRecipientCap(settings, msg); err != nil {
+			return fmt.Errorf("manifest %s: %v", name, err)
+		}
+		msg.PinMessageID()
+		msgs[i] = msg
+		results[i] = manifestResult{Name: name, Status: "dry-run", MessageID: msg.MessageID, Recipients: len(msg.Recipients())}
+	}
+
+	if !v.GetBool("dry_run") {
+		if v.GetString("server") == "" {
+			return fmt.Errorf("server is required")
+		}
+		if err := inv.diags.check(v.GetBool("fail_on_warning")); err != nil {
+			return err
+		}
+		pool := newPool(inv)
+		defer pool.Close()
+		for i, msg := range msgs {
+			if inv.ctx.Err() != nil {
+				results[i].Status, results[i].Error = "skipped", errInterrupted.Error()
+				continue
+			}
+			session, err := sendOne(pool, msg, nil)
+			if err == nil {
+				err = checkResponse(expect, session)
+			}
+			if session.FinalResponse != nil {
+				results[i].Response = session.FinalResponse.String()
+				results[i].QueueID = session.FinalResponse.QueueID()
+			}
+			if err != nil {
+				results[i].Status, results[i].Error = "failed", err.Error()
+				continue
+			}
+			results[i].Status = "sent"
+		}
+	}
+
+	if err := writeManifestResults(inv.out, v.GetString("output"), results); err != nil {
+		return err
+	}
+	failed := 0
+	for _, result := range results {
+		if result.Status == "failed" || result.Status == "skipped" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d manifest messages failed", failed, len(results))
+	}
+	return inv.diags.check(v.GetBool("fail_on_warning"))
+}
+
+// writeManifestResults prints a line for each message of a manifest, or all
+// the results as one JSON object
+func writeManifestResults(w io.Writer, format string, results []manifestResult) error {
+	if format == "json" {
+		return json.NewEncoder(w).Encode(struct {
+			Messages []manifestResult `json:"messages"`
+		}{results})
+	}
+	for i, result := range results {
+		line := fmt.Sprintf("Message %d/%d (%s) %s", i+1, len(results), result.Name, result.Status)
+		if result.MessageID != "" {
+			line += " " + result.MessageID
+		}
+		switch {
+		case result.Error != "":
+			line += ": " + result.Error
+		case result.Response != "":
+			line += ": " + result.Response
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/asachs/smtp-edc/internal/client"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the send duration histogram
+var durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// metricsInterval is the least time between writes of the metrics file while a batch runs
+const metricsInterval = time.Second
+
+// batchMetrics counts the sends of a batch for the --metrics-file Prometheus export
+type batchMetrics struct {
+	mu       sync.Mutex
+	path     string
+	sends    int
+	failures map[string]int
+	// buckets counts the sends no slower than each of durationBuckets
+	buckets     []int
+	durationSum float64
+	written     time.Time
+	// inPlace rewrites the file directly instead of through a temporary file
+	inPlace bool
+}
+
+// newBatchMetrics returns metrics written to path, or nil if path is empty.
+// With inPlace the file is overwritten directly, for directories that cannot
+// be written to.
+func newBatchMetrics(path string, inPlace bool) *batchMetrics {
+	if path == "" {
+		return nil
+	}
+	return &batchMetrics{
+		path:     path,
+		inPlace:  inPlace,
+		failures: make(map[string]int),
+		buckets:  make([]int, len(durationBuckets)),
+	}
+}
+
+// observe records one send that took d and failed with err, if not nil, and
+// rewrites the metrics file if it has not been written recently. A nil
+// batchMetrics records nothing.
+func (m *batchMetrics) observe(d time.Duration, err error) error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sends++
+	if err != nil {
+		m.failures[failureCode(err)]++
+	}
+	seconds := d.Seconds()
+	m.durationSum += seconds
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			m.buckets[i]++
+		}
+	}
+
+	if time.Since(m.written) < metricsInterval {
+		return nil
+	}
+	return m.write()
+}
+
+// flush writes the metrics file with the final counts
+func (m *batchMetrics) flush() error {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.write()
+}
+
+// write replaces the metrics file through a temporary file in the same
+// directory, so a collector never reads a partly written file
+func (m *batchMetrics) write() error {
+	if m.inPlace {
+		if err := os.WriteFile(m.path, []byte(m.format()), 0644); err != nil {
+			return fmt.Errorf("failed to write metrics: %v", err)
+		}
+		m.written = time.Now()
+		return nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(m.path), "."+filepath.Base(m.path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	_, err = f.WriteString(m.format())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), m.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write metrics: %v", err)
+	}
+	m.written = time.Now()
+	return nil
+}
+
+// format returns the metrics in the Prometheus text exposition format
+func (m *batchMetrics) format() string {
+	var b strings.Builder
+	b.WriteString("# HELP smtp_edc_sends_total Messages sent or attempted.\n")
+	b.WriteString("# TYPE smtp_edc_sends_total counter\n")
+	fmt.Fprintf(&b, "smtp_edc_sends_total %d\n", m.sends)
+
+	b.WriteString("# HELP smtp_edc_failures_total Failed sends by SMTP reply code, \"none\" when the server did not reply.\n")
+	b.WriteString("# TYPE smtp_edc_failures_total counter\n")
+	codes := make([]string, 0, len(m.failures))
+	for code := range m.failures {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		fmt.Fprintf(&b, "smtp_edc_failures_total{code=%q} %d\n", code, m.failures[code])
+	}
+
+	b.WriteString("# HELP smtp_edc_send_duration_seconds Time taken to send each message.\n")
+	b.WriteString("# TYPE smtp_edc_send_duration_seconds histogram\n")
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(&b, "smtp_edc_send_duration_seconds_bucket{le=%q} %d\n",
+			strconv.FormatFloat(bound, 'g', -1, 64), m.buckets[i])
+	}
+	fmt.Fprintf(&b, "smtp_edc_send_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.sends)
+	fmt.Fprintf(&b, "smtp_edc_send_duration_seconds_sum %s\n", strconv.FormatFloat(m.durationSum, 'g', -1, 64))
+	fmt.Fprintf(&b, "smtp_edc_send_duration_seconds_count %d\n", m.sends)
+	return b.String()
+}
+
+// failureCode returns the reply code of a failed send as a label value
+func failureCode(err error) string {
+	var catalogErr *client.Error
+	if errors.As(err, &catalogErr) && catalogErr.Code() != 0 {
+		return strconv.Itoa(catalogErr.Code())
+	}
+	var smtpErr *client.SMTPError
+	if errors.As(err, &smtpErr) {
+		return strconv.Itoa(smtpErr.Code)
+	}
+	return "none"
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/asachs/smtp-edc/internal/client"
+)
+
+// runProbe connects to the server, prints its capabilities and optionally its HELP reply
+func runProbe(inv *invocation) error {
+	v := inv.settings
+	if v.GetString("server") == "" {
+		return fmt.Errorf("server is required")
+	}
+	if v.GetString("bad_sni") != "" && (v.GetBool("starttls") || v.GetBool("auto_tls") || v.GetBool("smtps")) {
+		return fmt.Errorf("--bad-sni runs its own STARTTLS and cannot be combined with --starttls, --auto-tls or --smtps")
+	}
+
+	c, err := dialSession(v, inv.diags)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	caps := c.Capabilities()
+	fmt.Fprintf(inv.out, "Server: %s:%d\n", v.GetString("server"), c.Session().Port)
+	if v.GetBool("auto_tls") || v.GetBool("smtps") {
+		fmt.Fprintf(inv.out, "  Connection: %s\n", tlsMode(c.Session()))
+	}
+	if session := c.Session(); session.TLS {
+		fmt.Fprintf(inv.out, "  TLS: %s, %s\n", session.TLSVersion, session.CipherSuite)
+	}
+	fmt.Fprintf(inv.out, "  PIPELINING: %t\n", caps.Pipelining)
+	fmt.Fprintf(inv.out, "  STARTTLS: %t\n", caps.StartTLS)
+	fmt.Fprintf(inv.out, "  8BITMIME: %t\n", caps.EightBit)
+	fmt.Fprintf(inv.out, "  DSN: %t\n", caps.DSN)
+	fmt.Fprintf(inv.out, "  CHUNKING: %t\n", caps.Chunking)
+	fmt.Fprintf(inv.out, "  SIZE: %d\n", caps.Size)
+	fmt.Fprintf(inv.out, "  AUTH: %s\n", strings.Join(caps.Auth, " "))
+
+	// Look for signs that a man in the middle stripped capabilities such as STARTTLS
+	if v.GetBool("check_starttls") || v.GetString("baseline") != "" {
+		var expected []string
+		if v.GetBool("check_starttls") {
+			expected = append(expected, "STARTTLS")
+		}
+		if path := v.GetString("baseline"); path != "" {
+			baseline, err := readBaseline(path)
+			if err != nil {
+				return err
+			}
+			expected = append(expected, baseline...)
+		}
+		warnings := downgradeWarnings(caps, expected, c.Session().TLS)
+		for _, warning := range warnings {
+			fmt.Fprintf(inv.out, "WARNING: %s\n", warning)
+		}
+		if len(warnings) > 0 && v.GetBool("paranoid") {
+			return fmt.Errorf("possible downgrade attack: %d capability warning(s)", len(warnings))
+		}
+	}
+
+	// Compare against the required capabilities, failing with the differences
+	if path := v.GetString("expect_caps"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to read expected capabilities: %v", err)
+		}
+		reqs, err := client.ParseCapabilityRequirements(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read expected capabilities: %v", err)
+		}
+		if problems := caps.Check(reqs, c.Session().TLS); len(problems) > 0 {
+			fmt.Fprintf(inv.out, "Capabilities differ from %s:\n", path)
+			for _, problem := range problems {
+				fmt.Fprintf(inv.out, "- %s\n", problem)
+			}
+			return fmt.Errorf("server does not meet %d expected capability(ies)", len(problems))
+		}
+		fmt.Fprintf(inv.out, "All %d expected capabilities present\n", len(reqs))
+	}
+
+	// Send the HELP command if requested
+	if v.GetBool("help_command") {
+		resp, err := c.Help(v.GetString("help_topic"))
+		if err != nil {
+			return fmt.Errorf("HELP failed: %v", err)
+		}
+		fmt.Fprintln(inv.out, resp)
+	}
+
+	// Each suite is tried on a connection of its own
+	if v.GetBool("cipher_scan") {
+		if err := scanCiphers(inv, c); err != nil {
+			return err
+		}
+	}
+
+	// The connection is not usable after a rejected handshake, so this comes last
+	if name := v.GetString("bad_sni"); name != "" {
+		return checkBadSNI(inv, c, name)
+	}
+
+	if err := c.Quit(); err != nil {
+		return fmt.Errorf("failed to quit: %v", err)
+	}
+	return nil
+}
+
+// scanCiphers reports which cipher suites the server accepts, out of those
+// given with --tls-ciphers or all the client supports with TLS 1.2
+func scanCiphers(inv *invocation, c *client.SMTPClient) error {
+	candidates := client.TLS12CipherSuites()
+	if names := inv.settings.GetString("tls_ciphers"); names != "" {
+		// Already checked when the session was set up
+		candidates, _ = client.ParseCipherSuites(parseAddressList(names))
+	}
+	scan, err := c.ScanCiphers(candidates)
+	if err != nil {
+		return fmt.Errorf("cipher scan failed: %v", err)
+	}
+
+	fmt.Fprintf(inv.out, "Cipher suites (%d of %d accepted):\n", len(scan.Accepted), len(candidates))
+	for _, name := range client.CipherSuiteNames(scan.Accepted) {
+		fmt.Fprintf(inv.out, "  accepted: %s\n", name)
+	}
+	for _, name := range client.CipherSuiteNames(scan.Rejected) {
+		fmt.Fprintf(inv.out, "  rejected: %s\n", name)
+	}
+	switch {
+	case !scan.PreferenceTested:
+		fmt.Fprintln(inv.out, "  Server preference: not tested, fewer than two suites accepted")
+	case scan.ServerPreference:
+		fmt.Fprintln(inv.out, "  Server preference: yes, the server applies its own order")
+	default:
+		fmt.Fprintln(inv.out, "  Server preference: none detected, the server followed the client's order")
+	}
+	return nil
+}
+
+// checkBadSNI runs STARTTLS presenting a server name the certificate should not
+// cover and fails if certificate verification accepts it
+func checkBadSNI(inv *invocation, c *client.SMTPClient, name string) error {
+	if !c.Capabilities().StartTLS {
+		return fmt.Errorf("--bad-sni requires STARTTLS, which the server does not advertise")
+	}
+	result, err := c.CheckServerName(name)
+	if err != nil {
+		return fmt.Errorf("failed to start TLS: %v", err)
+	}
+
+	fmt.Fprintf(inv.out, "STARTTLS with server name %s:\n", name)
+	fmt.Fprintf(inv.out, "  Certificate matches name: %t\n", result.Matched)
+	if result.Verified {
+		fmt.Fprintln(inv.out, "  Verification: accepted")
+		c.Quit()
+		return fmt.Errorf("certificate verification accepted server name %s; expected it to be rejected", name)
+	}
+	fmt.Fprintf(inv.out, "  Verification: rejected (%v)\n", result.Err)
+	if result.Matched {
+		fmt.Fprintln(inv.out, "  Note: the certificate covers this name, so it was rejected for another reason")
+	}
+	return nil
+}
+
+// downgradeWarnings reports each expected EHLO keyword that the live response
+// does not advertise. STARTTLS is not expected once the session is already
+// encrypted, since servers stop advertising it after the upgrade.
+func downgradeWarnings(caps client.ServerCapabilities, expected []string, tlsActive bool) []string {
+	var warnings []string
+	seen := make(map[string]bool)
+	for _, keyword := range expected {
+		keyword = strings.ToUpper(keyword)
+		if seen[keyword] || caps.Has(keyword) {
+			continue
+		}
+		seen[keyword] = true
+		switch {
+		case keyword == "STARTTLS" && tlsActive:
+		case keyword == "STARTTLS":
+			warnings = append(warnings, "server did not advertise STARTTLS; it may have been stripped by a man in the middle")
+		default:
+			warnings = append(warnings, fmt.Sprintf("server did not advertise %s, which is expected by the baseline", keyword))
+		}
+	}
+	return warnings
+}
+
+// readBaseline reads the EHLO keywords of a known-good capability baseline,
+// one extension per line as shown by the server (e.g. "AUTH PLAIN LOGIN").
+// Only the keyword is compared; blank lines and # comments are ignored.
+func readBaseline(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read baseline: %v", err)
+	}
+	defer f.Close()
+	return parseBaseline(f)
+}
+
+// parseBaseline parses the keywords of a capability baseline
+func parseBaseline(r io.Reader) ([]string, error) {
+	var keywords []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keywords = append(keywords, strings.ToUpper(strings.Fields(line)[0]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read baseline: %v", err)
+	}
+	return keywords, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/asachs/smtp-edc/internal/client"
+	"github.com/asachs/smtp-edc/internal/message"
+)
+
+// relayTestSubject marks the message sent by relay-test without --dry-relay
+const relayTestSubject = "smtp-edc relay test"
+
+// relayTestBody explains the message to whoever receives it
+const relayTestBody = "This message was sent by smtp-edc relay-test to check whether the server\r\n" +
+	"relays mail between outside domains. If it arrived, the server is an open relay.\r\n"
+
+// runRelayTest tries to send from an outside sender to an outside recipient
+// through the server, and fails if the server relays it
+func runRelayTest(inv *invocation) error {
+	v := inv.settings
+	if v.GetString("server") == "" {
+		return fmt.Errorf("server is required")
+	}
+	from := message.NormalizeAddress(v.GetString("relay_from"))
+	to := message.NormalizeAddress(v.GetString("relay_to"))
+	if to == "" {
+		return fmt.Errorf("--relay-to is required: an address at an outside domain that you control")
+	}
+	for _, addr := range []string{from, to} {
+		if err := message.ValidateEmail(addr); err != nil {
+			return err
+		}
+	}
+
+	c, err := dialSession(v, inv.diags)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	fmt.Fprintf(inv.out, "Relay test: %s -> %s via %s:%d\n", from, to, v.GetString("server"), c.Session().Port)
+	if session := c.Session(); session.AuthMechanism != "" {
+		fmt.Fprintf(inv.out, "  Authenticated with %s; servers usually relay for authenticated clients\n", session.AuthMechanism)
+	}
+
+	var stage string
+	if v.GetBool("dry_relay") {
+		stage, err = relayEnvelope(c, from, to)
+	} else {
+		msg := message.NewMessage(from, []string{to}, relayTestSubject, relayTestBody)
+		stage, err = relayMessage(c, msg)
+	}
+	if err != nil {
+		return err
+	}
+	if stage != "" {
+		fmt.Fprintf(inv.out, "Not an open relay: %s\n", stage)
+		return c.Quit()
+	}
+
+	if v.GetBool("dry_relay") {
+		fmt.Fprintln(inv.out, "OPEN RELAY: the server accepted the recipient (stopped before DATA)")
+	} else {
+		fmt.Fprintf(inv.out, "OPEN RELAY: the server accepted the message: %s\n", c.Session().FinalResponse)
+	}
+	c.Quit()
+	return fmt.Errorf("%s relays mail from %s to %s", v.GetString("server"), from, to)
+}
+
+// relayEnvelope sends MAIL FROM and RCPT TO, then resets the transaction
+// without sending any content. It returns where the server refused to relay,
+// or "" if it accepted the recipient.
+func relayEnvelope(c *client.SMTPClient, from, to string) (string, error) {
+	if err := c.MailFrom(from); err != nil {
+		return relayRefusal("sender rejected", err)
+	}
+	stage := ""
+	err := c.RcptTo(to)
+	if err != nil {
+		if stage, err = relayRefusal("recipient rejected", err); err != nil {
+			return "", err
+		}
+	}
+	if err := c.Reset(); err != nil {
+		return "", fmt.Errorf("failed to reset the transaction: %v", err)
+	}
+	return stage, nil
+}
+
+// relayMessage sends msg and returns where the server refused to relay it, or
+// "" if it accepted it
+func relayMessage(c *client.SMTPClient, msg *message.Message) (string, error) {
+	err := c.SendMessage(msg)
+	if err == nil {
+		return "", nil
+	}
+	var sendErr *client.Error
+	if !errors.As(err, &sendErr) {
+		return relayRefusal("rejected", err)
+	}
+	switch sendErr.Kind {
+	case client.ErrSender:
+		return relayRefusal("sender rejected", sendErr.Err)
+	case client.ErrRecipient:
+		return relayRefusal("recipient rejected", sendErr.Err)
+	case client.ErrData:
+		return relayRefusal("DATA rejected", sendErr.Err)
+	default:
+		return relayRefusal("message rejected", sendErr.Err)
+	}
+}
+
+// relayRefusal describes a rejection by the server, or returns err if the
+// server did not reply, as then nothing is known about relaying
+func relayRefusal(stage string, err error) (string, error) {
+	var smtpErr *client.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return "", fmt.Errorf("relay test failed: %v", err)
+	}
+	return fmt.Sprintf("%s with %s", stage, smtpErr), nil
+}
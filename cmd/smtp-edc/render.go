@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// runRender prints the message exactly as it would be sent in the DATA phase
+func runRender(inv *invocation) error {
+	msg, err := buildMessage(inv)
+	if err != nil {
+		return err
+	}
+	built, err := msg.Build()
+	if err != nil {
+		return fmt.Errorf("failed to build message: %v", err)
+	}
+	_, err = io.WriteString(inv.out, built)
+	return err
+}
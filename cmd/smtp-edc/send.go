@@ -0,0 +1,804 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/asachs/smtp-edc/internal/client"
+	"github.com/asachs/smtp-edc/internal/message"
+	"github.com/asachs/smtp-edc/internal/ratelimit"
+	"github.com/spf13/viper"
+)
+
+// runSend sends the message, or count copies of it, and reports the result
+func runSend(inv *invocation) error {
+	v := inv.settings
+	if v.GetString("manifest") != "" {
+		return runManifest(inv)
+	}
+	msg, err := buildMessage(inv)
+	if err != nil {
+		return err
+	}
+	expect, err := expectedResponse(v)
+	if err != nil {
+		return err
+	}
+
+	// The saved transaction must be the one sent, so keep its Message-ID
+	saving := v.GetString("dump_envelope") != "" || v.GetString("save_eml") != ""
+	if saving {
+		if v.GetInt("count") != 1 {
+			return fmt.Errorf("--dump-envelope and --save-eml require --count 1")
+		}
+		msg.PinMessageID()
+	}
+
+	// Report what would be sent without connecting
+	if v.GetBool("dry_run") {
+		if saving {
+			// Without a session no server capabilities are known, so
+			// parameters that depend on them are left out
+			c := client.NewSMTPClient(ehloName, false)
+			c.SetMailAuth(v.GetString("mail_auth"))
+			if err := saveTransaction(v, c, msg); err != nil {
+				return err
+			}
+		}
+		summary, err := newSummary("dry-run", msg, client.SessionInfo{})
+		if err != nil {
+			return err
+		}
+		summary.reportAttachments(inv)
+		summary.Warnings = inv.diags.all()
+		if v.GetBool("validate_mx") {
+			summary.DeliveryPlan = newRoutePlans(message.PlanDelivery(message.DefaultMXCache, msg.Recipients()))
+		}
+		if err := summary.write(inv.out, v.GetString("output")); err != nil {
+			return err
+		}
+		return inv.diags.check(v.GetBool("fail_on_warning"))
+	}
+
+	if v.GetString("server") == "" {
+		return fmt.Errorf("server is required")
+	}
+	if err := checkRecipientCap(v, msg); err != nil {
+		return err
+	}
+	if err := inv.diags.check(v.GetBool("fail_on_warning")); err != nil {
+		return err
+	}
+
+	count := v.GetInt("count")
+	depth := v.GetInt("thread_depth")
+	if depth > 1 {
+		if count != 1 {
+			return fmt.Errorf("--thread-depth cannot be combined with --count")
+		}
+		count = depth
+	}
+	if err := confirmSend(inv, msg, count); err != nil {
+		return err
+	}
+	if depth > 1 {
+		return sendThread(inv, msg, depth, expect)
+	}
+	if count == 1 {
+		pool := newPool(inv)
+		defer pool.Close()
+		var before func(*client.SMTPClient) error
+		if saving {
+			before = func(c *client.SMTPClient) error { return saveTransaction(v, c, msg) }
+		}
+		metrics := newBatchMetrics(v.GetString("metrics_file"), v.GetBool("no_temp_files"))
+		start := time.Now()
+		session, err := sendOne(pool, msg, before)
+		elapsed := time.Since(start)
+		metrics.observe(elapsed, err)
+		if err := metrics.flush(); err != nil {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to send message: %v", err)
+		}
+		summary, err := newSummary("sent", msg, session)
+		if err != nil {
+			return err
+		}
+		summary.reportAttachments(inv)
+		summary.Warnings = inv.diags.all()
+		summary.Duration = elapsed.Seconds()
+		if err := summary.write(inv.out, v.GetString("output")); err != nil {
+			return err
+		}
+		return checkResponse(expect, session)
+	}
+	return sendRepeated(inv, msg, count)
+}
+
+// expectedResponse compiles the --expect-response pattern, or returns nil if none is set
+func expectedResponse(v *viper.Viper) (*regexp.Regexp, error) {
+	pattern := v.GetString("expect_response")
+	if pattern == "" {
+		return nil, nil
+	}
+	expect, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --expect-response pattern: %v", err)
+	}
+	return expect, nil
+}
+
+// checkResponse fails when the server's final reply to a message does not
+// match expect, e.g. because a relay did not report a queue id
+func checkResponse(expect *regexp.Regexp, session client.SessionInfo) error {
+	if expect == nil {
+		return nil
+	}
+	if session.FinalResponse == nil {
+		return fmt.Errorf("no final response to match --expect-response %q", expect)
+	}
+	if reply := session.FinalResponse.String(); !expect.MatchString(reply) {
+		return fmt.Errorf("final response %q does not match --expect-response %q", reply, expect)
+	}
+	return nil
+}
+
+// checkRecipientCap refuses to send to more recipients than --max-recipients
+// allows unless --yes is set
+func checkRecipientCap(v *viper.Viper, msg *message.Message) error {
+	limit := v.GetInt("max_recipients")
+	if n := len(msg.Recipients()); limit > 0 && n > limit && !v.GetBool("yes") {
+		return fmt.Errorf("message has %d recipients, more than --max-recipients %d; pass --yes or raise the cap to send it", n, limit)
+	}
+	return nil
+}
+
+// sendThread sends depth messages, each a reply to the one before, so that
+// mail clients show them as one thread
+func sendThread(inv *invocation, msg *message.Message, depth int, expect *regexp.Regexp) error {
+	msg.PinMessageID()
+	if _, err := msg.Reply(); err != nil {
+		return fmt.Errorf("--thread-depth needs Message-IDs to chain the replies and cannot be combined with --minimal-headers")
+	}
+
+	pool := newPool(inv)
+	defer pool.Close()
+	for i := 0; i < depth; i++ {
+		if i > 0 {
+			var err error
+			if msg, err = msg.Reply(); err != nil {
+				return err
+			}
+			msg.Reset()
+		}
+		session, err := sendOne(pool, msg, nil)
+		if err == nil {
+			err = checkResponse(expect, session)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to send message %d/%d of the thread: %v", i+1, depth, err)
+		}
+		fmt.Fprintf(inv.out, "Message %d/%d sent: %s\n", i+1, depth, msg.MessageID)
+	}
+	return nil
+}
+
+// interruptGrace is how long an interrupted batch waits for the in-flight send
+const interruptGrace = 5 * time.Second
+
+// errInterrupted is returned when a batch is cancelled before it finishes
+var errInterrupted = errors.New("interrupted")
+
+// batchResult summarizes a batch of sends
+type batchResult struct {
+	Attempted   int
+	Failures    int
+	Slowest     time.Duration
+	Elapsed     time.Duration
+	Interrupted bool
+}
+
+// sendBatch calls send for messages 0 to count-1 until ctx is cancelled. A
+// send in flight when ctx is cancelled is given grace to finish; failures are
+// reported through onError.
+func sendBatch(ctx context.Context, count int, grace time.Duration, send func(i int) error, onError func(i int, err error)) batchResult {
+	var result batchResult
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		if ctx.Err() != nil {
+			result.Interrupted = true
+			break
+		}
+
+		sendStart := time.Now()
+		done := make(chan error, 1)
+		go func(i int) { done <- send(i) }(i)
+
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			select {
+			case err = <-done:
+			case <-time.After(grace):
+				err = fmt.Errorf("still in flight after %s", grace)
+			}
+		}
+
+		result.Attempted++
+		if err != nil {
+			result.Failures++
+			onError(i, err)
+			continue
+		}
+		if d := time.Since(sendStart); d > result.Slowest {
+			result.Slowest = d
+		}
+	}
+	if ctx.Err() != nil {
+		result.Interrupted = true
+	}
+	result.Elapsed = time.Since(start)
+	return result
+}
+
+// sendRepeated sends count copies of msg over pooled connections and prints throughput
+func sendRepeated(inv *invocation, msg *message.Message, count int) error {
+	v := inv.settings
+	if count < 1 {
+		return fmt.Errorf("invalid count %d: must be at least 1", count)
+	}
+	expect, err := expectedResponse(v)
+	if err != nil {
+		return err
+	}
+
+	pool := newPool(inv)
+	defer pool.Close()
+
+	// Send messages; an interrupt stops new sends and waits briefly for the current one
+	limiter := ratelimit.NewDomainLimiter(v.GetFloat64("per_domain_rate"))
+	metrics := newBatchMetrics(v.GetString("metrics_file"), v.GetBool("no_temp_files"))
+	result := sendBatch(inv.ctx, count, interruptGrace, func(i int) error {
+		// Each copy gets its own Date and, after Reset, a fresh Message-ID
+		m := msg.Clone()
+		if v.GetBool("unique") {
+			m = msg.Unique()
+		}
+		m.Reset()
+		// Hold the message until every recipient domain is under its rate
+		if err := limiter.Wait(inv.ctx, m.RecipientDomains()...); err != nil {
+			return err
+		}
+		start := time.Now()
+		session, err := sendOne(pool, m, nil)
+		// The file is rewritten as the batch runs; a failed write does not stop it
+		if err := metrics.observe(time.Since(start), err); err != nil {
+			inv.diags.warn(warnMetricsWrite, "%v", err)
+		}
+		if err != nil {
+			return err
+		}
+		return checkResponse(expect, session)
+	}, func(i int, err error) {
+		fmt.Fprintf(inv.out, "Message %d/%d failed: %v\n", i+1, count, err)
+	})
+
+	// Report benchmark results, partial if interrupted
+	sent := result.Attempted - result.Failures
+	if result.Interrupted {
+		fmt.Fprint(inv.out, "Interrupted: ")
+	}
+	fmt.Fprintf(inv.out, "Sent %d/%d messages in %s (%.2f msg/s, slowest %s, trace id %s)\n",
+		sent, count, result.Elapsed.Round(time.Millisecond),
+		float64(sent)/result.Elapsed.Seconds(), result.Slowest.Round(time.Millisecond),
+		msg.Headers[message.TraceIDHeader])
+	if waits, waited := pool.Waits(); waits > 0 {
+		fmt.Fprintf(inv.out, "Waited for a free connection (--max-connections %d) %d time(s), %s in total\n",
+			v.GetInt("max_connections"), waits, waited.Round(time.Millisecond))
+	}
+	if err := metrics.flush(); err != nil {
+		return err
+	}
+	if result.Interrupted {
+		return fmt.Errorf("%w after %d of %d messages", errInterrupted, result.Attempted, count)
+	}
+	if result.Failures > 0 {
+		return fmt.Errorf("%d of %d messages failed", result.Failures, count)
+	}
+	return nil
+}
+
+// newPool creates a connection pool that dials sessions from the resolved settings
+func newPool(inv *invocation) *client.Pool {
+	v := inv.settings
+	dial := func() (*client.SMTPClient, error) {
+		c, err := dialSession(v, inv.diags)
+		if err == nil && inv.redact != nil {
+			c.SetRedactor(inv.redact)
+		}
+		return c, err
+	}
+	return client.NewPool(dial, client.PoolConfig{
+		MaxIdle:     v.GetDuration("pool_max_idle"),
+		MaxLifetime: v.GetDuration("pool_max_lifetime"),
+		MaxOpen:     v.GetInt("max_connections"),
+	})
+}
+
+// sendOne sends a single message over a pooled connection and reports the
+// session it used. If before is set it is called with the connected client
+// just before the message is sent.
+func sendOne(pool *client.Pool, msg *message.Message, before func(*client.SMTPClient) error) (client.SessionInfo, error) {
+	smtpClient, err := pool.Get()
+	if err != nil {
+		return client.SessionInfo{}, err
+	}
+	if before != nil {
+		if err := before(smtpClient); err != nil {
+			pool.Put(smtpClient)
+			return client.SessionInfo{}, err
+		}
+	}
+	if err := smtpClient.SendMessage(msg); err != nil {
+		// A rejected message leaves the authenticated session usable
+		if smtpClient.Reusable() {
+			pool.Put(smtpClient)
+		} else {
+			pool.Discard(smtpClient)
+		}
+		return client.SessionInfo{}, err
+	}
+	session := smtpClient.Session()
+	// Linger on the connection before it is reused or quit, as --post-send-delay asks
+	if err := smtpClient.Hold(); err != nil {
+		pool.Discard(smtpClient)
+		return session, fmt.Errorf("message sent, but %v", err)
+	}
+	pool.Put(smtpClient)
+	return session, nil
+}
+
+// envelopeDump is the --dump-envelope file: the envelope of the transaction and
+// the commands that carry it, ready to be replayed
+type envelopeDump struct {
+	MailFrom   string   `json:"mail_from"`
+	Parameters []string `json:"mail_parameters,omitempty"`
+	RcptTo     []string `json:"rcpt_to"`
+	// RcptParameters holds the RCPT TO parameters by recipient, such as DSN requests
+	RcptParameters map[string][]string `json:"rcpt_parameters,omitempty"`
+	Commands       []string            `json:"commands"`
+}
+
+// saveTransaction writes the envelope c sends for msg and the message content
+// to the files named by --dump-envelope and --save-eml
+func saveTransaction(v *viper.Viper, c *client.SMTPClient, msg *message.Message) error {
+	if path := v.GetString("dump_envelope"); path != "" {
+		envelope := c.Envelope(msg)
+		data, err := json.MarshalIndent(envelopeDump{
+			MailFrom:       envelope.From,
+			Parameters:     envelope.Parameters,
+			RcptTo:         envelope.Recipients,
+			RcptParameters: envelope.RecipientParameters,
+			Commands:       envelope.Commands(),
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write envelope: %v", err)
+		}
+	}
+	if path := v.GetString("save_eml"); path != "" {
+		data, err := msg.Build()
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			return fmt.Errorf("failed to write message: %v", err)
+		}
+	}
+	return nil
+}
+
+// dotTerminationText is added to the body by --test-dot-termination. Its second
+// line is lost if the server takes the lone dot for the end of the data.
+const dotTerminationText = ".\r\nThis line follows a line holding only a dot.\r\n"
+
+// buildMessage validates the sender and recipients and assembles the message
+// from the body, template, header and attachment settings
+func buildMessage(inv *invocation) (*message.Message, error) {
+	v := inv.settings
+
+	// Validate required fields
+	from := message.NormalizeAddress(v.GetString("from"))
+	toAddrs := addressList(v, "to")
+	ccAddrs := addressList(v, "cc")
+	bccAddrs := addressList(v, "bcc")
+
+	// A message file supplies whatever the command line leaves unset
+	var msgFile *message.MessageFile
+	if path := v.GetString("message_file"); path != "" {
+		if v.GetString("template") != "" || v.GetString("html_template") != "" {
+			return nil, fmt.Errorf("--message-file cannot be combined with --template or --html-template")
+		}
+		var err error
+		if msgFile, err = message.ReadMessageFile(path); err != nil {
+			return nil, err
+		}
+		if from == "" {
+			from = message.NormalizeAddress(msgFile.From)
+		}
+		if len(toAddrs) == 0 && len(ccAddrs) == 0 && len(bccAddrs) == 0 {
+			toAddrs = normalizeAddresses(msgFile.To)
+			ccAddrs = normalizeAddresses(msgFile.Cc)
+			bccAddrs = normalizeAddresses(msgFile.Bcc)
+		}
+	}
+
+	// A saved message to relay likewise supplies the envelope from its headers
+	var eml *message.Message
+	if path := v.GetString("eml"); path != "" {
+		if msgFile != nil {
+			return nil, fmt.Errorf("--eml cannot be combined with --message-file")
+		}
+		var err error
+		if eml, err = message.ReadEML(path, v.GetBool("preserve_trace")); err != nil {
+			return nil, err
+		}
+		if from == "" {
+			from = message.NormalizeAddress(eml.From)
+		}
+		if len(toAddrs) == 0 && len(ccAddrs) == 0 && len(bccAddrs) == 0 {
+			toAddrs = normalizeAddresses(eml.To)
+			ccAddrs = normalizeAddresses(eml.Cc)
+		}
+	} else if v.GetBool("preserve_trace") {
+		return nil, fmt.Errorf("--preserve-trace requires --eml")
+	}
+
+	// Add the addresses of the directory entries matching the LDAP filter
+	if v.GetString("ldap_filter") != "" {
+		addrs, err := ldapRecipients(v)
+		if err != nil {
+			return nil, err
+		}
+		toAddrs = append(toAddrs, addrs...)
+	}
+
+	// Expand alias groups into their members before the envelope is built
+	if path := v.GetString("aliases"); path != "" {
+		aliases, err := message.ReadAliases(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, list := range []*[]string{&toAddrs, &ccAddrs, &bccAddrs} {
+			if *list, err = aliases.Expand(*list); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Keep the recipient addresses out of everything printed from here on
+	if v.GetBool("anonymize_recipients") {
+		var recipients []string
+		recipients = append(recipients, toAddrs...)
+		recipients = append(recipients, ccAddrs...)
+		recipients = append(recipients, bccAddrs...)
+		inv.redact = message.NewAddressAnonymizer(recipients)
+		inv.out = redactingWriter{w: inv.out, redact: inv.redact}
+	}
+
+	if from == "" || (len(toAddrs) == 0 && len(ccAddrs) == 0 && len(bccAddrs) == 0) {
+		return nil, fmt.Errorf("from and at least one recipient (to, cc, or bcc) are required (from: %q, to: %q, cc: %q, bcc: %q)",
+			from, strings.Join(toAddrs, ", "), strings.Join(ccAddrs, ", "), strings.Join(bccAddrs, ", "))
+	}
+
+	// Validate email addresses, reporting every invalid one at once
+	if errs := message.ValidateAddresses(from, toAddrs, ccAddrs, bccAddrs, v.GetBool("validate_mx")); len(errs) > 0 {
+		return nil, joinErrors(errs)
+	}
+
+	if eml != nil {
+		return relayEML(inv, eml, from, toAddrs, ccAddrs, bccAddrs)
+	}
+
+	// Read inline attachments; a Content-ID is generated for those without one
+	var inline []message.Attachment
+	for _, entry := range parseAddressList(v.GetString("inline")) {
+		filename, contentID, _ := strings.Cut(entry, "=")
+		attachment, err := message.ReadFileAttachment(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read inline attachment %s: %v", filename, err)
+		}
+		attachment.ContentID = contentID
+		inline = append(inline, *attachment)
+	}
+
+	var msg *message.Message
+
+	// Handle templates
+	templateFile := v.GetString("template")
+	htmlTemplateFile := v.GetString("html_template")
+	if templateFile != "" || htmlTemplateFile != "" || msgFile != nil {
+		// Parse template data
+		var data map[string]interface{}
+		if templateData := v.GetString("template_data"); templateData != "" {
+			if err := json.Unmarshal([]byte(templateData), &data); err != nil {
+				return nil, fmt.Errorf("failed to parse template data: %v", err)
+			}
+		}
+
+		// Load template; a --subject given on the command line replaces the message file's
+		subject := v.GetString("subject")
+		var tmpl *message.Template
+		var err error
+		if msgFile != nil {
+			if subject == "" {
+				tmpl, err = msgFile.Template()
+			} else {
+				tmpl, err = message.LoadTemplateFromString("", msgFile.Body, "")
+			}
+		} else {
+			tmpl, err = message.LoadTemplate(v.GetString("subject_template"), templateFile, htmlTemplateFile)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to load template: %v", err)
+		}
+
+		// Execute template
+		msg, err = tmpl.Execute(&message.TemplateData{
+			From:    from,
+			To:      toAddrs,
+			Cc:      ccAddrs,
+			Bcc:     bccAddrs,
+			Subject: subject,
+			Data:    data,
+			Inline:  inline,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to execute template: %v", err)
+		}
+	} else {
+		// Create message without template
+		msg = message.NewMessage(from, toAddrs, v.GetString("subject"), v.GetString("body"))
+		msg.Cc = ccAddrs
+		msg.Bcc = bccAddrs
+		msg.HTMLBody = v.GetString("html")
+
+		// Read body from file if specified
+		if bodyFile := v.GetString("body_file"); bodyFile != "" {
+			body, err := readFile(bodyFile)
+			if err != nil {
+				return nil, err
+			}
+			msg.Body = body
+		}
+
+		// Read HTML body from file if specified
+		if htmlFile := v.GetString("html_file"); htmlFile != "" {
+			htmlBody, err := readFile(htmlFile)
+			if err != nil {
+				return nil, err
+			}
+			msg.HTMLBody = htmlBody
+		}
+
+		for _, attachment := range inline {
+			msg.AddInline(attachment)
+		}
+	}
+
+	// Throwaway mailboxes rarely say anything about real deliverability
+	for _, domain := range msg.RecipientDomains() {
+		if message.IsDisposableDomain(domain) {
+			inv.diags.warn(warnDisposableDomain, "recipient domain %s is a disposable mailbox provider", domain)
+		}
+	}
+
+	// Display names only change the headers; the envelope uses the bare addresses
+	msg.FromName = v.GetString("from_name")
+	toNames, _ := inv.flags.GetStringArray("to_name")
+	if len(toNames) > len(msg.To) {
+		return nil, fmt.Errorf("%d --to-name values given for %d To address(es)", len(toNames), len(msg.To))
+	}
+	msg.ToNames = toNames
+
+	// Add custom headers; command line headers override those from files
+	msg.PreserveHeaderCase = v.GetBool("preserve_header_case")
+	if msgFile != nil {
+		for key, value := range msgFile.Headers {
+			msg.AddHeader(key, value)
+		}
+	}
+	if headersFile := v.GetString("headers_file"); headersFile != "" {
+		headers, err := message.ReadHeadersFile(headersFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read headers file: %v", err)
+		}
+		for key, value := range headers {
+			msg.AddHeader(key, value)
+		}
+	}
+	for key, value := range parseHeaders(v.GetString("headers")) {
+		if err := message.ValidateHeader(key, value); err != nil {
+			return nil, fmt.Errorf("invalid header: %v", err)
+		}
+		msg.AddHeader(key, value)
+	}
+	headerArgs, _ := inv.flags.GetStringArray("header")
+	headers, err := parseHeaderArgs(headerArgs)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		if err := message.ValidateHeader(key, value); err != nil {
+			return nil, fmt.Errorf("invalid header: %v", err)
+		}
+		msg.AddHeader(key, value)
+	}
+
+	// Tag the message with a correlation id, generating one if none was given
+	// unless the message should carry only the headers asked for
+	msg.MinimalHeaders = v.GetBool("minimal_headers")
+	msg.SetMessageID(v.GetString("message_id"))
+	msg.KeepLineEndings = v.GetBool("keep_line_endings")
+
+	// End the text body with a lone dot, which only arrives if it is dot-stuffed
+	if v.GetBool("test_dot_termination") {
+		if msg.Body != "" && !strings.HasSuffix(msg.Body, "\n") {
+			msg.Body += "\r\n"
+		}
+		msg.Body += dotTerminationText
+	}
+
+	// Shuffle the optional headers reproducibly, for header order fingerprinting tests
+	if v.GetBool("shuffle_headers") {
+		msg.ShuffleHeaders = true
+		msg.ShuffleSeed = v.GetInt64("shuffle_seed")
+		if !v.IsSet("shuffle_seed") {
+			msg.ShuffleSeed = time.Now().UnixNano()
+			fmt.Fprintf(os.Stderr, "Shuffling headers with --shuffle-seed %d\n", msg.ShuffleSeed)
+		}
+	}
+	traceID := v.GetString("trace_id")
+	if traceID == "" && !msg.MinimalHeaders {
+		traceID = message.GenerateTraceID()
+	}
+	if traceID != "" {
+		if err := message.ValidateHeader(message.TraceIDHeader, traceID); err != nil {
+			return nil, fmt.Errorf("invalid trace id: %v", err)
+		}
+		msg.AddHeader(message.TraceIDHeader, traceID)
+	}
+
+	// Add a trace header describing this hop if requested
+	if v.GetBool("add_received") {
+		msg.Received = message.ReceivedHeader(ehloName, receivedBy(v), receivedWith(v), time.Now())
+	}
+
+	// Format the Date header as asked, as long as receivers can still parse it
+	if layout := v.GetString("date_format"); layout != "" {
+		if err := message.ValidateDateFormat(layout); err != nil {
+			return nil, err
+		}
+		msg.DateFormat = layout
+	}
+
+	// Insert a placeholder text part for attachment-only messages if requested
+	msg.AutoBody = v.GetBool("auto_body")
+
+	// Add attachments
+	if attachments := v.GetString("attachments"); attachments != "" {
+		for _, entry := range parseAddressList(attachments) {
+			attachment, name, _ := strings.Cut(entry, "=")
+			if _, err := message.ReadFileAttachment(attachment); err != nil {
+				if !v.GetBool("skip_missing_attachments") {
+					return nil, fmt.Errorf("failed to read attachment %s: %v", attachment, err)
+				}
+				inv.diags.warn(warnSkippedAttachment, "skipping attachment %s: %v", attachment, err)
+				inv.skipped = append(inv.skipped, attachment)
+				continue
+			}
+			msg.AddAttachmentAs(attachment, name)
+		}
+	}
+
+	// Refuse options that would flatten a text and an HTML body into one
+	if err := msg.CheckAlternatives(); err != nil {
+		return nil, err
+	}
+
+	// Attach whole messages, e.g. to test how a forward is shown
+	attachedMessages, _ := inv.flags.GetStringArray("attach_message")
+	for _, path := range attachedMessages {
+		if err := msg.AddMessageAttachment(path); err != nil {
+			return nil, fmt.Errorf("failed to attach message %s: %v", path, err)
+		}
+	}
+
+	// Send each distinct content once, e.g. when globs or aliases name a file twice
+	if v.GetBool("dedupe_attachments") {
+		before := msg.EstimateSize()
+		inv.deduped = msg.DedupeAttachments()
+		inv.dedupeSaved = before - msg.EstimateSize()
+	}
+
+	// Refuse a message a strict receiver would reject before it is sent
+	if v.GetBool("strict_rfc5322") {
+		built, err := msg.Build()
+		if err != nil {
+			return nil, err
+		}
+		if errs := message.CheckRFC5322([]byte(built)); len(errs) > 0 {
+			return nil, fmt.Errorf("message does not conform to RFC 5322: %v", joinErrors(errs))
+		}
+	}
+
+	return msg, nil
+}
+
+// emlContentFlags are the flags that shape the content of a built message,
+// which --eml sends as it is
+var emlContentFlags = []string{
+	"subject", "subject_template", "body", "body_file", "html", "html_file", "template", "html_template",
+	"template_data", "attachments", "attach_message", "inline", "auto_body", "headers", "header", "headers_file",
+	"preserve_header_case", "from_name", "to_name", "date_format", "keep_line_endings", "test_dot_termination",
+	"shuffle_headers", "minimal_headers", "message_id", "trace_id", "thread_depth",
+}
+
+// relayEML prepares a message read with --eml for sending to the given
+// envelope, its content unchanged apart from an optional Received header
+func relayEML(inv *invocation, msg *message.Message, from string, to, cc, bcc []string) (*message.Message, error) {
+	v := inv.settings
+	for _, flag := range emlContentFlags {
+		if inv.flags.Changed(flag) {
+			return nil, fmt.Errorf("--eml sends the message as it is and cannot be combined with --%s", strings.ReplaceAll(flag, "_", "-"))
+		}
+	}
+	msg.From, msg.To, msg.Cc, msg.Bcc = from, to, cc, bcc
+
+	// Add this hop above the trace chain the message already carries
+	if v.GetBool("add_received") {
+		msg.Received = message.ReceivedHeader(ehloName, receivedBy(v), receivedWith(v), time.Now())
+	}
+
+	if v.GetBool("strict_rfc5322") {
+		built, err := msg.Build()
+		if err != nil {
+			return nil, err
+		}
+		if errs := message.CheckRFC5322([]byte(built)); len(errs) > 0 {
+			return nil, fmt.Errorf("message does not conform to RFC 5322: %v", joinErrors(errs))
+		}
+	}
+	return msg, nil
+}
+
+// receivedBy returns the server name for the synthetic Received header
+func receivedBy(v *viper.Viper) string {
+	if server := v.GetString("server"); server != "" {
+		return server
+	}
+	return "unknown"
+}
+
+// receivedWith returns the RFC 3848 protocol name for the configured session
+func receivedWith(v *viper.Viper) string {
+	with := "ESMTP"
+	if v.GetBool("starttls") || v.GetBool("smtps") {
+		with += "S"
+	}
+	if v.GetString("auth_type") != "" || v.GetString("oauth_token") != "" {
+		with += "A"
+	}
+	return with
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asachs/smtp-edc/internal/client"
+	"github.com/asachs/smtp-edc/internal/message"
+)
+
+// sendSummary describes what was (or, in a dry run, would be) sent
+type sendSummary struct {
+	Status      string `json:"status"`
+	TraceID     string `json:"trace_id,omitempty"`
+	Size        int    `json:"size"`
+	Parts       int    `json:"parts"`
+	Attachments int    `json:"attachments"`
+	// Skipped lists attachments that could not be read and were left out
+	Skipped []string `json:"skipped_attachments,omitempty"`
+	// Deduplicated lists attachments left out as copies of another, and
+	// DedupeSaved the bytes that saved
+	Deduplicated []dedupedAttachment `json:"deduplicated_attachments,omitempty"`
+	DedupeSaved  int                 `json:"dedupe_saved_bytes,omitempty"`
+	Recipients   int                 `json:"recipients"`
+	// Accepted and Rejected count the recipients the server took and refused
+	Accepted   int    `json:"recipients_accepted"`
+	Rejected   int    `json:"recipients_rejected"`
+	Server     string `json:"server,omitempty"`
+	Port       int    `json:"port,omitempty"`
+	TLS        bool   `json:"tls"`
+	TLSMode    string `json:"tls_mode"`
+	TLSVersion string `json:"tls_version,omitempty"`
+	Cipher     string `json:"cipher,omitempty"`
+	Pipelining bool   `json:"pipelining"`
+	Auth       string `json:"auth,omitempty"`
+	Greylisted bool   `json:"greylisted,omitempty"`
+	// Response is the server's final reply to the message and QueueID the queue id in it
+	Response string `json:"response,omitempty"`
+	QueueID  string `json:"queue_id,omitempty"`
+	// Duration is how long the send took in seconds, connecting included
+	Duration float64 `json:"duration_seconds,omitempty"`
+	// Warnings are the warnings of the run, with their codes
+	Warnings []diagnostic `json:"warnings,omitempty"`
+	// DeliveryPlan is filled in by dry runs with MX validation enabled
+	DeliveryPlan []routePlan `json:"delivery_plan,omitempty"`
+}
+
+// routePlan is the delivery route for one recipient domain
+type routePlan struct {
+	Domain     string     `json:"domain"`
+	Recipients []string   `json:"recipients"`
+	MX         []mxRecord `json:"mx,omitempty"`
+	Host       string     `json:"host,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// dedupedAttachment is an attachment left out because an earlier one has the same content
+type dedupedAttachment struct {
+	Filename string `json:"filename"`
+	Of       string `json:"duplicate_of"`
+}
+
+// mxRecord is one MX host and its preference
+type mxRecord struct {
+	Host       string `json:"host"`
+	Preference uint16 `json:"preference"`
+}
+
+// newRoutePlans converts resolved delivery routes for output
+func newRoutePlans(routes []message.DomainRoute) []routePlan {
+	plans := make([]routePlan, 0, len(routes))
+	for _, route := range routes {
+		plan := routePlan{Domain: route.Domain, Recipients: route.Recipients, Host: route.Host}
+		for _, mx := range route.MX {
+			plan.MX = append(plan.MX, mxRecord{Host: strings.TrimSuffix(mx.Host, "."), Preference: mx.Pref})
+		}
+		if route.Err != nil {
+			plan.Error = route.Err.Error()
+		}
+		plans = append(plans, plan)
+	}
+	return plans
+}
+
+// newSummary describes msg and the session it was sent over
+func newSummary(status string, msg *message.Message, session client.SessionInfo) (*sendSummary, error) {
+	built, err := msg.Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build message: %v", err)
+	}
+	summary := &sendSummary{
+		Status:      status,
+		TraceID:     msg.Headers[message.TraceIDHeader],
+		Size:        len(built),
+		Parts:       msg.PartCount(),
+		Attachments: len(msg.Attachments),
+		Recipients:  len(msg.Recipients()),
+		Accepted:    session.RecipientsAccepted,
+		Rejected:    session.RecipientsRejected,
+		Server:      session.Server,
+		Port:        session.Port,
+		TLS:         session.TLS,
+		TLSMode:     tlsMode(session),
+		TLSVersion:  session.TLSVersion,
+		Cipher:      session.CipherSuite,
+		Pipelining:  session.Pipelining,
+		Auth:        session.AuthMechanism,
+		Greylisted:  session.Greylisted,
+	}
+	if status != "dry-run" && !session.TLS {
+		summary.TLSVersion = "plaintext"
+	}
+	if resp := session.FinalResponse; resp != nil {
+		summary.Response = resp.String()
+		summary.QueueID = resp.QueueID()
+	}
+	return summary, nil
+}
+
+// reportAttachments adds the attachments the invocation left out
+func (s *sendSummary) reportAttachments(inv *invocation) {
+	s.Skipped = inv.skipped
+	for _, duplicate := range inv.deduped {
+		s.Deduplicated = append(s.Deduplicated, dedupedAttachment{Filename: duplicate.Filename, Of: duplicate.Of})
+	}
+	s.DedupeSaved = inv.dedupeSaved
+}
+
+// write prints the summary as text or JSON
+func (s *sendSummary) write(w io.Writer, format string) error {
+	if format == "json" {
+		return json.NewEncoder(w).Encode(s)
+	}
+
+	if s.Status == "dry-run" {
+		fmt.Fprintln(w, "Dry run: message not sent")
+	} else {
+		fmt.Fprintln(w, "Message sent successfully")
+	}
+	fmt.Fprintf(w, "  Size: %d bytes, %d part(s), %d attachment(s)\n", s.Size, s.Parts, s.Attachments)
+	if len(s.Skipped) > 0 {
+		fmt.Fprintf(w, "  Skipped attachments: %s\n", strings.Join(s.Skipped, ", "))
+	}
+	if len(s.Deduplicated) > 0 {
+		duplicates := make([]string, len(s.Deduplicated))
+		for i, duplicate := range s.Deduplicated {
+			duplicates[i] = fmt.Sprintf("%s (same as %s)", duplicate.Filename, duplicate.Of)
+		}
+		fmt.Fprintf(w, "  Deduplicated attachments: %s, saving %d bytes\n", strings.Join(duplicates, ", "), s.DedupeSaved)
+	}
+	if s.Status == "dry-run" {
+		fmt.Fprintf(w, "  Recipients: %d\n", s.Recipients)
+	} else {
+		fmt.Fprintf(w, "  Recipients: %d (%d accepted, %d rejected)\n", s.Recipients, s.Accepted, s.Rejected)
+	}
+	if s.TraceID != "" {
+		fmt.Fprintf(w, "  Trace ID: %s\n", s.TraceID)
+	}
+	if s.Status == "dry-run" {
+		s.writePlan(w)
+		return nil
+	}
+	fmt.Fprintf(w, "  Server: %s in %s\n", net.JoinHostPort(s.Server, strconv.Itoa(s.Port)), time.Duration(s.Duration*float64(time.Second)).Round(time.Millisecond))
+	auth := s.Auth
+	if auth == "" {
+		auth = "none"
+	}
+	security := s.TLSMode
+	if s.TLS && s.TLSVersion != "" {
+		security = fmt.Sprintf("%s (%s, %s)", s.TLSMode, s.TLSVersion, s.Cipher)
+	}
+	_, err := fmt.Fprintf(w, "  TLS: %s, pipelining: %s, auth: %s\n", security, yesNo(s.Pipelining), auth)
+	if s.Greylisted {
+		_, err = fmt.Fprintln(w, "  Greylisted: deferred once, accepted on retry")
+	}
+	if s.Response != "" {
+		_, err = fmt.Fprintf(w, "  Response: %s\n", s.Response)
+	}
+	if s.QueueID != "" {
+		_, err = fmt.Fprintf(w, "  Queue ID: %s\n", s.QueueID)
+	}
+	return err
+}
+
+// tlsMode says how the session is secured: "implicit TLS", "STARTTLS" or "none"
+func tlsMode(session client.SessionInfo) string {
+	switch {
+	case session.ImplicitTLS:
+		return "implicit TLS"
+	case session.TLS:
+		return "STARTTLS"
+	default:
+		return "none"
+	}
+}
+
+// yesNo formats a boolean for the text summary
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// writePlan prints the delivery plan, if any, as text
+func (s *sendSummary) writePlan(w io.Writer) {
+	if len(s.DeliveryPlan) == 0 {
+		return
+	}
+	fmt.Fprintln(w, "Delivery plan:")
+	for _, plan := range s.DeliveryPlan {
+		fmt.Fprintf(w, "  %s (%d recipient(s))\n", plan.Domain, len(plan.Recipients))
+		if plan.Error != "" {
+			fmt.Fprintf(w, "    error: %s\n", plan.Error)
+			continue
+		}
+		if len(plan.MX) == 0 {
+			fmt.Fprintf(w, "    no MX records; direct send would use %s\n", plan.Host)
+			continue
+		}
+		for _, mx := range plan.MX {
+			marker := ""
+			if mx.Host == plan.Host {
+				marker = "  <- direct send"
+			}
+			fmt.Fprintf(w, "    %5d %s%s\n", mx.Preference, mx.Host, marker)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/asachs/smtp-edc/internal/message"
+)
+
+// runValidate checks the addresses and message options without connecting to a server
+func runValidate(inv *invocation) error {
+	msg, err := buildMessage(inv)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, err := range msg.ValidateAll() {
+		// Sending a header-only message is allowed
+		if !errors.Is(err, message.ErrBodyRequired) {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid message: %v", joinErrors(errs))
+	}
+	if _, err := msg.Build(); err != nil {
+		return fmt.Errorf("invalid message: %v", err)
+	}
+
+	var recipients []string
+	recipients = append(recipients, msg.To...)
+	recipients = append(recipients, msg.Cc...)
+	recipients = append(recipients, msg.Bcc...)
+	fmt.Fprintf(inv.out, "Message is valid (from %s, %d recipient(s): %s)\n",
+		msg.From, len(recipients), strings.Join(recipients, ", "))
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/spf13/pflag"
+)
+
+// Build metadata, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=..."
+var (
+	version = "dev"
+	commit  = "none"
+	date    = "unknown"
+)
+
+// versionInfo describes the running build
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"go_version"`
+}
+
+func init() {
+	commands = append(commands, &command{
+		name:    "version",
+		summary: "Print version and build information",
+		flags:   func(fs *pflag.FlagSet) {},
+		run: func(inv *invocation) error {
+			return writeVersion(inv.out, inv.settings.GetString("output"))
+		},
+	})
+}
+
+// buildVersion returns the build metadata, falling back to the module
+// information embedded by `go install` when no ldflags were given
+func buildVersion() versionInfo {
+	info := versionInfo{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "dev" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "none":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.Date == "unknown":
+				info.Date = s.Value
+			}
+		}
+	}
+	return info
+}
+
+// writeVersion prints the build metadata as text or JSON
+func writeVersion(w io.Writer, format string) error {
+	info := buildVersion()
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	}
+	_, err := fmt.Fprintf(w, "smtp-edc %s\n  commit: %s\n  built: %s\n  go: %s\n",
+		info.Version, info.Commit, info.Date, info.GoVersion)
+	return err
+}
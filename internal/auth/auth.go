@@ -27,6 +27,9 @@ func Base64Decode(s string) (string, error) {
 	return string(decoded), nil
 }
 
+// Types lists the authentication types accepted by NewAuthenticator
+var Types = []string{"plain", "login", "cram-md5", "xoauth2"}
+
 // NewAuthenticator creates a new authenticator based on the type
 func NewAuthenticator(authType string) (Authenticator, error) {
 	switch authType {
@@ -36,6 +39,8 @@ func NewAuthenticator(authType string) (Authenticator, error) {
 		return &LoginAuthenticator{}, nil
 	case "cram-md5":
 		return &CRAMMD5Authenticator{}, nil
+	case "xoauth2":
+		return &XOAuth2Authenticator{}, nil
 	default:
 		return nil, fmt.Errorf("unsupported authentication type: %s", authType)
 	}
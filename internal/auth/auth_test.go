@@ -14,6 +14,7 @@ func TestNewAuthenticator(t *testing.T) {
 		{"plain", true},
 		{"login", true},
 		{"cram-md5", true},
+		{"xoauth2", true},
 		{"invalid", false},
 	}
 
@@ -42,3 +43,18 @@ func TestNewAuthenticator(t *testing.T) {
 		})
 	}
 }
+
+func TestXOAuth2Authenticator(t *testing.T) {
+	auth := &XOAuth2Authenticator{}
+	response, err := auth.Authenticate("user@example.com", "ya29.token")
+	if err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	decoded, err := Base64Decode(response)
+	if err != nil {
+		t.Fatalf("response is not base64: %v", err)
+	}
+	if want := "user=user@example.com\x01auth=Bearer ya29.token\x01\x01"; decoded != want {
+		t.Errorf("decoded response = %q, want %q", decoded, want)
+	}
+}
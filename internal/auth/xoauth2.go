@@ -0,0 +1,21 @@
+package auth
+
+import (
+	"fmt"
+)
+
+// XOAuth2Authenticator implements the XOAUTH2 mechanism used by Gmail and
+// Office 365, which authenticates with an OAuth2 bearer token instead of a password
+type XOAuth2Authenticator struct{}
+
+// Type returns the authentication type
+func (a *XOAuth2Authenticator) Type() string {
+	return "XOAUTH2"
+}
+
+// Authenticate returns the initial client response for the user's access token
+func (a *XOAuth2Authenticator) Authenticate(username, token string) (string, error) {
+	// XOAUTH2 format: user=<email>^Aauth=Bearer <token>^A^A
+	authString := fmt.Sprintf("user=%s\x01auth=Bearer %s\x01\x01", username, token)
+	return Base64Encode(authString), nil
+}
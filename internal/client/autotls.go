@@ -0,0 +1,45 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// SetImplicitTLS makes connections start TLS as soon as they are opened, as on
+// port 465, rather than in plaintext
+func (c *SMTPClient) SetImplicitTLS(enabled bool) {
+	c.implicitTLS = enabled
+}
+
+// ConnectTLS connects with implicit TLS (SMTPS), as on port 465: the TLS
+// handshake comes before the server greeting. The timeout and retries apply
+// as with Connect, and a reconnect uses implicit TLS again.
+func (c *SMTPClient) ConnectTLS(server string, port int) error {
+	c.implicitTLS = true
+	return c.Connect(server, port)
+}
+
+// ConnectAuto connects with implicit TLS, falling back to plaintext when the
+// server answers the TLS handshake in plaintext, as on ports 25 and 587. Other
+// handshake failures, such as an untrusted certificate, are returned rather
+// than downgrading the connection. Session reports which way was taken; after
+// a plaintext connection the caller can send EHLO and use STARTTLS if offered.
+func (c *SMTPClient) ConnectAuto(server string, port int) error {
+	c.implicitTLS = true
+	return c.withRetry("connect", func() error {
+		err := c.connect(server, port)
+		if c.implicitTLS && speaksPlaintext(err) {
+			c.debugf("Server %s does not speak TLS on connect; reconnecting in plaintext\n", server)
+			c.implicitTLS = false
+			err = c.connect(server, port)
+		}
+		return err
+	})
+}
+
+// speaksPlaintext reports whether err is a TLS handshake that failed because
+// the server sent something other than a TLS record, such as a 220 greeting
+func speaksPlaintext(err error) bool {
+	var recordErr tls.RecordHeaderError
+	return errors.As(err, &recordErr)
+}
@@ -0,0 +1,118 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// CapabilityRequirement is one line of an expected-capabilities file:
+// "KEYWORD" requires the extension, "KEYWORD PARAM..." also requires each
+// parameter (e.g. "AUTH LOGIN"), and "KEYWORD>=N" requires a numeric first
+// parameter of at least N (e.g. "SIZE>=10485760")
+type CapabilityRequirement struct {
+	Keyword string
+	Params  []string
+	// Min is the smallest acceptable value when HasMin is set
+	Min    int64
+	HasMin bool
+}
+
+// String returns the requirement as written in the expectations file
+func (r CapabilityRequirement) String() string {
+	if r.HasMin {
+		return fmt.Sprintf("%s>=%d", r.Keyword, r.Min)
+	}
+	return strings.Join(append([]string{r.Keyword}, r.Params...), " ")
+}
+
+// ParseCapabilityRequirements reads requirements one per line; blank lines and
+// # comments are ignored
+func ParseCapabilityRequirements(r io.Reader) ([]CapabilityRequirement, error) {
+	var reqs []CapabilityRequirement
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if keyword, value, ok := strings.Cut(line, ">="); ok {
+			min, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid minimum in %q", n, line)
+			}
+			reqs = append(reqs, CapabilityRequirement{Keyword: strings.ToUpper(strings.TrimSpace(keyword)), Min: min, HasMin: true})
+			continue
+		}
+
+		fields := strings.Fields(strings.ToUpper(line))
+		reqs = append(reqs, CapabilityRequirement{Keyword: fields[0], Params: fields[1:]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return reqs, nil
+}
+
+// extension returns the parameters of an advertised EHLO keyword
+func (caps ServerCapabilities) extension(keyword string) ([]string, bool) {
+	for _, ext := range caps.Extensions {
+		if fields := strings.Fields(ext); len(fields) > 0 && strings.EqualFold(fields[0], keyword) {
+			return fields[1:], true
+		}
+	}
+	return nil, false
+}
+
+// Check compares the advertised capabilities against reqs and describes each
+// requirement that is not met. STARTTLS is treated as met once the session is
+// already encrypted, since servers stop advertising it after the upgrade.
+func (caps ServerCapabilities) Check(reqs []CapabilityRequirement, tlsActive bool) []string {
+	var problems []string
+	for _, req := range reqs {
+		if req.Keyword == "STARTTLS" && tlsActive {
+			continue
+		}
+		params, ok := caps.extension(req.Keyword)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: not advertised", req))
+			continue
+		}
+		advertised := strings.TrimSpace(req.Keyword + " " + strings.Join(params, " "))
+
+		if req.HasMin {
+			// A missing or zero value (as with SIZE 0) means there is no limit
+			value := int64(0)
+			if len(params) > 0 {
+				v, err := strconv.ParseInt(params[0], 10, 64)
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("%s: server advertises %s", req, advertised))
+					continue
+				}
+				value = v
+			}
+			if value != 0 && value < req.Min {
+				problems = append(problems, fmt.Sprintf("%s: server advertises %s", req, advertised))
+			}
+			continue
+		}
+
+		for _, want := range req.Params {
+			found := false
+			for _, param := range params {
+				if strings.EqualFold(param, want) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				problems = append(problems, fmt.Sprintf("%s: server advertises %s", req, advertised))
+				break
+			}
+		}
+	}
+	return problems
+}
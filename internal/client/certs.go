@@ -0,0 +1,58 @@
+package client
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// LoadRootCAs builds a root CA pool from a PEM bundle file and/or a directory
+// of PEM files, like OpenSSL's CAfile and CApath. Files in the directory that
+// hold no PEM certificates are skipped and reported in the returned warnings.
+func LoadRootCAs(caFile, caDir string) (*x509.CertPool, []string, error) {
+	pool := x509.NewCertPool()
+	var warnings []string
+
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read CA file: %v", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, nil, fmt.Errorf("no PEM certificates found in CA file %s", caFile)
+		}
+	}
+
+	if caDir != "" {
+		entries, err := os.ReadDir(caDir)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read CA directory: %v", err)
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+		loaded := 0
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			path := filepath.Join(caDir, entry.Name())
+			data, err := os.ReadFile(path)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("skipping %s: %v", path, err))
+				continue
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				warnings = append(warnings, fmt.Sprintf("skipping %s: no PEM certificates", path))
+				continue
+			}
+			loaded++
+		}
+		if loaded == 0 {
+			return nil, warnings, fmt.Errorf("no PEM certificates found in CA directory %s", caDir)
+		}
+	}
+
+	return pool, warnings, nil
+}
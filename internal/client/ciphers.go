@@ -0,0 +1,221 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CipherScan is the outcome of ScanCiphers
+type CipherScan struct {
+	// Accepted and Rejected hold the candidate suites in the order given
+	Accepted []uint16
+	Rejected []uint16
+	// PreferenceTested reports whether at least two suites were accepted, so
+	// that the server could be offered a choice
+	PreferenceTested bool
+	// ServerPreference reports that the server chose a suite the client ranked
+	// lower, so it applies its own order rather than the client's. A server
+	// whose order happens to match the client's cannot be told apart.
+	ServerPreference bool
+}
+
+// ParseCipherSuites returns the IDs of the named cipher suites, such as
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, including the insecure ones that are
+// still implemented. Only TLS 1.0 to 1.2 suites can be chosen; the TLS 1.3
+// suites are always offered.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]*tls.CipherSuite)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite
+	}
+	var ids []uint16
+	for _, name := range names {
+		suite, ok := suites[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if !supportsTLS12(suite) {
+			return nil, fmt.Errorf("cipher suite %s is TLS 1.3 only and cannot be chosen", suite.Name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// TLS12CipherSuites returns every cipher suite the client can offer with TLS
+// 1.2, the secure ones first
+func TLS12CipherSuites() []uint16 {
+	var ids []uint16
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if supportsTLS12(suite) {
+			ids = append(ids, suite.ID)
+		}
+	}
+	return ids
+}
+
+// supportsTLS12 reports whether suite can be used with TLS 1.2
+func supportsTLS12(suite *tls.CipherSuite) bool {
+	for _, version := range suite.SupportedVersions {
+		if version == tls.VersionTLS12 {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCipherSuites restricts TLS handshakes to the given cipher suites. As the
+// TLS 1.3 suites cannot be restricted, this also limits TLS to version 1.2.
+// No suites lifts the restriction.
+func (c *SMTPClient) SetCipherSuites(ids []uint16) {
+	c.cipherSuites = ids
+}
+
+// ScanCiphers finds which of the candidate TLS 1.2 cipher suites the server
+// accepts, with a new connection offering each suite on its own, using
+// implicit TLS or STARTTLS as the client does. It then offers accepted suites
+// in pairs to see whether the server follows the client's order. Only the
+// negotiation is of interest, so certificates are not verified.
+func (c *SMTPClient) ScanCiphers(candidates []uint16) (CipherScan, error) {
+	var scan CipherScan
+	for _, id := range candidates {
+		_, accepted, err := c.tryCiphers([]uint16{id})
+		if err != nil {
+			return scan, err
+		}
+		if accepted {
+			scan.Accepted = append(scan.Accepted, id)
+		} else {
+			scan.Rejected = append(scan.Rejected, id)
+		}
+	}
+	if len(scan.Accepted) < 2 {
+		return scan, nil
+	}
+
+	// When the orders differ, some pair of neighbours in the client's order
+	// is ranked the other way round by the server
+	scan.PreferenceTested = true
+	order := clientOrder(scan.Accepted)
+	for i := 0; i+1 < len(order); i++ {
+		chosen, accepted, err := c.tryCiphers(order[i : i+2])
+		if err != nil {
+			return scan, err
+		}
+		if accepted && chosen == order[i+1] {
+			scan.ServerPreference = true
+			break
+		}
+	}
+	return scan, nil
+}
+
+// tryCiphers opens a new connection to the server and performs a TLS
+// handshake offering only suites. It returns the suite the server chose, or
+// false if the handshake failed. An error means the connection could not get
+// as far as the handshake.
+func (c *SMTPClient) tryCiphers(suites []uint16) (uint16, bool, error) {
+	addr := net.JoinHostPort(c.server, strconv.Itoa(c.port))
+	conn, err := net.DialTimeout("tcp", addr, c.timeout)
+	if err != nil {
+		return 0, false, &Error{Kind: ErrConnect, Subject: addr, Err: err}
+	}
+	defer conn.Close()
+
+	probe := NewSMTPClient(c.hostname, false)
+	probe.server, probe.port = c.server, c.port
+	probe.tlsServer = c.tlsServer
+	probe.clientCert = c.clientCert
+	probe.skipVerify = true
+	probe.cipherSuites = suites
+	if !c.implicitTLS {
+		probe.conn = conn
+		probe.ioTimeout = c.ioTimeout
+		probe.retry.MaxAttempts = 1
+		if err := probe.connect(c.server, c.port); err != nil {
+			return 0, false, err
+		}
+		if err := probe.Ehlo(); err != nil {
+			return 0, false, err
+		}
+		if !probe.capabilities.StartTLS {
+			return 0, false, fmt.Errorf("server does not advertise STARTTLS")
+		}
+		if err := probe.requestTLS(); err != nil {
+			return 0, false, err
+		}
+	}
+
+	tlsConn := tls.Client(conn, probe.tlsConfig())
+	tlsConn.SetDeadline(time.Now().Add(c.timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		c.debugf("Handshake offering %s failed: %v\n", cipherSuiteNames(suites), err)
+		return 0, false, nil
+	}
+	chosen := tlsConn.ConnectionState().CipherSuite
+	c.debugf("Handshake offering %s chose %s\n", cipherSuiteNames(suites), tls.CipherSuiteName(chosen))
+	return chosen, true, nil
+}
+
+// clientOrder returns suites in the order the client offers them in its
+// ClientHello. crypto/tls ignores the configured order and applies its own,
+// so the hello is sent to an in-memory server that records it.
+func clientOrder(suites []uint16) []uint16 {
+	clientConn, serverConn := net.Pipe()
+	hello := make(chan []uint16, 1)
+	go func() {
+		defer serverConn.Close()
+		tls.Server(serverConn, &tls.Config{
+			GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+				hello <- info.CipherSuites
+				return nil, errors.New("client hello recorded")
+			},
+		}).Handshake()
+	}()
+	tls.Client(clientConn, &tls.Config{
+		CipherSuites:       suites,
+		MinVersion:         tls.VersionTLS12,
+		MaxVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+	}).Handshake()
+	clientConn.Close()
+
+	var recorded []uint16
+	select {
+	case recorded = <-hello:
+	default:
+	}
+	offered := make(map[uint16]bool)
+	for _, id := range suites {
+		offered[id] = true
+	}
+	var order []uint16
+	for _, id := range recorded {
+		if offered[id] {
+			order = append(order, id)
+		}
+	}
+	if len(order) != len(suites) {
+		return suites
+	}
+	return order
+}
+
+// cipherSuiteNames lists the names of the given suites
+func cipherSuiteNames(ids []uint16) string {
+	return strings.Join(CipherSuiteNames(ids), ", ")
+}
+
+// CipherSuiteNames returns the names of the given suites
+func CipherSuiteNames(ids []uint16) []string {
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = tls.CipherSuiteName(id)
+	}
+	return names
+}
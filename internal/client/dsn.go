@@ -0,0 +1,79 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DSNOptions requests delivery status notifications (RFC 3461). The
+// parameters are only sent to servers that advertise DSN.
+type DSNOptions struct {
+	// Notify is sent as NOTIFY= on each RCPT TO: NEVER, or any of SUCCESS,
+	// FAILURE and DELAY
+	Notify []string
+	// Return is sent as RET= on MAIL FROM: FULL or HDRS, the part of the
+	// message returned with a notification
+	Return string
+	// EnvID is sent as ENVID= on MAIL FROM and is returned in notifications
+	EnvID string
+}
+
+// enabled reports whether any notification parameter is set
+func (o DSNOptions) enabled() bool {
+	return len(o.Notify) > 0 || o.Return != "" || o.EnvID != ""
+}
+
+// Validate checks the options against the values RFC 3461 allows
+func (o DSNOptions) Validate() error {
+	for _, n := range o.Notify {
+		switch strings.ToUpper(n) {
+		case "SUCCESS", "FAILURE", "DELAY":
+		case "NEVER":
+			if len(o.Notify) > 1 {
+				return fmt.Errorf("DSN notify NEVER cannot be combined with other conditions")
+			}
+		default:
+			return fmt.Errorf("invalid DSN notify condition %q: must be NEVER, SUCCESS, FAILURE or DELAY", n)
+		}
+	}
+	if ret := strings.ToUpper(o.Return); ret != "" && ret != "FULL" && ret != "HDRS" {
+		return fmt.Errorf("invalid DSN return %q: must be FULL or HDRS", o.Return)
+	}
+	if len(o.EnvID) > 100 {
+		return fmt.Errorf("DSN envelope id is %d characters long, over the limit of 100", len(o.EnvID))
+	}
+	return nil
+}
+
+// SetDSN requests delivery status notifications for the messages sent
+func (c *SMTPClient) SetDSN(opts DSNOptions) {
+	c.dsn = opts
+}
+
+// dsnMailParameters returns the RET= and ENVID= parameters for MAIL FROM
+func (c *SMTPClient) dsnMailParameters() []string {
+	if !c.capabilities.DSN {
+		return nil
+	}
+	var params []string
+	if c.dsn.Return != "" {
+		params = append(params, "RET="+strings.ToUpper(c.dsn.Return))
+	}
+	if c.dsn.EnvID != "" {
+		params = append(params, "ENVID="+xtext(c.dsn.EnvID))
+	}
+	return params
+}
+
+// dsnRcptParameters returns the NOTIFY= and ORCPT= parameters for the RCPT TO
+// of recipient when notifications are requested and the server advertises DSN
+func (c *SMTPClient) dsnRcptParameters(recipient string) []string {
+	if !c.capabilities.DSN || !c.dsn.enabled() {
+		return nil
+	}
+	var params []string
+	if len(c.dsn.Notify) > 0 {
+		params = append(params, "NOTIFY="+strings.ToUpper(strings.Join(c.dsn.Notify, ",")))
+	}
+	return append(params, "ORCPT=rfc822;"+xtext(recipient))
+}
@@ -0,0 +1,95 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/asachs/smtp-edc/internal/message"
+)
+
+// Envelope is the SMTP envelope of a message: the reverse path and parameters
+// given with MAIL FROM and the forward paths given with RCPT TO
+type Envelope struct {
+	// Command is MAIL, or the legacy command sent in its place
+	Command    string
+	From       string
+	Parameters []string
+	Recipients []string
+	// RecipientParameters holds the RCPT TO parameters of each recipient that has any
+	RecipientParameters map[string][]string
+}
+
+// Envelope returns the envelope the client sends for msg. Parameters that
+// depend on the server, such as SIZE= and AUTH=, are only included once the
+// capabilities of the session are known.
+func (c *SMTPClient) Envelope(msg *message.Message) Envelope {
+	envelope := Envelope{
+		Command:    "MAIL",
+		From:       msg.From,
+		Recipients: msg.Recipients(),
+	}
+	if c.legacyCommand != "" {
+		envelope.Command = c.legacyCommand
+	} else {
+		// Declare the size SendMessage would, falling back to an estimate
+		// for a message that cannot be built
+		size := int64(msg.EstimateSize())
+		if data, err := messageContent(msg); err == nil {
+			size = int64(len(data))
+		}
+		envelope.Parameters = c.mailParameters(size, msg.EightBit())
+	}
+	for _, recipient := range envelope.Recipients {
+		if params := c.rcptParameters(recipient); len(params) > 0 {
+			if envelope.RecipientParameters == nil {
+				envelope.RecipientParameters = make(map[string][]string)
+			}
+			envelope.RecipientParameters[recipient] = params
+		}
+	}
+	return envelope
+}
+
+// Commands returns the MAIL FROM and RCPT TO commands in the order they are sent
+func (e Envelope) Commands() []string {
+	commands := []string{mailCommand(e.Command, e.From, e.Parameters)}
+	for _, recipient := range e.Recipients {
+		commands = append(commands, rcptCommand(recipient, e.RecipientParameters[recipient]))
+	}
+	return commands
+}
+
+// mailParameters returns the ESMTP parameters added to MAIL FROM for a
+// message of size bytes, each only when the server advertises the extension
+// it belongs to. A declared size replaces the real one, and a message with
+// 8bit parts is declared with BODY=8BITMIME.
+func (c *SMTPClient) mailParameters(size int64, eightBit bool) []string {
+	var params []string
+	if c.declaredSize > 0 {
+		size = c.declaredSize
+	}
+	if size > 0 && c.capabilities.Has("SIZE") {
+		params = append(params, fmt.Sprintf("SIZE=%d", size))
+	}
+	if eightBit && c.capabilities.EightBit {
+		params = append(params, "BODY=8BITMIME")
+	}
+	if c.mailAuth != "" && c.capabilities.Has("AUTH") {
+		identity := "<>"
+		if c.mailAuth != "<>" {
+			identity = xtext(c.mailAuth)
+		}
+		params = append(params, "AUTH="+identity)
+	}
+	return append(params, c.dsnMailParameters()...)
+}
+
+// mailCommand formats a MAIL FROM command, or a legacy command in its place
+func mailCommand(command, from string, params []string) string {
+	return strings.Join(append([]string{fmt.Sprintf("%s FROM:<%s>", command, from)}, params...), " ")
+}
+
+// rcptCommand formats a RCPT TO command
+func rcptCommand(to string, params []string) string {
+	return strings.Join(append([]string{fmt.Sprintf("RCPT TO:<%s>", to)}, params...), " ")
+}
@@ -0,0 +1,125 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrorKind identifies a common failure with a message in ErrorCatalog
+type ErrorKind int
+
+const (
+	// ErrConnect is a failure to connect or to read the server greeting
+	ErrConnect ErrorKind = iota
+	// ErrAuth is a failed AUTH exchange
+	ErrAuth
+	// ErrSender is a rejected MAIL FROM
+	ErrSender
+	// ErrRecipient is a rejected RCPT TO
+	ErrRecipient
+	// ErrData is a rejected DATA command
+	ErrData
+	// ErrMessage is a message rejected after its content was sent
+	ErrMessage
+)
+
+// ErrorCatalog holds the message for each kind of failure, with any %s
+// standing for the server, mechanism or address involved. Entries can be replaced to
+// reword or translate the messages.
+var ErrorCatalog = map[ErrorKind]string{
+	ErrConnect:   "cannot connect to %s",
+	ErrAuth:      "authentication with %s failed",
+	ErrSender:    "sender %s rejected",
+	ErrRecipient: "recipient %s rejected",
+	ErrData:      "DATA command rejected",
+	ErrMessage:   "message rejected",
+}
+
+// Error is a common failure with its message from ErrorCatalog. When the
+// server replied, the message ends with the reply exactly as it was sent,
+// including the code and any enhanced status code.
+type Error struct {
+	Kind ErrorKind
+	// Subject is the server, mechanism or address the failure concerns
+	Subject string
+	Err     error
+}
+
+// Error returns the catalog message followed by the server's reply or the cause
+func (e *Error) Error() string {
+	format, ok := ErrorCatalog[e.Kind]
+	if !ok {
+		format = "%s failed"
+	}
+	msg := format
+	if strings.Contains(format, "%s") {
+		msg = fmt.Sprintf(format, e.Subject)
+	}
+
+	var smtpErr *SMTPError
+	if errors.As(e.Err, &smtpErr) {
+		return fmt.Sprintf("%s: server replied %s", msg, smtpErr)
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+// Unwrap returns the underlying error, such as an *SMTPError
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// RecipientsError reports that the server rejected every recipient of a
+// message, with an *Error for each rejection
+type RecipientsError struct {
+	Rejections []error
+}
+
+// Error lists the reason for each rejection
+func (e *RecipientsError) Error() string {
+	reasons := make([]string, len(e.Rejections))
+	for i, err := range e.Rejections {
+		reasons[i] = err.Error()
+	}
+	return "no recipients accepted: " + strings.Join(reasons, "; ")
+}
+
+// Unwrap returns the rejections, so errors.As finds the first *Error
+func (e *RecipientsError) Unwrap() []error {
+	return e.Rejections
+}
+
+// Code returns the server's reply code, or 0 if the server did not reply
+func (e *Error) Code() int {
+	var smtpErr *SMTPError
+	if errors.As(e.Err, &smtpErr) {
+		return smtpErr.Code
+	}
+	return 0
+}
+
+// EnhancedCode returns the RFC 3463 enhanced status code of the server's
+// reply, such as "5.1.1", or "" if there is none
+func (e *Error) EnhancedCode() string {
+	var smtpErr *SMTPError
+	if errors.As(e.Err, &smtpErr) {
+		return smtpErr.EnhancedCode()
+	}
+	return ""
+}
+
+// enhancedCodePattern matches an RFC 3463 enhanced status code
+var enhancedCodePattern = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}$`)
+
+// EnhancedCode returns the RFC 3463 enhanced status code that starts the
+// reply text, such as "5.1.1", or "" if there is none
+func (e *SMTPError) EnhancedCode() string {
+	if len(e.Lines) == 0 {
+		return ""
+	}
+	if fields := strings.Fields(e.Lines[0]); len(fields) > 0 && enhancedCodePattern.MatchString(fields[0]) {
+		return fields[0]
+	}
+	return ""
+}
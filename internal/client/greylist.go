@@ -0,0 +1,53 @@
+package client
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// greylistPattern matches the wording greylisting servers use in deferrals
+var greylistPattern = regexp.MustCompile(`(?i)gr[ae]y-?list`)
+
+// greylistDelayPattern extracts a suggested wait such as "try again in 300 seconds"
+var greylistDelayPattern = regexp.MustCompile(`(?i)(?:in|after|wait)\s+(\d+)\s*(seconds?|secs?|minutes?|mins?)\b`)
+
+// IsGreylisted reports whether err is a greylisting deferral: a 450 or 451
+// reply that says so, or that carries the 4.7.1 or 4.2.0 enhanced status
+// greylisting servers send. When the reply suggests how long to wait, that
+// delay is returned too.
+func IsGreylisted(err error) (bool, time.Duration) {
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) || (smtpErr.Code != 450 && smtpErr.Code != 451) {
+		return false, 0
+	}
+
+	text := strings.Join(smtpErr.Lines, " ")
+	greylisted := greylistPattern.MatchString(text)
+	if fields := strings.Fields(text); len(fields) > 0 && (fields[0] == "4.7.1" || fields[0] == "4.2.0") {
+		greylisted = true
+	}
+	if !greylisted {
+		return false, 0
+	}
+
+	match := greylistDelayPattern.FindStringSubmatch(text)
+	if match == nil {
+		return true, 0
+	}
+	n, _ := strconv.Atoi(match[1])
+	delay := time.Duration(n) * time.Second
+	if strings.HasPrefix(strings.ToLower(match[2]), "m") {
+		delay = time.Duration(n) * time.Minute
+	}
+	return true, delay
+}
+
+// SetGreylistRetry enables greylisting handling: a greylisted message is sent
+// again once, after the delay the server suggests or, failing that, after
+// delay. Zero disables the retry.
+func (c *SMTPClient) SetGreylistRetry(delay time.Duration) {
+	c.greylistDelay = delay
+}
@@ -0,0 +1,44 @@
+package client
+
+import (
+	"fmt"
+	"time"
+)
+
+// SetPostSendDelay sets how long Hold keeps the connection open and idle
+// after a message is sent, to test how servers treat lingering clients
+func (c *SMTPClient) SetPostSendDelay(delay time.Duration) {
+	c.postSendDelay = delay
+}
+
+// SetKeepalive makes Hold send NOOP at this interval while it waits; zero or
+// less keeps the connection silent
+func (c *SMTPClient) SetKeepalive(interval time.Duration) {
+	c.keepalive = interval
+}
+
+// Hold waits for the post-send delay with the connection open, sending NOOP
+// at the keepalive interval if one is set. It returns at once without a
+// delay, and fails if the server rejects a NOOP or drops the connection.
+func (c *SMTPClient) Hold() error {
+	if c.postSendDelay <= 0 {
+		return nil
+	}
+	c.debugf("Holding the connection open for %s\n", c.postSendDelay)
+
+	deadline := time.Now().Add(c.postSendDelay)
+	for {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return nil
+		}
+		if c.keepalive <= 0 || wait <= c.keepalive {
+			time.Sleep(wait)
+			return nil
+		}
+		time.Sleep(c.keepalive)
+		if err := c.Noop(); err != nil {
+			return fmt.Errorf("connection lost while held open: %v", err)
+		}
+	}
+}
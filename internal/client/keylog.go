@@ -0,0 +1,32 @@
+package client
+
+import (
+	"fmt"
+	"os"
+)
+
+// keyLogFile appends the TLS secrets written to it to a file in the NSS key
+// log format, opening the file for each write so that no handle outlives the
+// handshakes that use it
+type keyLogFile string
+
+// Write appends p to the file, creating it readable only by its owner
+func (path keyLogFile) Write(p []byte) (int, error) {
+	f, err := os.OpenFile(string(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open TLS key log: %v", err)
+	}
+	n, err := f.Write(p)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return n, err
+}
+
+// SetKeyLogFile makes TLS handshakes append their session secrets to path, so
+// that tools such as Wireshark can decrypt a capture of the session. Anyone
+// who can read the file can decrypt the traffic, credentials included. An
+// empty path turns key logging off.
+func (c *SMTPClient) SetKeyLogFile(path string) {
+	c.keyLogPath = path
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// legacyCommands are the RFC 821 alternatives to MAIL: SEND delivers to the
+// user's terminal, SOML to the terminal or else the mailbox, and SAML to both.
+// RFC 5321 dropped them, and few servers other than old or embedded ones still
+// accept them.
+var legacyCommands = []string{"SEND", "SOML", "SAML"}
+
+// ParseLegacyCommand returns name as a legacy command for SetLegacyCommand
+func ParseLegacyCommand(name string) (string, error) {
+	command := strings.ToUpper(strings.TrimSpace(name))
+	for _, legacy := range legacyCommands {
+		if command == legacy {
+			return command, nil
+		}
+	}
+	return "", fmt.Errorf("invalid legacy command %q: must be one of %s", name, strings.Join(legacyCommands, ", "))
+}
+
+// SetLegacyCommand sends the obsolete SEND, SOML or SAML command in place of
+// MAIL, to test legacy devices. ESMTP parameters are only defined for MAIL, so
+// none are added to it. An empty command restores MAIL.
+func (c *SMTPClient) SetLegacyCommand(command string) {
+	c.legacyCommand = command
+}
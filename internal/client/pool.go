@@ -0,0 +1,218 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolClosed is returned when a client is requested from a closed pool
+var ErrPoolClosed = errors.New("connection pool is closed")
+
+// DialFunc establishes a new, ready-to-use SMTP session
+type DialFunc func() (*SMTPClient, error)
+
+// PoolConfig holds connection pool configuration
+type PoolConfig struct {
+	// MaxIdle is how long a connection may sit unused before it is closed (0 disables)
+	MaxIdle time.Duration
+	// MaxLifetime is how long a connection may live in total before it is closed (0 disables)
+	MaxLifetime time.Duration
+	// MaxOpen caps the sessions open at once, idle or in use; Get waits for a
+	// slot when the cap is reached (0 disables)
+	MaxOpen int
+}
+
+// pooledClient tracks an idle client and when it was last returned to the pool
+type pooledClient struct {
+	client   *SMTPClient
+	lastUsed time.Time
+}
+
+// Pool keeps established SMTP sessions around so they can be reused across messages
+type Pool struct {
+	mu     sync.Mutex
+	dial   DialFunc
+	config PoolConfig
+	idle   []pooledClient
+	closed bool
+	// open counts the sessions dialed and not yet closed, including ones being dialed
+	open int
+	// released is signalled when a session is closed or returned to the pool
+	released *sync.Cond
+	waits    int
+	waited   time.Duration
+}
+
+// NewPool creates a new connection pool using dial to open new sessions
+func NewPool(dial DialFunc, config PoolConfig) *Pool {
+	p := &Pool{
+		dial:   dial,
+		config: config,
+	}
+	p.released = sync.NewCond(&p.mu)
+	return p
+}
+
+// Get returns an idle session that still answers NOOP, or dials a new one.
+// When MaxOpen sessions are already open it waits until one is returned or closed.
+func (p *Pool) Get() (*SMTPClient, error) {
+	var waitStart time.Time
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		// Quit expired sessions without holding the lock, then look again
+		if expired := p.evictExpired(time.Now()); len(expired) > 0 {
+			p.mu.Unlock()
+			p.closeClients(expired)
+			continue
+		}
+		if len(p.idle) == 0 {
+			if p.config.MaxOpen > 0 && p.open >= p.config.MaxOpen {
+				// Count each blocked Get once, however often it is woken
+				if waitStart.IsZero() {
+					waitStart = time.Now()
+					p.waits++
+				}
+				p.released.Wait()
+				p.mu.Unlock()
+				continue
+			}
+			p.open++
+			if !waitStart.IsZero() {
+				p.waited += time.Since(waitStart)
+			}
+			p.mu.Unlock()
+			break
+		}
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if !waitStart.IsZero() {
+			p.waited += time.Since(waitStart)
+			waitStart = time.Time{}
+		}
+		p.mu.Unlock()
+
+		// Validate the connection before handing it out
+		if err := pc.client.Noop(); err != nil {
+			pc.client.debugf("Discarding pooled connection: %v\n", err)
+			pc.client.Close()
+			p.release()
+			continue
+		}
+		return pc.client, nil
+	}
+
+	c, err := p.dial()
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	return c, nil
+}
+
+// release gives up the slot of a session that was closed or never opened
+func (p *Pool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.open--
+	p.released.Signal()
+}
+
+// Waits returns how many times Get had to wait for a slot because MaxOpen
+// sessions were open, and the total time spent waiting
+func (p *Pool) Waits() (int, time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.waits, p.waited
+}
+
+// Put returns a session to the pool for later reuse
+func (p *Pool) Put(c *SMTPClient) {
+	p.mu.Lock()
+	now := time.Now()
+	if p.closed || p.expired(c, now, now) {
+		p.mu.Unlock()
+		p.closeClients([]pooledClient{{client: c}})
+		return
+	}
+	p.idle = append(p.idle, pooledClient{client: c, lastUsed: now})
+	expired := p.evictExpired(now)
+	p.released.Broadcast()
+	p.mu.Unlock()
+	p.closeClients(expired)
+}
+
+// Discard closes a session that should not be reused (e.g. after an error)
+func (p *Pool) Discard(c *SMTPClient) {
+	c.Close()
+	p.release()
+}
+
+// Close quits all idle sessions and prevents further use of the pool
+func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	// Waiting Gets return ErrPoolClosed
+	p.released.Broadcast()
+	p.mu.Unlock()
+	p.closeClients(idle)
+}
+
+// Idle returns the number of idle sessions currently held by the pool
+func (p *Pool) Idle() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.idle)
+}
+
+// expired reports whether a client exceeded the idle timeout or maximum lifetime
+func (p *Pool) expired(c *SMTPClient, lastUsed, now time.Time) bool {
+	if p.config.MaxIdle > 0 && now.Sub(lastUsed) > p.config.MaxIdle {
+		return true
+	}
+	if p.config.MaxLifetime > 0 && now.Sub(c.connectedAt) > p.config.MaxLifetime {
+		return true
+	}
+	return false
+}
+
+// evictExpired removes idle sessions past their idle timeout or lifetime and
+// returns them for closeClients, which must be called once p.mu is released;
+// p.mu must be held
+func (p *Pool) evictExpired(now time.Time) []pooledClient {
+	var expired []pooledClient
+	kept := p.idle[:0]
+	for _, pc := range p.idle {
+		if p.expired(pc.client, pc.lastUsed, now) {
+			expired = append(expired, pc)
+			continue
+		}
+		kept = append(kept, pc)
+	}
+	p.idle = kept
+	return expired
+}
+
+// closeClients politely ends sessions taken out of the pool, ignoring errors
+// from connections that may already be gone, then gives up their slots. QUIT
+// waits for the server, so p.mu must not be held.
+func (p *Pool) closeClients(clients []pooledClient) {
+	if len(clients) == 0 {
+		return
+	}
+	for _, pc := range clients {
+		pc.client.Quit()
+		pc.client.Close()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.open -= len(clients)
+	// Closing may free more than one slot
+	p.released.Broadcast()
+}
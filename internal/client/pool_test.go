@@ -0,0 +1,259 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPoolReusesIdleConnection(t *testing.T) {
+	dials := 0
+	pool := NewPool(func() (*SMTPClient, error) {
+		dials++
+		c, _ := newScriptedClient(t, "220 ready\r\n250 OK\r\n250 OK\r\n")
+		return c, nil
+	}, PoolConfig{MaxIdle: time.Minute, MaxLifetime: time.Minute})
+	defer pool.Close()
+
+	first, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	pool.Put(first)
+
+	second, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if second != first {
+		t.Errorf("Get() returned a new connection, want the idle one to be reused")
+	}
+	if dials != 1 {
+		t.Errorf("dial called %d times, want 1", dials)
+	}
+}
+
+func TestPoolReplacesExpiredConnection(t *testing.T) {
+	tests := []struct {
+		name   string
+		config PoolConfig
+	}{
+		{name: "max lifetime", config: PoolConfig{MaxLifetime: 10 * time.Millisecond}},
+		{name: "max idle", config: PoolConfig{MaxIdle: 10 * time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dials := 0
+			pool := NewPool(func() (*SMTPClient, error) {
+				dials++
+				c, _ := newScriptedClient(t, "220 ready\r\n250 OK\r\n221 Bye\r\n")
+				return c, nil
+			}, tt.config)
+			defer pool.Close()
+
+			first, err := pool.Get()
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			pool.Put(first)
+			time.Sleep(20 * time.Millisecond)
+
+			second, err := pool.Get()
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if second == first {
+				t.Errorf("Get() reused an expired connection")
+			}
+			if dials != 2 {
+				t.Errorf("dial called %d times, want 2", dials)
+			}
+		})
+	}
+}
+
+func TestPoolReconnectsWhenNoopFails(t *testing.T) {
+	dials := 0
+	pool := NewPool(func() (*SMTPClient, error) {
+		dials++
+		c, _ := newScriptedClient(t, "220 ready\r\n421 Timeout\r\n")
+		return c, nil
+	}, PoolConfig{})
+	defer pool.Close()
+
+	first, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	pool.Put(first)
+
+	second, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if second == first {
+		t.Errorf("Get() returned a connection that failed NOOP")
+	}
+	if dials != 2 {
+		t.Errorf("dial called %d times, want 2", dials)
+	}
+}
+
+func TestPoolMaxOpen(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	// The sink server records the most connections it had open at once
+	var mu sync.Mutex
+	open, maxOpen := 0, 0
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			open++
+			if open > maxOpen {
+				maxOpen = open
+			}
+			mu.Unlock()
+			go func(conn net.Conn) {
+				defer func() {
+					mu.Lock()
+					open--
+					mu.Unlock()
+				}()
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprint(conn, "220 ready\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.HasPrefix(strings.ToUpper(line), "QUIT") {
+						fmt.Fprint(conn, "221 bye\r\n")
+						return
+					}
+					fmt.Fprint(conn, "250 OK\r\n")
+				}
+			}(conn)
+		}
+	}()
+
+	const limit = 2
+	pool := NewPool(func() (*SMTPClient, error) {
+		c := NewSMTPClient("localhost", false)
+		if err := c.Connect("127.0.0.1", ln.Addr().(*net.TCPAddr).Port); err != nil {
+			return nil, err
+		}
+		return c, c.Ehlo()
+	}, PoolConfig{MaxOpen: limit})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := pool.Get()
+			if err != nil {
+				t.Errorf("Get() error = %v", err)
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+			pool.Put(c)
+		}()
+	}
+	wg.Wait()
+	pool.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxOpen > limit {
+		t.Errorf("server saw %d connections open at once, want at most %d", maxOpen, limit)
+	}
+	if waits, _ := pool.Waits(); waits == 0 {
+		t.Error("Waits() = 0, want the workers over the limit to have waited for a slot")
+	}
+}
+
+func TestPoolCloseWakesWaiters(t *testing.T) {
+	pool := NewPool(func() (*SMTPClient, error) {
+		c, _ := newScriptedClient(t, "220 ready\r\n221 Bye\r\n")
+		return c, nil
+	}, PoolConfig{MaxOpen: 1})
+
+	if _, err := pool.Get(); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.Get()
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	pool.Close()
+
+	select {
+	case err := <-done:
+		if err != ErrPoolClosed {
+			t.Errorf("waiting Get() error = %v, want ErrPoolClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close() did not wake a Get() waiting for a slot")
+	}
+}
+
+func TestPoolQuitsOutsideLock(t *testing.T) {
+	quitting, unblock := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	pool := NewPool(func() (*SMTPClient, error) {
+		c, _ := newScriptedClient(t, "220 ready\r\n")
+		// The server answers QUIT only when the test lets it
+		c.conn.(*mockConn).readFunc = func(b []byte) (int, error) {
+			once.Do(func() { close(quitting) })
+			<-unblock
+			return 0, io.EOF
+		}
+		return c, nil
+	}, PoolConfig{})
+
+	c, err := pool.Get()
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	pool.Put(c)
+	closed := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+	<-quitting
+
+	// The pool stays usable while Close waits for the reply to QUIT
+	done := make(chan error, 1)
+	go func() {
+		_, err := pool.Get()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != ErrPoolClosed {
+			t.Errorf("Get() error = %v, want ErrPoolClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Get() blocked while Close() was quitting a session")
+	}
+	close(unblock)
+	<-closed
+}
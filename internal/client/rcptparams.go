@@ -0,0 +1,78 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// recipientData is what a RCPT TO parameter template can refer to
+type recipientData struct {
+	Recipient string
+}
+
+// rcptParamFuncs are the functions available in RCPT TO parameter templates
+var rcptParamFuncs = template.FuncMap{"xtext": xtext}
+
+// SetRecipientParameters adds ESMTP parameters to every RCPT TO, each a
+// text/template rendered for the recipient, such as
+// "ORCPT=rfc822;{{xtext .Recipient}}". A parameter replaces any the client
+// would send with the same keyword, such as the ORCPT= of a DSN request. The
+// parameters are sent whatever the server advertises.
+func (c *SMTPClient) SetRecipientParameters(params []string) error {
+	var templates []*template.Template
+	for _, param := range params {
+		tmpl, err := template.New("rcpt-param").Funcs(rcptParamFuncs).Option("missingkey=error").Parse(param)
+		if err != nil {
+			return fmt.Errorf("invalid RCPT TO parameter %q: %v", param, err)
+		}
+		// Fail now rather than halfway through the recipients
+		if err := tmpl.Execute(&bytes.Buffer{}, recipientData{Recipient: "user@example.com"}); err != nil {
+			return fmt.Errorf("invalid RCPT TO parameter %q: %v", param, err)
+		}
+		templates = append(templates, tmpl)
+	}
+	c.rcptParamTemplates = templates
+	return nil
+}
+
+// rcptParameters returns the ESMTP parameters added to the RCPT TO for recipient
+func (c *SMTPClient) rcptParameters(recipient string) []string {
+	var custom []string
+	for _, tmpl := range c.rcptParamTemplates {
+		var b bytes.Buffer
+		if err := tmpl.Execute(&b, recipientData{Recipient: recipient}); err != nil {
+			// Templates are checked when set, so this takes an unusual template
+			c.debugf("RCPT TO parameter for %s failed: %v\n", c.redacted(recipient), err)
+			continue
+		}
+		if param := strings.TrimSpace(b.String()); param != "" {
+			custom = append(custom, param)
+		}
+	}
+
+	var params []string
+	for _, param := range c.dsnRcptParameters(recipient) {
+		if !hasParameter(custom, parameterKeyword(param)) {
+			params = append(params, param)
+		}
+	}
+	return append(params, custom...)
+}
+
+// parameterKeyword returns the keyword of an ESMTP parameter, in upper case
+func parameterKeyword(param string) string {
+	keyword, _, _ := strings.Cut(param, "=")
+	return strings.ToUpper(keyword)
+}
+
+// hasParameter reports whether params includes one with the given keyword
+func hasParameter(params []string, keyword string) bool {
+	for _, param := range params {
+		if parameterKeyword(param) == keyword {
+			return true
+		}
+	}
+	return false
+}
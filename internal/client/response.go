@@ -0,0 +1,128 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Response represents a complete, possibly multiline, SMTP reply
+type Response struct {
+	Code  int
+	Lines []string
+}
+
+// Message returns the reply text without the status codes, one line per reply line
+func (r *Response) Message() string {
+	return strings.Join(r.Lines, "\n")
+}
+
+// String returns the reply as it appeared on the wire, without line terminators
+func (r *Response) String() string {
+	var b strings.Builder
+	for i, line := range r.Lines {
+		sep := "-"
+		if i == len(r.Lines)-1 {
+			sep = " "
+		}
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "%d%s%s", r.Code, sep, line)
+	}
+	return b.String()
+}
+
+// queueIDPattern matches the queue id in replies such as Postfix's "250 2.0.0
+// Ok: queued as 4BQ2Dk1x2Nz9sWQ" and Exim's "250 OK id=1qB6xS-0004Zc-2T"
+var queueIDPattern = regexp.MustCompile(`(?i)(?:queued as|\bid=)\s*([A-Za-z0-9._-]+)`)
+
+// QueueID returns the queue id the server reported for an accepted message,
+// or "" if the reply does not contain one in a known form
+func (r *Response) QueueID() string {
+	if m := queueIDPattern.FindStringSubmatch(r.Message()); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// readReply reads a complete reply, following continuation lines until the final line
+func (c *SMTPClient) readReply() (*Response, error) {
+	resp := &Response{}
+	for {
+		line, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 3 {
+			return nil, fmt.Errorf("malformed response: %q", line)
+		}
+
+		code, err := strconv.Atoi(line[:3])
+		if err != nil {
+			return nil, fmt.Errorf("malformed response code: %q", line)
+		}
+		if resp.Code != 0 && code != resp.Code {
+			return nil, fmt.Errorf("inconsistent response codes: %d and %d", resp.Code, code)
+		}
+		resp.Code = code
+
+		if len(line) == 3 {
+			resp.Lines = append(resp.Lines, "")
+			return resp, nil
+		}
+		resp.Lines = append(resp.Lines, line[4:])
+		if line[3] != '-' {
+			return resp, nil
+		}
+	}
+}
+
+// SMTPError is a 4xx or 5xx reply from the server
+type SMTPError struct {
+	Code  int
+	Lines []string
+}
+
+// Error returns the server's reply as it appeared on the wire
+func (e *SMTPError) Error() string {
+	return (&Response{Code: e.Code, Lines: e.Lines}).String()
+}
+
+// Temporary reports whether the reply is a transient (4xx) failure
+func (e *SMTPError) Temporary() bool {
+	return e.Code >= 400 && e.Code < 500
+}
+
+// IsRetryable reports whether the operation that failed with err may succeed
+// if tried again: a transient (4xx) reply, or a network error such as a lost
+// connection or a timeout. A permanent (5xx) reply is not retryable, and
+// neither is an error of the client's own, such as a message that cannot be
+// built or ErrPipelineDesync.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var smtpErr *SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Temporary()
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || isConnClosed(err)
+}
+
+// readStatus reads a complete reply, returning an *SMTPError for 4xx and 5xx codes
+func (c *SMTPClient) readStatus() (*Response, error) {
+	resp, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code >= 400 {
+		return resp, &SMTPError{Code: resp.Code, Lines: resp.Lines}
+	}
+	return resp, nil
+}
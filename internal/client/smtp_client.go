@@ -3,11 +3,17 @@ package client
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/smtp"
+	"os"
 	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/asachs/smtp-edc/internal/auth"
@@ -27,6 +33,20 @@ type ServerCapabilities struct {
 	Auth       []string
 	Size       int
 	EightBit   bool
+	DSN        bool
+	Chunking   bool
+	// Extensions holds every extension line advertised after the EHLO greeting
+	Extensions []string
+}
+
+// Has reports whether the server advertised the given EHLO keyword
+func (caps ServerCapabilities) Has(keyword string) bool {
+	for _, ext := range caps.Extensions {
+		if fields := strings.Fields(ext); len(fields) > 0 && strings.EqualFold(fields[0], keyword) {
+			return true
+		}
+	}
+	return false
 }
 
 // SMTPClient represents an SMTP client connection
@@ -37,23 +57,130 @@ type SMTPClient struct {
 	hostname     string
 	server       string
 	debug        bool
+	debugOut     io.Writer
 	tls          bool
 	retry        RetryConfig
 	timeout      time.Duration
+	ioTimeout    time.Duration
 	capabilities ServerCapabilities
 	client       smtp.Client
+	connectedAt  time.Time
+	pipelining   bool
+	authMech     string
+	tlsServer    string
+	rootCAs      *x509.CertPool
+	port         int
+	// keyLogPath receives the TLS session secrets when set
+	keyLogPath string
+	// maxAuthAttempts bounds the mechanisms Authenticate tries
+	maxAuthAttempts int
+	// authType, username and password are kept to re-authenticate after a reconnect
+	authType string
+	username string
+	password string
+	// connLost is set when the server closes the connection, so the next retry reconnects
+	connLost bool
+	// maxLineLength bounds how much of a response line is buffered
+	maxLineLength int
+	// mailAuth is the RFC 4954 AUTH= identity for MAIL FROM, "<>" for anonymous
+	mailAuth string
+	// greylistDelay enables one retry of a greylisted message after this delay
+	greylistDelay time.Duration
+	// greylisted records that the last message was greylisted before being accepted
+	greylisted bool
+	// xclient holds the XCLIENT attributes sent, to send them again after a reconnect
+	xclient map[string]string
+	// declaredSize is sent as the MAIL FROM SIZE= parameter when set
+	declaredSize int64
+	// redact rewrites debug output, e.g. to hide recipient addresses
+	redact func(string) string
+	// implicitTLS starts TLS as soon as the connection is opened
+	implicitTLS bool
+	// ehloFallbacks are the EHLO names tried when the server rejects the hostname
+	ehloFallbacks []string
+	// finalResponse is the reply accepting the last message
+	finalResponse *Response
+	// clientCert is presented to servers that ask for a client certificate
+	clientCert *tls.Certificate
+	// skipVerify disables verification of the server certificate
+	skipVerify bool
+	// rcptAccepted and rcptRejected count the RCPT TO replies of the last transaction
+	rcptAccepted int
+	rcptRejected int
+	// dsn holds the delivery status notifications requested
+	dsn DSNOptions
+	// cipherSuites restricts the TLS 1.2 cipher suites offered
+	cipherSuites []uint16
+	// messageSize is the estimated size of the message being sent, for SIZE=
+	messageSize int64
+	// eightBit is set while sending a message with 8bit parts, for BODY=8BITMIME
+	eightBit bool
+	// legacyCommand is sent in place of MAIL when set
+	legacyCommand string
+	// rcptParamTemplates render extra RCPT TO parameters for each recipient
+	rcptParamTemplates []*template.Template
+	// chunking sends the message with BDAT when the server advertises CHUNKING
+	chunking  bool
+	chunkSize int
+	// postSendDelay is how long Hold keeps the connection open, sending NOOP
+	// every keepalive if set
+	postSendDelay time.Duration
+	keepalive     time.Duration
+}
+
+// DefaultMaxLineLength is the longest response line accepted by default. RFC
+// 5321 limits reply lines to 512 octets; this leaves generous headroom.
+const DefaultMaxLineLength = 64 * 1024
+
+// SessionInfo describes the features in use on an established session
+type SessionInfo struct {
+	TLS bool
+	// ImplicitTLS is set when TLS was started on connect rather than with STARTTLS
+	ImplicitTLS   bool
+	Pipelining    bool
+	AuthMechanism string
+	// Greylisted is set when the last message was deferred by greylisting and then retried
+	Greylisted bool
+	// FinalResponse is the reply accepting the last message, in which relays
+	// often report the queue id, or nil if no message was accepted
+	FinalResponse *Response
+	// Server and Port are the address connected to
+	Server string
+	Port   int
+	// TLSVersion and CipherSuite describe the TLS connection, if any
+	TLSVersion  string
+	CipherSuite string
+	// RecipientsAccepted and RecipientsRejected count the RCPT TO replies of
+	// the last transaction; a rejection ends the transaction
+	RecipientsAccepted int
+	RecipientsRejected int
 }
 
+// AuthAuto is the authentication type that picks the strongest advertised mechanism
+const AuthAuto = "auto"
+
+// authStrength lists the supported mechanisms, strongest first. CRAM-MD5 never
+// sends the password; PLAIN needs one round trip less than LOGIN.
+var authStrength = []string{"cram-md5", "plain", "login"}
+
 // NewSMTPClient creates a new SMTP client connection
 func NewSMTPClient(hostname string, debug bool) *SMTPClient {
 	return &SMTPClient{
 		hostname: hostname,
 		debug:    debug,
+		debugOut: os.Stdout,
 		retry: RetryConfig{
 			MaxAttempts: 3,
 			Delay:       time.Second * 2,
 		},
-		timeout: time.Second * 30,
+		timeout:       time.Second * 30,
+		maxLineLength: DefaultMaxLineLength,
+		ioTimeout:     time.Second * 30,
+		pipelining:    true,
+		chunking:      true,
+		chunkSize:     DefaultChunkSize,
+		// Two attempts allow one fallback without risking a lockout
+		maxAuthAttempts: 2,
 	}
 }
 
@@ -63,9 +190,108 @@ func (c *SMTPClient) SetRetryConfig(maxAttempts int, delay time.Duration) {
 	c.retry.Delay = delay
 }
 
-// SetTimeout sets the connection timeout
+// SetTimeout sets both the connect timeout and the I/O timeout
 func (c *SMTPClient) SetTimeout(timeout time.Duration) {
 	c.timeout = timeout
+	c.ioTimeout = timeout
+}
+
+// SetConnectTimeout sets how long to wait for the TCP connection to be established
+func (c *SMTPClient) SetConnectTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// SetIOTimeout sets how long to wait for each server response (0 disables)
+func (c *SMTPClient) SetIOTimeout(timeout time.Duration) {
+	c.ioTimeout = timeout
+}
+
+// SetMaxLineLength sets the longest response line accepted from the server;
+// zero removes the limit
+func (c *SMTPClient) SetMaxLineLength(n int) {
+	c.maxLineLength = n
+}
+
+// SetMailAuth sets the identity sent as the AUTH= parameter of MAIL FROM
+// (RFC 4954) when the server supports AUTH. Use "<>" to declare that the
+// submitter is not known; an empty identity omits the parameter.
+func (c *SMTPClient) SetMailAuth(identity string) {
+	c.mailAuth = identity
+}
+
+// SetRedactor sets a function applied to the session transcript and other
+// debug output before it is printed, such as one that hides addresses
+func (c *SMTPClient) SetRedactor(redact func(string) string) {
+	c.redact = redact
+}
+
+// SetDebugOutput sets where the session transcript and other debug output
+// are written, by default os.Stdout, e.g. to keep them out of
+// machine-readable output
+func (c *SMTPClient) SetDebugOutput(w io.Writer) {
+	c.debugOut = w
+}
+
+// debugf writes debug output when debugging is enabled
+func (c *SMTPClient) debugf(format string, args ...interface{}) {
+	if c.debug {
+		fmt.Fprintf(c.debugOut, format, args...)
+	}
+}
+
+// redacted returns s as it may be printed
+func (c *SMTPClient) redacted(s string) string {
+	if c.redact == nil {
+		return s
+	}
+	return c.redact(s)
+}
+
+// SetDeclaredSize sets the message size declared with the RFC 1870 SIZE=
+// parameter on MAIL FROM, sent as given whatever the real size of the
+// message. This tests how a server treats messages over its limit without
+// sending one. Zero declares no size.
+func (c *SMTPClient) SetDeclaredSize(size int64) {
+	c.declaredSize = size
+}
+
+// SetPipelining enables or disables the use of pipelining when the server advertises it
+func (c *SMTPClient) SetPipelining(enabled bool) {
+	c.pipelining = enabled
+}
+
+// SetTLSServerName sets the name used for SNI and certificate verification
+// when it differs from the host being connected to
+func (c *SMTPClient) SetTLSServerName(name string) {
+	c.tlsServer = name
+}
+
+// Capabilities returns the capabilities advertised in the last EHLO response
+func (c *SMTPClient) Capabilities() ServerCapabilities {
+	return c.capabilities
+}
+
+// Session reports the server, whether TLS and pipelining are in use, which AUTH
+// mechanism succeeded and how the last transaction went
+func (c *SMTPClient) Session() SessionInfo {
+	info := SessionInfo{
+		TLS:                c.tls || c.implicitTLS,
+		ImplicitTLS:        c.implicitTLS,
+		Pipelining:         c.capabilities.Pipelining && c.pipelining,
+		AuthMechanism:      c.authMech,
+		Greylisted:         c.greylisted,
+		FinalResponse:      c.finalResponse,
+		Server:             c.server,
+		Port:               c.port,
+		RecipientsAccepted: c.rcptAccepted,
+		RecipientsRejected: c.rcptRejected,
+	}
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		info.TLSVersion = tlsVersionString(state.Version)
+		info.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	}
+	return info
 }
 
 // withRetry executes a function with retry logic
@@ -74,15 +300,32 @@ func (c *SMTPClient) withRetry(operation string, fn func() error) error {
 	for attempt := 1; attempt <= c.retry.MaxAttempts; attempt++ {
 		if err := fn(); err != nil {
 			lastErr = err
-			if c.debug {
-				fmt.Printf("Attempt %d/%d for %s failed: %v\n",
-					attempt, c.retry.MaxAttempts, operation, err)
+			// Greylisting is handled by waiting, not by retrying straight away
+			if greylisted, _ := IsGreylisted(err); greylisted && c.greylistDelay > 0 {
+				return err
+			}
+			c.debugf("Attempt %d/%d for %s failed: %s\n",
+				attempt, c.retry.MaxAttempts, operation, c.redacted(err.Error()))
+			// A permanent rejection gets the same answer however often it is
+			// tried, and so does a failure of the client's own, such as a
+			// pipelining desync, even when it cost the connection
+			if !IsRetryable(err) {
+				return err
 			}
 			if attempt < c.retry.MaxAttempts {
 				time.Sleep(c.retry.Delay)
+				// A dead connection can never succeed; replace it before retrying
+				if c.connLost {
+					if reconnectErr := c.reconnect(); reconnectErr != nil {
+						// Without a connection another attempt cannot run
+						c.debugf("Reconnect for %s failed: %s\n", operation, c.redacted(reconnectErr.Error()))
+						return fmt.Errorf("%s failed after %d of %d attempts (%v): %w",
+							operation, attempt, c.retry.MaxAttempts, err, reconnectErr)
+					}
+				}
 				continue
 			}
-			return fmt.Errorf("%s failed after %d attempts: %v",
+			return fmt.Errorf("%s failed after %d attempts: %w",
 				operation, c.retry.MaxAttempts, err)
 		}
 		return nil
@@ -90,54 +333,213 @@ func (c *SMTPClient) withRetry(operation string, fn func() error) error {
 	return lastErr
 }
 
+// transaction wraps a mail transaction so that a failure on a live connection
+// is followed by RSET, letting the next attempt start a new transaction. If
+// the RSET is not accepted the session state is unknown, so the connection
+// is treated as lost. Each attempt counts its recipients afresh.
+func (c *SMTPClient) transaction(fn func() error) func() error {
+	return func() error {
+		c.rcptAccepted, c.rcptRejected = 0, 0
+		err := fn()
+		if err != nil && !c.connLost && c.conn != nil {
+			reset := c.SendCommand("RSET")
+			if reset == nil {
+				var resp *Response
+				if resp, reset = c.readReply(); reset == nil && resp.Code >= 300 {
+					reset = fmt.Errorf("RSET refused: %s", resp)
+				}
+			}
+			if reset != nil {
+				c.connLost = true
+			}
+		}
+		return err
+	}
+}
+
+// Reusable reports whether the session can carry another message: it is
+// connected, and any failed transaction was reset. Authentication persists
+// for the life of the connection, so a pool can keep such a session after a
+// rejected message instead of dialing and authenticating again.
+func (c *SMTPClient) Reusable() bool {
+	return c.conn != nil && !c.connLost
+}
+
+// isReply reports whether err carries a 4xx or 5xx reply from the server
+func isReply(err error) bool {
+	var smtpErr *SMTPError
+	return errors.As(err, &smtpErr)
+}
+
 // Connect establishes a connection to the SMTP server
 func (c *SMTPClient) Connect(server string, port int) error {
 	return c.withRetry("connect", func() error {
-		// If we already have a connection (likely a mock in tests), use it
-		if c.conn != nil {
-			// Test the connection by trying to read the server greeting
-			c.reader = bufio.NewReader(c.conn)
-			c.writer = bufio.NewWriter(c.conn)
-			c.server = server
-
-			// Read server greeting to verify connection
-			_, err := c.readResponse()
-			if err != nil {
-				return fmt.Errorf("failed to read server greeting: %v", err)
-			}
+		return c.connect(server, port)
+	})
+}
 
-			return nil
+// connect makes a single attempt to connect and read the greeting
+func (c *SMTPClient) connect(server string, port int) error {
+	c.server = server
+	c.port = port
+	c.connLost = false
+	addr := net.JoinHostPort(server, strconv.Itoa(port))
+
+	// If we already have a connection (likely a mock in tests), use it
+	if c.conn != nil {
+		// Test the connection by trying to read the server greeting
+		c.reader = bufio.NewReader(c.conn)
+		c.writer = bufio.NewWriter(c.conn)
+
+		// Read server greeting to verify connection
+		if err := c.readGreeting(); err != nil {
+			return &Error{Kind: ErrConnect, Subject: addr, Err: err}
 		}
 
-		addr := fmt.Sprintf("%s:%d", server, port)
+		c.connectedAt = time.Now()
+		return nil
+	}
 
-		// Create connection with timeout
-		conn, err := net.DialTimeout("tcp", addr, c.timeout)
-		if err != nil {
-			return fmt.Errorf("failed to connect to SMTP server: %v", err)
+	// Create connection with timeout
+	conn, err := net.DialTimeout("tcp", addr, c.timeout)
+	if err != nil {
+		return &Error{Kind: ErrConnect, Subject: addr, Err: err}
+	}
+
+	// With implicit TLS the handshake comes before the greeting
+	if c.implicitTLS {
+		tlsConn := tls.Client(conn, c.tlsConfig())
+		tlsConn.SetDeadline(time.Now().Add(c.timeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return &Error{Kind: ErrConnect, Subject: addr, Err: handshakeError(err)}
 		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
 
-		// Set read/write timeouts
-		conn.SetDeadline(time.Now().Add(c.timeout))
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.writer = bufio.NewWriter(conn)
 
-		c.conn = conn
-		c.reader = bufio.NewReader(conn)
-		c.writer = bufio.NewWriter(conn)
-		c.server = server
+	// Read server greeting; drop the connection so a retry dials a new one
+	if err := c.readGreeting(); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return &Error{Kind: ErrConnect, Subject: addr, Err: err}
+	}
 
-		// Read server greeting
-		_, err = c.readResponse()
-		if err != nil {
-			c.conn.Close()
-			return fmt.Errorf("failed to read server greeting: %v", err)
+	c.connectedAt = time.Now()
+	return nil
+}
+
+// reconnect replaces a connection the server closed, restoring STARTTLS,
+// XCLIENT and authentication as they were on the old session
+func (c *SMTPClient) reconnect() error {
+	c.debugf("Connection to %s lost; reconnecting\n", c.server)
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	useTLS := c.tls
+	c.tls = false
+
+	if err := c.connect(c.server, c.port); err != nil {
+		return fmt.Errorf("failed to reconnect: %v", err)
+	}
+	if err := c.Ehlo(); err != nil {
+		return fmt.Errorf("failed to send EHLO after reconnect: %v", err)
+	}
+	if useTLS {
+		if err := c.StartTLS(); err != nil {
+			return fmt.Errorf("failed to start TLS after reconnect: %v", err)
+		}
+		if err := c.Ehlo(); err != nil {
+			return fmt.Errorf("failed to send EHLO after reconnect: %v", err)
+		}
+	}
+	if c.xclient != nil {
+		if err := c.XClient(c.xclient); err != nil {
+			return fmt.Errorf("failed to send XCLIENT after reconnect: %v", err)
+		}
+		if err := c.Ehlo(); err != nil {
+			return fmt.Errorf("failed to send EHLO after reconnect: %v", err)
 		}
+	}
+	if c.authType != "" {
+		if err := c.authenticate(c.authType, c.username, c.password); err != nil {
+			return fmt.Errorf("failed to authenticate after reconnect: %v", err)
+		}
+	}
+	return nil
+}
 
-		return nil
-	})
+// isConnClosed reports whether err means the server closed the connection
+func isConnClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// isTimeout reports whether err is a network timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// readGreeting reads the server's 220 greeting, including any continuation
+// lines of a multiline banner so they are not mistaken for the EHLO reply. A
+// server refusing the session (554) is reported with its reply.
+func (c *SMTPClient) readGreeting() error {
+	if _, err := c.readStatus(); err != nil {
+		var smtpErr *SMTPError
+		if errors.As(err, &smtpErr) {
+			return err
+		}
+		return fmt.Errorf("failed to read server greeting: %w", err)
+	}
+	return nil
 }
 
 // StartTLS initiates a TLS connection
 func (c *SMTPClient) StartTLS() error {
+	return c.startTLS(c.tlsConfig())
+}
+
+// startTLS sends STARTTLS and upgrades the connection using tlsConfig
+func (c *SMTPClient) startTLS(tlsConfig *tls.Config) error {
+	if err := c.requestTLS(); err != nil {
+		return err
+	}
+
+	c.debugf("Starting TLS handshake with server %s\n", c.server)
+
+	// Upgrade connection to TLS
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	err := tlsConn.Handshake()
+	if err != nil {
+		c.debugf("TLS handshake failed: %v\n", err)
+		c.debugf("TLS version attempted: %d\n", tlsConfig.MinVersion)
+		c.debugf("Server name: %s\n", tlsConfig.ServerName)
+		return handshakeError(err)
+	}
+
+	if c.debug {
+		state := tlsConn.ConnectionState()
+		c.debugf("TLS handshake successful\n")
+		c.debugf("TLS version: %s\n", tlsVersionString(state.Version))
+		c.debugf("Cipher suite: %s\n", tls.CipherSuiteName(state.CipherSuite))
+	}
+
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	c.writer = bufio.NewWriter(tlsConn)
+	c.tls = true
+
+	return nil
+}
+
+// requestTLS sends STARTTLS and reads the server's go-ahead for the handshake
+func (c *SMTPClient) requestTLS() error {
 	err := c.SendCommand("STARTTLS")
 	if err != nil {
 		return fmt.Errorf("failed to send STARTTLS command: %v", err)
@@ -154,46 +556,67 @@ func (c *SMTPClient) StartTLS() error {
 			if line[0] != '2' {
 				return fmt.Errorf("server rejected STARTTLS: %s", line)
 			}
-			break
+			return nil
 		}
 	}
+}
 
-	// Create TLS configuration
-	tlsConfig := &tls.Config{
-		ServerName:         c.server,
-		InsecureSkipVerify: true,
-		MinVersion:         tls.VersionTLS12, // Force TLS 1.2 or higher
+// handshakeError describes a failed TLS handshake, naming the x509 reason when
+// the server certificate did not verify
+func handshakeError(err error) error {
+	var verifyErr *tls.CertificateVerificationError
+	if errors.As(err, &verifyErr) {
+		return fmt.Errorf("server certificate verification failed: %w", err)
 	}
+	return fmt.Errorf("TLS handshake failed: %w", err)
+}
 
-	if c.debug {
-		fmt.Printf("Starting TLS handshake with server %s\n", c.server)
-	}
+// SetRootCAs verifies the server certificate against pool instead of the
+// system roots
+func (c *SMTPClient) SetRootCAs(pool *x509.CertPool) {
+	c.rootCAs = pool
+}
 
-	// Upgrade connection to TLS
-	tlsConn := tls.Client(c.conn, tlsConfig)
-	err = tlsConn.Handshake()
+// SetSkipVerify disables verification of the server certificate, for test
+// servers with self-signed certificates. Certificates are verified by default.
+func (c *SMTPClient) SetSkipVerify(skip bool) {
+	c.skipVerify = skip
+}
+
+// SetClientCertificate loads a PEM certificate and private key to present
+// during the TLS handshake, for servers that require mutual TLS
+func (c *SMTPClient) SetClientCertificate(certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		if c.debug {
-			fmt.Printf("TLS handshake failed: %v\n", err)
-			fmt.Printf("TLS version attempted: %d\n", tlsConfig.MinVersion)
-			fmt.Printf("Server name: %s\n", tlsConfig.ServerName)
-		}
-		return fmt.Errorf("TLS handshake failed: %v", err)
+		return fmt.Errorf("failed to load client certificate: %v", err)
 	}
+	c.clientCert = &cert
+	return nil
+}
 
-	if c.debug {
-		state := tlsConn.ConnectionState()
-		fmt.Println("TLS handshake successful")
-		fmt.Printf("TLS version: %s\n", tlsVersionString(state.Version))
-		fmt.Printf("Cipher suite: %s\n", tls.CipherSuiteName(state.CipherSuite))
+// tlsConfig returns the TLS configuration for a handshake with the server
+func (c *SMTPClient) tlsConfig() *tls.Config {
+	serverName := c.server
+	if c.tlsServer != "" {
+		serverName = c.tlsServer
 	}
-
-	c.conn = tlsConn
-	c.reader = bufio.NewReader(tlsConn)
-	c.writer = bufio.NewWriter(tlsConn)
-	c.tls = true
-
-	return nil
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: c.skipVerify,
+		RootCAs:            c.rootCAs,
+		MinVersion:         tls.VersionTLS12, // Force TLS 1.2 or higher
+	}
+	if c.keyLogPath != "" {
+		config.KeyLogWriter = keyLogFile(c.keyLogPath)
+	}
+	if c.clientCert != nil {
+		config.Certificates = []tls.Certificate{*c.clientCert}
+	}
+	if len(c.cipherSuites) > 0 {
+		config.CipherSuites = c.cipherSuites
+		config.MaxVersion = tls.VersionTLS12
+	}
+	return config
 }
 
 // tlsVersionString converts a TLS version number to a string
@@ -212,20 +635,144 @@ func tlsVersionString(version uint16) string {
 	}
 }
 
-// Authenticate performs SMTP authentication
+// Authenticate performs SMTP authentication. With AuthAuto the strongest
+// mechanism the server advertises is used. When a mechanism is rejected with
+// 504, 534 or 535, the next strongest advertised one is tried, up to the
+// limit set with SetMaxAuthAttempts; Session reports the one that succeeded.
 func (c *SMTPClient) Authenticate(authType, username, password string) error {
+	mechs := c.authCandidates(authType)
+	if len(mechs) == 0 {
+		return &Error{Kind: ErrAuth, Subject: strings.ToUpper(authType), Err: errors.New("the server advertises no supported AUTH mechanism")}
+	}
+	if c.maxAuthAttempts > 0 && len(mechs) > c.maxAuthAttempts {
+		mechs = mechs[:c.maxAuthAttempts]
+	}
+
+	var err error
+	for i, mech := range mechs {
+		if err = c.authenticate(mech, username, password); err == nil {
+			c.authMech = strings.ToUpper(mech)
+			c.authType, c.username, c.password = mech, username, password
+			return nil
+		}
+		err = &Error{Kind: ErrAuth, Subject: strings.ToUpper(mech), Err: err}
+		if !isAuthRejected(err) {
+			break
+		}
+		if i+1 < len(mechs) {
+			c.debugf("AUTH %s was rejected; trying %s\n", strings.ToUpper(mech), strings.ToUpper(mechs[i+1]))
+		}
+	}
+	return err
+}
+
+// authenticateXOAuth2 sends AUTH XOAUTH2 with the initial response built from
+// the access token. A rejected token is answered with a 334 challenge holding
+// a base64 JSON error, which must be acknowledged with an empty line before
+// the server sends the final status.
+func (c *SMTPClient) authenticateXOAuth2(authenticator auth.Authenticator, username, token string) error {
+	response, err := authenticator.Authenticate(username, token)
+	if err != nil {
+		return fmt.Errorf("failed to generate XOAUTH2 response: %v", err)
+	}
+	if err := c.SendCommand("AUTH XOAUTH2 " + response); err != nil {
+		return fmt.Errorf("failed to send AUTH command: %v", err)
+	}
+	resp, err := c.readStatus()
+	if err != nil {
+		return err
+	}
+	if resp.Code == 334 {
+		if c.debug && len(resp.Lines) > 0 {
+			if details, err := auth.Base64Decode(resp.Lines[0]); err == nil {
+				c.debugf("XOAUTH2 error: %s\n", details)
+			}
+		}
+		if err := c.SendCommand(""); err != nil {
+			return fmt.Errorf("failed to acknowledge XOAUTH2 error: %v", err)
+		}
+		resp, err = c.readStatus()
+		if err != nil {
+			return err
+		}
+	}
+	if resp.Code != 235 {
+		return fmt.Errorf("unexpected reply during AUTH: %s", resp)
+	}
+	return nil
+}
+
+// SetMaxAuthAttempts limits how many mechanisms Authenticate tries before
+// giving up, so that falling back does not lock the account (0 for no limit)
+func (c *SMTPClient) SetMaxAuthAttempts(n int) {
+	c.maxAuthAttempts = n
+}
+
+// authCandidates returns the mechanisms to try for authType in order: the
+// given one followed by the other advertised ones, or for AuthAuto the
+// advertised ones, strongest first
+func (c *SMTPClient) authCandidates(authType string) []string {
+	// An access token is no password, so XOAUTH2 never falls back
+	if authType == "xoauth2" {
+		return []string{authType}
+	}
+	var mechs []string
+	if authType != AuthAuto {
+		mechs = append(mechs, authType)
+	}
+	advertised, _ := c.capabilities.extension("AUTH")
+	for _, mech := range authStrength {
+		if mech == authType {
+			continue
+		}
+		for _, offered := range advertised {
+			if strings.EqualFold(offered, mech) {
+				mechs = append(mechs, mech)
+				break
+			}
+		}
+	}
+	return mechs
+}
+
+// isAuthRejected reports whether the server refused the mechanism or the
+// credentials, rather than failing in a way another mechanism would not fix
+func isAuthRejected(err error) bool {
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) {
+		return false
+	}
+	switch smtpErr.Code {
+	case 504, 534, 535:
+		return true
+	}
+	return false
+}
+
+// authenticate runs the AUTH exchange for the given mechanism. Each step
+// answers a 334 challenge and the exchange ends with 235 or a failure reply.
+func (c *SMTPClient) authenticate(authType, username, password string) error {
 	// Create authenticator
 	authenticator, err := auth.NewAuthenticator(authType)
 	if err != nil {
 		return fmt.Errorf("failed to create authenticator: %v", err)
 	}
 
+	// XOAUTH2 sends its only response with the command
+	if authType == "xoauth2" {
+		return c.authenticateXOAuth2(authenticator, username, password)
+	}
+
 	// Send AUTH command
 	cmd := fmt.Sprintf("AUTH %s", authenticator.Type())
 	err = c.SendCommand(cmd)
 	if err != nil {
 		return fmt.Errorf("failed to send AUTH command: %v", err)
 	}
+	challenge, err := c.readChallenge()
+	if err != nil {
+		return err
+	}
 
 	// Handle different authentication methods
 	switch authType {
@@ -238,8 +785,6 @@ func (c *SMTPClient) Authenticate(authType, username, password string) error {
 		if err != nil {
 			return fmt.Errorf("failed to send PLAIN auth response: %v", err)
 		}
-		_, err = c.readResponse()
-		return err
 
 	case "login":
 		// First step: send username
@@ -251,8 +796,7 @@ func (c *SMTPClient) Authenticate(authType, username, password string) error {
 		if err != nil {
 			return fmt.Errorf("failed to send LOGIN username: %v", err)
 		}
-		_, err = c.readResponse()
-		if err != nil {
+		if _, err := c.readChallenge(); err != nil {
 			return err
 		}
 
@@ -262,18 +806,10 @@ func (c *SMTPClient) Authenticate(authType, username, password string) error {
 		if err != nil {
 			return fmt.Errorf("failed to send LOGIN password: %v", err)
 		}
-		_, err = c.readResponse()
-		return err
 
 	case "cram-md5":
-		// Get challenge from server
-		challenge, err := c.readResponse()
-		if err != nil {
-			return fmt.Errorf("failed to read CRAM-MD5 challenge: %v", err)
-		}
-
-		// Generate and send response
-		response, err := authenticator.(*auth.CRAMMD5Authenticator).GenerateResponse(challenge, username, password)
+		// Answer the server's challenge
+		response, err := authenticator.(*auth.CRAMMD5Authenticator).GenerateResponse(challenge.Lines[0], username, password)
 		if err != nil {
 			return fmt.Errorf("failed to generate CRAM-MD5 response: %v", err)
 		}
@@ -281,12 +817,25 @@ func (c *SMTPClient) Authenticate(authType, username, password string) error {
 		if err != nil {
 			return fmt.Errorf("failed to send CRAM-MD5 response: %v", err)
 		}
-		_, err = c.readResponse()
-		return err
 
 	default:
 		return fmt.Errorf("unsupported authentication type: %s", authType)
 	}
+
+	_, err = c.readStatus()
+	return err
+}
+
+// readChallenge reads a 334 reply carrying the next step of an AUTH exchange
+func (c *SMTPClient) readChallenge() (*Response, error) {
+	resp, err := c.readStatus()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != 334 {
+		return nil, fmt.Errorf("unexpected reply during AUTH: %s", resp)
+	}
+	return resp, nil
 }
 
 // Close closes the SMTP connection
@@ -299,18 +848,18 @@ func (c *SMTPClient) Close() error {
 
 // SendCommand sends a command to the SMTP server
 func (c *SMTPClient) SendCommand(cmd string) error {
-	if c.debug {
-		fmt.Printf("C: %s\n", cmd)
-	}
+	c.debugf("C: %s\n", c.redacted(cmd))
 
 	_, err := c.writer.WriteString(cmd + "\r\n")
 	if err != nil {
-		return fmt.Errorf("failed to write command: %v", err)
+		c.connLost = c.connLost || isConnClosed(err)
+		return fmt.Errorf("failed to write command: %w", err)
 	}
 
 	err = c.writer.Flush()
 	if err != nil {
-		return fmt.Errorf("failed to flush command: %v", err)
+		c.connLost = c.connLost || isConnClosed(err)
+		return fmt.Errorf("failed to flush command: %w", err)
 	}
 
 	return nil
@@ -318,14 +867,34 @@ func (c *SMTPClient) SendCommand(cmd string) error {
 
 // readResponse reads the server's response
 func (c *SMTPClient) readResponse() (string, error) {
-	line, err := c.reader.ReadString('\n')
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %v", err)
+	// Give every response the full I/O timeout, however long the session has been open
+	if c.ioTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.ioTimeout))
 	}
 
-	if c.debug {
-		fmt.Printf("S: %s", line)
+	// Read the line in buffer-sized chunks so a line without CRLF cannot grow without bound
+	var buf []byte
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		buf = append(buf, chunk...)
+		if c.maxLineLength > 0 && len(buf) > c.maxLineLength {
+			// The rest of the line is still unread, so the connection cannot be reused
+			c.connLost = true
+			return "", fmt.Errorf("response line exceeds %d bytes", c.maxLineLength)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			// A reply that times out may still arrive later, leaving the session out of step
+			c.connLost = c.connLost || isConnClosed(err) || isTimeout(err)
+			return "", fmt.Errorf("failed to read response: %w", err)
+		}
+		break
 	}
+	line := string(buf)
+
+	c.debugf("S: %s", c.redacted(line))
 
 	return line, nil
 }
@@ -346,9 +915,16 @@ func (c *SMTPClient) Helo() error {
 func (c *SMTPClient) parseCapabilities(response string) {
 	c.capabilities = ServerCapabilities{}
 	lines := strings.Split(response, "\r\n")
+	greeting := true
 	for _, line := range lines {
 		if strings.HasPrefix(line, "250-") || strings.HasPrefix(line, "250 ") {
 			capability := strings.TrimPrefix(strings.TrimPrefix(line, "250-"), "250 ")
+			// The first line carries the server's domain rather than an extension
+			if greeting {
+				greeting = false
+				continue
+			}
+			c.capabilities.Extensions = append(c.capabilities.Extensions, capability)
 			switch {
 			case strings.HasPrefix(capability, "PIPELINING"):
 				c.capabilities.Pipelining = true
@@ -362,6 +938,10 @@ func (c *SMTPClient) parseCapabilities(response string) {
 				}
 			case strings.HasPrefix(capability, "8BITMIME"):
 				c.capabilities.EightBit = true
+			case strings.HasPrefix(capability, "DSN"):
+				c.capabilities.DSN = true
+			case strings.HasPrefix(capability, "CHUNKING"):
+				c.capabilities.Chunking = true
 			}
 		}
 	}
@@ -369,13 +949,32 @@ func (c *SMTPClient) parseCapabilities(response string) {
 
 // Ehlo sends the EHLO command to the server and parses capabilities
 func (c *SMTPClient) Ehlo() error {
-	cmd := fmt.Sprintf("EHLO %s", c.hostname)
+	err := c.ehlo(c.hostname)
+	rejected := c.hostname
+	for _, name := range c.ehloFallbacks {
+		if !isEhloNameRejected(err) || c.connLost {
+			break
+		}
+		c.debugf("EHLO %s rejected; retrying as %s\n", rejected, name)
+		rejected = name
+		if err = c.ehlo(name); err == nil {
+			// Later EHLO and HELO commands, e.g. after STARTTLS, use the accepted name
+			c.hostname = name
+		}
+	}
+	return err
+}
+
+// ehlo sends EHLO with the given name and records the capabilities advertised
+func (c *SMTPClient) ehlo(name string) error {
+	cmd := fmt.Sprintf("EHLO %s", name)
 	err := c.SendCommand(cmd)
 	if err != nil {
 		return err
 	}
 
 	var response strings.Builder
+	var lines []string
 	// Read all response lines until we get a final response
 	for {
 		line, err := c.readResponse()
@@ -383,10 +982,15 @@ func (c *SMTPClient) Ehlo() error {
 			return err
 		}
 		response.WriteString(line)
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) >= 4 {
+			lines = append(lines, line[4:])
+		}
 		// Check if this is the final response line
 		if len(line) >= 4 && line[3] == ' ' {
 			if line[0] != '2' {
-				return fmt.Errorf("server rejected EHLO: %s", line)
+				code, _ := strconv.Atoi(line[:3])
+				return fmt.Errorf("server rejected EHLO: %w", &SMTPError{Code: code, Lines: lines})
 			}
 			break
 		}
@@ -397,59 +1001,102 @@ func (c *SMTPClient) Ehlo() error {
 	return nil
 }
 
+// isEhloNameRejected reports whether err is an EHLO rejection that another
+// name could get past: 501 for an invalid name, or a 550, 553 or 554 policy
+// refusal such as for a name that does not resolve or looks dynamic
+func isEhloNameRejected(err error) bool {
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) {
+		return false
+	}
+	switch smtpErr.Code {
+	case 501, 550, 553, 554:
+		return true
+	}
+	return false
+}
+
+// SetEhloFallbackNames sets names to try in turn when the server rejects the
+// EHLO name with a policy error
+func (c *SMTPClient) SetEhloFallbackNames(names []string) {
+	c.ehloFallbacks = names
+}
+
+// mailFromCommand returns the MAIL FROM command for from, with any parameters
+// the server supports, or the legacy command set in its place
+func (c *SMTPClient) mailFromCommand(from string) string {
+	if c.legacyCommand != "" {
+		return mailCommand(c.legacyCommand, from, nil)
+	}
+	return mailCommand("MAIL", from, c.mailParameters(c.messageSize, c.eightBit))
+}
+
+// xtext encodes s for an ESMTP parameter value (RFC 3461 section 4)
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch < '!' || ch > '~' || ch == '+' || ch == '=' {
+			fmt.Fprintf(&b, "+%02X", ch)
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	return b.String()
+}
+
 // MailFrom sends the MAIL FROM command
 func (c *SMTPClient) MailFrom(from string) error {
-	cmd := fmt.Sprintf("MAIL FROM:<%s>", from)
+	cmd := c.mailFromCommand(from)
 	err := c.SendCommand(cmd)
 	if err != nil {
 		return err
 	}
 
-	_, err = c.readResponse()
+	_, err = c.readStatus()
 	return err
 }
 
 // RcptTo sends the RCPT TO command
 func (c *SMTPClient) RcptTo(to string) error {
-	cmd := fmt.Sprintf("RCPT TO:<%s>", to)
-	err := c.SendCommand(cmd)
+	err := c.SendCommand(rcptCommand(to, c.rcptParameters(to)))
 	if err != nil {
 		return err
 	}
 
-	_, err = c.readResponse()
+	_, err = c.readStatus()
 	return err
 }
 
-// sendMessageNonPipelined sends a message without using pipelining
-func (c *SMTPClient) sendMessageNonPipelined(msg *message.Message) error {
-	return c.withRetry("send message", func() error {
-		// Set sender
-		if err := c.MailFrom(msg.From); err != nil {
-			return fmt.Errorf("failed to set sender: %v", err)
-		}
+// sendEnvelope sends MAIL FROM and a RCPT TO for each recipient, waiting for
+// each reply in turn
+func (c *SMTPClient) sendEnvelope(msg *message.Message) error {
+	// Set sender
+	if err := c.MailFrom(msg.From); err != nil {
+		return &Error{Kind: ErrSender, Subject: msg.From, Err: err}
+	}
 
-		// Set recipients (To, Cc, and Bcc)
-		allRecipients := make([]string, 0)
-		allRecipients = append(allRecipients, msg.To...)
-		allRecipients = append(allRecipients, msg.Cc...)
-		allRecipients = append(allRecipients, msg.Bcc...)
+	// Set recipients (To, Cc, and Bcc) without duplicates
+	uniqueRecipients := msg.Recipients()
 
-		// Remove duplicates
-		seen := make(map[string]bool)
-		uniqueRecipients := make([]string, 0)
-		for _, recipient := range allRecipients {
-			if !seen[recipient] {
-				seen[recipient] = true
-				uniqueRecipients = append(uniqueRecipients, recipient)
+	// Send RCPT TO for each unique recipient
+	for _, recipient := range uniqueRecipients {
+		if err := c.RcptTo(recipient); err != nil {
+			if isReply(err) {
+				c.rcptRejected++
 			}
+			return &Error{Kind: ErrRecipient, Subject: recipient, Err: err}
 		}
+		c.rcptAccepted++
+	}
+	return nil
+}
 
-		// Send RCPT TO for each unique recipient
-		for _, recipient := range uniqueRecipients {
-			if err := c.RcptTo(recipient); err != nil {
-				return fmt.Errorf("failed to set recipient %s: %v", recipient, err)
-			}
+// sendMessageNonPipelined sends a message, built as data, without using pipelining
+func (c *SMTPClient) sendMessageNonPipelined(msg *message.Message, data string) error {
+	return c.withRetry("send message", c.transaction(func() error {
+		if err := c.sendEnvelope(msg); err != nil {
+			return err
 		}
 
 		// Send DATA command
@@ -457,40 +1104,182 @@ func (c *SMTPClient) sendMessageNonPipelined(msg *message.Message) error {
 			return fmt.Errorf("failed to send DATA command: %v", err)
 		}
 
-		// Read server response
-		_, err := c.readResponse()
+		// Only 354 invites the message content
+		resp, err := c.readStatus()
 		if err != nil {
-			return fmt.Errorf("server rejected DATA command: %v", err)
+			return &Error{Kind: ErrData, Err: err}
+		}
+		if resp.Code != 354 {
+			return &Error{Kind: ErrData, Err: unexpectedDataReply(resp)}
 		}
 
-		// Build and send message
-		messageData, err := msg.Build()
-		if err != nil {
-			return fmt.Errorf("failed to build message: %v", err)
+		// Send message data followed by the end of message marker
+		if err := c.writeData(data); err != nil {
+			return err
 		}
 
-		// Send message data
-		if err := c.SendCommand(messageData); err != nil {
-			return fmt.Errorf("failed to send message: %v", err)
+		// Read final response
+		resp, err = c.readStatus()
+		if err != nil {
+			return &Error{Kind: ErrMessage, Err: err}
 		}
+		c.finalResponse = resp
+		return nil
+	}))
+}
 
-		// Send end of message marker
-		if err := c.SendCommand("."); err != nil {
-			return fmt.Errorf("failed to send end of message marker: %v", err)
+// completeData makes sure the headers of a built message are followed by the
+// blank line that separates them from the (possibly empty) body, and that the
+// message ends with a line break
+func completeData(data string) string {
+	if !strings.Contains(data, "\r\n\r\n") {
+		// Header-only message: add the empty line that ends the header section
+		if !strings.HasSuffix(data, "\r\n") {
+			data += "\r\n"
 		}
+		return data + "\r\n"
+	}
+	if !strings.HasSuffix(data, "\r\n") {
+		data += "\r\n"
+	}
+	return data
+}
 
-		// Read final response
-		_, err = c.readResponse()
-		return err
-	})
+// stuffDots doubles the dot at the start of every line of data
+func stuffDots(data string) string {
+	if strings.HasPrefix(data, ".") {
+		data = "." + data
+	}
+	return strings.ReplaceAll(data, "\n.", "\n..")
 }
 
-// SendMessage sends a message, using pipelining if available
+// writeData transmits the message content and the end of data marker, with the
+// terminating dot on a line of its own as required by RFC 5321 section
+// 4.1.1.4. Lines starting with a dot get a second one so that none is taken
+// for the end of the data (section 4.5.2).
+func (c *SMTPClient) writeData(data string) error {
+	data = stuffDots(completeData(data))
+
+	if c.debug {
+		c.debugf("C: %s.\n", c.redacted(data))
+	}
+
+	if _, err := c.writer.WriteString(data + ".\r\n"); err != nil {
+		c.connLost = c.connLost || isConnClosed(err)
+		return fmt.Errorf("failed to send message: %w", err)
+	}
+	if err := c.writer.Flush(); err != nil {
+		c.connLost = c.connLost || isConnClosed(err)
+		return fmt.Errorf("failed to send end of message marker: %w", err)
+	}
+	return nil
+}
+
+// ErrMessageTooLarge reports a message over the SIZE limit the server advertises
+var ErrMessageTooLarge = errors.New("message too large")
+
+// ErrEightBitUnsupported reports a message with 8bit parts for a server that
+// does not advertise 8BITMIME
+var ErrEightBitUnsupported = errors.New("server does not support 8BITMIME")
+
+// SendMessage sends a message, using BDAT instead of DATA when the server
+// advertises CHUNKING and pipelining the envelope when it advertises
+// PIPELINING, each unless disabled. The message is built once, before
+// anything is sent, and every attempt sends the same content; its size in
+// bytes is declared with SIZE= when the server supports it, and a message
+// over the server's limit fails with ErrMessageTooLarge without a transaction,
+// as does one with 8bit parts, with ErrEightBitUnsupported, on a server
+// without 8BITMIME.
 func (c *SMTPClient) SendMessage(msg *message.Message) error {
-	if c.capabilities.Pipelining {
-		return c.SendMessagePipelined(msg)
+	c.greylisted = false
+	c.finalResponse = nil
+	data, err := messageContent(msg)
+	if err != nil {
+		return err
+	}
+	size := int64(len(data))
+	if limit := c.capabilities.Size; limit > 0 && size > int64(limit) {
+		return fmt.Errorf("%w: %d bytes, over the server's SIZE limit of %d", ErrMessageTooLarge, size, limit)
+	}
+	eightBit := msg.EightBit()
+	if eightBit && !c.capabilities.EightBit {
+		return fmt.Errorf("%w: the message has an attached message with 8-bit content", ErrEightBitUnsupported)
+	}
+	c.messageSize, c.eightBit = size, eightBit
+	defer func() { c.messageSize, c.eightBit = 0, false }()
+	err = c.sendMessage(msg, data)
+	greylisted, delay := IsGreylisted(err)
+	if !greylisted {
+		return err
+	}
+	if c.greylistDelay == 0 {
+		return fmt.Errorf("message was greylisted: %w", err)
+	}
+
+	// Wait as long as the server asked, then try the whole transaction once more
+	if delay == 0 {
+		delay = c.greylistDelay
+	}
+	c.debugf("Message greylisted; retrying in %s\n", delay)
+	time.Sleep(delay)
+	c.greylisted = true
+	if err := c.sendMessage(msg, data); err != nil {
+		return fmt.Errorf("message was greylisted and the retry after %s failed: %w", delay, err)
+	}
+	return nil
+}
+
+// SendWithReconnect sends a message like SendMessage, but when the connection
+// fails mid-session (the server closes it or stops responding) it connects
+// again, repeating EHLO, STARTTLS, XCLIENT and AUTH as on the first session,
+// and retries the send, up to the retry limit. Replies from the server,
+// including 5xx rejections, are returned without reconnecting. A connection
+// lost after the message content was sent may still have delivered it, so a
+// retry can deliver it twice.
+func (c *SMTPClient) SendWithReconnect(msg *message.Message) error {
+	// Each send gets a single attempt; retries happen here, on a new connection
+	retry := c.retry
+	c.retry.MaxAttempts = 1
+	defer func() { c.retry = retry }()
+
+	var err error
+	for attempt := 1; attempt <= retry.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(retry.Delay)
+			if err = c.reconnect(); err != nil {
+				c.debugf("Reconnect %d/%d failed: %s\n", attempt-1, retry.MaxAttempts-1, c.redacted(err.Error()))
+				continue
+			}
+		}
+		err = c.SendMessage(msg)
+		if err == nil || !c.connLost {
+			return err
+		}
+		c.debugf("Connection lost during send: %s\n", c.redacted(err.Error()))
 	}
-	return c.sendMessageNonPipelined(msg)
+	return fmt.Errorf("send failed after %d connection attempts: %w", retry.MaxAttempts, err)
+}
+
+// messageContent builds msg into the content sent after DATA or BDAT, before
+// dot-stuffing
+func messageContent(msg *message.Message) (string, error) {
+	built, err := msg.Build()
+	if err != nil {
+		return "", fmt.Errorf("failed to build message: %v", err)
+	}
+	return completeData(built), nil
+}
+
+// sendMessage sends a message, built as data, using BDAT or pipelining if
+// available and enabled
+func (c *SMTPClient) sendMessage(msg *message.Message, data string) error {
+	if c.capabilities.Chunking && c.chunking {
+		return c.sendMessageBDAT(msg, data)
+	}
+	if c.capabilities.Pipelining && c.pipelining {
+		return c.sendMessagePipelined(msg, data)
+	}
+	return c.sendMessageNonPipelined(msg, data)
 }
 
 // SendMessagePipelined sends a message using SMTP pipelining if supported
@@ -498,81 +1287,187 @@ func (c *SMTPClient) SendMessagePipelined(msg *message.Message) error {
 	if !c.capabilities.Pipelining {
 		return c.SendMessage(msg)
 	}
+	data, err := messageContent(msg)
+	if err != nil {
+		return err
+	}
+	return c.sendMessagePipelined(msg, data)
+}
 
-	return c.withRetry("send pipelined message", func() error {
-		// Prepare all recipients
-		allRecipients := make([]string, 0)
-		allRecipients = append(allRecipients, msg.To...)
-		allRecipients = append(allRecipients, msg.Cc...)
-		allRecipients = append(allRecipients, msg.Bcc...)
-
-		// Remove duplicates
-		seen := make(map[string]bool)
-		uniqueRecipients := make([]string, 0)
-		for _, recipient := range allRecipients {
-			if !seen[recipient] {
-				seen[recipient] = true
-				uniqueRecipients = append(uniqueRecipients, recipient)
-			}
+// sendMessagePipelined sends a message, built as data, with its envelope pipelined
+func (c *SMTPClient) sendMessagePipelined(msg *message.Message, data string) error {
+	return c.withRetry("send pipelined message", c.transaction(func() error {
+		if err := c.sendEnvelopePipelined(msg); err != nil {
+			return err
 		}
 
-		// Send MAIL FROM and all RCPT TO commands in one batch
-		if err := c.SendCommand(fmt.Sprintf("MAIL FROM:<%s>", msg.From)); err != nil {
-			return fmt.Errorf("failed to send MAIL FROM: %v", err)
+		if err := c.SendCommand("DATA"); err != nil {
+			return fmt.Errorf("failed to send DATA: %v", err)
 		}
-
-		for _, recipient := range uniqueRecipients {
-			if err := c.SendCommand(fmt.Sprintf("RCPT TO:<%s>", recipient)); err != nil {
-				return fmt.Errorf("failed to send RCPT TO: %v", err)
+		if err := c.readPipelinedReply("DATA"); err != nil {
+			if !isReply(err) {
+				return fmt.Errorf("DATA command failed: %w", err)
 			}
+			return &Error{Kind: ErrData, Err: err}
 		}
 
-		if err := c.SendCommand("DATA"); err != nil {
-			return fmt.Errorf("failed to send DATA: %v", err)
+		// Send message content
+		if err := c.writeData(data); err != nil {
+			return err
 		}
 
-		// Flush the writer to send all commands at once
-		if err := c.writer.Flush(); err != nil {
-			return fmt.Errorf("failed to flush commands: %v", err)
+		// Read final response
+		resp, err := c.readStatus()
+		if err != nil {
+			return &Error{Kind: ErrMessage, Err: err}
 		}
+		c.finalResponse = resp
+		return nil
+	}))
+}
 
-		// Read responses for MAIL FROM and all RCPT TO commands
-		_, err := c.readResponse() // MAIL FROM response
-		if err != nil {
-			return fmt.Errorf("MAIL FROM failed: %v", err)
+// sendEnvelopePipelined sends MAIL FROM and every RCPT TO in one batch, then
+// reads the replies
+func (c *SMTPClient) sendEnvelopePipelined(msg *message.Message) error {
+	// Prepare all recipients without duplicates
+	uniqueRecipients := msg.Recipients()
+
+	// Send MAIL FROM and all RCPT TO commands in one batch
+	mailCmd := c.mailFromCommand(msg.From)
+	if err := c.SendCommand(mailCmd); err != nil {
+		return fmt.Errorf("failed to send MAIL FROM: %v", err)
+	}
+
+	rcptCmds := make([]string, len(uniqueRecipients))
+	for i, recipient := range uniqueRecipients {
+		rcptCmds[i] = rcptCommand(recipient, c.rcptParameters(recipient))
+		if err := c.SendCommand(rcptCmds[i]); err != nil {
+			return fmt.Errorf("failed to send RCPT TO: %v", err)
 		}
+	}
+
+	// Flush the writer to send all commands at once
+	if err := c.writer.Flush(); err != nil {
+		c.connLost = c.connLost || isConnClosed(err)
+		return fmt.Errorf("failed to flush commands: %w", err)
+	}
 
-		for range uniqueRecipients {
-			_, err := c.readResponse() // RCPT TO response
-			if err != nil {
-				return fmt.Errorf("RCPT TO failed: %v", err)
+	// Read every reply so the session stays in step, keeping the rejections
+	var senderRejected error
+	if err := c.readPipelinedReply(mailCmd); err != nil {
+		if !isReply(err) {
+			return fmt.Errorf("MAIL FROM failed: %w", err)
+		}
+		senderRejected = &Error{Kind: ErrSender, Subject: msg.From, Err: err}
+	}
+	var rejections []error
+	for i, recipient := range uniqueRecipients {
+		if err := c.readPipelinedReply(rcptCmds[i]); err != nil {
+			if !isReply(err) {
+				return fmt.Errorf("RCPT TO failed: %w", err)
 			}
+			c.rcptRejected++
+			rejections = append(rejections, &Error{Kind: ErrRecipient, Subject: recipient, Err: err})
+			continue
 		}
+		c.rcptAccepted++
+	}
 
-		// Read DATA response
-		_, err = c.readResponse()
-		if err != nil {
-			return fmt.Errorf("DATA command failed: %v", err)
-		}
+	// The message content waits for the replies so that a rejected
+	// transaction is reset instead of ending in an empty message
+	switch {
+	case senderRejected != nil:
+		return senderRejected
+	case c.rcptAccepted == 0 && len(rejections) > 0:
+		return &RecipientsError{Rejections: rejections}
+	case len(rejections) > 0:
+		return rejections[0]
+	}
+	return nil
+}
 
-		// Send message content
-		messageData, err := msg.Build()
-		if err != nil {
-			return fmt.Errorf("failed to build message: %v", err)
-		}
+// unexpectedDataReply reports a reply to DATA other than 354 that is not an
+// error code either, as a refusal to take the message content
+func unexpectedDataReply(resp *Response) error {
+	return &SMTPError{Code: resp.Code, Lines: resp.Lines}
+}
 
-		if err := c.SendCommand(messageData); err != nil {
-			return fmt.Errorf("failed to send message: %v", err)
-		}
+// ErrPipelineDesync reports that the replies to a pipelined batch did not line
+// up with its commands, so they cannot be attributed to the right command
+var ErrPipelineDesync = errors.New("pipelining response desync")
+
+// readPipelinedReply reads the reply to one command of a pipelined batch and
+// checks that it can belong to that command. Only DATA is answered with 354 and
+// DATA is never answered with a 2xx code, so either reply means the server sent
+// fewer or more replies than commands. The session is out of step after that,
+// so the connection is dropped.
+func (c *SMTPClient) readPipelinedReply(cmd string) error {
+	resp, err := c.readStatus()
+	if resp == nil {
+		return err
+	}
 
-		if err := c.SendCommand("."); err != nil {
-			return fmt.Errorf("failed to send end of message: %v", err)
-		}
+	var problem string
+	switch {
+	case cmd != "DATA" && resp.Code == 354:
+		problem = "fewer replies than commands"
+	case cmd == "DATA" && resp.Code < 300:
+		problem = "more replies than commands"
+	case cmd == "DATA" && err == nil && resp.Code != 354:
+		return unexpectedDataReply(resp)
+	default:
+		return err
+	}
+	c.conn.Close()
+	c.connLost = true
+	return fmt.Errorf("%w: %s was answered with %q; the server sent %s",
+		ErrPipelineDesync, cmd, resp.String(), problem)
+}
 
-		// Read final response
-		_, err = c.readResponse()
+// Help sends the HELP command, optionally for a topic, and returns the full reply
+func (c *SMTPClient) Help(topic string) (*Response, error) {
+	cmd := "HELP"
+	if topic != "" {
+		cmd = fmt.Sprintf("HELP %s", topic)
+	}
+	if err := c.SendCommand(cmd); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Code != 211 && resp.Code != 214 {
+		return resp, fmt.Errorf("server rejected HELP: %s", resp)
+	}
+	return resp, nil
+}
+
+// Noop sends the NOOP command, verifying the connection is still usable
+func (c *SMTPClient) Noop() error {
+	if err := c.SendCommand("NOOP"); err != nil {
 		return err
-	})
+	}
+
+	line, err := c.readResponse()
+	if err != nil {
+		return err
+	}
+	if len(line) < 1 || line[0] != '2' {
+		return fmt.Errorf("server rejected NOOP: %s", strings.TrimSpace(line))
+	}
+	return nil
+}
+
+// Reset sends the RSET command, abandoning the current transaction
+func (c *SMTPClient) Reset() error {
+	if err := c.SendCommand("RSET"); err != nil {
+		return err
+	}
+
+	_, err := c.readStatus()
+	return err
 }
 
 // Quit sends the QUIT command
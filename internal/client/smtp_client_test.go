@@ -1,11 +1,31 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/asachs/smtp-edc/internal/auth"
 	"github.com/asachs/smtp-edc/internal/message"
 )
 
@@ -107,6 +127,68 @@ func TestSetTimeout(t *testing.T) {
 	if client.timeout != timeout {
 		t.Errorf("SetTimeout() = %v, want %v", client.timeout, timeout)
 	}
+	if client.ioTimeout != timeout {
+		t.Errorf("SetTimeout() ioTimeout = %v, want %v", client.ioTimeout, timeout)
+	}
+}
+
+func TestIOTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	// The server accepts immediately but is slow to greet and to answer NOOP
+	const delay = 200 * time.Millisecond
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				time.Sleep(delay)
+				conn.Write([]byte("220 ready\r\n"))
+				buf := make([]byte, 512)
+				if _, err := conn.Read(buf); err != nil {
+					return
+				}
+				time.Sleep(delay)
+				conn.Write([]byte("250 OK\r\n"))
+			}(conn)
+		}
+	}()
+
+	tests := []struct {
+		name           string
+		connectTimeout time.Duration
+		ioTimeout      time.Duration
+		wantErr        bool
+	}{
+		{name: "slow responses within io timeout", connectTimeout: 50 * time.Millisecond, ioTimeout: time.Second},
+		{name: "slow responses beyond io timeout", connectTimeout: time.Second, ioTimeout: 50 * time.Millisecond, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewSMTPClient("localhost", false)
+			c.SetRetryConfig(1, 0)
+			c.SetConnectTimeout(tt.connectTimeout)
+			c.SetIOTimeout(tt.ioTimeout)
+
+			err := c.Connect("127.0.0.1", port)
+			if err == nil {
+				defer c.Close()
+				err = c.Noop()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Connect/Noop error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
 }
 
 func TestConnect(t *testing.T) {
@@ -245,3 +327,2281 @@ func (m *mockConn) RemoteAddr() net.Addr               { return nil }
 func (m *mockConn) SetDeadline(t time.Time) error      { return nil }
 func (m *mockConn) SetReadDeadline(t time.Time) error  { return nil }
 func (m *mockConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// scriptedConn returns a mockConn that replays the given server responses one
+// line per read and records everything the client writes
+func scriptedConn(responses string, written *bytes.Buffer) *mockConn {
+	lines := strings.SplitAfter(responses, "\n")
+	var current *strings.Reader
+	return &mockConn{
+		readFunc: func(b []byte) (n int, err error) {
+			for current == nil || current.Len() == 0 {
+				if len(lines) == 0 || lines[0] == "" {
+					return 0, io.EOF
+				}
+				current = strings.NewReader(lines[0])
+				lines = lines[1:]
+			}
+			return current.Read(b)
+		},
+		writeFunc: func(b []byte) (n int, err error) {
+			return written.Write(b)
+		},
+	}
+}
+
+// newScriptedClient returns a connected client whose server replies are scripted
+func newScriptedClient(t *testing.T, responses string) (*SMTPClient, *bytes.Buffer) {
+	t.Helper()
+	written := &bytes.Buffer{}
+	c := NewSMTPClient("localhost", false)
+	c.retry.MaxAttempts = 1
+	c.conn = scriptedConn(responses, written)
+	if err := c.Connect("smtp.example.com", 25); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	return c, written
+}
+
+func TestHelp(t *testing.T) {
+	tests := []struct {
+		name      string
+		topic     string
+		responses string
+		wantCmd   string
+		wantLines []string
+		wantErr   bool
+	}{
+		{
+			name:  "multiline help",
+			topic: "",
+			responses: "220 ready\r\n" +
+				"214-Commands supported:\r\n" +
+				"214-  HELO EHLO MAIL RCPT DATA\r\n" +
+				"214 End of HELP info\r\n",
+			wantCmd:   "HELP\r\n",
+			wantLines: []string{"Commands supported:", "  HELO EHLO MAIL RCPT DATA", "End of HELP info"},
+		},
+		{
+			name:      "help topic",
+			topic:     "RCPT",
+			responses: "220 ready\r\n214 RCPT TO:<recipient>\r\n",
+			wantCmd:   "HELP RCPT\r\n",
+			wantLines: []string{"RCPT TO:<recipient>"},
+		},
+		{
+			name:      "help not implemented",
+			responses: "220 ready\r\n502 5.5.1 Command not implemented\r\n",
+			wantCmd:   "HELP\r\n",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, tt.responses)
+
+			resp, err := c.Help(tt.topic)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Help() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if written.String() != tt.wantCmd {
+				t.Errorf("Help() sent %q, want %q", written.String(), tt.wantCmd)
+			}
+			if tt.wantErr {
+				return
+			}
+			if resp.Code != 214 {
+				t.Errorf("Help() code = %d, want 214", resp.Code)
+			}
+			if strings.Join(resp.Lines, "|") != strings.Join(tt.wantLines, "|") {
+				t.Errorf("Help() lines = %q, want %q", resp.Lines, tt.wantLines)
+			}
+		})
+	}
+}
+
+func TestSetPipelining(t *testing.T) {
+	responses := "220 ready\r\n" +
+		"250-smtp.example.com\r\n" +
+		"250 PIPELINING\r\n" +
+		"250 OK\r\n" +
+		"250 OK\r\n" +
+		"354 Go ahead\r\n" +
+		"250 Queued\r\n"
+	c, written := newScriptedClient(t, responses)
+	if err := c.Ehlo(); err != nil {
+		t.Fatalf("Ehlo() error = %v", err)
+	}
+	if !c.capabilities.Pipelining {
+		t.Fatal("Expected PIPELINING to be advertised")
+	}
+
+	c.SetPipelining(false)
+	written.Reset()
+
+	// Capture what had been written each time the client waited for a reply
+	var snapshots []string
+	conn := c.conn.(*mockConn)
+	read := conn.readFunc
+	conn.readFunc = func(b []byte) (int, error) {
+		snapshots = append(snapshots, written.String())
+		return read(b)
+	}
+
+	msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+	if err := c.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	if len(snapshots) == 0 || snapshots[0] != "MAIL FROM:<from@example.com>\r\n" {
+		t.Errorf("Expected the client to wait for the MAIL FROM reply before sending more, got %q", snapshots)
+	}
+}
+
+func TestSendMessageEmptyBodyFraming(t *testing.T) {
+	responses := "220 ready\r\n" +
+		"250 OK\r\n" +
+		"250 OK\r\n" +
+		"354 Go ahead\r\n" +
+		"250 Queued\r\n"
+	c, written := newScriptedClient(t, responses)
+
+	msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Header only", "")
+	if err := c.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	wire := written.String()
+	data := wire[strings.Index(wire, "DATA\r\n")+len("DATA\r\n"):]
+	if !strings.HasSuffix(data, "\r\n\r\n.\r\n") {
+		t.Errorf("Expected headers, a blank line and the terminating dot, got %q", data)
+	}
+	if strings.Contains(data, "\r\n\r\n\r\n") {
+		t.Errorf("Expected exactly one blank line before the terminating dot, got %q", data)
+	}
+	if strings.Count(data, "\r\n.\r\n") != 1 {
+		t.Errorf("Expected a single end of data marker, got %q", data)
+	}
+}
+
+func TestSendMessageDotStuffing(t *testing.T) {
+	responses := "220 ready\r\n" +
+		"250 OK\r\n" +
+		"250 OK\r\n" +
+		"354 Go ahead\r\n" +
+		"250 Queued\r\n"
+	c, written := newScriptedClient(t, responses)
+
+	msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Dots", "before\n.\nafter\n")
+	if err := c.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	wire := written.String()
+	data := wire[strings.Index(wire, "DATA\r\n")+len("DATA\r\n"):]
+	if !strings.Contains(data, "\r\nbefore\r\n..\r\nafter\r\n.\r\n") {
+		t.Errorf("Expected the lone dot to be doubled, got %q", data)
+	}
+	if strings.Count(data, "\r\n.\r\n") != 1 {
+		t.Errorf("Expected a single end of data marker, got %q", data)
+	}
+}
+
+func TestDataReplyMustBe354(t *testing.T) {
+	tests := []struct {
+		name     string
+		ehlo     string
+		data     string
+		wantText string
+	}{
+		{name: "bad sequence", ehlo: "250 8BITMIME\r\n", data: "503 5.5.1 Bad sequence of commands\r\n", wantText: "503 5.5.1 Bad sequence"},
+		{name: "other 3xx", ehlo: "250 8BITMIME\r\n", data: "334 Go on\r\n", wantText: "DATA command rejected: server replied 334 Go on"},
+		{name: "bad sequence, pipelined", ehlo: "250 PIPELINING\r\n", data: "503 5.5.1 Bad sequence of commands\r\n", wantText: "503 5.5.1 Bad sequence"},
+		{name: "other 3xx, pipelined", ehlo: "250 PIPELINING\r\n", data: "334 Go on\r\n", wantText: "DATA command rejected: server replied 334 Go on"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n"+tt.ehlo+
+				"250 OK\r\n250 OK\r\n"+tt.data+"250 Reset\r\n")
+			c.SetRetryConfig(1, 0)
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+
+			msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Secret body")
+			err := c.SendMessage(msg)
+			var sendErr *Error
+			if !errors.As(err, &sendErr) || sendErr.Kind != ErrData || !strings.Contains(err.Error(), tt.wantText) {
+				t.Fatalf("SendMessage() error = %v, want a DATA error with %q", err, tt.wantText)
+			}
+			wire := written.String()
+			if strings.Contains(wire, "Secret body") || strings.Contains(wire, "Subject:") {
+				t.Errorf("Expected the message content not to be sent, got %q", wire)
+			}
+			if !strings.HasSuffix(wire, "RSET\r\n") {
+				t.Errorf("Expected the transaction to be reset, got %q", wire)
+			}
+		})
+	}
+}
+
+func TestStuffDots(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{data: "Body\n.hidden\n", want: "Body\n..hidden\n"},
+		{data: ".start of section\r\n", want: "..start of section\r\n"},
+		{data: "a\r\n.\r\n..two\r\n", want: "a\r\n..\r\n...two\r\n"},
+		{data: "no dots. here\r\n", want: "no dots. here\r\n"},
+	}
+
+	for _, tt := range tests {
+		if got := stuffDots(tt.data); got != tt.want {
+			t.Errorf("stuffDots(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestSendMessageHiddenLine(t *testing.T) {
+	for _, pipelining := range []bool{false, true} {
+		ehlo := "250 8BITMIME\r\n"
+		if pipelining {
+			ehlo = "250 PIPELINING\r\n"
+		}
+		c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n"+ehlo+
+			"250 OK\r\n250 OK\r\n354 Go ahead\r\n250 Queued\r\n")
+		if err := c.Ehlo(); err != nil {
+			t.Fatalf("Ehlo() error = %v", err)
+		}
+
+		msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Dots", "before\n.hidden\nafter")
+		if err := c.SendMessage(msg); err != nil {
+			t.Fatalf("SendMessage() with pipelining %t error = %v", pipelining, err)
+		}
+		if wire := written.String(); !strings.Contains(wire, "\n..hidden\r\n") {
+			t.Errorf("Expected the line to be dot-stuffed with pipelining %t, got %q", pipelining, wire)
+		}
+	}
+}
+
+// testCertificate returns a self-signed certificate for the given host names
+func testCertificate(t *testing.T, hosts ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		DNSNames:              hosts,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// startTLSServer starts a server that greets, accepts STARTTLS and completes
+// the TLS handshake with config, returning its port
+func startTLSServer(t *testing.T, config *tls.Config) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "220 ready\r\n")
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			return
+		}
+		fmt.Fprint(conn, "220 Go ahead\r\n")
+		tlsConn := tls.Server(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return
+		}
+		io.Copy(io.Discard, tlsConn)
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestStartTLSServerName(t *testing.T) {
+	tests := []struct {
+		name       string
+		serverName string
+		want       string
+	}{
+		{name: "defaults to connect host", want: "localhost"},
+		{name: "override", serverName: "mail.example.com", want: "mail.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := testCertificate(t, "mail.example.com")
+			sni := make(chan string, 1)
+			port := startTLSServer(t, &tls.Config{
+				GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+					sni <- hello.ServerName
+					return &cert, nil
+				},
+			})
+
+			c := NewSMTPClient("localhost", false)
+			c.SetRetryConfig(1, 0)
+			c.SetSkipVerify(true)
+			c.SetTLSServerName(tt.serverName)
+			if err := c.Connect("localhost", port); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer c.Close()
+			if err := c.StartTLS(); err != nil {
+				t.Fatalf("StartTLS() error = %v", err)
+			}
+
+			if got := <-sni; got != tt.want {
+				t.Errorf("SNI = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// testCA creates a CA certificate and key, returning the certificate as PEM
+func testCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse CA certificate: %v", err)
+	}
+	return ca, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// testLeaf creates a server certificate for host signed by ca
+func testLeaf(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, host string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestLoadRootCAsFromDir(t *testing.T) {
+	caOne, keyOne, pemOne := testCA(t, "CA One")
+	caTwo, keyTwo, pemTwo := testCA(t, "CA Two")
+	caOther, keyOther, _ := testCA(t, "Untrusted CA")
+
+	dir := t.TempDir()
+	for name, data := range map[string][]byte{
+		"one.pem":    pemOne,
+		"two.crt":    pemTwo,
+		"README.txt": []byte("not a certificate"),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	pool, warnings, err := LoadRootCAs("", dir)
+	if err != nil {
+		t.Fatalf("LoadRootCAs() error = %v", err)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "README.txt") {
+		t.Errorf("warnings = %v, want one for README.txt", warnings)
+	}
+
+	tests := []struct {
+		name    string
+		cert    tls.Certificate
+		wantErr bool
+	}{
+		{name: "signed by first CA", cert: testLeaf(t, caOne, keyOne, "localhost")},
+		{name: "signed by second CA", cert: testLeaf(t, caTwo, keyTwo, "localhost")},
+		{name: "signed by unknown CA", cert: testLeaf(t, caOther, keyOther, "localhost"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := startTLSServer(t, &tls.Config{Certificates: []tls.Certificate{tt.cert}})
+
+			c := NewSMTPClient("localhost", false)
+			c.SetRetryConfig(1, 0)
+			c.SetRootCAs(pool)
+			if err := c.Connect("localhost", port); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer c.Close()
+			if err := c.StartTLS(); (err != nil) != tt.wantErr {
+				t.Errorf("StartTLS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if _, _, err := LoadRootCAs("", t.TempDir()); err == nil {
+		t.Error("LoadRootCAs() accepted a directory without certificates")
+	}
+}
+
+func TestMultilineGreeting(t *testing.T) {
+	c, _ := newScriptedClient(t, "220-mail.example.com ESMTP\r\n"+
+		"220-Unauthorized use is prohibited\r\n"+
+		"220 Ready\r\n"+
+		"250-mail.example.com Hello\r\n"+
+		"250-PIPELINING\r\n"+
+		"250 STARTTLS\r\n")
+
+	if err := c.Ehlo(); err != nil {
+		t.Fatalf("Ehlo() error = %v", err)
+	}
+	caps := c.Capabilities()
+	if !caps.Pipelining || !caps.StartTLS {
+		t.Errorf("capabilities = %+v, want PIPELINING and STARTTLS", caps)
+	}
+	if want := []string{"PIPELINING", "STARTTLS"}; strings.Join(caps.Extensions, ",") != strings.Join(want, ",") {
+		t.Errorf("extensions = %v, want %v", caps.Extensions, want)
+	}
+}
+
+func TestReconnectAfterDisconnect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+
+	connections := make(chan int, 2)
+	go func() {
+		for n := 1; n <= 2; n++ {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			connections <- n
+			go func(n int, conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				fmt.Fprint(conn, "220 ready\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+					case strings.HasPrefix(cmd, "RCPT") && n == 1:
+						// Drop the first connection mid-transaction
+						return
+					case cmd == "DATA":
+						fmt.Fprint(conn, "354 go ahead\r\n")
+						for {
+							line, err := r.ReadString('\n')
+							if err != nil || line == ".\r\n" {
+								break
+							}
+						}
+						fmt.Fprint(conn, "250 queued\r\n")
+					case cmd == "QUIT":
+						fmt.Fprint(conn, "221 bye\r\n")
+						return
+					default:
+						fmt.Fprint(conn, "250 OK\r\n")
+					}
+				}
+			}(n, conn)
+		}
+	}()
+
+	c := NewSMTPClient("localhost", false)
+	c.SetRetryConfig(2, 0)
+	if err := c.Connect("127.0.0.1", ln.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.Ehlo(); err != nil {
+		t.Fatalf("Ehlo() error = %v", err)
+	}
+
+	msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+	if err := c.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage() error = %v, want success after reconnecting", err)
+	}
+	if len(connections) != 2 {
+		t.Errorf("server saw %d connection(s), want a reconnect after the disconnect", len(connections))
+	}
+}
+
+func TestMaxLineLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		reply   string
+		wantErr string
+	}{
+		{name: "within limit", limit: 1024, reply: "250 " + strings.Repeat("a", 900) + "\r\n"},
+		{name: "over limit", limit: 1024, reply: "250 " + strings.Repeat("a", 10000) + "\r\n", wantErr: "exceeds 1024 bytes"},
+		{name: "over limit without CRLF", limit: 1024, reply: strings.Repeat("a", 10000), wantErr: "exceeds 1024 bytes"},
+		{name: "unlimited", limit: 0, reply: "250 " + strings.Repeat("a", 10000) + "\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newScriptedClient(t, "220 ready\r\n"+tt.reply)
+			c.SetMaxLineLength(tt.limit)
+
+			_, err := c.readResponse()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("readResponse() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("readResponse() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMailFromAuthParameter(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity string
+		ehlo     string
+		want     string
+	}{
+		{name: "address", identity: "submitter@example.com", ehlo: "250 AUTH PLAIN LOGIN\r\n", want: "MAIL FROM:<from@example.com> AUTH=submitter@example.com\r\n"},
+		{name: "anonymous", identity: "<>", ehlo: "250 AUTH PLAIN\r\n", want: "MAIL FROM:<from@example.com> AUTH=<>\r\n"},
+		{name: "xtext encoded", identity: "a+b=c@example.com", ehlo: "250 AUTH PLAIN\r\n", want: "MAIL FROM:<from@example.com> AUTH=a+2Bb+3Dc@example.com\r\n"},
+		{name: "server without AUTH", identity: "submitter@example.com", ehlo: "250 SIZE 1000\r\n", want: "MAIL FROM:<from@example.com>\r\n"},
+		{name: "not set", ehlo: "250 AUTH PLAIN\r\n", want: "MAIL FROM:<from@example.com>\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n"+tt.ehlo+"250 OK\r\n")
+			c.SetMailAuth(tt.identity)
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+			written.Reset()
+
+			if err := c.MailFrom("from@example.com"); err != nil {
+				t.Fatalf("MailFrom() error = %v", err)
+			}
+			if got := written.String(); got != tt.want {
+				t.Errorf("MAIL FROM = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsGreylisted(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		want      bool
+		wantDelay time.Duration
+	}{
+		{name: "enhanced status", err: &SMTPError{Code: 451, Lines: []string{"4.7.1 Please try again later"}}, want: true},
+		{name: "postgrey", err: &SMTPError{Code: 450, Lines: []string{"4.2.0 <to@example.com>: Recipient address rejected: Greylisted"}}, want: true},
+		{name: "suggested seconds", err: &SMTPError{Code: 451, Lines: []string{"Greylisted, try again in 300 seconds"}}, want: true, wantDelay: 300 * time.Second},
+		{name: "suggested minutes", err: &SMTPError{Code: 451, Lines: []string{"4.7.1 graylisted, please retry after 2 minutes"}}, want: true, wantDelay: 2 * time.Minute},
+		{name: "wrapped", err: fmt.Errorf("failed to set recipient: %w", &SMTPError{Code: 451, Lines: []string{"4.7.1 greylisted"}}), want: true},
+		{name: "other temporary failure", err: &SMTPError{Code: 451, Lines: []string{"4.3.0 Local error in processing"}}},
+		{name: "permanent failure", err: &SMTPError{Code: 550, Lines: []string{"5.7.1 greylisted forever"}}},
+		{name: "not a reply", err: errors.New("connection reset")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, delay := IsGreylisted(tt.err)
+			if got != tt.want || delay != tt.wantDelay {
+				t.Errorf("IsGreylisted() = %v, %s, want %v, %s", got, delay, tt.want, tt.wantDelay)
+			}
+		})
+	}
+}
+
+func TestGreylistRetry(t *testing.T) {
+	responses := "220 ready\r\n" +
+		"250 mail.example.com\r\n" + // EHLO
+		"250 OK\r\n" + // MAIL FROM
+		"451 4.7.1 Greylisted, please try again later\r\n" + // RCPT TO
+		"250 OK\r\n" + // RSET
+		"250 OK\r\n" + // MAIL FROM
+		"250 OK\r\n" + // RCPT TO
+		"354 go ahead\r\n" + // DATA
+		"250 queued\r\n"
+
+	c, written := newScriptedClient(t, responses)
+	c.SetGreylistRetry(10 * time.Millisecond)
+	if err := c.Ehlo(); err != nil {
+		t.Fatalf("Ehlo() error = %v", err)
+	}
+
+	msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+	if err := c.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage() error = %v, want acceptance on retry", err)
+	}
+	if !c.Session().Greylisted {
+		t.Error("Session().Greylisted = false, want the deferral reported")
+	}
+	sent := written.String()
+	if strings.Count(sent, "MAIL FROM:") != 2 || !strings.Contains(sent, "RSET\r\n") {
+		t.Errorf("commands = %q, want RSET and a second transaction", sent)
+	}
+
+	// Without greylist handling the deferral is reported as such
+	c, _ = newScriptedClient(t, "220 ready\r\n250 OK\r\n451 4.7.1 Greylisted\r\n250 OK\r\n")
+	err := c.SendMessage(msg)
+	if err == nil || !strings.Contains(err.Error(), "greylisted") {
+		t.Errorf("SendMessage() error = %v, want a greylisting error", err)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "no error"},
+		{name: "transient reply", err: &SMTPError{Code: 451, Lines: []string{"4.3.0 Try again later"}}, want: true},
+		{name: "permanent reply", err: &SMTPError{Code: 550, Lines: []string{"5.1.1 Mailbox does not exist"}}},
+		{name: "wrapped permanent reply", err: &Error{Kind: ErrRecipient, Subject: "to@example.com", Err: &SMTPError{Code: 550}}},
+		{name: "connection lost", err: fmt.Errorf("failed to read response: %w", io.EOF), want: true},
+		{name: "timeout", err: fmt.Errorf("failed to read response: %w", os.ErrDeadlineExceeded), want: true},
+		{name: "connection refused", err: &Error{Kind: ErrConnect, Subject: "localhost:25", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}, want: true},
+		{name: "message not built", err: fmt.Errorf("failed to build message: %v", errors.New("subject is required"))},
+		{name: "pipelining desync", err: fmt.Errorf("%w: unexpected reply", ErrPipelineDesync)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryOnlyTransientFailures(t *testing.T) {
+	tests := []struct {
+		name      string
+		subject   string
+		responses string
+		wantErr   bool
+		wantMail  int
+	}{
+		{
+			name:    "permanent rejection fails fast",
+			subject: "Subject",
+			responses: "550 5.1.1 Mailbox does not exist\r\n" + // MAIL FROM
+				"250 OK\r\n", // RSET
+			wantErr:  true,
+			wantMail: 1,
+		},
+		{
+			name:    "transient rejection is retried",
+			subject: "Subject",
+			responses: "451 4.3.0 Try again later\r\n" + // MAIL FROM
+				"250 OK\r\n" + // RSET
+				"250 OK\r\n" + // MAIL FROM
+				"250 OK\r\n" + // RCPT TO
+				"354 go ahead\r\n" + // DATA
+				"250 queued\r\n",
+			wantMail: 2,
+		},
+		{
+			// Building fails the same way every time, so nothing is sent
+			name:     "message that cannot be built fails fast",
+			wantErr:  true,
+			wantMail: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, "220 ready\r\n"+tt.responses)
+			c.SetRetryConfig(3, 0)
+
+			msg := message.NewMessage("from@example.com", []string{"to@example.com"}, tt.subject, "Body")
+			err := c.SendMessage(msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SendMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := strings.Count(written.String(), "MAIL FROM:"); got != tt.wantMail {
+				t.Errorf("MAIL FROM sent %d times, want %d", got, tt.wantMail)
+			}
+		})
+	}
+}
+
+func TestRetryKeepsMessageID(t *testing.T) {
+	c, written := newScriptedClient(t, "220 ready\r\n"+
+		"250 OK\r\n250 OK\r\n354 go ahead\r\n"+ // MAIL FROM, RCPT TO, DATA
+		"451 4.3.0 Try again later\r\n"+ // end of message
+		"250 OK\r\n"+ // RSET
+		"250 OK\r\n250 OK\r\n354 go ahead\r\n250 queued\r\n")
+	c.SetRetryConfig(2, 0)
+
+	msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+	if err := c.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	ids := regexp.MustCompile(`Message-ID: (\S+)`).FindAllStringSubmatch(written.String(), -1)
+	if len(ids) != 2 || ids[0][1] != ids[1][1] {
+		t.Errorf("Message-IDs sent = %q, want the same one on both attempts", ids)
+	}
+}
+
+func TestRetryReconnectRefused(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// Refuse the redial, then drop the session at MAIL FROM
+		ln.Close()
+		fmt.Fprint(conn, "220 ready\r\n")
+		bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+	}()
+
+	c := NewSMTPClient("localhost", false)
+	c.SetRetryConfig(3, 0)
+	c.SetIOTimeout(time.Second)
+	if err := c.Connect("127.0.0.1", ln.Addr().(*net.TCPAddr).Port); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+	err = c.SendMessage(msg)
+	if err == nil || !strings.Contains(err.Error(), "failed to reconnect") {
+		t.Fatalf("SendMessage() error = %v, want the failed reconnect", err)
+	}
+	if c.Reusable() {
+		t.Error("Reusable() = true after the reconnect failed")
+	}
+}
+
+func TestCapabilityCheck(t *testing.T) {
+	reqs, err := ParseCapabilityRequirements(strings.NewReader("# required\nSTARTTLS\nauth login\nSIZE>=10485760\n"))
+	if err != nil {
+		t.Fatalf("ParseCapabilityRequirements() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		extensions []string
+		tlsActive  bool
+		want       []string
+	}{
+		{
+			name:       "all met",
+			extensions: []string{"STARTTLS", "AUTH PLAIN LOGIN", "SIZE 52428800"},
+		},
+		{
+			name:       "missing capability",
+			extensions: []string{"AUTH PLAIN LOGIN", "SIZE 52428800"},
+			want:       []string{"STARTTLS: not advertised"},
+		},
+		{
+			name:       "missing parameter",
+			extensions: []string{"STARTTLS", "AUTH PLAIN", "SIZE 52428800"},
+			want:       []string{"AUTH LOGIN: server advertises AUTH PLAIN"},
+		},
+		{
+			name:       "size too small",
+			extensions: []string{"STARTTLS", "AUTH LOGIN", "SIZE 1000"},
+			want:       []string{"SIZE>=10485760: server advertises SIZE 1000"},
+		},
+		{
+			name:       "unlimited size and STARTTLS already in use",
+			extensions: []string{"AUTH LOGIN", "SIZE 0"},
+			tlsActive:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			caps := ServerCapabilities{Extensions: tt.extensions}
+			if got := caps.Check(reqs, tt.tlsActive); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Check() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseCapabilityRequirements(strings.NewReader("SIZE>=lots\n")); err == nil {
+		t.Error("ParseCapabilityRequirements() accepted a non-numeric minimum")
+	}
+}
+
+func TestDisplayNamesInHeadersOnly(t *testing.T) {
+	c, written := newScriptedClient(t, "220 ready\r\n"+
+		"250 OK\r\n"+ // MAIL FROM
+		"250 OK\r\n"+ // RCPT TO
+		"354 go ahead\r\n"+
+		"250 queued\r\n")
+
+	msg := message.NewMessage("support@example.com", []string{"pat@example.com"}, "Subject", "Body")
+	msg.FromName = "Support Team"
+	msg.ToNames = []string{"O'Brien, Pat"}
+	if err := c.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	sent := written.String()
+	for _, want := range []string{
+		"MAIL FROM:<support@example.com>\r\n",
+		"RCPT TO:<pat@example.com>\r\n",
+		"From: \"Support Team\" <support@example.com>\r\n",
+		"To: \"O'Brien, Pat\" <pat@example.com>\r\n",
+	} {
+		if !strings.Contains(sent, want) {
+			t.Errorf("session missing %q:\n%s", want, sent)
+		}
+	}
+}
+
+func TestEnvelopeMatchesSession(t *testing.T) {
+	c, written := newScriptedClient(t, "220 ready\r\n"+
+		"250-mail.example.com\r\n250 AUTH PLAIN\r\n"+
+		"250 OK\r\n"+ // MAIL FROM
+		"250 OK\r\n"+ // RCPT TO
+		"250 OK\r\n"+ // RCPT TO
+		"354 go ahead\r\n"+
+		"250 queued\r\n")
+	c.SetMailAuth("submitter@example.com")
+	if err := c.Ehlo(); err != nil {
+		t.Fatalf("Ehlo() error = %v", err)
+	}
+	written.Reset()
+
+	msg := message.NewMessage("from@example.com", []string{"a@example.com", "a@EXAMPLE.com"}, "Subject", "Body")
+	msg.Cc = []string{"b@example.com"}
+	envelope := c.Envelope(msg)
+	if err := c.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	want := []string{"MAIL FROM:<from@example.com> AUTH=submitter@example.com", "RCPT TO:<a@example.com>", "RCPT TO:<b@example.com>"}
+	if got := envelope.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Commands() = %q, want %q", got, want)
+	}
+	if !strings.HasPrefix(written.String(), strings.Join(want, "\r\n")+"\r\nDATA\r\n") {
+		t.Errorf("session does not match the envelope:\n%s", written.String())
+	}
+}
+
+func TestCheckServerName(t *testing.T) {
+	ca, caKey, caPEM := testCA(t, "Test CA")
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caPEM)
+	cert := testLeaf(t, ca, caKey, "mail.example.com")
+
+	tests := []struct {
+		name         string
+		serverName   string
+		rootCAs      *x509.CertPool
+		wantVerified bool
+		wantMatched  bool
+		wantHostErr  bool
+	}{
+		{name: "mismatched name", serverName: "wrong.example.com", rootCAs: pool, wantHostErr: true},
+		{name: "matching name", serverName: "mail.example.com", rootCAs: pool, wantVerified: true, wantMatched: true},
+		{name: "matching name, untrusted chain", serverName: "mail.example.com", wantMatched: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := startTLSServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+			c := NewSMTPClient("localhost", false)
+			c.SetRetryConfig(1, 0)
+			if tt.rootCAs != nil {
+				c.SetRootCAs(tt.rootCAs)
+			}
+			if err := c.Connect("localhost", port); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer c.Close()
+
+			result, err := c.CheckServerName(tt.serverName)
+			if err != nil {
+				t.Fatalf("CheckServerName() error = %v", err)
+			}
+			if result.Verified != tt.wantVerified || result.Matched != tt.wantMatched {
+				t.Errorf("CheckServerName() = %+v, want verified %v, matched %v", result, tt.wantVerified, tt.wantMatched)
+			}
+			var hostErr x509.HostnameError
+			if errors.As(result.Err, &hostErr) != tt.wantHostErr {
+				t.Errorf("CheckServerName() error = %v, want hostname error %v", result.Err, tt.wantHostErr)
+			}
+		})
+	}
+}
+
+func TestXClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		ehlo    string
+		attrs   map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "attributes",
+			ehlo:  "250 XCLIENT NAME ADDR PROTO HELO LOGIN\r\n",
+			attrs: map[string]string{"NAME": "client.example.com", "ADDR": "192.0.2.10", "login": "a+b=c"},
+			want:  "XCLIENT ADDR=192.0.2.10 LOGIN=a+2Bb+3Dc NAME=client.example.com\r\n",
+		},
+		{
+			name:  "unavailable value",
+			ehlo:  "250 XCLIENT NAME ADDR\r\n",
+			attrs: map[string]string{"NAME": "[UNAVAILABLE]"},
+			want:  "XCLIENT NAME=[UNAVAILABLE]\r\n",
+		},
+		{name: "attribute not supported", ehlo: "250 XCLIENT NAME ADDR\r\n", attrs: map[string]string{"LOGIN": "alice"}, wantErr: true},
+		{name: "not advertised", ehlo: "250 PIPELINING\r\n", attrs: map[string]string{"ADDR": "192.0.2.10"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n"+tt.ehlo+"220 mail.example.com ESMTP\r\n")
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+			written.Reset()
+
+			err := c.XClient(tt.attrs)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("XClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := written.String(); got != tt.want {
+				t.Errorf("XCLIENT command = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeclaredSize(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int64
+		identity string
+		ehlo     string
+		want     string
+	}{
+		{name: "over the limit", size: 123456789, ehlo: "250 SIZE 1000\r\n", want: "MAIL FROM:<from@example.com> SIZE=123456789\r\n"},
+		{name: "no limit", size: 42, ehlo: "250 SIZE\r\n", want: "MAIL FROM:<from@example.com> SIZE=42\r\n"},
+		{name: "with AUTH", size: 42, identity: "<>", ehlo: "250-SIZE 1000\r\n250 AUTH PLAIN\r\n", want: "MAIL FROM:<from@example.com> SIZE=42 AUTH=<>\r\n"},
+		{name: "server without SIZE", size: 42, ehlo: "250 PIPELINING\r\n", want: "MAIL FROM:<from@example.com>\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n"+tt.ehlo+"250 OK\r\n")
+			c.SetDeclaredSize(tt.size)
+			c.SetMailAuth(tt.identity)
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+			written.Reset()
+
+			if err := c.MailFrom("from@example.com"); err != nil {
+				t.Fatalf("MailFrom() error = %v", err)
+			}
+			if got := written.String(); got != tt.want {
+				t.Errorf("MAIL FROM = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", strings.Repeat("x", 2000)+"\r\n")
+	built, err := msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	size := len(built)
+	tests := []struct {
+		name     string
+		ehlo     string
+		wantErr  bool
+		wantMail string
+	}{
+		{name: "over the limit", ehlo: "250 SIZE 1000\r\n", wantErr: true},
+		{name: "within the limit", ehlo: "250 SIZE 100000\r\n", wantMail: fmt.Sprintf("MAIL FROM:<from@example.com> SIZE=%d\r\n", size)},
+		{name: "unlimited", ehlo: "250 SIZE 0\r\n", wantMail: fmt.Sprintf("MAIL FROM:<from@example.com> SIZE=%d\r\n", size)},
+		{name: "server without SIZE", ehlo: "250 8BITMIME\r\n", wantMail: "MAIL FROM:<from@example.com>\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n"+tt.ehlo+
+				"250 OK\r\n250 OK\r\n354 Go ahead\r\n250 Queued\r\n")
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+			written.Reset()
+
+			err := c.SendMessage(msg)
+			if tt.wantErr {
+				if !errors.Is(err, ErrMessageTooLarge) {
+					t.Fatalf("SendMessage() error = %v, want ErrMessageTooLarge", err)
+				}
+				if written.Len() != 0 {
+					t.Errorf("Expected nothing to be sent, got %q", written.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SendMessage() error = %v", err)
+			}
+			if got, _, _ := strings.Cut(written.String(), "RCPT"); got != tt.wantMail {
+				t.Errorf("MAIL FROM = %q, want %q", got, tt.wantMail)
+			}
+		})
+	}
+}
+
+func TestEightBitMIME(t *testing.T) {
+	plain := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+	eightBit := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+	eightBit.Attachments = append(eightBit.Attachments, *message.NewAttachment("fwd.eml", message.MessageContentType,
+		[]byte("From: a@example.com\r\nSubject: Grüße\r\n\r\nDanke schön\r\n")))
+	tests := []struct {
+		name     string
+		ehlo     string
+		msg      *message.Message
+		wantErr  bool
+		wantMail string
+	}{
+		{name: "8bit message", ehlo: "250 8BITMIME\r\n", msg: eightBit, wantMail: "MAIL FROM:<from@example.com> BODY=8BITMIME\r\n"},
+		{name: "7bit message", ehlo: "250 8BITMIME\r\n", msg: plain, wantMail: "MAIL FROM:<from@example.com>\r\n"},
+		{name: "server without 8BITMIME", ehlo: "250 PIPELINING\r\n", msg: eightBit, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n"+tt.ehlo+
+				"250 OK\r\n250 OK\r\n354 Go ahead\r\n250 Queued\r\n")
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+			written.Reset()
+
+			err := c.SendMessage(tt.msg)
+			if tt.wantErr {
+				if !errors.Is(err, ErrEightBitUnsupported) {
+					t.Fatalf("SendMessage() error = %v, want ErrEightBitUnsupported", err)
+				}
+				if written.Len() != 0 {
+					t.Errorf("Expected nothing to be sent, got %q", written.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SendMessage() error = %v", err)
+			}
+			if got, _, _ := strings.Cut(written.String(), "RCPT"); got != tt.wantMail {
+				t.Errorf("MAIL FROM = %q, want %q", got, tt.wantMail)
+			}
+		})
+	}
+}
+
+func TestSendMessageBDAT(t *testing.T) {
+	c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n250 CHUNKING\r\n"+
+		"250 OK\r\n250 OK\r\n250 Chunk\r\n250 Chunk\r\n250 Chunk\r\n250 Chunk\r\n250 Chunk\r\n250 Queued\r\n")
+	if err := c.Ehlo(); err != nil {
+		t.Fatalf("Ehlo() error = %v", err)
+	}
+	if !c.Capabilities().Chunking {
+		t.Fatal("Expected CHUNKING to be detected")
+	}
+	written.Reset()
+
+	c.SetChunkSize(100)
+	msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Chunks", "before\n.\n"+strings.Repeat("x", 300))
+	if err := c.SendMessage(msg); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if got := c.Session().FinalResponse.Message(); got != "Queued" {
+		t.Errorf("Final response = %q, want Queued", got)
+	}
+
+	wire := written.String()
+	if strings.Contains(wire, "DATA\r\n") {
+		t.Errorf("Expected BDAT instead of DATA, got %q", wire)
+	}
+	rest := wire[strings.Index(wire, "BDAT"):]
+	var content string
+	var chunks int
+	for rest != "" {
+		line, after, ok := strings.Cut(rest, "\r\n")
+		if !ok {
+			t.Fatalf("Unterminated command %q", rest)
+		}
+		var size int
+		var last string
+		if n, _ := fmt.Sscanf(line, "BDAT %d %s", &size, &last); n < 1 {
+			t.Fatalf("Expected a BDAT command, got %q", line)
+		}
+		if size > 100 || size > len(after) {
+			t.Fatalf("BDAT %d does not match the chunk that follows: %q", size, after)
+		}
+		chunks++
+		content += after[:size]
+		rest = after[size:]
+		if wantLast := rest == ""; (last == "LAST") != wantLast {
+			t.Errorf("Chunk %d: LAST = %t, want %t", chunks, last == "LAST", wantLast)
+		}
+	}
+	if chunks < 4 {
+		t.Errorf("Expected the message to be split into at least 4 chunks, got %d", chunks)
+	}
+	if !strings.Contains(content, "\r\nbefore\r\n.\r\nxxx") {
+		t.Errorf("Expected the content to be sent without dot-stuffing, got %q", content)
+	}
+}
+
+func TestLegacyCommand(t *testing.T) {
+	for _, command := range []string{"SEND", "SOML", "SAML"} {
+		t.Run(command, func(t *testing.T) {
+			c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n250 SIZE 100000\r\n"+
+				"250 OK\r\n250 OK\r\n354 Go ahead\r\n250 Queued\r\n")
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+			written.Reset()
+
+			c.SetLegacyCommand(command)
+			msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+			if err := c.SendMessage(msg); err != nil {
+				t.Fatalf("SendMessage() error = %v", err)
+			}
+			want := command + " FROM:<from@example.com>\r\nRCPT TO:<to@example.com>\r\n"
+			if got := written.String(); !strings.HasPrefix(got, want) {
+				t.Errorf("Expected %q in place of MAIL FROM, got %q", want, got)
+			}
+		})
+	}
+
+	if _, err := ParseLegacyCommand("VRFY"); err == nil {
+		t.Error("Expected ParseLegacyCommand(\"VRFY\") to fail")
+	}
+	if got, err := ParseLegacyCommand(" saml"); err != nil || got != "SAML" {
+		t.Errorf("ParseLegacyCommand(\" saml\") = %q, %v, want SAML", got, err)
+	}
+}
+
+func TestRecipientParameters(t *testing.T) {
+	recipients := []string{"alice@example.com", "bob+tag@example.org"}
+	want := []string{
+		"RCPT TO:<alice@example.com> NOTIFY=FAILURE orcpt=rfc822;alice@example.com X-TEST=1\r\n",
+		"RCPT TO:<bob+tag@example.org> NOTIFY=FAILURE orcpt=rfc822;bob+2Btag@example.org X-TEST=1\r\n",
+	}
+	for _, pipelining := range []bool{false, true} {
+		ehlo := "250 DSN\r\n"
+		if pipelining {
+			ehlo = "250-DSN\r\n250 PIPELINING\r\n"
+		}
+		c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n"+ehlo+
+			"250 OK\r\n250 OK\r\n250 OK\r\n354 Go ahead\r\n250 Queued\r\n")
+		if err := c.Ehlo(); err != nil {
+			t.Fatalf("Ehlo() error = %v", err)
+		}
+		// The template's ORCPT replaces the one the DSN request adds
+		c.SetDSN(DSNOptions{Notify: []string{"failure"}})
+		if err := c.SetRecipientParameters([]string{"orcpt=rfc822;{{xtext .Recipient}}", "X-TEST=1"}); err != nil {
+			t.Fatalf("SetRecipientParameters() error = %v", err)
+		}
+
+		msg := message.NewMessage("from@example.com", recipients, "Subject", "Body")
+		if err := c.SendMessage(msg); err != nil {
+			t.Fatalf("SendMessage() with pipelining %t error = %v", pipelining, err)
+		}
+		wire := written.String()
+		for _, rcpt := range want {
+			if !strings.Contains(wire, rcpt) {
+				t.Errorf("Expected %q with pipelining %t, got %q", rcpt, pipelining, wire)
+			}
+		}
+	}
+
+	c := NewSMTPClient("localhost", false)
+	for _, param := range []string{"ORCPT={{.Address}}", "ORCPT={{lower .Recipient}}", "ORCPT={{"} {
+		if err := c.SetRecipientParameters([]string{param}); err == nil {
+			t.Errorf("Expected SetRecipientParameters(%q) to fail", param)
+		}
+	}
+}
+
+func TestDSN(t *testing.T) {
+	full := DSNOptions{Notify: []string{"success", "failure", "delay"}, Return: "hdrs", EnvID: "id 42"}
+	tests := []struct {
+		name     string
+		opts     DSNOptions
+		ehlo     string
+		wantMail string
+		wantRcpt string
+	}{
+		{
+			name:     "server with DSN",
+			opts:     full,
+			ehlo:     "250 DSN\r\n",
+			wantMail: "MAIL FROM:<from@example.com> RET=HDRS ENVID=id+2042\r\n",
+			wantRcpt: "RCPT TO:<to+tag@example.com> NOTIFY=SUCCESS,FAILURE,DELAY ORCPT=rfc822;to+2Btag@example.com\r\n",
+		},
+		{
+			name:     "notify only",
+			opts:     DSNOptions{Notify: []string{"NEVER"}},
+			ehlo:     "250 DSN\r\n",
+			wantMail: "MAIL FROM:<from@example.com>\r\n",
+			wantRcpt: "RCPT TO:<to+tag@example.com> NOTIFY=NEVER ORCPT=rfc822;to+2Btag@example.com\r\n",
+		},
+		{
+			name:     "server without DSN",
+			opts:     full,
+			ehlo:     "250 PIPELINING\r\n",
+			wantMail: "MAIL FROM:<from@example.com>\r\n",
+			wantRcpt: "RCPT TO:<to+tag@example.com>\r\n",
+		},
+		{
+			name:     "not requested",
+			ehlo:     "250 DSN\r\n",
+			wantMail: "MAIL FROM:<from@example.com>\r\n",
+			wantRcpt: "RCPT TO:<to+tag@example.com>\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n"+tt.ehlo+"250 OK\r\n250 OK\r\n")
+			c.SetDSN(tt.opts)
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+			written.Reset()
+
+			if err := c.MailFrom("from@example.com"); err != nil {
+				t.Fatalf("MailFrom() error = %v", err)
+			}
+			if err := c.RcptTo("to+tag@example.com"); err != nil {
+				t.Fatalf("RcptTo() error = %v", err)
+			}
+			if got, want := written.String(), tt.wantMail+tt.wantRcpt; got != want {
+				t.Errorf("commands = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDSNOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    DSNOptions
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "all conditions", opts: DSNOptions{Notify: []string{"SUCCESS", "failure", "Delay"}, Return: "full"}},
+		{name: "never", opts: DSNOptions{Notify: []string{"NEVER"}}},
+		{name: "never with another condition", opts: DSNOptions{Notify: []string{"NEVER", "FAILURE"}}, wantErr: true},
+		{name: "unknown condition", opts: DSNOptions{Notify: []string{"BOUNCE"}}, wantErr: true},
+		{name: "unknown return", opts: DSNOptions{Return: "BODY"}, wantErr: true},
+		{name: "long envelope id", opts: DSNOptions{EnvID: strings.Repeat("x", 101)}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestErrorCatalog(t *testing.T) {
+	const reply = "550 5.1.1 <nobody@example.com>: Recipient address rejected: User unknown"
+	tests := []struct {
+		name      string
+		ehlo      string
+		responses string
+	}{
+		{name: "sequential", ehlo: "250 SIZE 1000\r\n", responses: "250 OK\r\n" + reply + "\r\n250 RSET OK\r\n"},
+		{name: "pipelined", ehlo: "250 PIPELINING\r\n", responses: "250 OK\r\n" + reply + "\r\n554 5.5.1 No valid recipients\r\n250 RSET OK\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n"+tt.ehlo+tt.responses)
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+
+			err := c.SendMessage(message.NewMessage("from@example.com", []string{"nobody@example.com"}, "Subject", "Body"))
+			var catalogErr *Error
+			if !errors.As(err, &catalogErr) {
+				t.Fatalf("SendMessage() error = %v, want an *Error", err)
+			}
+			if catalogErr.Kind != ErrRecipient || catalogErr.Code() != 550 || catalogErr.EnhancedCode() != "5.1.1" {
+				t.Errorf("error = %+v (code %d, enhanced %q), want a 550 5.1.1 recipient rejection", catalogErr, catalogErr.Code(), catalogErr.EnhancedCode())
+			}
+			if want := "recipient nobody@example.com rejected: server replied " + reply; !strings.Contains(err.Error(), want) {
+				t.Errorf("error = %q, want it to contain %q", err, want)
+			}
+		})
+	}
+
+	t.Run("authentication", func(t *testing.T) {
+		c, _ := newScriptedClient(t, "220 ready\r\n334 \r\n535 5.7.8 Authentication credentials invalid\r\n")
+		err := c.Authenticate("plain", "user", "wrong")
+		if err == nil || err.Error() != "authentication with PLAIN failed: server replied 535 5.7.8 Authentication credentials invalid" {
+			t.Errorf("Authenticate() error = %v", err)
+		}
+	})
+
+	t.Run("custom message", func(t *testing.T) {
+		saved := ErrorCatalog[ErrRecipient]
+		defer func() { ErrorCatalog[ErrRecipient] = saved }()
+		ErrorCatalog[ErrRecipient] = "Empfänger %s abgelehnt"
+
+		err := &Error{Kind: ErrRecipient, Subject: "a@example.com", Err: &SMTPError{Code: 550, Lines: []string{"No such user"}}}
+		if got, want := err.Error(), "Empfänger a@example.com abgelehnt: server replied 550 No such user"; got != want {
+			t.Errorf("Error() = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestPipelinedNoRecipientsAccepted(t *testing.T) {
+	c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n250 PIPELINING\r\n"+
+		"250 OK\r\n"+
+		"550 5.1.1 No such user a\r\n"+
+		"550 5.1.1 No such user b\r\n"+
+		"250 Reset\r\n")
+	if err := c.Ehlo(); err != nil {
+		t.Fatalf("Ehlo() error = %v", err)
+	}
+
+	msg := message.NewMessage("from@example.com", []string{"a@example.com", "b@example.com"}, "Subject", "Body")
+	err := c.SendMessagePipelined(msg)
+	var recipientsErr *RecipientsError
+	if !errors.As(err, &recipientsErr) || len(recipientsErr.Rejections) != 2 {
+		t.Fatalf("SendMessagePipelined() error = %v, want a RecipientsError with both rejections", err)
+	}
+	for _, want := range []string{"no recipients accepted", "recipient a@example.com rejected: server replied 550 5.1.1 No such user a", "recipient b@example.com rejected: server replied 550 5.1.1 No such user b"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error = %q, want it to contain %q", err, want)
+		}
+	}
+	var catalogErr *Error
+	if !errors.As(err, &catalogErr) || catalogErr.Code() != 550 {
+		t.Errorf("errors.As(*Error) = %v, want the first rejection", catalogErr)
+	}
+
+	wire := written.String()
+	if strings.Contains(wire, "DATA\r\n") {
+		t.Errorf("DATA was sent with no recipients accepted: %q", wire)
+	}
+	if !strings.HasSuffix(wire, "RSET\r\n") {
+		t.Errorf("Expected the transaction to be reset, got %q", wire)
+	}
+	if !c.Reusable() {
+		t.Error("connection was dropped after the reset")
+	}
+}
+
+func TestPipelineDesync(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses string
+		wantErr   string
+	}{
+		{
+			name:      "one reply missing",
+			responses: "250 OK\r\n250 OK\r\n354 Go ahead\r\n",
+			wantErr:   `RCPT TO:<b@example.com> was answered with "354 Go ahead"; the server sent fewer replies than commands`,
+		},
+		{
+			name:      "one reply extra",
+			responses: "250 OK\r\n250 OK\r\n250 OK\r\n250 OK\r\n354 Go ahead\r\n",
+			wantErr:   `DATA was answered with "250 OK"; the server sent more replies than commands`,
+		},
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	port := ln.Addr().(*net.TCPAddr).Port
+	var redials atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			redials.Add(1)
+			fmt.Fprint(conn, "421 not expected\r\n")
+			conn.Close()
+		}
+	}()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n250 PIPELINING\r\n"+tt.responses)
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+			// A retry would reconnect to this server, which counts the sessions
+			c.SetRetryConfig(3, 0)
+			c.server, c.port = "127.0.0.1", port
+			redials.Store(0)
+
+			msg := message.NewMessage("from@example.com", []string{"a@example.com", "b@example.com"}, "Subject", "Body")
+			err := c.SendMessagePipelined(msg)
+			if !errors.Is(err, ErrPipelineDesync) {
+				t.Fatalf("SendMessagePipelined() error = %v, want ErrPipelineDesync", err)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %q, want it to contain %q", err, tt.wantErr)
+			}
+			if strings.Contains(written.String(), "Subject:") {
+				t.Error("message content was sent after the desync")
+			}
+			if !c.connLost {
+				t.Error("connection was kept after the desync")
+			}
+			if n := redials.Load(); n != 0 {
+				t.Errorf("client opened %d more sessions after the desync, want the send to fail without a retry", n)
+			}
+		})
+	}
+}
+
+// startAutoTLSServer serves connections that start with TLS when implicit is
+// set, and otherwise in plaintext with STARTTLS offered
+func startAutoTLSServer(t *testing.T, config *tls.Config, implicit bool) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	if implicit {
+		ln = tls.NewListener(ln, config)
+	}
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		fmt.Fprint(conn, "220 ready\r\n")
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "EHLO"):
+				fmt.Fprint(conn, "250-localhost\r\n250 STARTTLS\r\n")
+			case strings.HasPrefix(line, "STARTTLS"):
+				fmt.Fprint(conn, "220 Go ahead\r\n")
+				tlsConn := tls.Server(conn, config)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				io.Copy(io.Discard, tlsConn)
+				return
+			default:
+				fmt.Fprint(conn, "500 Unrecognized command\r\n")
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestScanCiphers(t *testing.T) {
+	cert := testCertificate(t, "localhost")
+	aes128 := tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	aes256 := tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	chacha := tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305
+	candidates := []uint16{aes128, aes256, chacha}
+
+	// serverConfig accepts aes128 and chacha, choosing between them with pick
+	serverConfig := func(pick func(offered []uint16) uint16) *tls.Config {
+		return &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				var offered []uint16
+				for _, id := range hello.CipherSuites {
+					if id == aes128 || id == chacha {
+						offered = append(offered, id)
+					}
+				}
+				if len(offered) == 0 {
+					return nil, errors.New("no shared cipher suite")
+				}
+				return &tls.Config{Certificates: []tls.Certificate{cert}, CipherSuites: []uint16{pick(offered)}, MaxVersion: tls.VersionTLS12}, nil
+			},
+		}
+	}
+	first := func(offered []uint16) uint16 { return offered[0] }
+	last := func(offered []uint16) uint16 { return offered[len(offered)-1] }
+
+	tests := []struct {
+		name                 string
+		pick                 func([]uint16) uint16
+		implicit             bool
+		wantServerPreference bool
+	}{
+		{name: "follows client order", pick: first},
+		{name: "own order", pick: last, wantServerPreference: true},
+		{name: "implicit TLS", pick: first, implicit: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := startAutoTLSServer(t, serverConfig(tt.pick), tt.implicit)
+			c := NewSMTPClient("localhost", false)
+			c.SetRetryConfig(1, 0)
+			c.SetSkipVerify(true)
+			connect := c.Connect
+			if tt.implicit {
+				connect = c.ConnectTLS
+			}
+			if err := connect("localhost", port); err != nil {
+				t.Fatalf("connect error = %v", err)
+			}
+			defer c.Close()
+
+			scan, err := c.ScanCiphers(candidates)
+			if err != nil {
+				t.Fatalf("ScanCiphers() error = %v", err)
+			}
+			if want := []uint16{aes128, chacha}; !reflect.DeepEqual(scan.Accepted, want) {
+				t.Errorf("Accepted = %v, want %v", CipherSuiteNames(scan.Accepted), CipherSuiteNames(want))
+			}
+			if want := []uint16{aes256}; !reflect.DeepEqual(scan.Rejected, want) {
+				t.Errorf("Rejected = %v, want %v", CipherSuiteNames(scan.Rejected), CipherSuiteNames(want))
+			}
+			if !scan.PreferenceTested || scan.ServerPreference != tt.wantServerPreference {
+				t.Errorf("PreferenceTested = %v, ServerPreference = %v, want true, %v", scan.PreferenceTested, scan.ServerPreference, tt.wantServerPreference)
+			}
+		})
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	got, err := ParseCipherSuites([]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", " tls_rsa_with_3des_ede_cbc_sha"})
+	if err != nil {
+		t.Fatalf("ParseCipherSuites() error = %v", err)
+	}
+	if want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseCipherSuites() = %v, want %v", got, want)
+	}
+	for _, name := range []string{"TLS_AES_128_GCM_SHA256", "TLS_BOGUS"} {
+		if _, err := ParseCipherSuites([]string{name}); err == nil {
+			t.Errorf("ParseCipherSuites(%q) accepted a suite that cannot be chosen", name)
+		}
+	}
+}
+
+func TestConnectAuto(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "localhost")}}
+
+	t.Run("implicit TLS", func(t *testing.T) {
+		port := startAutoTLSServer(t, config, true)
+		c := NewSMTPClient("localhost", false)
+		c.SetRetryConfig(1, 0)
+		c.SetSkipVerify(true)
+		if err := c.ConnectAuto("localhost", port); err != nil {
+			t.Fatalf("ConnectAuto() error = %v", err)
+		}
+		defer c.Close()
+		if session := c.Session(); !session.TLS || !session.ImplicitTLS {
+			t.Errorf("Session() = %+v, want implicit TLS", session)
+		}
+	})
+
+	t.Run("plaintext with STARTTLS", func(t *testing.T) {
+		port := startAutoTLSServer(t, config, false)
+		c := NewSMTPClient("localhost", false)
+		c.SetRetryConfig(1, 0)
+		c.SetSkipVerify(true)
+		if err := c.ConnectAuto("localhost", port); err != nil {
+			t.Fatalf("ConnectAuto() error = %v", err)
+		}
+		defer c.Close()
+		if session := c.Session(); session.TLS || session.ImplicitTLS {
+			t.Fatalf("Session() = %+v, want a plaintext connection", session)
+		}
+		if err := c.Ehlo(); err != nil {
+			t.Fatalf("Ehlo() error = %v", err)
+		}
+		if !c.Capabilities().StartTLS {
+			t.Fatal("STARTTLS not advertised on the plaintext connection")
+		}
+		if err := c.StartTLS(); err != nil {
+			t.Fatalf("StartTLS() error = %v", err)
+		}
+		if session := c.Session(); !session.TLS || session.ImplicitTLS {
+			t.Errorf("Session() = %+v, want STARTTLS", session)
+		}
+	})
+
+	t.Run("untrusted certificate is not downgraded", func(t *testing.T) {
+		port := startAutoTLSServer(t, config, true)
+		c := NewSMTPClient("localhost", false)
+		c.SetRetryConfig(1, 0)
+		c.SetRootCAs(x509.NewCertPool())
+		err := c.ConnectAuto("localhost", port)
+		if err == nil {
+			c.Close()
+			t.Fatal("ConnectAuto() succeeded with an untrusted certificate")
+		}
+		if !c.implicitTLS {
+			t.Error("ConnectAuto() fell back to plaintext after a certificate error")
+		}
+	})
+}
+
+func TestEhloFallbackNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses string
+		wantCmds  string
+		wantName  string
+		wantErr   bool
+	}{
+		{
+			name:      "second name accepted",
+			responses: "220 ready\r\n550 5.7.1 Dynamic host names are not accepted\r\n250-mail.example.com\r\n250 PIPELINING\r\n",
+			wantCmds:  "EHLO localhost\r\nEHLO mta.example.com\r\n",
+			wantName:  "mta.example.com",
+		},
+		{
+			name:      "all names rejected",
+			responses: "220 ready\r\n550 5.7.1 Rejected\r\n501 5.5.4 Invalid domain\r\n550 5.7.1 Rejected\r\n",
+			wantCmds:  "EHLO localhost\r\nEHLO mta.example.com\r\nEHLO relay.example.com\r\n",
+			wantName:  "localhost",
+			wantErr:   true,
+		},
+		{
+			name:      "not a name rejection",
+			responses: "220 ready\r\n502 5.5.1 Command not implemented\r\n",
+			wantCmds:  "EHLO localhost\r\n",
+			wantName:  "localhost",
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, tt.responses)
+			c.SetEhloFallbackNames([]string{"mta.example.com", "relay.example.com"})
+			err := c.Ehlo()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Ehlo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if written.String() != tt.wantCmds {
+				t.Errorf("commands = %q, want %q", written.String(), tt.wantCmds)
+			}
+			if c.hostname != tt.wantName {
+				t.Errorf("hostname = %q, want %q", c.hostname, tt.wantName)
+			}
+			if err == nil && !c.capabilities.Pipelining {
+				t.Error("capabilities of the accepted EHLO were not recorded")
+			}
+		})
+	}
+}
+
+func TestSendWithReconnect(t *testing.T) {
+	tests := []struct {
+		name      string
+		rcptReply string
+		wantErr   bool
+		wantConns int
+	}{
+		{name: "dropped connection", wantConns: 2},
+		{name: "rejection", rcptReply: "550 5.1.1 No such user\r\n", wantErr: true, wantConns: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Failed to listen: %v", err)
+			}
+			defer ln.Close()
+
+			// Each connection reports the commands it received once it closes
+			sessions := make(chan []string, 3)
+			go func() {
+				for n := 1; ; n++ {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					go func(n int, conn net.Conn) {
+						var cmds []string
+						defer func() { sessions <- cmds }()
+						defer conn.Close()
+						r := bufio.NewReader(conn)
+						fmt.Fprint(conn, "220 ready\r\n")
+						for {
+							line, err := r.ReadString('\n')
+							if err != nil {
+								return
+							}
+							cmd := strings.ToUpper(strings.TrimSpace(line))
+							cmds = append(cmds, strings.Fields(cmd)[0])
+							switch {
+							case strings.HasPrefix(cmd, "EHLO"):
+								fmt.Fprint(conn, "250-localhost\r\n250 AUTH PLAIN\r\n")
+							case strings.HasPrefix(cmd, "AUTH"):
+								fmt.Fprint(conn, "334 \r\n")
+								if _, err := r.ReadString('\n'); err != nil {
+									return
+								}
+								fmt.Fprint(conn, "235 2.7.0 Authenticated\r\n")
+							case strings.HasPrefix(cmd, "MAIL") && n == 1 && tt.rcptReply == "":
+								// Drop the first connection mid-transaction
+								return
+							case strings.HasPrefix(cmd, "RCPT") && tt.rcptReply != "":
+								fmt.Fprint(conn, tt.rcptReply)
+							case cmd == "DATA":
+								fmt.Fprint(conn, "354 go ahead\r\n")
+								for line != ".\r\n" {
+									if line, err = r.ReadString('\n'); err != nil {
+										return
+									}
+								}
+								fmt.Fprint(conn, "250 queued\r\n")
+							case cmd == "QUIT":
+								fmt.Fprint(conn, "221 bye\r\n")
+								return
+							default:
+								fmt.Fprint(conn, "250 OK\r\n")
+							}
+						}
+					}(n, conn)
+				}
+			}()
+
+			c := NewSMTPClient("localhost", false)
+			c.SetRetryConfig(3, 0)
+			if err := c.Connect("127.0.0.1", ln.Addr().(*net.TCPAddr).Port); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+			if err := c.Authenticate("plain", "user", "secret"); err != nil {
+				t.Fatalf("Authenticate() error = %v", err)
+			}
+
+			msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+			err = c.SendWithReconnect(msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SendWithReconnect() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			c.Close()
+
+			var conns [][]string
+			for i := 0; i < tt.wantConns; i++ {
+				conns = append(conns, <-sessions)
+			}
+			select {
+			case extra := <-sessions:
+				t.Fatalf("server saw %d connections, want %d (extra: %v)", tt.wantConns+1, tt.wantConns, extra)
+			case <-time.After(50 * time.Millisecond):
+			}
+			if tt.wantConns == 2 {
+				// The second session repeats the whole setup before sending
+				want := []string{"EHLO", "AUTH", "MAIL", "RCPT", "DATA"}
+				if got := conns[1]; len(got) < len(want) || !reflect.DeepEqual(got[:len(want)], want) {
+					t.Errorf("commands after reconnect = %v, want %v first", got, want)
+				}
+			}
+			if c.retry.MaxAttempts != 3 {
+				t.Errorf("retry limit = %d after SendWithReconnect, want it restored to 3", c.retry.MaxAttempts)
+			}
+		})
+	}
+}
+
+func TestKeyLogFile(t *testing.T) {
+	cert := testCertificate(t, "localhost")
+	port := startTLSServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	path := filepath.Join(t.TempDir(), "keys.log")
+
+	c := NewSMTPClient("localhost", false)
+	c.SetRetryConfig(1, 0)
+	c.SetSkipVerify(true)
+	c.SetKeyLogFile(path)
+	if err := c.Connect("localhost", port); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.StartTLS(); err != nil {
+		t.Fatalf("StartTLS() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read key log: %v", err)
+	}
+	// TLS 1.3 logs its traffic secrets, TLS 1.2 the master secret
+	if !strings.Contains(string(data), "CLIENT_TRAFFIC_SECRET_0 ") && !strings.Contains(string(data), "CLIENT_RANDOM ") {
+		t.Errorf("key log has no session secrets:\n%s", data)
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm() != 0600 {
+		t.Errorf("key log mode = %v, want 0600", info.Mode().Perm())
+	}
+}
+
+func TestAuthFallback(t *testing.T) {
+	const (
+		ehlo      = "220 ready\r\n250-mail.example.com\r\n250 AUTH CRAM-MD5 LOGIN\r\n"
+		cramFails = "334 PDEyMzQ1QGV4YW1wbGUuY29tPg==\r\n535 5.7.8 Authentication credentials invalid\r\n"
+		loginOK   = "334 VXNlcm5hbWU6\r\n334 UGFzc3dvcmQ6\r\n235 2.7.0 Authenticated\r\n"
+	)
+	tests := []struct {
+		name        string
+		authType    string
+		maxAttempts int
+		responses   string
+		wantMech    string
+		wantAuths   []string
+		wantErr     bool
+	}{
+		{
+			name:      "auto falls back to LOGIN",
+			authType:  AuthAuto,
+			responses: cramFails + loginOK,
+			wantMech:  "LOGIN",
+			wantAuths: []string{"AUTH CRAM-MD5", "AUTH LOGIN"},
+		},
+		{
+			name:      "preferred mechanism falls back",
+			authType:  "cram-md5",
+			responses: cramFails + loginOK,
+			wantMech:  "LOGIN",
+			wantAuths: []string{"AUTH CRAM-MD5", "AUTH LOGIN"},
+		},
+		{
+			name:        "attempts capped",
+			authType:    AuthAuto,
+			maxAttempts: 1,
+			responses:   cramFails,
+			wantAuths:   []string{"AUTH CRAM-MD5"},
+			wantErr:     true,
+		},
+		{
+			name:      "temporary failure is not retried",
+			authType:  AuthAuto,
+			responses: "454 4.7.0 Temporary authentication failure\r\n",
+			wantAuths: []string{"AUTH CRAM-MD5"},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, ehlo+tt.responses)
+			if tt.maxAttempts > 0 {
+				c.SetMaxAuthAttempts(tt.maxAttempts)
+			}
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+
+			err := c.Authenticate(tt.authType, "user", "secret")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var auths []string
+			for _, line := range strings.Split(written.String(), "\r\n") {
+				if strings.HasPrefix(line, "AUTH ") {
+					auths = append(auths, line)
+				}
+			}
+			if !reflect.DeepEqual(auths, tt.wantAuths) {
+				t.Errorf("AUTH commands = %q, want %q", auths, tt.wantAuths)
+			}
+			if got := c.Session().AuthMechanism; got != tt.wantMech {
+				t.Errorf("AuthMechanism = %q, want %q", got, tt.wantMech)
+			}
+		})
+	}
+
+	t.Run("auto without advertised mechanisms", func(t *testing.T) {
+		c, _ := newScriptedClient(t, "220 ready\r\n250 mail.example.com\r\n")
+		if err := c.Ehlo(); err != nil {
+			t.Fatalf("Ehlo() error = %v", err)
+		}
+		if err := c.Authenticate(AuthAuto, "user", "secret"); err == nil {
+			t.Error("Authenticate(auto) succeeded without any advertised mechanism")
+		}
+	})
+}
+
+func TestAuthenticateXOAuth2(t *testing.T) {
+	initial := auth.Base64Encode("user=user@example.com\x01auth=Bearer token\x01\x01")
+	tests := []struct {
+		name      string
+		responses string
+		wantLines []string
+		wantErr   bool
+	}{
+		{
+			name:      "accepted",
+			responses: "235 2.7.0 Accepted\r\n",
+			wantLines: []string{"AUTH XOAUTH2 " + initial},
+		},
+		{
+			name: "rejected token",
+			responses: "334 " + auth.Base64Encode(`{"status":"401","schemes":"bearer","scope":"https://mail.google.com/"}`) + "\r\n" +
+				"535 5.7.8 Username and Password not accepted\r\n",
+			wantLines: []string{"AUTH XOAUTH2 " + initial, ""},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, written := newScriptedClient(t, "220 ready\r\n250-mail.example.com\r\n250 AUTH XOAUTH2 PLAIN LOGIN\r\n"+tt.responses)
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+			written.Reset()
+
+			err := c.Authenticate("xoauth2", "user@example.com", "token")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			// The empty line acknowledges the error; the token is never retried as a password
+			if got := strings.Split(strings.TrimSuffix(written.String(), "\r\n"), "\r\n"); !reflect.DeepEqual(got, tt.wantLines) {
+				t.Errorf("client sent %q, want %q", got, tt.wantLines)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "535") {
+				t.Errorf("Authenticate() error = %v, want the final 535 reply", err)
+			}
+		})
+	}
+}
+
+func TestFinalResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		final       string
+		wantReply   string
+		wantQueueID string
+	}{
+		{name: "postfix", final: "250 2.0.0 Ok: queued as 4BQ2Dk1x2Nz9sWQ\r\n", wantReply: "250 2.0.0 Ok: queued as 4BQ2Dk1x2Nz9sWQ", wantQueueID: "4BQ2Dk1x2Nz9sWQ"},
+		{name: "exim", final: "250 OK id=1qB6xS-0004Zc-2T\r\n", wantReply: "250 OK id=1qB6xS-0004Zc-2T", wantQueueID: "1qB6xS-0004Zc-2T"},
+		{name: "multiline", final: "250-Message accepted\r\n250 queued as ABC123\r\n", wantReply: "250-Message accepted\n250 queued as ABC123", wantQueueID: "ABC123"},
+		{name: "no queue id", final: "250 OK\r\n", wantReply: "250 OK"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newScriptedClient(t, "220 ready\r\n250 OK\r\n250 OK\r\n354 Go ahead\r\n"+tt.final)
+			if resp := c.Session().FinalResponse; resp != nil {
+				t.Fatalf("FinalResponse before sending = %q, want nil", resp)
+			}
+			msg := message.NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+			if err := c.SendMessage(msg); err != nil {
+				t.Fatalf("SendMessage() error = %v", err)
+			}
+			resp := c.Session().FinalResponse
+			if resp == nil {
+				t.Fatal("FinalResponse = nil after an accepted message")
+			}
+			if got := resp.String(); got != tt.wantReply {
+				t.Errorf("FinalResponse = %q, want %q", got, tt.wantReply)
+			}
+			if got := resp.QueueID(); got != tt.wantQueueID {
+				t.Errorf("QueueID() = %q, want %q", got, tt.wantQueueID)
+			}
+		})
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	ca, caKey, _ := testCA(t, "Client CA")
+	cert := testLeaf(t, ca, caKey, "client.example.com")
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	// The server requires a certificate and records the one presented
+	presented := make(chan []byte, 1)
+	port := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t, "localhost")},
+		ClientAuth:   tls.RequireAnyClientCert,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			presented <- rawCerts[0]
+			return nil
+		},
+	})
+
+	c := NewSMTPClient("localhost", false)
+	c.SetRetryConfig(1, 0)
+	c.SetSkipVerify(true)
+	if err := c.SetClientCertificate(certFile, keyFile); err != nil {
+		t.Fatalf("SetClientCertificate() error = %v", err)
+	}
+	if err := c.Connect("localhost", port); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.StartTLS(); err != nil {
+		t.Fatalf("StartTLS() error = %v", err)
+	}
+	select {
+	case got := <-presented:
+		if !bytes.Equal(got, cert.Certificate[0]) {
+			t.Error("server received a different client certificate")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not receive a client certificate")
+	}
+
+	// A key that does not match the certificate, or a missing file, is refused
+	otherKey := filepath.Join(dir, "other.key")
+	other, _ := testCertificate(t, "other").PrivateKey.(*ecdsa.PrivateKey)
+	otherDER, _ := x509.MarshalECPrivateKey(other)
+	os.WriteFile(otherKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: otherDER}), 0600)
+	for _, files := range [][2]string{{certFile, otherKey}, {filepath.Join(dir, "missing.crt"), keyFile}} {
+		if err := NewSMTPClient("localhost", false).SetClientCertificate(files[0], files[1]); err == nil {
+			t.Errorf("SetClientCertificate(%q, %q) succeeded, want an error", files[0], files[1])
+		}
+	}
+}
+
+func TestSessionRecipientCounts(t *testing.T) {
+	c, _ := newScriptedClient(t, "220 ready\r\n250 OK\r\n250 OK\r\n550 5.1.1 No such user\r\n250 Reset\r\n")
+	msg := message.NewMessage("from@example.com", []string{"one@example.com", "two@example.com"}, "Subject", "Body")
+	if err := c.SendMessage(msg); err == nil {
+		t.Fatal("SendMessage() succeeded, want the recipient rejection")
+	}
+	session := c.Session()
+	if session.RecipientsAccepted != 1 || session.RecipientsRejected != 1 {
+		t.Errorf("recipients accepted = %d, rejected = %d, want 1 and 1", session.RecipientsAccepted, session.RecipientsRejected)
+	}
+	if session.Server != "smtp.example.com" || session.Port != 25 || session.TLSVersion != "" {
+		t.Errorf("session = %+v, want smtp.example.com:25 without TLS", session)
+	}
+}
+
+func TestStartTLSVerifiesCertificate(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "localhost")}}
+	tests := []struct {
+		name       string
+		skipVerify bool
+		wantErr    bool
+	}{
+		{name: "self-signed certificate rejected by default", wantErr: true},
+		{name: "self-signed certificate accepted with skip verify", skipVerify: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := startTLSServer(t, config)
+			c := NewSMTPClient("localhost", false)
+			c.SetRetryConfig(1, 0)
+			c.SetSkipVerify(tt.skipVerify)
+			if err := c.Connect("localhost", port); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer c.Close()
+
+			err := c.StartTLS()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("StartTLS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				return
+			}
+			// The x509 reason is reported, not just a failed handshake
+			var unknownAuthority x509.UnknownAuthorityError
+			if !errors.As(err, &unknownAuthority) || !strings.Contains(err.Error(), "certificate verification failed") {
+				t.Errorf("StartTLS() error = %v, want the x509 unknown authority error", err)
+			}
+		})
+	}
+}
+
+func TestConnectTLS(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t, "localhost")}}
+
+	t.Run("implicit TLS", func(t *testing.T) {
+		port := startAutoTLSServer(t, config, true)
+		c := NewSMTPClient("localhost", false)
+		c.SetRetryConfig(1, 0)
+		c.SetSkipVerify(true)
+		if err := c.ConnectTLS("localhost", port); err != nil {
+			t.Fatalf("ConnectTLS() error = %v", err)
+		}
+		defer c.Close()
+		if err := c.Ehlo(); err != nil {
+			t.Fatalf("Ehlo() error = %v", err)
+		}
+		if session := c.Session(); !session.TLS || !session.ImplicitTLS || session.TLSVersion == "" {
+			t.Errorf("Session() = %+v, want implicit TLS", session)
+		}
+	})
+
+	t.Run("plaintext server is not downgraded", func(t *testing.T) {
+		port := startAutoTLSServer(t, config, false)
+		c := NewSMTPClient("localhost", false)
+		c.SetRetryConfig(2, 0)
+		c.SetSkipVerify(true)
+		err := c.ConnectTLS("localhost", port)
+		if err == nil {
+			c.Close()
+			t.Fatal("ConnectTLS() succeeded against a plaintext server")
+		}
+		// The handshake would fail the same way again, so is not retried
+		if !strings.Contains(err.Error(), "TLS handshake failed") || strings.Contains(err.Error(), "attempts") {
+			t.Errorf("ConnectTLS() error = %v, want the handshake to fail once", err)
+		}
+	})
+}
+
+func TestHold(t *testing.T) {
+	tests := []struct {
+		name      string
+		delay     time.Duration
+		keepalive time.Duration
+		responses string
+		wantNoops int
+		wantErr   bool
+	}{
+		{name: "no delay", responses: "221 bye\r\n"},
+		{name: "silent", delay: 150 * time.Millisecond, responses: "221 bye\r\n"},
+		{
+			name:      "keepalive",
+			delay:     150 * time.Millisecond,
+			keepalive: 40 * time.Millisecond,
+			responses: strings.Repeat("250 OK\r\n", 3) + "221 bye\r\n",
+			wantNoops: 3,
+		},
+		{
+			name:      "dropped",
+			delay:     150 * time.Millisecond,
+			keepalive: 40 * time.Millisecond,
+			responses: "421 idle too long\r\n",
+			wantNoops: 1,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var written bytes.Buffer
+			var quitAt time.Time
+			conn := scriptedConn("220 ready\r\n"+tt.responses, &written)
+			conn.writeFunc = func(b []byte) (int, error) {
+				if strings.HasPrefix(string(b), "QUIT") {
+					quitAt = time.Now()
+				}
+				return written.Write(b)
+			}
+			c := NewSMTPClient("localhost", false)
+			c.conn = conn
+			if err := c.Connect("smtp.example.com", 25); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			c.SetPostSendDelay(tt.delay)
+			c.SetKeepalive(tt.keepalive)
+
+			start := time.Now()
+			err := c.Hold()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Hold() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if got := strings.Count(written.String(), "NOOP\r\n"); got != tt.wantNoops {
+				t.Errorf("sent %d NOOPs, want %d", got, tt.wantNoops)
+			}
+			if tt.wantErr {
+				return
+			}
+			if err := c.Quit(); err != nil {
+				t.Fatalf("Quit() error = %v", err)
+			}
+			if held := quitAt.Sub(start); held < tt.delay {
+				t.Errorf("QUIT sent %s after the message, want at least %s", held, tt.delay)
+			}
+		})
+	}
+}
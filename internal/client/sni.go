@@ -0,0 +1,49 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// SNIResult is the outcome of a STARTTLS handshake that presented a chosen
+// server name with certificate verification enabled
+type SNIResult struct {
+	ServerName string
+	// Verified reports whether certificate verification accepted the handshake
+	Verified bool
+	// Matched reports whether the server certificate is valid for ServerName,
+	// whether or not its chain could be verified
+	Matched bool
+	// Err is the reason verification rejected the certificate
+	Err error
+}
+
+// CheckServerName performs STARTTLS presenting name as the SNI and verifies
+// the server certificate against it, even when verification is otherwise
+// skipped. Testing with a name the certificate does not cover shows that
+// verification really happens: the handshake should fail. An error is returned
+// only when the handshake fails for a reason other than verification. The
+// connection cannot be used afterwards unless the handshake was verified.
+func (c *SMTPClient) CheckServerName(name string) (SNIResult, error) {
+	config := c.tlsConfig()
+	config.ServerName = name
+	config.InsecureSkipVerify = false
+
+	result := SNIResult{ServerName: name}
+	err := c.startTLS(config)
+	if err == nil {
+		result.Verified = true
+		result.Matched = true
+		return result, nil
+	}
+
+	var verifyErr *tls.CertificateVerificationError
+	if !errors.As(err, &verifyErr) {
+		return result, err
+	}
+	result.Err = verifyErr.Err
+	if certs := verifyErr.UnverifiedCertificates; len(certs) > 0 {
+		result.Matched = certs[0].VerifyHostname(name) == nil
+	}
+	return result, nil
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// XClient sends the Postfix XCLIENT command, which lets a trusted client such
+// as a proxy override the client information the server sees: ADDR, NAME,
+// LOGIN and so on. It is meant for testing relay policies from a host the
+// server trusts to send XCLIENT. The server must advertise XCLIENT with every
+// attribute used. On success the server greets again, so EHLO must be repeated.
+func (c *SMTPClient) XClient(attrs map[string]string) error {
+	supported, ok := c.capabilities.extension("XCLIENT")
+	if !ok {
+		return fmt.Errorf("server does not advertise XCLIENT")
+	}
+	cmd, err := xclientCommand(attrs, supported)
+	if err != nil {
+		return err
+	}
+
+	if err := c.SendCommand(cmd); err != nil {
+		return err
+	}
+	if _, err := c.readStatus(); err != nil {
+		return fmt.Errorf("server rejected XCLIENT: %w", err)
+	}
+	c.xclient = attrs
+	return nil
+}
+
+// xclientCommand formats the XCLIENT command with the attributes sorted by
+// name and their values xtext encoded, checking that each attribute is one
+// the server listed
+func xclientCommand(attrs map[string]string, supported []string) (string, error) {
+	if len(attrs) == 0 {
+		return "", fmt.Errorf("no XCLIENT attributes given")
+	}
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return strings.ToUpper(names[i]) < strings.ToUpper(names[j]) })
+
+	params := make([]string, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, s := range supported {
+			if strings.EqualFold(s, name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("server does not accept XCLIENT attribute %s (supported: %s)", name, strings.Join(supported, " "))
+		}
+		params = append(params, strings.ToUpper(name)+"="+xtext(attrs[name]))
+	}
+	return "XCLIENT " + strings.Join(params, " "), nil
+}
@@ -45,22 +45,31 @@ func SaveConfig(config *SMTPConfig, filename string) error {
 	return os.WriteFile(filename, data, 0644)
 }
 
-// Validate checks if the configuration is valid
+// Validate checks if the configuration is valid, returning the first problem
 func (c *SMTPConfig) Validate() error {
+	if errs := c.ValidateAll(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// ValidateAll checks the configuration and returns every problem found
+func (c *SMTPConfig) ValidateAll() []error {
+	var errs []error
 	if c.Server == "" {
-		return errors.New("server is required")
+		errs = append(errs, errors.New("server is required"))
 	}
 	if c.Port == 0 {
-		return errors.New("port is required")
+		errs = append(errs, errors.New("port is required"))
 	}
 	if c.Username == "" {
-		return errors.New("username is required")
+		errs = append(errs, errors.New("username is required"))
 	}
 	if c.Password == "" {
-		return errors.New("password is required")
+		errs = append(errs, errors.New("password is required"))
 	}
 	if c.AuthType == "" {
-		return errors.New("auth_type is required")
+		errs = append(errs, errors.New("auth_type is required"))
 	}
-	return nil
+	return errs
 }
@@ -1,7 +1,10 @@
 package config
 
 import (
+	"bytes"
+	"encoding/json"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -156,3 +159,87 @@ func TestValidate(t *testing.T) {
 		t.Errorf("Validate did not return an error for an invalid config")
 	}
 }
+
+func TestTemplateRoundTrip(t *testing.T) {
+	for _, format := range []string{"yaml", "json"} {
+		t.Run(format, func(t *testing.T) {
+			data, err := Template(format)
+			if err != nil {
+				t.Fatalf("Template(%q) error = %v", format, err)
+			}
+			if format == "yaml" && !bytes.Contains(data, []byte("# SMTP server port")) {
+				t.Errorf("YAML template has no field comments:\n%s", data)
+			}
+
+			filename := filepath.Join(t.TempDir(), "smtp-edc."+format)
+			if err := os.WriteFile(filename, data, 0644); err != nil {
+				t.Fatalf("Failed to write template: %v", err)
+			}
+			loaded, err := LoadConfig(filename)
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %v\n%s", err, data)
+			}
+			if !reflect.DeepEqual(loaded, DefaultConfig()) {
+				t.Errorf("LoadConfig() = %+v, want %+v", loaded, DefaultConfig())
+			}
+		})
+	}
+
+	if _, err := Template("toml"); err == nil {
+		t.Error("Template() accepted an unsupported format")
+	}
+}
+
+func TestSchema(t *testing.T) {
+	data, err := Schema()
+	if err != nil {
+		t.Fatalf("Schema() error = %v", err)
+	}
+
+	var schema struct {
+		Type       string                            `json:"type"`
+		Properties map[string]map[string]interface{} `json:"properties"`
+	}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		t.Fatalf("Schema() is not valid JSON: %v", err)
+	}
+	if schema.Type != "object" {
+		t.Errorf("schema type = %q, want object", schema.Type)
+	}
+
+	// Every config field must be described
+	fields := reflect.TypeOf(SMTPConfig{})
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Field(i).Tag.Get("yaml")
+		property, ok := schema.Properties[name]
+		if !ok {
+			t.Errorf("schema is missing property %q", name)
+			continue
+		}
+		if property["description"] == "" {
+			t.Errorf("schema property %q has no description", name)
+		}
+	}
+	if got := schema.Properties["port"]["type"]; got != "integer" {
+		t.Errorf("port type = %v, want integer", got)
+	}
+}
+
+func TestValidateAll(t *testing.T) {
+	cfg := &SMTPConfig{
+		Port:     587,
+		Password: "password",
+		AuthType: "plain",
+	}
+
+	errs := cfg.ValidateAll()
+	if len(errs) != 2 {
+		t.Fatalf("ValidateAll() = %v, want 2 errors", errs)
+	}
+	if errs[0].Error() != "server is required" || errs[1].Error() != "username is required" {
+		t.Errorf("ValidateAll() = %v, want server and username errors", errs)
+	}
+	if err := cfg.Validate(); err == nil || err.Error() != "server is required" {
+		t.Errorf("Validate() = %v, want the first error", err)
+	}
+}
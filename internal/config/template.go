@@ -0,0 +1,120 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/asachs/smtp-edc/internal/auth"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// fieldDescriptions documents each configuration key for templates and the schema
+var fieldDescriptions = map[string]string{
+	"server":      "SMTP server host name or IP address",
+	"port":        "SMTP server port (25, 465 or 587)",
+	"username":    "Username for SMTP authentication",
+	"password":    "Password for SMTP authentication; prefer the SMTP_PASSWORD environment variable",
+	"auth_type":   "Authentication mechanism (" + strings.Join(auth.Types, ", ") + "); leave empty to skip AUTH",
+	"starttls":    "Upgrade the connection with STARTTLS",
+	"skip_verify": "Skip TLS certificate verification (testing only)",
+	"templates":   "Named message templates, mapping a name to a template file",
+}
+
+// DefaultConfig returns the configuration used when no file is given
+func DefaultConfig() *SMTPConfig {
+	return &SMTPConfig{
+		Server:    "smtp.example.com",
+		Port:      25,
+		Templates: map[string]string{},
+	}
+}
+
+// Template returns a config file with every field set to its default value,
+// in "yaml" (commented) or "json" format
+func Template(format string) ([]byte, error) {
+	var node yaml.Node
+	if err := node.Encode(DefaultConfig()); err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "yaml", "yml":
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			node.Content[i].HeadComment = fieldDescriptions[node.Content[i].Value]
+		}
+		doc := &yaml.Node{
+			Kind:        yaml.DocumentNode,
+			HeadComment: "smtp-edc configuration\nValues given on the command line or in SMTP_* environment variables take precedence.",
+			Content:     []*yaml.Node{&node},
+		}
+		return yaml.Marshal(doc)
+	case "json":
+		// Go through a map so the keys match the YAML names LoadConfig expects
+		var fields map[string]interface{}
+		if err := node.Decode(&fields); err != nil {
+			return nil, err
+		}
+		data, err := json.MarshalIndent(fields, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	default:
+		return nil, fmt.Errorf("unsupported config format %q: expected yaml or json", format)
+	}
+}
+
+// Schema returns a JSON Schema describing SMTPConfig, for editor validation
+func Schema() ([]byte, error) {
+	defaults := reflect.ValueOf(DefaultConfig()).Elem()
+	properties := make(map[string]interface{})
+
+	t := defaults.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		property := map[string]interface{}{"description": fieldDescriptions[name]}
+		switch field.Type.Kind() {
+		case reflect.String:
+			property["type"] = "string"
+		case reflect.Int:
+			property["type"] = "integer"
+			property["minimum"] = 1
+			property["maximum"] = 65535
+		case reflect.Bool:
+			property["type"] = "boolean"
+		case reflect.Map:
+			property["type"] = "object"
+			property["additionalProperties"] = map[string]string{"type": "string"}
+		default:
+			return nil, fmt.Errorf("no schema type for field %s", field.Name)
+		}
+		if name == "auth_type" {
+			property["enum"] = append([]string{""}, auth.Types...)
+		}
+		if value := defaults.Field(i); !value.IsZero() && field.Type.Kind() != reflect.Map {
+			property["default"] = value.Interface()
+		}
+		properties[name] = property
+	}
+
+	schema := map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "smtp-edc configuration",
+		"type":        "object",
+		"properties":  properties,
+		"required":    []string{"server"},
+		"description": "Configuration file for smtp-edc. Other command line settings may also be given by their flag name.",
+	}
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
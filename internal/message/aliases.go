@@ -0,0 +1,94 @@
+package message
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Aliases maps a group name to the addresses it stands for. Members may be
+// other aliases, which are expanded in turn.
+type Aliases map[string][]string
+
+// ReadAliases reads and parses an aliases file
+func ReadAliases(filename string) (Aliases, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read aliases: %v", err)
+	}
+	defer f.Close()
+	return ParseAliases(f)
+}
+
+// ParseAliases parses one alias per line in the style of /etc/aliases:
+// "team@local: alice@example.com, bob@example.com". Blank lines and # comments
+// are ignored. Names are matched case-insensitively.
+func ParseAliases(r io.Reader) (Aliases, error) {
+	aliases := make(Aliases)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, list, ok := strings.Cut(line, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d: expected \"name: address, ...\"", n)
+		}
+		for _, member := range strings.Split(list, ",") {
+			if member = NormalizeAddress(member); member != "" {
+				aliases[name] = append(aliases[name], member)
+			}
+		}
+		if len(aliases[name]) == 0 {
+			return nil, fmt.Errorf("line %d: alias %s has no members", n, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read aliases: %v", err)
+	}
+	return aliases, nil
+}
+
+// Expand replaces each alias in addresses with its members, recursively.
+// Addresses that are not aliases are kept as they are. An alias that refers
+// back to itself, directly or through others, is an error.
+func (a Aliases) Expand(addresses []string) ([]string, error) {
+	var expanded []string
+	for _, addr := range addresses {
+		members, err := a.expand(addr, nil)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, members...)
+	}
+	return expanded, nil
+}
+
+// expand resolves addr, with path holding the aliases being expanded above it
+func (a Aliases) expand(addr string, path []string) ([]string, error) {
+	name := strings.ToLower(addr)
+	members, ok := a[name]
+	if !ok {
+		return []string{addr}, nil
+	}
+	for _, parent := range path {
+		if parent == name {
+			return nil, fmt.Errorf("alias loop: %s", strings.Join(append(path, name), " -> "))
+		}
+	}
+
+	path = append(path, name)
+	var expanded []string
+	for _, member := range members {
+		resolved, err := a.expand(member, path)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, resolved...)
+	}
+	return expanded, nil
+}
@@ -0,0 +1,43 @@
+package message
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+)
+
+// AnonymizeAddress returns a stand-in for addr that does not reveal it but is
+// the same every time: "anon-" and the first 8 hex digits of the SHA-256 of
+// the normalized, lowercased address
+func AnonymizeAddress(addr string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(NormalizeAddress(addr))))
+	return "anon-" + hex.EncodeToString(sum[:4])
+}
+
+// NewAddressAnonymizer returns a function that replaces each of addresses,
+// as given, normalized or lowercased, with its AnonymizeAddress stand-in
+// wherever it appears in a string
+func NewAddressAnonymizer(addresses []string) func(string) string {
+	forms := make(map[string]string)
+	for _, addr := range addresses {
+		anon := AnonymizeAddress(addr)
+		for _, form := range []string{addr, NormalizeAddress(addr), strings.ToLower(addr)} {
+			if form != "" {
+				forms[form] = anon
+			}
+		}
+	}
+
+	// Longer addresses go first so that one containing another is replaced whole
+	keys := make([]string, 0, len(forms))
+	for form := range forms {
+		keys = append(keys, form)
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+	pairs := make([]string, 0, 2*len(keys))
+	for _, form := range keys {
+		pairs = append(pairs, form, forms[form])
+	}
+	return strings.NewReplacer(pairs...).Replace
+}
@@ -1,8 +1,11 @@
 package message
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"mime"
 	"os"
 	"path/filepath"
 	"strings"
@@ -35,11 +38,106 @@ func NewAttachment(filename string, contentType string, content []byte) *Attachm
 	}
 }
 
+// disposition returns the Content-Disposition type of the attachment
+func (a *Attachment) disposition() string {
+	if a.Inline {
+		return "inline"
+	}
+	return "attachment"
+}
+
+// MessageContentType is the content type of an attached email message
+const MessageContentType = "message/rfc822"
+
+// isMessage reports whether the attachment is an email message, which is
+// attached as it is since RFC 2046 does not allow message/rfc822 to be base64
+// encoded
+func (a *Attachment) isMessage() bool {
+	return strings.EqualFold(a.ContentType, MessageContentType)
+}
+
+// transferEncoding returns the Content-Transfer-Encoding of the attachment
+func (a *Attachment) transferEncoding() string {
+	if !a.isMessage() {
+		return "base64"
+	}
+	for _, b := range a.Content {
+		if b >= 0x80 {
+			return "8bit"
+		}
+	}
+	return "7bit"
+}
+
+// EightBit reports whether the message has parts sent with
+// Content-Transfer-Encoding 8bit, attached messages holding bytes outside
+// US-ASCII, which may only be sent to servers offering 8BITMIME (RFC 6152)
+func (m *Message) EightBit() bool {
+	for i := range m.Attachments {
+		if m.Attachments[i].transferEncoding() == "8bit" {
+			return true
+		}
+	}
+	return false
+}
+
+// messageBody returns an attached message with CRLF line endings, ending
+// with a line break
+func (a *Attachment) messageBody() string {
+	body := strings.ReplaceAll(string(a.Content), "\r\n", "\n")
+	body = strings.ReplaceAll(body, "\n", "\r\n")
+	if !strings.HasSuffix(body, "\r\n") {
+		body += "\r\n"
+	}
+	return body
+}
+
 // EncodeBase64 encodes the attachment data in base64
 func (a *Attachment) EncodeBase64() string {
 	return base64.StdEncoding.EncodeToString(a.Content)
 }
 
+// base64LineLength is the longest line of base64-encoded content, as RFC 2045
+// section 6.8 requires
+const base64LineLength = 76
+
+// base64Body returns the content base64-encoded in lines of at most
+// base64LineLength characters, each ending in CRLF
+func (a *Attachment) base64Body() string {
+	encoded := a.EncodeBase64()
+	var b strings.Builder
+	for len(encoded) > base64LineLength {
+		b.WriteString(encoded[:base64LineLength])
+		b.WriteString("\r\n")
+		encoded = encoded[base64LineLength:]
+	}
+	b.WriteString(encoded)
+	b.WriteString("\r\n")
+	return b.String()
+}
+
+// writePart writes the attachment as a part of the multipart with the given
+// boundary. Attached messages are included as they are, everything else is
+// base64-encoded.
+func (a *Attachment) writePart(w io.Writer, boundary string) {
+	fmt.Fprintf(w, "--%s\r\n", boundary)
+	io.WriteString(w, headerLine("Content-Type", a.ContentType))
+	io.WriteString(w, headerLine("Content-Transfer-Encoding", a.transferEncoding()))
+	// FormatMediaType quotes the name only when it is not a plain
+	// token, as with spaces in "report (2).pdf"
+	io.WriteString(w, headerLine("Content-Disposition", mime.FormatMediaType(a.disposition(),
+		map[string]string{"filename": mime.QEncoding.Encode("utf-8", a.Filename)})))
+	if a.ContentID != "" {
+		io.WriteString(w, headerLine("Content-ID", "<"+a.ContentID+">"))
+	}
+	fmt.Fprintf(w, "\r\n")
+	if a.isMessage() {
+		io.WriteString(w, a.messageBody())
+		return
+	}
+	io.WriteString(w, a.base64Body())
+}
+
 // determineContentType determines the MIME type based on file extension
 func determineContentType(filename string) string {
 	ext := filepath.Ext(filename)
@@ -74,3 +172,33 @@ func determineContentType(filename string) string {
 		return "application/octet-stream"
 	}
 }
+
+// DuplicateAttachment is an attachment removed by DedupeAttachments
+type DuplicateAttachment struct {
+	Filename string
+	// Of is the name of the earlier attachment with the same content, which is kept
+	Of string
+}
+
+// DedupeAttachments removes every attachment whose content is the same as
+// an earlier one's, comparing SHA-256 hashes of the content rather than the
+// names, and returns the ones removed. Inline attachments are kept, since
+// the HTML body refers to each by its Content-ID.
+func (m *Message) DedupeAttachments() []DuplicateAttachment {
+	var removed []DuplicateAttachment
+	seen := make(map[[sha256.Size]byte]string)
+	kept := m.Attachments[:0]
+	for _, attachment := range m.Attachments {
+		if !attachment.Inline {
+			sum := sha256.Sum256(attachment.Content)
+			if first, ok := seen[sum]; ok {
+				removed = append(removed, DuplicateAttachment{Filename: attachment.Filename, Of: first})
+				continue
+			}
+			seen[sum] = attachment.Filename
+		}
+		kept = append(kept, attachment)
+	}
+	m.Attachments = kept
+	return removed
+}
@@ -0,0 +1,115 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// traceHeaders are the RFC 5322 section 3.6.7 trace fields, which a relayed
+// message loses unless they are preserved
+var traceHeaders = []string{"Received", "Return-Path"}
+
+// ReadEML reads a saved message (.eml) to relay as it is; see ParseEML
+func ReadEML(filename string, preserveTrace bool) (*Message, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+	return ParseEML(data, preserveTrace)
+}
+
+// ParseEML returns a message that sends data as its content, for relaying a
+// saved message. The From, To, Cc and Subject fields are taken from its
+// headers, so the envelope can follow them; the content itself is not rebuilt.
+// Received and Return-Path trace headers are left out unless preserveTrace is
+// set, in which case they are kept byte for byte, in their order and with
+// their folding. Line endings are converted to CRLF.
+func ParseEML(data []byte, preserveTrace bool) (*Message, error) {
+	content := NormalizeLineEndings(string(data))
+	header, body := content, ""
+	if i := strings.Index(content, "\r\n\r\n"); i >= 0 {
+		header, body = content[:i+2], content[i+4:]
+	} else if !strings.HasSuffix(header, "\r\n") {
+		header += "\r\n"
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(header + "\r\n"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid message: %v", err)
+	}
+	msg := NewMessage("", nil, parsed.Header.Get("Subject"), "")
+	if from := parsed.Header.Get("From"); from != "" {
+		addr, err := mail.ParseAddress(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid From header: %v", err)
+		}
+		msg.From = addr.Address
+	}
+	for _, field := range []struct {
+		name string
+		list *[]string
+	}{{"To", &msg.To}, {"Cc", &msg.Cc}} {
+		addrs, err := parsed.Header.AddressList(field.name)
+		if err != nil && !errors.Is(err, mail.ErrHeaderNotPresent) {
+			return nil, fmt.Errorf("invalid %s header: %v", field.name, err)
+		}
+		for _, addr := range addrs {
+			*field.list = append(*field.list, addr.Address)
+		}
+	}
+	if date, err := parsed.Header.Date(); err == nil {
+		msg.Date = date
+	}
+	msg.MessageID = parsed.Header.Get("Message-ID")
+	msg.NoMessageID = msg.MessageID == ""
+
+	var raw strings.Builder
+	for _, field := range headerFields(header) {
+		if preserveTrace || !isTraceHeader(field) {
+			raw.WriteString(field)
+		}
+	}
+	raw.WriteString("\r\n")
+	raw.WriteString(body)
+	msg.Raw = []byte(raw.String())
+	return msg, nil
+}
+
+// headerFields splits a CRLF-terminated header section into its fields, each
+// with its continuation lines and line endings as they are
+func headerFields(header string) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if len(fields) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// isTraceHeader reports whether a header field is one of the traceHeaders
+func isTraceHeader(field string) bool {
+	name, _, _ := strings.Cut(field, ":")
+	for _, trace := range traceHeaders {
+		if strings.EqualFold(strings.TrimSpace(name), trace) {
+			return true
+		}
+	}
+	return false
+}
+
+// rawContent returns Raw below the Received header for this hop, if any
+func (m *Message) rawContent() string {
+	if m.Received == "" {
+		return string(m.Raw)
+	}
+	return fmt.Sprintf("Received: %s\r\n%s", m.Received, m.Raw)
+}
@@ -0,0 +1,140 @@
+package message
+
+import (
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxHeaderLine is the line length, without CRLF, that headers folded by the
+// builder stay within where they can (RFC 5322 section 2.1.1)
+const maxHeaderLine = 78
+
+// maxEncodedLine is the longest a header line holding RFC 2047 encoded-words
+// may be (RFC 2047 section 2), which also keeps each word within 75 characters
+const maxEncodedLine = 76
+
+// encodeHeader returns the value of the named header ready to send: values
+// holding non-ASCII characters become RFC 2047 encoded-words (see
+// encodeWords), and in address headers only the display names are encoded.
+// Other values are returned as they are.
+func encodeHeader(name, value string) string {
+	if isASCII(value) {
+		return value
+	}
+	for _, header := range addressHeaders {
+		if strings.EqualFold(name, header) {
+			if addrs, err := mail.ParseAddressList(value); err == nil {
+				formatted := make([]string, len(addrs))
+				for i, addr := range addrs {
+					formatted[i] = addr.String()
+				}
+				return strings.Join(formatted, ", ")
+			}
+		}
+	}
+
+	return encodeWords(name, value)
+}
+
+// encodeWords returns value as RFC 2047 encoded-words in Q or B encoding,
+// whichever is shorter, one per line. The encoder splits the value between
+// characters into words of at most 75 characters; a first word too long to
+// share its line with the name, within maxEncodedLine, starts on the next
+// line. The spaces folding them are not part of the text.
+func encodeWords(name, value string) string {
+	encoded := mime.QEncoding.Encode("utf-8", value)
+	if b := mime.BEncoding.Encode("utf-8", value); len(b) < len(encoded) {
+		encoded = b
+	}
+
+	words := strings.Fields(encoded)
+	folded := strings.Join(words, "\r\n ")
+	if len(name)+len(": ")+len(words[0]) > maxEncodedLine {
+		return "\r\n " + folded
+	}
+	return folded
+}
+
+// isASCII reports whether s holds only ASCII characters
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// headerLine returns a header field ready to send, folded by foldHeader
+func headerLine(name, value string) string {
+	folded := foldHeader(name, value)
+	// A value starting on a continuation line has its space there
+	if strings.HasPrefix(folded, "\r\n") {
+		return name + ":" + folded + "\r\n"
+	}
+	return name + ": " + folded + "\r\n"
+}
+
+// foldHeader returns the value of the named header with a CRLF inserted
+// before spaces, so that its lines stay within maxHeaderLine where its words
+// allow. Spaces inside quoted strings and angle-bracketed addresses are left
+// alone, and encoded-words hold none. Removing the CRLFs gives back the value,
+// unless a word would make a line longer than maxLineLength, which it is then
+// split to stay within (see hardWrap). Values already folded, such as by
+// encodeWords, are returned as they are.
+func foldHeader(name, value string) string {
+	if strings.Contains(value, "\r\n") || len(name)+len(": ")+len(value) <= maxHeaderLine {
+		return value
+	}
+
+	// Find the spaces a line may be broken before
+	var breaks []int
+	quoted, angle := false, false
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '"':
+			quoted = !quoted
+		case c == '<' && !quoted:
+			angle = true
+		case c == '>' && !quoted:
+			angle = false
+		case c == ' ' && i > 0 && !quoted && !angle:
+			breaks = append(breaks, i)
+		}
+	}
+	breaks = append(breaks, len(value))
+
+	// Break before the last space that keeps each line short enough
+	var folded strings.Builder
+	start, indent := 0, len(name)+len(": ")
+	last := start
+	for _, end := range breaks {
+		if indent+end-start > maxHeaderLine && last > start {
+			folded.WriteString(hardWrap(value[start:last], indent))
+			folded.WriteString("\r\n")
+			start, indent = last, 0
+		}
+		last = end
+	}
+	folded.WriteString(hardWrap(value[start:], indent))
+	return folded.String()
+}
+
+// hardWrap splits a line that starts indent characters in and has no space
+// left to fold at, so that no line is longer than maxLineLength, the RFC 5322
+// limit. Each continuation line starts with a space that is not in the value.
+func hardWrap(line string, indent int) string {
+	var wrapped strings.Builder
+	for indent+len(line) > maxLineLength {
+		n := max(maxLineLength-indent, 1)
+		wrapped.WriteString(line[:n])
+		wrapped.WriteString("\r\n ")
+		line, indent = line[n:], len(" ")
+	}
+	wrapped.WriteString(line)
+	return wrapped.String()
+}
@@ -0,0 +1,116 @@
+package message
+
+import (
+	"encoding/base64"
+	"mime"
+	"strings"
+)
+
+// boundaryLength and alternativeBoundaryLength are the lengths of the
+// multipart/mixed and multipart/alternative boundaries generated by Build
+var (
+	boundaryLength            = len(newBoundary("boundary"))
+	alternativeBoundaryLength = len(newBoundary("alternative"))
+)
+
+// EstimateSize returns the approximate size in bytes of the message produced
+// by Build, without encoding attachments or assembling the message. Bodies
+// count as they are, attachments at their base64-encoded size. The estimate
+// can be checked against the SIZE limit a server advertises before sending.
+func (m *Message) EstimateSize() int {
+	if m.Raw != nil {
+		return len(m.rawContent())
+	}
+	size := 0
+	header := func(key, value string) {
+		size += len(headerLine(key, value))
+	}
+
+	if m.Received != "" {
+		header("Received", m.Received)
+	}
+	header("From", formatAddress(m.FromName, m.From))
+	header("To", strings.Join(m.toHeader(), ", "))
+	if len(m.Cc) > 0 {
+		header("Cc", strings.Join(m.Cc, ", "))
+	}
+	header("Subject", encodeHeader("Subject", m.Subject))
+	header("Date", m.dateHeader())
+	if m.mimeVersion() {
+		header("MIME-Version", "1.0")
+	}
+	if id := m.messageID(); id != "" {
+		header("Message-ID", id)
+	}
+	for key, value := range m.Headers {
+		header(m.headerKey(key), encodeHeader(key, value))
+	}
+
+	if len(m.Attachments) == 0 && m.HTMLBody == "" {
+		if !m.MinimalHeaders {
+			header("Content-Type", "text/plain; charset=utf-8")
+		}
+		return size + len("\r\n") + len(m.textBody())
+	}
+
+	// Each part starts with a "--boundary" line and the message ends with "--boundary--"
+	bodies := func(boundaryLength int) {
+		for _, part := range []struct{ contentType, body string }{
+			{"text/plain; charset=utf-8", m.textBody()},
+			{"text/html; charset=utf-8", m.htmlBody()},
+		} {
+			if part.body != "" {
+				size += len("--") + boundaryLength + len("\r\n")
+				header("Content-Type", part.contentType)
+				size += len("\r\n") + len(part.body) + len("\r\n")
+			}
+		}
+	}
+	alternatives := func() {
+		header("Content-Type", "multipart/alternative; boundary="+strings.Repeat("x", alternativeBoundaryLength))
+		size += len("\r\n")
+		bodies(alternativeBoundaryLength)
+		size += len("--") + alternativeBoundaryLength + len("--\r\n")
+	}
+	if len(m.Attachments) == 0 && m.hasAlternatives() {
+		alternatives()
+		return size
+	}
+
+	delimiter := len("--") + boundaryLength + len("\r\n")
+	header("Content-Type", "multipart/mixed; boundary="+strings.Repeat("x", boundaryLength))
+	size += len("\r\n")
+	if m.hasAlternatives() {
+		size += delimiter
+		alternatives()
+	} else {
+		bodies(boundaryLength)
+	}
+	for _, attachment := range m.Attachments {
+		size += delimiter
+		header("Content-Type", attachment.ContentType)
+		header("Content-Transfer-Encoding", attachment.transferEncoding())
+		header("Content-Disposition", mime.FormatMediaType(attachment.disposition(),
+			map[string]string{"filename": mime.QEncoding.Encode("utf-8", attachment.Filename)}))
+		if attachment.ContentID != "" {
+			header("Content-ID", "<"+attachment.ContentID+">")
+		}
+		if attachment.isMessage() {
+			size += len("\r\n") + len(attachment.messageBody())
+			continue
+		}
+		size += len("\r\n") + encodedSize(len(attachment.Content))
+	}
+	return size + delimiter + len("--")
+}
+
+// encodedSize returns the length of n bytes of attachment content once
+// encoded, which base64 expands by a third, with a CRLF ending each line
+func encodedSize(n int) int {
+	encoded := base64.StdEncoding.EncodedLen(n)
+	lines := (encoded + base64LineLength - 1) / base64LineLength
+	if lines == 0 {
+		lines = 1
+	}
+	return encoded + lines*len("\r\n")
+}
@@ -0,0 +1,80 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// frontMatterDelimiter opens and closes the YAML front-matter block
+const frontMatterDelimiter = "---"
+
+// MessageFile is a self-contained message definition: YAML front-matter with
+// the envelope and headers, followed by a body template
+type MessageFile struct {
+	From    string            `yaml:"from"`
+	To      []string          `yaml:"to"`
+	Cc      []string          `yaml:"cc"`
+	Bcc     []string          `yaml:"bcc"`
+	Subject string            `yaml:"subject"`
+	Headers map[string]string `yaml:"headers"`
+	// Body is the template source following the front-matter
+	Body string `yaml:"-"`
+}
+
+// ReadMessageFile reads and parses a message file
+func ReadMessageFile(filename string) (*MessageFile, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message file: %v", err)
+	}
+	return ParseMessageFile(data)
+}
+
+// ParseMessageFile splits a message file into its front-matter and body. A
+// file that does not start with "---" has no front-matter and is all body.
+func ParseMessageFile(data []byte) (*MessageFile, error) {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	mf := &MessageFile{}
+
+	first, rest, _ := bytes.Cut(data, []byte("\n"))
+	if string(bytes.TrimSpace(first)) != frontMatterDelimiter {
+		mf.Body = string(data)
+		return mf, nil
+	}
+
+	// Find the closing delimiter line
+	var frontMatter []byte
+	closed := false
+	for len(rest) > 0 {
+		var line []byte
+		line, rest, _ = bytes.Cut(rest, []byte("\n"))
+		if string(bytes.TrimSpace(line)) == frontMatterDelimiter {
+			closed = true
+			break
+		}
+		frontMatter = append(frontMatter, line...)
+		frontMatter = append(frontMatter, '\n')
+	}
+	if !closed {
+		return nil, fmt.Errorf("front-matter is not closed with %q", frontMatterDelimiter)
+	}
+
+	if err := yaml.Unmarshal(frontMatter, mf); err != nil {
+		return nil, fmt.Errorf("failed to parse front-matter: %v", err)
+	}
+	for key, value := range mf.Headers {
+		if err := ValidateHeader(key, value); err != nil {
+			return nil, fmt.Errorf("invalid front-matter header: %v", err)
+		}
+	}
+	mf.Body = string(rest)
+	return mf, nil
+}
+
+// Template parses the subject and body as templates
+func (mf *MessageFile) Template() (*Template, error) {
+	return LoadTemplateFromString(mf.Subject, mf.Body, "")
+}
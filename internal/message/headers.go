@@ -0,0 +1,66 @@
+package message
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ParseHeaderLines parses headers in standard "Key: Value" format, one per
+// line. Lines starting with whitespace continue (fold) the previous header,
+// and blank lines and lines starting with '#' are ignored.
+func ParseHeaderLines(r io.Reader) (map[string]string, error) {
+	headers := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+
+	var key string
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		// Folded continuation of the previous header
+		if line != "" && (line[0] == ' ' || line[0] == '\t') {
+			if key == "" {
+				return nil, fmt.Errorf("line %d: continuation line without a header", lineNum)
+			}
+			headers[key] = headers[key] + " " + strings.TrimSpace(line)
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			key = ""
+			continue
+		}
+
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: expected \"Key: Value\", got %q", lineNum, line)
+		}
+		key = strings.TrimSpace(parts[0])
+		headers[key] = strings.TrimSpace(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read headers: %v", err)
+	}
+
+	for k, v := range headers {
+		if err := ValidateHeader(k, v); err != nil {
+			return nil, err
+		}
+	}
+	return headers, nil
+}
+
+// ReadHeadersFile reads headers from a file in the format accepted by ParseHeaderLines
+func ReadHeadersFile(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open headers file: %v", err)
+	}
+	defer f.Close()
+
+	return ParseHeaderLines(f)
+}
@@ -2,12 +2,17 @@ package message
 
 import (
 	"bytes"
-	"encoding/base64"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"mime"
+	"io"
+	mathrand "math/rand"
+	"net/mail"
+	"net/textproto"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 )
@@ -24,13 +29,57 @@ type Message struct {
 	Headers     map[string]string
 	Attachments []Attachment
 	Date        time.Time
+	// AutoBody adds a placeholder text part to attachment-only messages
+	AutoBody bool
+	// PreserveHeaderCase emits custom header names exactly as given instead of canonicalizing them
+	PreserveHeaderCase bool
+	// Received, if set, is emitted as a Received: trace header above all other headers
+	Received string
+	// FromName is the sender's display name in the From header; the envelope
+	// sender stays the bare From address
+	FromName string
+	// ToNames holds display names for the To addresses, by position
+	ToNames []string
+	// MessageID pins the Message-ID; when it is empty (and no Message-ID header
+	// is set) one is generated and kept until Reset
+	MessageID string
+	// NoMessageID leaves out the generated Message-ID, e.g. so that tests get
+	// the same output from every build; a pinned one is still emitted
+	NoMessageID bool
+	// DateFormat is the Go time layout of the Date header, by default
+	// time.RFC1123Z; it must give RFC 5322 dates (see ValidateDateFormat)
+	DateFormat string
+	// MinimalHeaders leaves out the headers the builder adds on its own: a
+	// generated Message-ID, MIME-Version, and Content-Type for plain text
+	MinimalHeaders bool
+	// KeepLineEndings sends the text and HTML bodies with their line endings
+	// as given instead of converting them to CRLF
+	KeepLineEndings bool
+	// ShuffleHeaders puts the Message-ID and custom headers in a random order,
+	// drawn from ShuffleSeed, after From, To, Cc, Subject and Date
+	ShuffleHeaders bool
+	ShuffleSeed    int64
+	// Raw, if set, is sent as the whole content instead of one built from the
+	// other fields, below the Received header if there is one (see ParseEML)
+	Raw []byte
+
+	// generatedID is the Message-ID generated for this send, so that retries
+	// and size estimates all carry the same one
+	generatedID string
 }
 
+// AutoBodyText is the placeholder text used for attachment-only messages when AutoBody is set
+const AutoBodyText = "See attached."
+
 // Attachment represents an email attachment
 type Attachment struct {
 	Filename    string
 	ContentType string
 	Content     []byte
+	// Inline displays the attachment within the HTML body instead of as a download
+	Inline bool
+	// ContentID lets the HTML body reference an inline attachment as cid:<ContentID>
+	ContentID string
 }
 
 // NewMessage creates a new email message
@@ -86,6 +135,68 @@ func (m *Message) SetDate(date time.Time) {
 	m.Date = date
 }
 
+// Reset prepares the message to be sent again by setting its Date to now.
+// Unless pinned with MessageID or a Message-ID header, the next Build
+// generates a new Message-ID; until then every build reuses the last one.
+func (m *Message) Reset() {
+	m.Date = time.Now()
+	m.generatedID = ""
+}
+
+// SetMessageID pins the Message-ID used by every build, adding the angle
+// brackets if id has none. An empty id goes back to a generated one.
+func (m *Message) SetMessageID(id string) {
+	m.MessageID = msgID(id)
+}
+
+// PinMessageID fixes the Message-ID used by later builds, generating one if
+// none is set, so that a saved copy of the message matches the one sent.
+// With MinimalHeaders or NoMessageID no Message-ID is generated.
+func (m *Message) PinMessageID() {
+	if m.MessageID == "" && !m.MinimalHeaders && !m.NoMessageID {
+		m.MessageID = GenerateMessageID(domainOf(m.From))
+	}
+}
+
+// formatAddress returns addr with its display name, quoted or encoded as
+// needed, or addr alone when there is no name
+func formatAddress(name, addr string) string {
+	if name == "" {
+		return addr
+	}
+	return (&mail.Address{Name: name, Address: addr}).String()
+}
+
+// toHeader returns the To addresses with their display names
+func (m *Message) toHeader() []string {
+	to := make([]string, len(m.To))
+	for i, addr := range m.To {
+		name := ""
+		if i < len(m.ToNames) {
+			name = m.ToNames[i]
+		}
+		to[i] = formatAddress(name, addr)
+	}
+	return to
+}
+
+// messageID returns the Message-ID to emit, or "" when a Message-ID header is
+// set and will be emitted with the custom headers
+func (m *Message) messageID() string {
+	for key := range m.Headers {
+		if strings.EqualFold(key, "Message-ID") {
+			return ""
+		}
+	}
+	if m.MessageID != "" || m.MinimalHeaders || m.NoMessageID {
+		return m.MessageID
+	}
+	if m.generatedID == "" {
+		m.generatedID = GenerateMessageID(domainOf(m.From))
+	}
+	return m.generatedID
+}
+
 // AddHeader adds a custom header to the message
 func (m *Message) AddHeader(key, value string) {
 	m.Headers[key] = value
@@ -93,113 +204,544 @@ func (m *Message) AddHeader(key, value string) {
 
 // AddAttachment adds an attachment to the message
 func (m *Message) AddAttachment(filename string) error {
+	return m.AddAttachmentAs(filename, "")
+}
+
+// AddAttachmentAs adds the file as an attachment shown to the recipient as
+// name, or under its own base name if name is empty. A name already used by
+// another attachment gets a numbered suffix, e.g. "report (2).pdf".
+func (m *Message) AddAttachmentAs(filename, name string) error {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		return err
 	}
+	if name == "" {
+		name = filepath.Base(filename)
+	}
 
 	contentType := "application/octet-stream"
 	m.Attachments = append(m.Attachments, Attachment{
-		Filename:    filepath.Base(filename),
+		Filename:    m.uniqueFilename(name),
 		ContentType: contentType,
 		Content:     data,
 	})
 	return nil
 }
 
+// uniqueFilename returns name, numbered if another attachment already uses
+// it. Names are compared case-insensitively since many clients save them to
+// case-insensitive file systems.
+func (m *Message) uniqueFilename(name string) string {
+	used := func(candidate string) bool {
+		for _, attachment := range m.Attachments {
+			if strings.EqualFold(attachment.Filename, candidate) {
+				return true
+			}
+		}
+		return false
+	}
+	if !used(name) {
+		return name
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for n := 2; ; n++ {
+		if candidate := fmt.Sprintf("%s (%d)%s", base, n, ext); !used(candidate) {
+			return candidate
+		}
+	}
+}
+
+// AddMessageAttachment attaches the email message in the file, such as a
+// saved .eml, as a message/rfc822 part so that clients show it as a
+// forwarded message
+func (m *Message) AddMessageAttachment(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return m.attachMessage(data, filepath.Base(filename))
+}
+
+// AttachMessage builds inner and attaches it as a message/rfc822 part
+func (m *Message) AttachMessage(inner *Message) error {
+	data, err := inner.Build()
+	if err != nil {
+		return fmt.Errorf("failed to build attached message: %v", err)
+	}
+	return m.attachMessage([]byte(data), "forwarded.eml")
+}
+
+// attachMessage adds data, which must parse as an email message, as a
+// message/rfc822 attachment
+func (m *Message) attachMessage(data []byte, name string) error {
+	if _, err := mail.ReadMessage(bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("not an email message: %v", err)
+	}
+	m.Attachments = append(m.Attachments, Attachment{
+		Filename:    m.uniqueFilename(name),
+		ContentType: MessageContentType,
+		Content:     data,
+	})
+	return nil
+}
+
+// AddInline adds an attachment to be displayed within the HTML body and
+// returns its Content-ID, generating one if the attachment has none
+func (m *Message) AddInline(attachment Attachment) string {
+	attachment.Inline = true
+	if attachment.ContentID == "" {
+		attachment.ContentID = GenerateContentID(domainOf(m.From))
+	}
+	m.Attachments = append(m.Attachments, attachment)
+	return attachment.ContentID
+}
+
+// ContentID returns the Content-ID of the inline attachment with the given file name
+func (m *Message) ContentID(filename string) (string, error) {
+	for _, attachment := range m.Attachments {
+		if attachment.Inline && attachment.Filename == filename {
+			return attachment.ContentID, nil
+		}
+	}
+	return "", fmt.Errorf("no inline attachment named %q", filename)
+}
+
+// Recipients returns the envelope recipients (To, Cc and Bcc), dropping
+// duplicates by their normalized address
+func (m *Message) Recipients() []string {
+	seen := make(map[string]bool)
+	recipients := make([]string, 0, len(m.To)+len(m.Cc)+len(m.Bcc))
+	for _, list := range [][]string{m.To, m.Cc, m.Bcc} {
+		for _, recipient := range list {
+			if key := NormalizeAddress(recipient); !seen[key] {
+				seen[key] = true
+				recipients = append(recipients, recipient)
+			}
+		}
+	}
+	return recipients
+}
+
+// RecipientDomains returns the distinct domains of the envelope recipients,
+// lowercased, in the order they first appear
+func (m *Message) RecipientDomains() []string {
+	seen := make(map[string]bool)
+	var domains []string
+	for _, recipient := range m.Recipients() {
+		if domain := strings.ToLower(domainOf(recipient)); !seen[domain] {
+			seen[domain] = true
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+// PartCount returns the number of MIME body parts Build produces
+func (m *Message) PartCount() int {
+	if len(m.Attachments) == 0 && m.HTMLBody == "" {
+		return 1
+	}
+	parts := len(m.Attachments)
+	if m.textBody() != "" {
+		parts++
+	}
+	if m.HTMLBody != "" {
+		parts++
+	}
+	return parts
+}
+
+// Clone returns a copy of the message that can be modified independently
+func (m *Message) Clone() *Message {
+	clone := *m
+	clone.To = append([]string(nil), m.To...)
+	clone.Cc = append([]string(nil), m.Cc...)
+	clone.Bcc = append([]string(nil), m.Bcc...)
+	clone.ToNames = append([]string(nil), m.ToNames...)
+	clone.Attachments = append([]Attachment(nil), m.Attachments...)
+	clone.Headers = make(map[string]string, len(m.Headers))
+	for k, v := range m.Headers {
+		clone.Headers[k] = v
+	}
+	return &clone
+}
+
+// Unique returns a copy of the message with a fresh Message-ID and a random
+// token injected into the subject and body, so relays treat repeated sends as
+// distinct messages
+func (m *Message) Unique() *Message {
+	clone := m.Clone()
+	token := randomToken(8)
+
+	clone.Headers["Message-ID"] = GenerateMessageID(domainOf(m.From))
+	clone.Subject = fmt.Sprintf("%s [%s]", m.Subject, token)
+	if clone.Body != "" || clone.HTMLBody == "" {
+		clone.Body = fmt.Sprintf("%s\r\n\r\nToken: %s\r\n", clone.Body, token)
+	}
+	if clone.HTMLBody != "" {
+		clone.HTMLBody = fmt.Sprintf("%s\r\n<!-- token: %s -->\r\n", clone.HTMLBody, token)
+	}
+	return clone
+}
+
+// Reply returns a copy of the message that answers it, for building a thread:
+// the subject gets a "Re: " prefix, In-Reply-To names this message's
+// Message-ID and References lists this message's references followed by that
+// ID. The reply gets its own pinned Message-ID. This message's Message-ID must
+// be pinned, with PinMessageID or a Message-ID header, so it matches the one sent.
+func (m *Message) Reply() (*Message, error) {
+	parentID := m.MessageID
+	if id := m.header("Message-ID"); id != "" {
+		parentID = id
+	}
+	if parentID == "" {
+		return nil, fmt.Errorf("cannot reply to a message without a pinned Message-ID")
+	}
+
+	reply := m.Clone()
+	reply.setHeader("Message-ID", "")
+	reply.setHeader("References", "")
+	reply.MessageID = GenerateMessageID(domainOf(m.From))
+	reply.SetInReplyTo(parentID)
+	for _, id := range strings.Fields(m.header("References")) {
+		reply.AddReference(id)
+	}
+	reply.AddReference(parentID)
+	if !strings.HasPrefix(strings.ToLower(m.Subject), "re:") {
+		reply.Subject = "Re: " + m.Subject
+	}
+	return reply, nil
+}
+
+// ReceivedHeader returns the value of an RFC 5321 section 4.4 Received: trace
+// header recording a hop from the from host to the by host using protocol with
+func ReceivedHeader(from, by, with string, date time.Time) string {
+	return fmt.Sprintf("from %s by %s with %s; %s", from, by, with, date.Format(time.RFC1123Z))
+}
+
+// GenerateMessageID returns a new RFC 5322 Message-ID for the given domain, or
+// for this host without one. The 128 random bits come from crypto/rand, so
+// that IDs do not collide across hosts and processes.
+func GenerateMessageID(domain string) string {
+	if domain == "" {
+		domain = localDomain()
+	}
+	return fmt.Sprintf("<%d.%s@%s>", time.Now().UnixNano(), randomToken(16), domain)
+}
+
+// GenerateContentID returns a new unique Content-ID, without angle brackets,
+// for the given domain, or for this host without one
+func GenerateContentID(domain string) string {
+	if domain == "" {
+		domain = localDomain()
+	}
+	return fmt.Sprintf("%s@%s", randomToken(12), domain)
+}
+
+// TraceIDHeader carries the correlation id set by --trace-id
+const TraceIDHeader = "X-Trace-Id"
+
+// GenerateTraceID returns a new random (version 4) UUID for correlating a message
+func GenerateTraceID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand should never fail; fall back to the clock
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// randomToken returns n random bytes encoded as hex
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand should never fail; fall back to the clock
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// localDomain returns the host name to identify messages by when the sender
+// has no domain
+func localDomain() string {
+	if host, err := os.Hostname(); err == nil && host != "" && !strings.ContainsAny(host, " <>@") {
+		return host
+	}
+	return "localhost"
+}
+
+// domainOf returns the domain part of an email address
+func domainOf(addr string) string {
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		return strings.Trim(addr[i+1:], "> ")
+	}
+	return ""
+}
+
 // Validate checks if the message has all required fields
 func (m *Message) Validate() error {
+	return m.validate(true)
+}
+
+// ErrBodyRequired is reported by Validate for a message with no body or
+// attachments. Build accepts such a message and sends only the headers.
+var ErrBodyRequired = errors.New("body is required")
+
+// ValidateAll checks the required fields and returns every problem found
+func (m *Message) ValidateAll() []error {
+	return m.validateAll(true)
+}
+
+// validate returns the first missing field, optionally allowing a header-only message
+func (m *Message) validate(requireBody bool) error {
+	if errs := m.validateAll(requireBody); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// validateAll checks the required fields, optionally allowing a header-only message
+func (m *Message) validateAll(requireBody bool) []error {
+	var errs []error
 	if m.From == "" {
-		return errors.New("from address is required")
+		errs = append(errs, errors.New("from address is required"))
 	}
 	if len(m.To) == 0 {
-		return errors.New("at least one recipient is required")
+		errs = append(errs, errors.New("at least one recipient is required"))
 	}
 	if m.Subject == "" {
-		return errors.New("subject is required")
+		errs = append(errs, errors.New("subject is required"))
 	}
-	if m.Body == "" && m.HTMLBody == "" && len(m.Attachments) == 0 {
-		return errors.New("body is required")
+	if requireBody && m.Body == "" && m.HTMLBody == "" && len(m.Attachments) == 0 {
+		errs = append(errs, ErrBodyRequired)
 	}
 	if m.Date.IsZero() {
-		return errors.New("date is required")
+		errs = append(errs, errors.New("date is required"))
+	}
+	if m.DateFormat != "" {
+		if err := ValidateDateFormat(m.DateFormat); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// dateHeader returns the Date header value in DateFormat
+func (m *Message) dateHeader() string {
+	if m.DateFormat == "" {
+		return m.Date.Format(time.RFC1123Z)
+	}
+	return m.Date.Format(m.DateFormat)
+}
+
+// ErrFlattenedAlternatives is reported by CheckAlternatives when the text and
+// HTML bodies could not be sent in a structure that lets clients pick one
+var ErrFlattenedAlternatives = errors.New("text and HTML bodies cannot be sent as alternatives")
+
+// CheckAlternatives checks that a message with both a text and an HTML body
+// can send them as a multipart/alternative, failing with
+// ErrFlattenedAlternatives when MinimalHeaders leaves out the MIME headers
+// needed to keep them apart
+func (m *Message) CheckAlternatives() error {
+	if m.Body != "" && m.HTMLBody != "" && m.MinimalHeaders {
+		return fmt.Errorf("%w: minimal headers leave out the MIME headers that separate them, so both would be shown as one text", ErrFlattenedAlternatives)
 	}
 	return nil
 }
 
-// Build constructs the complete email message as a string
+// hasAlternatives reports whether the message has both a text and an HTML
+// body, sent as a multipart/alternative
+func (m *Message) hasAlternatives() bool {
+	return m.textBody() != "" && m.HTMLBody != ""
+}
+
+// newBoundary returns a multipart boundary for the given kind of multipart
+func newBoundary(kind string) string {
+	return fmt.Sprintf("_%s_%d_", kind, time.Now().UnixNano())
+}
+
+// writePart writes a body part of the multipart with the given boundary
+func writePart(w io.Writer, boundary, contentType, body string) {
+	fmt.Fprintf(w, "--%s\r\n%s\r\n%s\r\n", boundary, headerLine("Content-Type", contentType), body)
+}
+
+// writeAlternatives writes the text and HTML bodies as the parts of a
+// multipart/alternative with the given boundary. RFC 2046 section 5.1.4 puts
+// the preferred version last, so plain text comes first.
+func (m *Message) writeAlternatives(w io.Writer, boundary string) {
+	writePart(w, boundary, "text/plain; charset=utf-8", m.textBody())
+	writePart(w, boundary, "text/html; charset=utf-8", m.htmlBody())
+	fmt.Fprintf(w, "--%s--\r\n", boundary)
+}
+
+// writeBodies writes the bodies as parts of the multipart/mixed with the given
+// boundary, nesting a text and an HTML body in a multipart/alternative
+func (m *Message) writeBodies(w io.Writer, boundary string) {
+	if m.hasAlternatives() {
+		alternative := newBoundary("alternative")
+		fmt.Fprintf(w, "--%s\r\n%s\r\n", boundary, headerLine("Content-Type", "multipart/alternative; boundary="+alternative))
+		m.writeAlternatives(w, alternative)
+		return
+	}
+	if body := m.textBody(); body != "" {
+		writePart(w, boundary, "text/plain; charset=utf-8", body)
+	}
+	if m.HTMLBody != "" {
+		writePart(w, boundary, "text/html; charset=utf-8", m.htmlBody())
+	}
+}
+
+// extraHeaders returns the Message-ID and custom header lines: the Message-ID
+// first and custom headers sorted by name, or all in an order shuffled with
+// ShuffleSeed when ShuffleHeaders is set
+func (m *Message) extraHeaders() []string {
+	var lines []string
+	if id := m.messageID(); id != "" {
+		lines = append(lines, headerLine("Message-ID", id))
+	}
+	keys := make([]string, 0, len(m.Headers))
+	for key := range m.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, headerLine(m.headerKey(key), encodeHeader(key, m.Headers[key])))
+	}
+	if m.ShuffleHeaders {
+		shuffle := mathrand.New(mathrand.NewSource(m.ShuffleSeed))
+		shuffle.Shuffle(len(lines), func(i, j int) { lines[i], lines[j] = lines[j], lines[i] })
+	}
+	return lines
+}
+
+// headerKey returns the header name as it should be emitted. Standard headers
+// are converted to their canonical form (e.g. "message-id" becomes
+// "Message-Id") while X- headers and names under PreserveHeaderCase are kept
+// as given.
+func (m *Message) headerKey(key string) string {
+	if m.PreserveHeaderCase || len(key) >= 2 && strings.EqualFold(key[:2], "X-") {
+		return key
+	}
+	return textproto.CanonicalMIMEHeaderKey(key)
+}
+
+// textBody returns the plain text body with CRLF line endings, substituting
+// AutoBodyText for attachment-only messages when AutoBody is set
+func (m *Message) textBody() string {
+	if m.AutoBody && m.Body == "" && m.HTMLBody == "" && len(m.Attachments) > 0 {
+		return AutoBodyText
+	}
+	return m.lineEndings(m.Body)
+}
+
+// htmlBody returns the HTML body with CRLF line endings
+func (m *Message) htmlBody() string {
+	return m.lineEndings(m.HTMLBody)
+}
+
+// lineEndings converts LF, CR and CRLF line endings in body to CRLF unless
+// KeepLineEndings is set
+func (m *Message) lineEndings(body string) string {
+	if m.KeepLineEndings {
+		return body
+	}
+	return NormalizeLineEndings(body)
+}
+
+// NormalizeLineEndings converts every line ending in s, whether LF, CR or
+// CRLF, to CRLF as SMTP requires
+func NormalizeLineEndings(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.ReplaceAll(s, "\r", "\n")
+	return strings.ReplaceAll(s, "\n", "\r\n")
+}
+
+// Build constructs the complete email message as a string. A message without
+// a body is allowed and produces the headers followed by an empty body.
 func (m *Message) Build() (string, error) {
-	if err := m.Validate(); err != nil {
+	if m.Raw != nil {
+		return m.rawContent(), nil
+	}
+	if err := m.validate(false); err != nil {
 		return "", err
 	}
 
 	var builder strings.Builder
 
+	// Trace headers go above all others
+	if m.Received != "" {
+		builder.WriteString(headerLine("Received", m.Received))
+	}
+
 	// Add standard headers
-	builder.WriteString(fmt.Sprintf("From: %s\r\n", m.From))
-	builder.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(m.To, ", ")))
+	builder.WriteString(headerLine("From", formatAddress(m.FromName, m.From)))
+	builder.WriteString(headerLine("To", strings.Join(m.toHeader(), ", ")))
 	if len(m.Cc) > 0 {
-		builder.WriteString(fmt.Sprintf("Cc: %s\r\n", strings.Join(m.Cc, ", ")))
+		builder.WriteString(headerLine("Cc", strings.Join(m.Cc, ", ")))
+	}
+	builder.WriteString(headerLine("Subject", encodeHeader("Subject", m.Subject)))
+	builder.WriteString(headerLine("Date", m.dateHeader()))
+	if m.mimeVersion() {
+		builder.WriteString(headerLine("MIME-Version", "1.0"))
 	}
-	builder.WriteString(fmt.Sprintf("Subject: %s\r\n", m.Subject))
-	builder.WriteString(fmt.Sprintf("Date: %s\r\n", m.Date.Format(time.RFC1123Z)))
 
-	// Add custom headers
-	for key, value := range m.Headers {
-		builder.WriteString(fmt.Sprintf("%s: %s\r\n", key, value))
+	// Add the Message-ID and custom headers
+	for _, line := range m.extraHeaders() {
+		builder.WriteString(line)
 	}
 
 	// Handle message body and attachments
-	if len(m.Attachments) > 0 || m.HTMLBody != "" {
+	if len(m.Attachments) == 0 && m.hasAlternatives() {
+		// Text and HTML only: the alternatives are the whole message
+		boundary := newBoundary("alternative")
+		builder.WriteString(headerLine("Content-Type", "multipart/alternative; boundary="+boundary))
+		builder.WriteString("\r\n")
+		m.writeAlternatives(&builder, boundary)
+	} else if len(m.Attachments) > 0 || m.HTMLBody != "" {
 		// Create multipart boundary
-		boundary := fmt.Sprintf("_boundary_%d_", time.Now().UnixNano())
-		builder.WriteString(fmt.Sprintf("Content-Type: multipart/mixed; boundary=%s\r\n", boundary))
+		boundary := newBoundary("boundary")
+		builder.WriteString(headerLine("Content-Type", "multipart/mixed; boundary="+boundary))
 		builder.WriteString("\r\n")
 
-		// Add text body
-		if m.Body != "" {
-			builder.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-			builder.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
-			builder.WriteString("\r\n")
-			builder.WriteString(m.Body)
-			builder.WriteString("\r\n")
-		}
-
-		// Add HTML body if present
-		if m.HTMLBody != "" {
-			builder.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-			builder.WriteString("Content-Type: text/html; charset=utf-8\r\n")
-			builder.WriteString("\r\n")
-			builder.WriteString(m.HTMLBody)
-			builder.WriteString("\r\n")
-		}
+		// Add the text and HTML bodies
+		m.writeBodies(&builder, boundary)
 
 		// Add attachments
-		for _, attachment := range m.Attachments {
-			builder.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-			builder.WriteString(fmt.Sprintf("Content-Type: %s\r\n", attachment.ContentType))
-			builder.WriteString("Content-Transfer-Encoding: base64\r\n")
-			builder.WriteString(fmt.Sprintf("Content-Disposition: attachment; filename=%s\r\n",
-				mime.QEncoding.Encode("utf-8", attachment.Filename)))
-			builder.WriteString("\r\n")
-			builder.WriteString(base64.StdEncoding.EncodeToString(attachment.Content))
-			builder.WriteString("\r\n")
+		for i := range m.Attachments {
+			m.Attachments[i].writePart(&builder, boundary)
 		}
 
 		// End multipart
 		builder.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
 	} else {
 		// Simple text message
-		builder.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		if !m.MinimalHeaders {
+			builder.WriteString(headerLine("Content-Type", "text/plain; charset=utf-8"))
+		}
 		builder.WriteString("\r\n")
-		builder.WriteString(m.Body)
+		builder.WriteString(m.textBody())
 	}
 
 	return builder.String(), nil
 }
 
+// mimeVersion reports whether the builder adds MIME-Version: 1.0, which it
+// does unless MinimalHeaders is set or a MIME-Version header is given
+func (m *Message) mimeVersion() bool {
+	return !m.MinimalHeaders && m.header("MIME-Version") == ""
+}
+
 // BuildMessage constructs the complete email message as a byte slice
 func (m *Message) BuildMessage() ([]byte, error) {
+	if m.Raw != nil {
+		return []byte(m.rawContent()), nil
+	}
 	// Only validate if there's a body or attachments
 	if m.Body != "" || m.HTMLBody != "" || len(m.Attachments) > 0 {
 		if err := m.Validate(); err != nil {
@@ -209,85 +751,93 @@ func (m *Message) BuildMessage() ([]byte, error) {
 
 	var buf bytes.Buffer
 
+	// Trace headers go above all others
+	if m.Received != "" {
+		buf.WriteString(headerLine("Received", m.Received))
+	}
+
 	// Set default headers
 	headers := map[string]string{
-		"From":         m.From,
-		"To":           strings.Join(m.To, ","),
-		"Subject":      m.Subject,
-		"Date":         m.Date.Format(time.RFC1123Z),
-		"MIME-Version": "1.0",
+		"From":    formatAddress(m.FromName, m.From),
+		"To":      strings.Join(m.toHeader(), ", "),
+		"Subject": encodeHeader("Subject", m.Subject),
+		"Date":    m.dateHeader(),
+	}
+	if m.mimeVersion() {
+		headers["MIME-Version"] = "1.0"
 	}
 
 	// Add CC if present
 	if len(m.Cc) > 0 {
-		headers["Cc"] = strings.Join(m.Cc, ",")
+		headers["Cc"] = strings.Join(m.Cc, ", ")
 	}
 
 	// Add BCC if present
 	if len(m.Bcc) > 0 {
-		headers["Bcc"] = strings.Join(m.Bcc, ",")
+		headers["Bcc"] = strings.Join(m.Bcc, ", ")
+	}
+
+	if id := m.messageID(); id != "" {
+		headers["Message-ID"] = id
 	}
 
 	// Add custom headers
 	for k, v := range m.Headers {
-		headers[k] = v
+		headers[m.headerKey(k)] = encodeHeader(k, v)
 	}
 
 	// Handle attachments
 	if len(m.Attachments) > 0 {
-		boundary := fmt.Sprintf("_boundary_%d_", time.Now().UnixNano())
+		boundary := newBoundary("boundary")
 		headers["Content-Type"] = fmt.Sprintf("multipart/mixed; boundary=%s", boundary)
 
 		// Write headers
 		for k, v := range headers {
-			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+			buf.WriteString(headerLine(k, v))
 		}
 		fmt.Fprintf(&buf, "\r\n")
 
-		// Add text body part
-		if m.Body != "" {
-			fmt.Fprintf(&buf, "--%s\r\n", boundary)
-			fmt.Fprintf(&buf, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
-			fmt.Fprintf(&buf, "%s\r\n", m.Body)
-		}
-
-		// Add HTML body part if present
-		if m.HTMLBody != "" {
-			fmt.Fprintf(&buf, "--%s\r\n", boundary)
-			fmt.Fprintf(&buf, "Content-Type: text/html; charset=utf-8\r\n\r\n")
-			fmt.Fprintf(&buf, "%s\r\n", m.HTMLBody)
-		}
+		// Add the text and HTML body parts
+		m.writeBodies(&buf, boundary)
 
 		// Add attachments
-		for _, attachment := range m.Attachments {
-			fmt.Fprintf(&buf, "--%s\r\n", boundary)
-			fmt.Fprintf(&buf, "Content-Type: %s\r\n", attachment.ContentType)
-			fmt.Fprintf(&buf, "Content-Disposition: attachment; filename=\"%s\"\r\n", attachment.Filename)
-			fmt.Fprintf(&buf, "\r\n")
-			fmt.Fprintf(&buf, "%s\r\n", string(attachment.Content))
+		for i := range m.Attachments {
+			m.Attachments[i].writePart(&buf, boundary)
 		}
 
 		// End multipart
 		fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	} else if m.hasAlternatives() {
+		boundary := newBoundary("alternative")
+		headers["Content-Type"] = fmt.Sprintf("multipart/alternative; boundary=%s", boundary)
+
+		// Write headers
+		for k, v := range headers {
+			buf.WriteString(headerLine(k, v))
+		}
+		fmt.Fprintf(&buf, "\r\n")
+
+		// Write the text and HTML alternatives
+		m.writeAlternatives(&buf, boundary)
 	} else {
 		// Set content type based on body type
 		if m.HTMLBody != "" {
 			headers["Content-Type"] = "text/html; charset=utf-8"
-		} else {
+		} else if !m.MinimalHeaders {
 			headers["Content-Type"] = "text/plain; charset=utf-8"
 		}
 
 		// Write headers
 		for k, v := range headers {
-			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+			buf.WriteString(headerLine(k, v))
 		}
 		fmt.Fprintf(&buf, "\r\n")
 
 		// Write body
 		if m.HTMLBody != "" {
-			fmt.Fprintf(&buf, "%s", m.HTMLBody)
+			fmt.Fprintf(&buf, "%s", m.htmlBody())
 		} else {
-			fmt.Fprintf(&buf, "%s", m.Body)
+			fmt.Fprintf(&buf, "%s", m.textBody())
 		}
 	}
 
@@ -2,12 +2,20 @@ package message
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
+	"net"
 	"net/mail"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -368,7 +376,7 @@ func TestBuildMessage(t *testing.T) {
 	if parsedMsg.Header.Get("From") != from {
 		t.Errorf("Expected 'From' header to be %s, but got %s", from, parsedMsg.Header.Get("From"))
 	}
-	if strings.Join(parsedMsg.Header["To"], ",") != strings.Join(to, ",") {
+	if strings.Join(parsedMsg.Header["To"], ",") != strings.Join(to, ", ") {
 		t.Errorf("Expected 'To' header to be %v, but got %v", to, parsedMsg.Header["To"])
 	}
 
@@ -455,10 +463,13 @@ func TestBuildMessage_WithAttachment(t *testing.T) {
 	if part.Header.Get("Content-Type") != "application/octet-stream" {
 		t.Fatalf("Expected Content-Type for second part to be application/octet-stream")
 	}
-	if part.Header.Get("Content-Disposition") != "attachment; filename=\""+filepath.Base(tmpFile.Name())+"\"" {
-		t.Fatalf("Expected Content-Disposition for second part to be attachment; filename=\"%s\"", filepath.Base(tmpFile.Name()))
+	if part.FileName() != filepath.Base(tmpFile.Name()) || !strings.HasPrefix(part.Header.Get("Content-Disposition"), "attachment;") {
+		t.Fatalf("Expected Content-Disposition for second part to be an attachment named %s, got %s", filepath.Base(tmpFile.Name()), part.Header.Get("Content-Disposition"))
 	}
-	attachmentContent, err := io.ReadAll(part)
+	if part.Header.Get("Content-Transfer-Encoding") != "base64" {
+		t.Fatalf("Expected Content-Transfer-Encoding for second part to be base64")
+	}
+	attachmentContent, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, part))
 	if err != nil {
 		t.Fatalf("Failed to read attachment content: %v", err)
 	}
@@ -467,6 +478,60 @@ func TestBuildMessage_WithAttachment(t *testing.T) {
 	}
 }
 
+func TestAttachmentRoundTrip(t *testing.T) {
+	blob := make([]byte, 200)
+	for i := range blob {
+		blob[i] = byte(i * 7)
+	}
+	msg := NewMessage("from@example.com", []string{"to@example.com"}, "Binary", "See attached")
+	msg.Attachments = append(msg.Attachments, Attachment{Filename: "blob.png", ContentType: "image/png", Content: blob})
+
+	builds := map[string]func() (string, error){
+		"Build": msg.Build,
+		"BuildMessage": func() (string, error) {
+			data, err := msg.BuildMessage()
+			return string(data), err
+		},
+	}
+	for name, build := range builds {
+		built, err := build()
+		if err != nil {
+			t.Fatalf("%s() error = %v", name, err)
+		}
+		parsed, err := mail.ReadMessage(strings.NewReader(built))
+		if err != nil {
+			t.Fatalf("%s() output does not parse: %v", name, err)
+		}
+		_, params, _ := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+		mr := multipart.NewReader(parsed.Body, params["boundary"])
+		var attachment *multipart.Part
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				t.Fatalf("%s() has no attachment part: %v", name, err)
+			}
+			if part.FileName() == "blob.png" {
+				attachment = part
+				break
+			}
+		}
+
+		if got := attachment.Header.Get("Content-Transfer-Encoding"); got != "base64" {
+			t.Errorf("%s() Content-Transfer-Encoding = %q, want base64", name, got)
+		}
+		encoded, _ := io.ReadAll(attachment)
+		for _, line := range strings.Split(strings.TrimSuffix(string(encoded), "\r\n"), "\r\n") {
+			if len(line) > 76 {
+				t.Errorf("%s() base64 line is %d characters long, over 76", name, len(line))
+			}
+		}
+		decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, strings.NewReader(string(encoded))))
+		if err != nil || !bytes.Equal(decoded, blob) {
+			t.Errorf("%s() attachment decodes to %x, %v, want %x", name, decoded, err, blob)
+		}
+	}
+}
+
 func TestBuildMessage_NoBody(t *testing.T) {
 	from := "test@example.com"
 	to := []string{"recipient@example.com"}
@@ -492,6 +557,29 @@ func TestBuildMessage_NoBody(t *testing.T) {
 	}
 }
 
+func TestValidateAll(t *testing.T) {
+	msg := &Message{To: []string{"to@example.com"}, Date: time.Now()}
+
+	errs := msg.ValidateAll()
+	want := []string{"from address is required", "subject is required", "body is required"}
+	if len(errs) != len(want) {
+		t.Fatalf("ValidateAll() = %v, want %d errors", errs, len(want))
+	}
+	for i, err := range errs {
+		if err.Error() != want[i] {
+			t.Errorf("error %d = %q, want %q", i, err, want[i])
+		}
+	}
+	if !errors.Is(errs[2], ErrBodyRequired) {
+		t.Errorf("missing body error = %v, want ErrBodyRequired", errs[2])
+	}
+
+	bad := ValidateAddresses("sender", []string{"ok@example.com", "bad"}, nil, []string{"also-bad"}, false)
+	if len(bad) != 3 {
+		t.Errorf("ValidateAddresses() = %v, want 3 errors", bad)
+	}
+}
+
 func TestValidateEmail(t *testing.T) {
 	validEmails := []string{"test@example.com", "test.test@subdomain.example.co.uk", "123@example.com"}
 	invalidEmails := []string{"test", "test@", "@example.com", "test@@example.com"}
@@ -510,3 +598,1407 @@ func TestValidateEmail(t *testing.T) {
 		}
 	}
 }
+
+func TestUnique(t *testing.T) {
+	msg := NewMessage("test@example.com", []string{"recipient@example.com"}, "Load Test", "Test Body")
+
+	const count = 10
+	seen := make(map[string]bool)
+	for i := 0; i < count; i++ {
+		unique := msg.Unique()
+		id := unique.Headers["Message-ID"]
+		if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@example.com>") {
+			t.Errorf("Unexpected Message-ID format: %s", id)
+		}
+		if seen[id] {
+			t.Errorf("Duplicate Message-ID generated: %s", id)
+		}
+		seen[id] = true
+
+		if unique.Subject == msg.Subject {
+			t.Errorf("Expected subject to carry a unique token, got %q", unique.Subject)
+		}
+		if !strings.HasPrefix(unique.Body, msg.Body) || unique.Body == msg.Body {
+			t.Errorf("Expected body to carry a unique token, got %q", unique.Body)
+		}
+	}
+	if len(seen) != count {
+		t.Errorf("Expected %d distinct Message-IDs, got %d", count, len(seen))
+	}
+
+	// The original message must be left untouched
+	if _, ok := msg.Headers["Message-ID"]; ok {
+		t.Error("Unique() modified the original message headers")
+	}
+	if msg.Subject != "Load Test" {
+		t.Errorf("Unique() modified the original subject: %q", msg.Subject)
+	}
+}
+
+func TestBuildAutoBody(t *testing.T) {
+	newMsg := func(autoBody bool) *Message {
+		msg := NewMessage("test@example.com", []string{"recipient@example.com"}, "Report", "")
+		msg.Attachments = append(msg.Attachments, *NewAttachment("report.pdf", "application/pdf", []byte("%PDF-1.4")))
+		msg.AutoBody = autoBody
+		return msg
+	}
+
+	built, err := newMsg(true).Build()
+	if err != nil {
+		t.Fatalf("Build returned an error: %v", err)
+	}
+	if !strings.Contains(built, "Content-Type: text/plain; charset=utf-8\r\n\r\n"+AutoBodyText+"\r\n") {
+		t.Errorf("Expected a placeholder text part, got:\n%s", built)
+	}
+
+	raw, err := newMsg(true).BuildMessage()
+	if err != nil {
+		t.Fatalf("BuildMessage returned an error: %v", err)
+	}
+	if !strings.Contains(string(raw), AutoBodyText) {
+		t.Errorf("Expected BuildMessage to include a placeholder text part, got:\n%s", raw)
+	}
+
+	built, err = newMsg(false).Build()
+	if err != nil {
+		t.Fatalf("Build returned an error: %v", err)
+	}
+	if strings.Contains(built, AutoBodyText) {
+		t.Errorf("Expected no placeholder text part without AutoBody, got:\n%s", built)
+	}
+}
+
+func TestHeaderCaseNormalization(t *testing.T) {
+	tests := []struct {
+		name     string
+		preserve bool
+		key      string
+		want     string
+	}{
+		{name: "standard header canonicalized", key: "message-id", want: "Message-Id: "},
+		{name: "mime header canonicalized", key: "mime-version", want: "Mime-Version: "},
+		{name: "x header preserved", key: "X-SMTP-edc", want: "X-SMTP-edc: "},
+		{name: "preservation on", preserve: true, key: "message-id", want: "message-id: "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewMessage("test@example.com", []string{"recipient@example.com"}, "Test Subject", "Test Body")
+			msg.PreserveHeaderCase = tt.preserve
+			msg.AddHeader(tt.key, "value")
+
+			built, err := msg.Build()
+			if err != nil {
+				t.Fatalf("Build returned an error: %v", err)
+			}
+			if !strings.Contains(built, "\r\n"+tt.want+"value\r\n") {
+				t.Errorf("Expected header %q in built message, got:\n%s", tt.want, built)
+			}
+
+			raw, err := msg.BuildMessage()
+			if err != nil {
+				t.Fatalf("BuildMessage returned an error: %v", err)
+			}
+			if !strings.Contains(string(raw), tt.want+"value\r\n") {
+				t.Errorf("Expected header %q in BuildMessage output, got:\n%s", tt.want, raw)
+			}
+		})
+	}
+}
+
+func TestParseHeaderLines(t *testing.T) {
+	input := "X-Campaign: spring, 2025\r\n" +
+		"# comment lines are ignored\n" +
+		"X-Long: first part\n" +
+		"  continued here\n" +
+		"\tand here\n" +
+		"\n" +
+		"X-URL: http://example.com/a,b\n"
+
+	headers, err := ParseHeaderLines(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseHeaderLines returned an error: %v", err)
+	}
+
+	expected := map[string]string{
+		"X-Campaign": "spring, 2025",
+		"X-Long":     "first part continued here and here",
+		"X-URL":      "http://example.com/a,b",
+	}
+	if len(headers) != len(expected) {
+		t.Errorf("Expected %d headers, got %d: %v", len(expected), len(headers), headers)
+	}
+	for k, v := range expected {
+		if headers[k] != v {
+			t.Errorf("Expected header %s to be %q, got %q", k, v, headers[k])
+		}
+	}
+}
+
+func TestParseHeaderLines_Invalid(t *testing.T) {
+	testCases := map[string]string{
+		"missing colon":        "X-Broken\n",
+		"leading continuation": " orphan\n",
+		"invalid name":         "X Bad: value\n",
+		"empty name":           ": value\n",
+	}
+
+	for name, input := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ParseHeaderLines(strings.NewReader(input)); err == nil {
+				t.Errorf("Expected an error for %q", input)
+			}
+		})
+	}
+}
+
+func TestValidateHeader(t *testing.T) {
+	if err := ValidateHeader("X-Test", "value"); err != nil {
+		t.Errorf("Expected valid header, got %v", err)
+	}
+	if err := ValidateHeader("X-Test", "value\r\nBcc: victim@example.com"); err == nil {
+		t.Error("Expected an error for a header value containing CRLF")
+	}
+	if err := ValidateHeader("X-Test\r\nBcc", "value"); err == nil {
+		t.Error("Expected an error for a header name containing CRLF")
+	}
+}
+
+func TestBuildReceivedHeader(t *testing.T) {
+	date := time.Date(2025, 4, 22, 10, 30, 0, 0, time.UTC)
+	received := ReceivedHeader("client.example.com", "mx.example.com", "ESMTPS", date)
+	if want := "from client.example.com by mx.example.com with ESMTPS; Tue, 22 Apr 2025 10:30:00 +0000"; received != want {
+		t.Errorf("ReceivedHeader() = %q, want %q", received, want)
+	}
+
+	msg := NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+	msg.AddHeader("X-Test", "1")
+
+	built, err := msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if strings.Contains(built, "Received:") {
+		t.Error("Build() added a Received header without it being enabled")
+	}
+
+	msg.Received = received
+	built, err = msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	// The long trace header is folded; unfolding it gives back the value
+	if want := "Received: " + received + "\r\n"; !strings.HasPrefix(strings.ReplaceAll(built, "\r\n ", " "), want) {
+		t.Errorf("Build() does not start with %q:\n%s", want, built)
+	}
+	if strings.Count(built, "Received:") != 1 {
+		t.Errorf("Build() emitted %d Received headers, want 1", strings.Count(built, "Received:"))
+	}
+}
+
+func TestTemplateInlineCID(t *testing.T) {
+	tmpl, err := LoadTemplateFromString("", "", `<p>Hi</p><img src="cid:{{cid "logo.png"}}">`)
+	if err != nil {
+		t.Fatalf("LoadTemplateFromString() error = %v", err)
+	}
+
+	logo := NewAttachment("logo.png", "image/png", []byte("not really a png"))
+	msg, err := tmpl.Execute(&TemplateData{
+		From:    "from@example.com",
+		To:      []string{"to@example.com"},
+		Subject: "Inline",
+		Inline:  []Attachment{*logo},
+	})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+
+	cid, err := msg.ContentID("logo.png")
+	if err != nil {
+		t.Fatalf("ContentID() error = %v", err)
+	}
+	if !strings.HasSuffix(cid, "@example.com") {
+		t.Errorf("generated Content-ID %q is not in the sender's domain", cid)
+	}
+
+	built, err := msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if !strings.Contains(built, `src="cid:`+cid+`"`) {
+		t.Errorf("HTML does not reference cid:%s:\n%s", cid, built)
+	}
+	if !strings.Contains(built, "Content-ID: <"+cid+">\r\n") {
+		t.Errorf("inline part does not declare Content-ID <%s>:\n%s", cid, built)
+	}
+	if !strings.Contains(built, "Content-Disposition: inline; filename=logo.png\r\n") {
+		t.Errorf("inline part is not marked inline:\n%s", built)
+	}
+
+	// A supplied Content-ID is kept, and unknown names fail to render
+	if got := NewMessage("a@example.com", nil, "", "").AddInline(Attachment{Filename: "x.png", ContentID: "given@id"}); got != "given@id" {
+		t.Errorf("AddInline() = %q, want the supplied Content-ID", got)
+	}
+	if _, err := tmpl.Execute(&TemplateData{From: "from@example.com", To: []string{"to@example.com"}}); err == nil {
+		t.Error("Execute() succeeded referencing a missing inline attachment")
+	}
+}
+
+// fakeResolver serves MX records from a map and counts lookups
+type fakeResolver struct {
+	records map[string][]*net.MX
+	lookups int
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.lookups++
+	records, ok := r.records[name]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	// Return a copy so sorting does not change the fixture
+	return append([]*net.MX(nil), records...), nil
+}
+
+func TestPlanDelivery(t *testing.T) {
+	resolver := &fakeResolver{records: map[string][]*net.MX{
+		"example.com": {
+			{Host: "mx3.example.com.", Pref: 30},
+			{Host: "mx1.example.com.", Pref: 10},
+			{Host: "mx2.example.com.", Pref: 20},
+		},
+		"nomx.example.org": {},
+		"null.example.net": {{Host: ".", Pref: 0}},
+	}}
+	cache := NewMXCache(resolver)
+
+	routes := PlanDelivery(cache, []string{
+		"a@example.com", "b@nomx.example.org", "c@Example.com", "d@null.example.net", "e@missing.invalid",
+	})
+	if len(routes) != 4 {
+		t.Fatalf("PlanDelivery() returned %d routes, want 4", len(routes))
+	}
+
+	example := routes[0]
+	if example.Domain != "example.com" || len(example.Recipients) != 2 {
+		t.Errorf("example.com route = %+v, want both example.com recipients", example)
+	}
+	var hosts []string
+	for _, mx := range example.MX {
+		hosts = append(hosts, mx.Host)
+	}
+	if want := []string{"mx1.example.com.", "mx2.example.com.", "mx3.example.com."}; strings.Join(hosts, " ") != strings.Join(want, " ") {
+		t.Errorf("MX hosts = %v, want sorted by preference %v", hosts, want)
+	}
+	if example.Host != "mx1.example.com" {
+		t.Errorf("direct send host = %q, want mx1.example.com", example.Host)
+	}
+
+	if routes[1].Host != "nomx.example.org" || routes[1].Err != nil {
+		t.Errorf("domain without MX = %+v, want the implicit MX", routes[1])
+	}
+	if routes[2].Err == nil {
+		t.Error("null MX domain has no error")
+	}
+	if routes[3].Err == nil {
+		t.Error("unresolvable domain has no error")
+	}
+
+	// Resolved domains are served from the cache
+	lookups := resolver.lookups
+	if _, err := cache.Lookup("example.com"); err != nil {
+		t.Fatalf("Lookup() error = %v", err)
+	}
+	if resolver.lookups != lookups {
+		t.Errorf("Lookup() queried the resolver again for a cached domain")
+	}
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"user@example.com", "user@example.com"},
+		{"User@Example.COM ", "User@example.com"},
+		{"  <user@example.com>", "user@example.com"},
+		{"< User@EXAMPLE.com >", "User@example.com"},
+		{"Jane Doe <Jane@Example.org>", "Jane@example.org"},
+		{"not-an-address", "not-an-address"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeAddress(tt.input); got != tt.want {
+			t.Errorf("NormalizeAddress(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+
+	msg := NewMessage("sender@example.com", []string{"user@example.com"}, "s", "b")
+	msg.Cc = []string{"<user@EXAMPLE.com>"}
+	msg.Bcc = []string{"User@example.com"}
+	if got := msg.Recipients(); len(got) != 2 {
+		t.Errorf("Recipients() = %v, want the local part case to keep two distinct addresses", got)
+	}
+}
+
+func TestIsDisposableDomain(t *testing.T) {
+	tests := []struct {
+		domain string
+		want   bool
+	}{
+		{"mailinator.com", true},
+		{"MAILINATOR.com.", true},
+		{"eu.mailinator.com", true},
+		{"example.com", false},
+		{"notmailinator.com", false},
+	}
+	for _, tt := range tests {
+		if got := IsDisposableDomain(tt.domain); got != tt.want {
+			t.Errorf("IsDisposableDomain(%q) = %v, want %v", tt.domain, got, tt.want)
+		}
+	}
+}
+
+func TestParseMessageFile(t *testing.T) {
+	data := []byte("---\n" +
+		"from: sender@example.com\n" +
+		"to: [a@example.com, b@example.com]\n" +
+		"subject: \"Report for {{.Data.month}}\"\n" +
+		"headers:\n" +
+		"  X-Campaign: monthly\n" +
+		"---\n" +
+		"Hello {{.Data.name}},\n" +
+		"the report is attached.\n")
+
+	mf, err := ParseMessageFile(data)
+	if err != nil {
+		t.Fatalf("ParseMessageFile() error = %v", err)
+	}
+	if mf.From != "sender@example.com" || len(mf.To) != 2 || mf.Headers["X-Campaign"] != "monthly" {
+		t.Errorf("front-matter = %+v", mf)
+	}
+
+	tmpl, err := mf.Template()
+	if err != nil {
+		t.Fatalf("Template() error = %v", err)
+	}
+	msg, err := tmpl.Execute(&TemplateData{
+		From: mf.From,
+		To:   mf.To,
+		Data: map[string]interface{}{"month": "May", "name": "Sam"},
+	})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if msg.Subject != "Report for May" {
+		t.Errorf("Subject = %q, want %q", msg.Subject, "Report for May")
+	}
+	if want := "Hello Sam,\nthe report is attached.\n"; msg.Body != want {
+		t.Errorf("Body = %q, want %q", msg.Body, want)
+	}
+
+	// Without front-matter the whole file is the body
+	mf, err = ParseMessageFile([]byte("just a body\n"))
+	if err != nil || mf.Body != "just a body\n" || mf.Subject != "" {
+		t.Errorf("ParseMessageFile(no front-matter) = %+v, %v", mf, err)
+	}
+
+	if _, err := ParseMessageFile([]byte("---\nsubject: x\nbody\n")); err == nil {
+		t.Error("ParseMessageFile() accepted unclosed front-matter")
+	}
+}
+
+func TestBuildMessageIDPerSend(t *testing.T) {
+	msg := NewMessage("sender@example.com", []string{"to@example.com"}, "Subject", "Body")
+	messageID := func() string {
+		built, err := msg.Build()
+		if err != nil {
+			t.Fatalf("Build() error = %v", err)
+		}
+		parsed, err := mail.ReadMessage(strings.NewReader(built))
+		if err != nil {
+			t.Fatalf("built message did not parse: %v", err)
+		}
+		return parsed.Header.Get("Message-ID")
+	}
+
+	// Every build of one send, such as a retry, carries the same id
+	first, second := messageID(), messageID()
+	if first == "" || first != second {
+		t.Errorf("Message-IDs = %q and %q, want the same id for each build", first, second)
+	}
+	if !strings.HasSuffix(first, "@example.com>") {
+		t.Errorf("Message-ID = %q, want the sender's domain", first)
+	}
+	if built, _ := msg.Build(); msg.EstimateSize() != len(built) {
+		t.Errorf("EstimateSize() = %d, want %d", msg.EstimateSize(), len(built))
+	}
+
+	// Reset starts a new send with a new id
+	msg.Reset()
+	if third := messageID(); third == first {
+		t.Errorf("Message-ID after Reset() = %q, want a new one", third)
+	}
+
+	// A pinned id is reused
+	msg.MessageID = "<pinned@example.com>"
+	if first, second := messageID(), messageID(); first != "<pinned@example.com>" || second != first {
+		t.Errorf("pinned Message-IDs = %q and %q, want <pinned@example.com>", first, second)
+	}
+
+	// Reset renews the Date
+	msg.SetDate(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	msg.Reset()
+	if time.Since(msg.Date) > time.Minute {
+		t.Errorf("Date after Reset() = %s, want now", msg.Date)
+	}
+}
+
+func TestSetMessageID(t *testing.T) {
+	msg := NewMessage("sender@example.com", []string{"to@example.com"}, "Subject", "Body")
+	for _, id := range []string{"abc@example.com", "<abc@example.com>", " abc@example.com "} {
+		msg.SetMessageID(id)
+		if msg.MessageID != "<abc@example.com>" {
+			t.Errorf("SetMessageID(%q) pinned %q, want <abc@example.com>", id, msg.MessageID)
+		}
+	}
+	for _, build := range []func() ([]byte, error){msg.BuildMessage, func() ([]byte, error) {
+		built, err := msg.Build()
+		return []byte(built), err
+	}} {
+		built, err := build()
+		if err != nil || !strings.Contains(string(built), "Message-ID: <abc@example.com>\r\n") {
+			t.Errorf("Expected the pinned Message-ID, got %q (%v)", built, err)
+		}
+	}
+
+	// Builds without a Message-ID are byte for byte the same
+	msg.SetMessageID("")
+	msg.NoMessageID = true
+	first, _ := msg.Build()
+	second, _ := msg.Build()
+	if strings.Contains(first, "Message-ID") || first != second {
+		t.Errorf("Expected identical builds without a Message-ID, got %q and %q", first, second)
+	}
+	msg.PinMessageID()
+	if msg.MessageID != "" {
+		t.Errorf("PinMessageID() with NoMessageID = %q, want none", msg.MessageID)
+	}
+
+	// A sender without a domain falls back to this host
+	host, err := os.Hostname()
+	if err != nil || strings.ContainsAny(host, " <>@") {
+		host = "localhost"
+	}
+	if id := GenerateMessageID(""); !strings.HasSuffix(id, "@"+host+">") {
+		t.Errorf("GenerateMessageID(\"\") = %q, want this host's name %s", id, host)
+	}
+}
+
+func TestDuplicateAttachmentNames(t *testing.T) {
+	var paths []string
+	for _, dir := range []string{t.TempDir(), t.TempDir(), t.TempDir()} {
+		path := filepath.Join(dir, "report.pdf")
+		if err := os.WriteFile(path, []byte("report in "+dir), 0644); err != nil {
+			t.Fatalf("Failed to write attachment: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	msg := NewMessage("sender@example.com", []string{"to@example.com"}, "Reports", "See attached")
+	for _, path := range paths[:2] {
+		if err := msg.AddAttachment(path); err != nil {
+			t.Fatalf("AddAttachment() error = %v", err)
+		}
+	}
+	if err := msg.AddAttachmentAs(paths[2], "REPORT.pdf"); err != nil {
+		t.Fatalf("AddAttachmentAs() error = %v", err)
+	}
+	if err := msg.AddAttachmentAs(paths[2], "custom.pdf"); err != nil {
+		t.Fatalf("AddAttachmentAs() error = %v", err)
+	}
+
+	built, err := msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	for _, want := range []string{"filename=report.pdf\r\n", `filename="report (2).pdf"`, `filename="REPORT (3).pdf"`, "filename=custom.pdf\r\n"} {
+		if !strings.Contains(built, want) {
+			t.Errorf("built message missing %s", want)
+		}
+	}
+}
+
+func TestAliasesExpand(t *testing.T) {
+	aliases, err := ParseAliases(strings.NewReader(`# test distribution lists
+team@local: alice@example.com, devs@local
+DEVS@local: bob@example.com, Carol@Example.COM
+everyone@local: team@local, devs@local, ops@example.com
+loop@local: back@local
+back@local: loop@local
+`))
+	if err != nil {
+		t.Fatalf("ParseAliases() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		in      []string
+		want    []string
+		wantErr bool
+	}{
+		{name: "nested", in: []string{"Team@local"}, want: []string{"alice@example.com", "bob@example.com", "Carol@example.com"}},
+		{name: "shared member is not a loop", in: []string{"everyone@local"}, want: []string{"alice@example.com", "bob@example.com", "Carol@example.com", "bob@example.com", "Carol@example.com", "ops@example.com"}},
+		{name: "plain address", in: []string{"dave@example.com"}, want: []string{"dave@example.com"}},
+		{name: "loop", in: []string{"loop@local"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := aliases.Expand(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Expand() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expand() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := ParseAliases(strings.NewReader("no separator\n")); err == nil {
+		t.Error("ParseAliases() accepted a line without a colon")
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	attachment := filepath.Join(t.TempDir(), "data file.bin")
+	if err := os.WriteFile(attachment, bytes.Repeat([]byte{0xA5}, 10000), 0644); err != nil {
+		t.Fatalf("Failed to write attachment: %v", err)
+	}
+
+	plain := NewMessage("from@example.com", []string{"to@example.com"}, "Plain", "Hello")
+	plain.Cc = []string{"cc@example.com"}
+	plain.AddHeader("X-Test", "yes")
+
+	mixed := NewMessage("from@example.com", []string{"to@example.com"}, "Mixed", "Hello")
+	mixed.FromName = "Sender"
+	mixed.HTMLBody = "<p>Hello</p>"
+	if err := mixed.AddAttachment(attachment); err != nil {
+		t.Fatalf("AddAttachment() error = %v", err)
+	}
+	mixed.AddInline(Attachment{Filename: "logo.png", ContentType: "image/png", Content: []byte("png")})
+
+	alternative := NewMessage("from@example.com", []string{"to@example.com"}, "Alternative", "Hello")
+	alternative.HTMLBody = "<p>Hello</p>"
+
+	for _, msg := range []*Message{plain, mixed, alternative} {
+		t.Run(msg.Subject, func(t *testing.T) {
+			built, err := msg.Build()
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			estimate := msg.EstimateSize()
+			if diff := estimate - len(built); diff < -len(built)/100 || diff > len(built)/100 {
+				t.Errorf("EstimateSize() = %d, Build() length = %d", estimate, len(built))
+			}
+		})
+	}
+}
+
+func TestAddressAnonymizer(t *testing.T) {
+	anonymize := NewAddressAnonymizer([]string{"bob@example.co", "Bob@Example.com"})
+	short, long := AnonymizeAddress("bob@example.co"), AnonymizeAddress("bob@example.com")
+	if short == long {
+		t.Fatalf("AnonymizeAddress() gave %s for two addresses", short)
+	}
+
+	got := anonymize("RCPT TO:<Bob@example.com> To: bob@example.com, bob@example.co")
+	want := "RCPT TO:<" + long + "> To: " + long + ", " + short
+	if got != want {
+		t.Errorf("anonymize() = %q, want %q", got, want)
+	}
+}
+
+func TestMinimalHeaders(t *testing.T) {
+	// Without MinimalHeaders both builders add the MIME headers, once
+	full := NewMessage("from@example.com", []string{"to@example.com"}, "Full", "Hello")
+	built, err := full.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	legacy, err := full.BuildMessage()
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	for name, data := range map[string]string{"Build": built, "BuildMessage": string(legacy)} {
+		for _, wanted := range []string{"MIME-Version: 1.0\r\n", "Content-Type: text/plain; charset=utf-8\r\n", "Message-ID: <"} {
+			if strings.Count(data, wanted) != 1 {
+				t.Errorf("%s() want one %q in:\n%s", name, wanted, data)
+			}
+		}
+	}
+	if estimate := full.EstimateSize(); estimate != len(built) {
+		t.Errorf("EstimateSize() = %d, Build() length = %d", estimate, len(built))
+	}
+	full.AddHeader("MIME-Version", "1.0")
+	if built, _ := full.Build(); strings.Count(strings.ToLower(built), "mime-version:") != 1 {
+		t.Errorf("Build() repeated a given MIME-Version:\n%s", built)
+	}
+
+	msg := NewMessage("from@example.com", []string{"to@example.com"}, "Minimal", "Hello")
+	msg.MinimalHeaders = true
+	msg.PinMessageID()
+
+	built, err = msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	header, body, _ := strings.Cut(built, "\r\n\r\n")
+	var names []string
+	for _, line := range strings.Split(header, "\r\n") {
+		name, _, _ := strings.Cut(line, ":")
+		names = append(names, name)
+	}
+	if want := []string{"From", "To", "Subject", "Date"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Build() headers = %v, want %v", names, want)
+	}
+	if body != "Hello" {
+		t.Errorf("Build() body = %q, want %q", body, "Hello")
+	}
+	if estimate := msg.EstimateSize(); estimate != len(built) {
+		t.Errorf("EstimateSize() = %d, Build() length = %d", estimate, len(built))
+	}
+
+	legacy, err = msg.BuildMessage()
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	for _, unwanted := range []string{"MIME-Version", "Content-Type", "Message-ID"} {
+		if strings.Contains(string(legacy), unwanted+":") {
+			t.Errorf("BuildMessage() contains %s:\n%s", unwanted, legacy)
+		}
+	}
+
+	// Multipart messages cannot do without their Content-Type
+	msg.HTMLBody = "<p>Hello</p>"
+	if built, _ := msg.Build(); !strings.Contains(built, "Content-Type: multipart/alternative") {
+		t.Errorf("Build() dropped the multipart Content-Type:\n%s", built)
+	}
+}
+
+func TestAttachMessage(t *testing.T) {
+	eml := filepath.Join(t.TempDir(), "original.eml")
+	if err := os.WriteFile(eml, []byte("From: alice@example.com\nTo: bob@example.com\nSubject: Original\n\nFirst line\n"), 0644); err != nil {
+		t.Fatalf("Failed to write message: %v", err)
+	}
+	inner := NewMessage("carol@example.com", []string{"dave@example.com"}, "Built", "Built body")
+
+	msg := NewMessage("from@example.com", []string{"to@example.com"}, "Fwd", "See below")
+	if err := msg.AddMessageAttachment(eml); err != nil {
+		t.Fatalf("AddMessageAttachment() error = %v", err)
+	}
+	if err := msg.AttachMessage(inner); err != nil {
+		t.Fatalf("AttachMessage() error = %v", err)
+	}
+	built, err := msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if estimate := msg.EstimateSize(); estimate != len(built) {
+		t.Errorf("EstimateSize() = %d, Build() length = %d", estimate, len(built))
+	}
+
+	parsed, err := mail.ReadMessage(strings.NewReader(built))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	boundary := strings.Split(parsed.Header.Get("Content-Type"), "boundary=")[1]
+	mr := multipart.NewReader(parsed.Body, boundary)
+	if _, err := mr.NextPart(); err != nil {
+		t.Fatalf("Failed to read the text part: %v", err)
+	}
+	for _, want := range []struct{ filename, subject string }{
+		{"original.eml", "Original"},
+		{"forwarded.eml", "Built"},
+	} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("Failed to read the %s part: %v", want.filename, err)
+		}
+		if got := part.Header.Get("Content-Type"); got != "message/rfc822" {
+			t.Errorf("Content-Type = %q, want message/rfc822", got)
+		}
+		if got := part.Header.Get("Content-Transfer-Encoding"); got != "7bit" {
+			t.Errorf("Content-Transfer-Encoding = %q, want 7bit", got)
+		}
+		if part.FileName() != want.filename {
+			t.Errorf("filename = %q, want %q", part.FileName(), want.filename)
+		}
+		nested, err := mail.ReadMessage(part)
+		if err != nil {
+			t.Fatalf("Failed to parse the attached message: %v", err)
+		}
+		if got := nested.Header.Get("Subject"); got != want.subject {
+			t.Errorf("attached Subject = %q, want %q", got, want.subject)
+		}
+	}
+
+	notMessage := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(notMessage, []byte("just some notes\n"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := msg.AddMessageAttachment(notMessage); err == nil {
+		t.Error("AddMessageAttachment() accepted a file that is not a message")
+	}
+}
+
+func TestCheckAlternatives(t *testing.T) {
+	tests := []struct {
+		name       string
+		body, html string
+		minimal    bool
+		wantErr    bool
+	}{
+		{name: "text only", body: "Hello"},
+		{name: "HTML only with minimal headers", html: "<p>Hello</p>", minimal: true},
+		{name: "text and HTML", body: "Hello", html: "<p>Hello</p>"},
+		{name: "text and HTML with minimal headers", body: "Hello", html: "<p>Hello</p>", minimal: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewMessage("from@example.com", []string{"to@example.com"}, "Subject", tt.body)
+			msg.HTMLBody = tt.html
+			msg.MinimalHeaders = tt.minimal
+			err := msg.CheckAlternatives()
+			if (err != nil) != tt.wantErr || err != nil && !errors.Is(err, ErrFlattenedAlternatives) {
+				t.Errorf("CheckAlternatives() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAlternativeBodies(t *testing.T) {
+	for _, attach := range []bool{false, true} {
+		msg := NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Hello")
+		msg.HTMLBody = "<p>Hello</p>"
+		if attach {
+			msg.Attachments = append(msg.Attachments, Attachment{Filename: "a.txt", ContentType: "text/plain", Content: []byte("data")})
+		}
+		builds := map[string]func() (string, error){
+			"Build": msg.Build,
+			"BuildMessage": func() (string, error) {
+				data, err := msg.BuildMessage()
+				return string(data), err
+			},
+		}
+		for name, build := range builds {
+			built, err := build()
+			if err != nil {
+				t.Fatalf("%s() error = %v", name, err)
+			}
+			parsed, err := mail.ReadMessage(strings.NewReader(built))
+			if err != nil {
+				t.Fatalf("%s() output does not parse: %v", name, err)
+			}
+
+			mediaType, params, _ := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+			body := io.Reader(parsed.Body)
+			var mixed *multipart.Reader
+			if attach {
+				if mediaType != "multipart/mixed" {
+					t.Fatalf("%s() with an attachment: Content-Type = %s, want multipart/mixed", name, mediaType)
+				}
+				mixed = multipart.NewReader(body, params["boundary"])
+				part, err := mixed.NextPart()
+				if err != nil {
+					t.Fatalf("%s() has no first part: %v", name, err)
+				}
+				mediaType, params, _ = mime.ParseMediaType(part.Header.Get("Content-Type"))
+				body = part
+			}
+			if mediaType != "multipart/alternative" {
+				t.Fatalf("%s() with attachment %t: Content-Type = %s, want multipart/alternative", name, attach, mediaType)
+			}
+
+			alternative := multipart.NewReader(body, params["boundary"])
+			for _, want := range []struct{ contentType, body string }{
+				{"text/plain; charset=utf-8", "Hello"},
+				{"text/html; charset=utf-8", "<p>Hello</p>"},
+			} {
+				part, err := alternative.NextPart()
+				if err != nil {
+					t.Fatalf("%s() is missing the %s alternative: %v", name, want.contentType, err)
+				}
+				content, _ := io.ReadAll(part)
+				if got := part.Header.Get("Content-Type"); got != want.contentType || string(content) != want.body {
+					t.Errorf("%s() alternative = %s %q, want %s %q", name, got, content, want.contentType, want.body)
+				}
+			}
+			if _, err := alternative.NextPart(); err != io.EOF {
+				t.Errorf("%s() has more than two alternatives: %v", name, err)
+			}
+			if mixed != nil {
+				if next, err := mixed.NextPart(); err != nil || next.FileName() != "a.txt" {
+					t.Errorf("%s() is missing the attachment after the alternatives: %v", name, err)
+				}
+			}
+		}
+	}
+}
+
+func TestDateFormat(t *testing.T) {
+	date := time.Date(2025, time.March, 4, 17, 30, 0, 0, time.FixedZone("CET", 60*60))
+	tests := []struct {
+		name    string
+		layout  string
+		want    string
+		wantErr bool
+	}{
+		{name: "default", want: "Tue, 04 Mar 2025 17:30:00 +0100"},
+		{name: "comment and no leading zero", layout: "Mon, 2 Jan 2006 15:04:05 -0700 (MST)", want: "Tue, 4 Mar 2025 17:30:00 +0100 (CET)"},
+		{name: "no day of week", layout: "2 Jan 2006 15:04 -0700", want: "4 Mar 2025 17:30 +0100"},
+		{name: "ISO 8601", layout: time.RFC3339, wantErr: true},
+		{name: "12-hour clock", layout: "Mon, 02 Jan 2006 03:04:05 -0700", wantErr: true},
+		{name: "no zone", layout: "Mon, 02 Jan 2006 15:04:05", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+			msg.SetDate(date)
+			msg.DateFormat = tt.layout
+			built, err := msg.Build()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Build() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.layout != "" && (ValidateDateFormat(tt.layout) != nil) != tt.wantErr {
+				t.Errorf("ValidateDateFormat(%q) disagrees with Build()", tt.layout)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !strings.Contains(built, "\r\nDate: "+tt.want+"\r\n") {
+				t.Errorf("Build() Date header is not %q:\n%s", tt.want, built)
+			}
+		})
+	}
+}
+
+func TestReply(t *testing.T) {
+	msg := NewMessage("from@example.com", []string{"to@example.com"}, "Thread", "Body")
+	if _, err := msg.Reply(); err == nil {
+		t.Fatal("Reply() accepted a message without a pinned Message-ID")
+	}
+	msg.PinMessageID()
+
+	// Build a thread of three messages and read back the headers that were sent
+	var sent []mail.Header
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			var err error
+			if msg, err = msg.Reply(); err != nil {
+				t.Fatalf("Reply() error = %v", err)
+			}
+		}
+		built, err := msg.Build()
+		if err != nil {
+			t.Fatalf("Build() error = %v", err)
+		}
+		parsed, err := mail.ReadMessage(strings.NewReader(built))
+		if err != nil {
+			t.Fatalf("failed to parse message %d: %v", i+1, err)
+		}
+		sent = append(sent, parsed.Header)
+	}
+
+	id1, id2 := sent[0].Get("Message-Id"), sent[1].Get("Message-Id")
+	if id1 == "" || id2 == "" || id1 == id2 {
+		t.Fatalf("Message-IDs are not distinct: %q, %q", id1, id2)
+	}
+	if got := sent[1].Get("In-Reply-To"); got != id1 {
+		t.Errorf("message 2 In-Reply-To = %q, want %q", got, id1)
+	}
+	if got, want := sent[2].Get("References"), id1+" "+id2; got != want {
+		t.Errorf("message 3 References = %q, want %q", got, want)
+	}
+	if got := sent[2].Get("In-Reply-To"); got != id2 {
+		t.Errorf("message 3 In-Reply-To = %q, want %q", got, id2)
+	}
+	if got := sent[2].Get("Subject"); got != "Re: Thread" {
+		t.Errorf("message 3 Subject = %q, want %q", got, "Re: Thread")
+	}
+}
+
+func TestNormalizeLineEndings(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "LF only", in: "one\ntwo\n", want: "one\r\ntwo\r\n"},
+		{name: "mixed", in: "one\r\ntwo\nthree\rfour", want: "one\r\ntwo\r\nthree\r\nfour"},
+		{name: "already CRLF", in: "one\r\ntwo\r\n", want: "one\r\ntwo\r\n"},
+		{name: "blank lines kept", in: "one\n\ntwo", want: "one\r\n\r\ntwo"},
+		{name: "single line", in: "one", want: "one"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NormalizeLineEndings(tt.in); got != tt.want {
+				t.Errorf("NormalizeLineEndings(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+
+	// A body read from an LF-only file is sent with CRLF endings unless KeepLineEndings is set
+	path := filepath.Join(t.TempDir(), "body.txt")
+	if err := os.WriteFile(path, []byte("Hello,\n\nThis file uses LF endings.\n"), 0644); err != nil {
+		t.Fatalf("Failed to write body file: %v", err)
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read body file: %v", err)
+	}
+	for _, keep := range []bool{false, true} {
+		msg := NewMessage("from@example.com", []string{"to@example.com"}, "Subject", string(body))
+		msg.HTMLBody = "<p>one</p>\n<p>two</p>\n"
+		msg.KeepLineEndings = keep
+		built, err := msg.Build()
+		if err != nil {
+			t.Fatalf("Build() error = %v", err)
+		}
+		bareLF := strings.Count(built, "\n") - strings.Count(built, "\r\n")
+		if keep && bareLF == 0 {
+			t.Error("Build() with KeepLineEndings converted the LF endings")
+		}
+		if !keep && bareLF != 0 {
+			t.Errorf("Build() left %d bare LF line endings:\n%q", bareLF, built)
+		}
+		if size := msg.EstimateSize(); !keep && size != len(built) {
+			t.Errorf("EstimateSize() = %d, want %d", size, len(built))
+		}
+	}
+}
+
+func TestCheckRFC5322(t *testing.T) {
+	valid := "From: from@example.com\r\nTo: \"Doe, Jane\" <to@example.com>\r\nSubject: Hello\r\nDate: Sat, 23 Nov 2024 21:05:09 -0500\r\n\r\nBody\r\n"
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "valid", data: valid},
+		{name: "folded header", data: strings.Replace(valid, "Subject: Hello\r\n", "Subject: a long\r\n subject\r\n", 1)},
+		{name: "long header line", data: "X-Long: " + strings.Repeat("a", 991) + "\r\n" + valid, wantErr: "999 characters long"},
+		{name: "header without a name", data: "Not a header\r\n" + valid, wantErr: "has no field name"},
+		{name: "space in field name", data: "Bad Name: x\r\n" + valid, wantErr: "invalid character ' '"},
+		{name: "bare LF", data: "X-Test: a\nb\r\n" + valid, wantErr: "bare CR or LF"},
+		{name: "non-ASCII", data: "X-Test: Grüße\r\n" + valid, wantErr: "non-ASCII character"},
+		{name: "no header end", data: "From: from@example.com\r\nDate: Sat, 23 Nov 2024 21:05:09 -0500\r\n", wantErr: "no blank line"},
+		{name: "missing Date", data: strings.Replace(valid, "Date: Sat, 23 Nov 2024 21:05:09 -0500\r\n", "", 1), wantErr: "required Date header is missing"},
+		{name: "duplicate Subject", data: "Subject: Again\r\n" + valid, wantErr: "Subject header appears 2 times"},
+		{name: "invalid Date", data: strings.Replace(valid, "Sat, 23 Nov 2024", "23/11/2024", 1), wantErr: "invalid Date header"},
+		{name: "invalid address", data: strings.Replace(valid, "To: \"Doe, Jane\" <to@example.com>", "To: Doe, Jane <to@example.com>", 1), wantErr: "invalid To header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := CheckRFC5322([]byte(tt.data))
+			if tt.wantErr == "" {
+				if len(errs) > 0 {
+					t.Errorf("CheckRFC5322() = %v, want no violations", errs)
+				}
+				return
+			}
+			if len(errs) == 0 || !strings.Contains(errors.Join(errs...).Error(), tt.wantErr) {
+				t.Errorf("CheckRFC5322() = %v, want a violation containing %q", errs, tt.wantErr)
+			}
+		})
+	}
+
+	// Built messages conform, including display names that need quoting or encoding
+	msg := NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+	msg.FromName = "Jörg Müller"
+	msg.ToNames = []string{"Doe, Jane"}
+	msg.Cc = []string{"cc@example.com"}
+	msg.HTMLBody = "<p>Body</p>"
+	built, err := msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if errs := CheckRFC5322([]byte(built)); len(errs) > 0 {
+		t.Errorf("CheckRFC5322(Build()) = %v, want no violations", errs)
+	}
+
+	// A header set without validation that breaks the syntax is caught
+	msg.AddHeader("X Bad", "value")
+	built, err = msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	if errs := CheckRFC5322([]byte(built)); len(errs) == 0 {
+		t.Error("CheckRFC5322() accepted a header name containing a space")
+	}
+}
+
+func TestShuffleHeaders(t *testing.T) {
+	newMessage := func() *Message {
+		msg := NewMessage("from@example.com", []string{"to@example.com"}, "Subject", "Body")
+		msg.MessageID = "<fixed@example.com>"
+		for _, key := range []string{"X-Campaign", "X-Mailer", "List-Unsubscribe", "Reply-To", "X-Priority", "Organization"} {
+			msg.AddHeader(key, "value")
+		}
+		return msg
+	}
+	headerLines := func(msg *Message) []string {
+		built, err := msg.Build()
+		if err != nil {
+			t.Fatalf("Build() error = %v", err)
+		}
+		header, _, _ := strings.Cut(built, "\r\n\r\n")
+		return strings.Split(header, "\r\n")
+	}
+
+	defaultOrder := headerLines(newMessage())
+	if again := headerLines(newMessage()); !reflect.DeepEqual(again, defaultOrder) {
+		t.Errorf("default header order is not stable:\n%q\n%q", defaultOrder, again)
+	}
+
+	shuffled := newMessage()
+	shuffled.ShuffleHeaders = true
+	shuffled.ShuffleSeed = 42
+	got := headerLines(shuffled)
+	if reflect.DeepEqual(got, defaultOrder) {
+		t.Errorf("ShuffleHeaders with seed 42 kept the default order %q", got)
+	}
+	// The required headers stay first, in their usual order
+	if !reflect.DeepEqual(got[:4], defaultOrder[:4]) || !strings.HasPrefix(got[0], "From: ") {
+		t.Errorf("leading headers = %q, want %q", got[:4], defaultOrder[:4])
+	}
+	sortedGot := append([]string(nil), got...)
+	sortedDefault := append([]string(nil), defaultOrder...)
+	sort.Strings(sortedGot)
+	sort.Strings(sortedDefault)
+	if !reflect.DeepEqual(sortedGot, sortedDefault) {
+		t.Errorf("shuffled header set = %q, want %q", sortedGot, sortedDefault)
+	}
+
+	// The same seed gives the same order and another seed a different one
+	if again := headerLines(shuffled); !reflect.DeepEqual(again, got) {
+		t.Errorf("seed 42 gave %q, then %q", got, again)
+	}
+	shuffled.ShuffleSeed = 7
+	if other := headerLines(shuffled); reflect.DeepEqual(other, got) {
+		t.Errorf("seeds 7 and 42 gave the same order %q", got)
+	}
+}
+
+func TestParseEML(t *testing.T) {
+	trace := "Received: from mx1.example.org (mx1.example.org [192.0.2.1])\r\n" +
+		"\tby mx2.example.net with ESMTPS id 4Xyz;\r\n" +
+		"\tMon, 1 Jul 2024 10:00:01 +0000\r\n" +
+		"Return-Path: <bounce@example.org>\r\n" +
+		"Received:  from client.example.org by mx1.example.org;  Mon, 1 Jul 2024 10:00:00 +0000\r\n"
+	rest := "From: Sender <sender@example.org>\r\n" +
+		"To: a@example.net, B <b@example.net>\r\n" +
+		"Cc: c@example.net\r\n" +
+		"Subject: Relayed\r\n" +
+		"Message-ID: <relayed@example.org>\r\n" +
+		"\r\n" +
+		"Body line\r\n"
+
+	tests := []struct {
+		name          string
+		preserveTrace bool
+		want          string
+	}{
+		{name: "trace removed", want: rest},
+		{name: "trace preserved", preserveTrace: true, want: trace + rest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ParseEML([]byte(trace+rest), tt.preserveTrace)
+			if err != nil {
+				t.Fatalf("ParseEML() error = %v", err)
+			}
+			built, err := msg.Build()
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if built != tt.want {
+				t.Errorf("Build() = %q, want %q", built, tt.want)
+			}
+			if msg.From != "sender@example.org" || !reflect.DeepEqual(msg.To, []string{"a@example.net", "b@example.net"}) ||
+				!reflect.DeepEqual(msg.Cc, []string{"c@example.net"}) {
+				t.Errorf("envelope = %s -> %v, cc %v", msg.From, msg.To, msg.Cc)
+			}
+			if msg.MessageID != "<relayed@example.org>" || msg.Subject != "Relayed" {
+				t.Errorf("MessageID = %q, Subject = %q", msg.MessageID, msg.Subject)
+			}
+			if size := msg.EstimateSize(); size != len(built) {
+				t.Errorf("EstimateSize() = %d, want %d", size, len(built))
+			}
+		})
+	}
+
+	// A Received header for this hop goes above the preserved chain
+	msg, err := ParseEML([]byte(strings.ReplaceAll(trace+rest, "\r\n", "\n")), true)
+	if err != nil {
+		t.Fatalf("ParseEML() error = %v", err)
+	}
+	msg.Received = "from edc by relay.example.com"
+	built, err := msg.BuildMessage()
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	if want := "Received: from edc by relay.example.com\r\n" + trace + rest; string(built) != want {
+		t.Errorf("BuildMessage() = %q, want %q", built, want)
+	}
+}
+
+func TestThreadingHeaders(t *testing.T) {
+	msg := NewMessage("sender@example.com", []string{"recipient@example.com"}, "Re: Plans", "Sounds good")
+	msg.SetInReplyTo("parent.4@example.com")
+	msg.AddReference("<root.1@example.com>")
+	msg.AddReference(" reply.2@example.com ")
+	msg.AddReference("reply.3@example.com")
+	msg.AddReference("parent.4@example.com")
+	msg.AddReference("")
+
+	wantInReplyTo := "In-Reply-To: <parent.4@example.com>\r\n"
+	wantReferences := "References: <root.1@example.com> <reply.2@example.com> <reply.3@example.com>\r\n <parent.4@example.com>\r\n"
+
+	built, err := msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	raw, err := msg.BuildMessage()
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	for name, data := range map[string]string{"Build": built, "BuildMessage": string(raw)} {
+		if !strings.Contains(data, wantInReplyTo) {
+			t.Errorf("%s() missing %q in:\n%s", name, wantInReplyTo, data)
+		}
+		if !strings.Contains(data, wantReferences) || strings.Count(data, "References:") != 1 {
+			t.Errorf("%s() want one header %q in:\n%s", name, wantReferences, data)
+		}
+		if errs := CheckRFC5322([]byte(data)); len(errs) > 0 {
+			t.Errorf("%s() does not conform to RFC 5322: %v", name, errs)
+		}
+
+		parsed, err := mail.ReadMessage(strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s() output does not parse: %v", name, err)
+		}
+		want := "<root.1@example.com> <reply.2@example.com> <reply.3@example.com> <parent.4@example.com>"
+		if got := strings.Join(strings.Fields(parsed.Header.Get("References")), " "); got != want {
+			t.Errorf("%s() References = %q, want %q", name, got, want)
+		}
+	}
+
+	msg.SetInReplyTo("")
+	if built, _ := msg.Build(); strings.Contains(built, "In-Reply-To") {
+		t.Errorf("SetInReplyTo(\"\") kept the header:\n%s", built)
+	}
+
+	// A long chain is stored unfolded and folded once, when built
+	for i := 5; i <= 40; i++ {
+		msg.AddReference(fmt.Sprintf("reply.%d@example.com", i))
+	}
+	if references := msg.Headers["References"]; strings.ContainsAny(references, "\r\n") {
+		t.Errorf("Headers[References] = %q, want it unfolded", references)
+	}
+	built, err = msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	header := built[:strings.Index(built, "\r\n\r\n")+2]
+	lines := strings.Split(header[strings.Index(header, "References:"):], "\r\n")
+	for i, line := range lines {
+		if i > 0 && !strings.HasPrefix(line, " ") {
+			if i < 2 {
+				t.Errorf("References is not folded:\n%s", header)
+			}
+			break
+		}
+		if len(line) > 78 {
+			t.Errorf("References line is %d characters long: %q", len(line), line)
+		}
+	}
+	if strings.Contains(header, "\r\n\r\n") || strings.Contains(header, "\r\r") {
+		t.Errorf("References folded twice:\n%s", header)
+	}
+	if errs := CheckRFC5322([]byte(built)); len(errs) > 0 {
+		t.Errorf("Build() does not conform to RFC 5322: %v", errs)
+	}
+}
+
+func TestDedupeAttachments(t *testing.T) {
+	msg := NewMessage("sender@example.com", []string{"recipient@example.com"}, "Files", "See attached")
+	msg.Attachments = []Attachment{
+		{Filename: "report.pdf", Content: []byte("same")},
+		{Filename: "logo.png", Content: []byte("same"), Inline: true, ContentID: "logo"},
+		{Filename: "report-copy.pdf", Content: []byte("same")},
+		{Filename: "notes.txt", Content: []byte("other")},
+		{Filename: "report.pdf (2)", Content: []byte("same")},
+	}
+
+	removed := msg.DedupeAttachments()
+	want := []DuplicateAttachment{{Filename: "report-copy.pdf", Of: "report.pdf"}, {Filename: "report.pdf (2)", Of: "report.pdf"}}
+	if !reflect.DeepEqual(removed, want) {
+		t.Errorf("DedupeAttachments() = %+v, want %+v", removed, want)
+	}
+	var names []string
+	for _, attachment := range msg.Attachments {
+		names = append(names, attachment.Filename)
+	}
+	if want := []string{"report.pdf", "logo.png", "notes.txt"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("attachments after DedupeAttachments() = %v, want %v", names, want)
+	}
+	if removed := msg.DedupeAttachments(); len(removed) != 0 {
+		t.Errorf("second DedupeAttachments() = %+v, want none", removed)
+	}
+}
+
+func TestEncodedHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		header  string
+	}{
+		{name: "ascii", subject: "Plain subject", header: "plain"},
+		{name: "latin", subject: "Überweisung bestätigt", header: "Grüße"},
+		{name: "cyrillic", subject: "Подтверждение перевода средств на ваш банковский счёт получено", header: "Привет"},
+		{name: "emoji", subject: "Launch day 🚀🚀🚀 tickets 🎟️ and party 🎉🎉 for everyone 🥳", header: "👍"},
+	}
+	encodedWord := regexp.MustCompile(`=\?utf-8\?[qb]\?[^?]*\?=`)
+	var decoder mime.WordDecoder
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewMessage("sender@example.com", []string{"recipient@example.com"}, tt.subject, "Body")
+			msg.AddHeader("X-Greeting", tt.header)
+			msg.AddHeader("Reply-To", "Jörg Müller <joerg@example.com>")
+
+			built, err := msg.Build()
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			raw, err := msg.BuildMessage()
+			if err != nil {
+				t.Fatalf("BuildMessage() error = %v", err)
+			}
+			for name, data := range map[string]string{"Build": built, "BuildMessage": string(raw)} {
+				if errs := CheckRFC5322([]byte(data)); len(errs) > 0 {
+					t.Errorf("%s() does not conform to RFC 5322: %v", name, errs)
+				}
+				header := data[:strings.Index(data, "\r\n\r\n")]
+				for _, line := range strings.Split(header, "\r\n") {
+					if encodedWord.MatchString(line) && len(line) > 76 {
+						t.Errorf("%s() line with an encoded-word is %d characters long: %q", name, len(line), line)
+					}
+				}
+				if tt.name != "ascii" && !encodedWord.MatchString(header) {
+					t.Errorf("%s() has no encoded-words in:\n%s", name, header)
+				}
+
+				parsed, err := mail.ReadMessage(strings.NewReader(data))
+				if err != nil {
+					t.Fatalf("%s() output does not parse: %v", name, err)
+				}
+				for key, want := range map[string]string{"Subject": tt.subject, "X-Greeting": tt.header} {
+					got, err := decoder.DecodeHeader(parsed.Header.Get(key))
+					if err != nil {
+						t.Fatalf("%s() %s does not decode: %v", name, key, err)
+					}
+					if got != want {
+						t.Errorf("%s() %s = %q, want %q", name, key, got, want)
+					}
+				}
+				replyTo, err := parsed.Header.AddressList("Reply-To")
+				if err != nil || len(replyTo) != 1 || replyTo[0].Name != "Jörg Müller" || replyTo[0].Address != "joerg@example.com" {
+					t.Errorf("%s() Reply-To = %v, %v", name, replyTo, err)
+				}
+			}
+			if tt.name == "ascii" && !strings.Contains(built, "Subject: Plain subject\r\n") {
+				t.Errorf("ASCII subject was changed:\n%s", built)
+			}
+			if size := msg.EstimateSize(); size != len(built) {
+				t.Errorf("EstimateSize() = %d, want %d", size, len(built))
+			}
+		})
+	}
+}
+
+func TestFoldedHeaders(t *testing.T) {
+	var to, cc []string
+	for i := 1; i <= 30; i++ {
+		to = append(to, fmt.Sprintf("recipient%02d@example.com", i))
+		cc = append(cc, fmt.Sprintf("copy%02d@example.org", i))
+	}
+	subject := strings.Repeat("A long subject that goes on ", 5) + "and ends here"
+	msg := NewMessage("sender@example.com", to, subject, "Body")
+	msg.Cc = cc
+	msg.ToNames = []string{"Doe, Jane Alexandra Elizabeth Catherine Margaret Victoria"}
+	for i := 1; i <= 12; i++ {
+		msg.AddReference(fmt.Sprintf("message.%d@example.com", i))
+	}
+	msg.AddHeader("X-Note", strings.Repeat("word ", 30)+strings.Repeat("x", 90))
+	// Too long for even an RFC 5322 line, so it has to be split
+	msg.AddHeader("X-Token", strings.Repeat("t", 2500))
+
+	built, err := msg.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	raw, err := msg.BuildMessage()
+	if err != nil {
+		t.Fatalf("BuildMessage() error = %v", err)
+	}
+	for name, data := range map[string]string{"Build": built, "BuildMessage": string(raw)} {
+		header := data[:strings.Index(data, "\r\n\r\n")]
+		for _, line := range strings.Split(header, "\r\n") {
+			// Only the 90-character word and the token may not fit
+			if len(line) > 78 && !strings.Contains(line, strings.Repeat("x", 90)) && !strings.Contains(line, "ttt") {
+				t.Errorf("%s() header line is %d characters long: %q", name, len(line), line)
+			}
+			if len(line) > 998 {
+				t.Errorf("%s() header line is over the RFC 5322 limit: %q", name, line)
+			}
+		}
+		if errs := CheckRFC5322([]byte(data)); len(errs) > 0 {
+			t.Errorf("%s() does not conform to RFC 5322: %v", name, errs)
+		}
+
+		parsed, err := mail.ReadMessage(strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s() output does not parse: %v", name, err)
+		}
+		for key, want := range map[string][]string{"To": to, "Cc": cc} {
+			addrs, err := parsed.Header.AddressList(key)
+			if err != nil {
+				t.Fatalf("%s() %s does not parse: %v", name, key, err)
+			}
+			var got []string
+			for _, addr := range addrs {
+				got = append(got, addr.Address)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s() %s = %v, want %v", name, key, got, want)
+			}
+			if key == "To" && addrs[0].Name != msg.ToNames[0] {
+				t.Errorf("%s() first To name = %q, want %q", name, addrs[0].Name, msg.ToNames[0])
+			}
+		}
+		unfold := strings.NewReplacer("\r\n ", " ")
+		if got := unfold.Replace(parsed.Header.Get("Subject")); got != subject {
+			t.Errorf("%s() Subject = %q, want %q", name, got, subject)
+		}
+		if got := len(strings.Fields(parsed.Header.Get("References"))); got != 12 {
+			t.Errorf("%s() References holds %d IDs, want 12", name, got)
+		}
+		if got := strings.Join(strings.Fields(parsed.Header.Get("X-Token")), ""); got != strings.Repeat("t", 2500) {
+			t.Errorf("%s() X-Token = %q, want the token split over lines", name, got)
+		}
+	}
+	if size := msg.EstimateSize(); size != len(built) {
+		t.Errorf("EstimateSize() = %d, want %d", size, len(built))
+	}
+}
@@ -0,0 +1,110 @@
+package message
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MXResolver looks up MX records; *net.Resolver satisfies it
+type MXResolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// MXCache remembers MX lookups so each domain is only resolved once
+type MXCache struct {
+	resolver MXResolver
+	mu       sync.Mutex
+	records  map[string][]*net.MX
+}
+
+// DefaultMXCache is shared by address validation and delivery planning
+var DefaultMXCache = NewMXCache(net.DefaultResolver)
+
+// NewMXCache creates an MX cache backed by the given resolver
+func NewMXCache(resolver MXResolver) *MXCache {
+	return &MXCache{
+		resolver: resolver,
+		records:  make(map[string][]*net.MX),
+	}
+}
+
+// Lookup returns the MX records for domain sorted by preference. Failed
+// lookups are not cached so they can be retried.
+func (c *MXCache) Lookup(domain string) ([]*net.MX, error) {
+	domain = strings.ToLower(domain)
+
+	c.mu.Lock()
+	records, ok := c.records[domain]
+	c.mu.Unlock()
+	if ok {
+		return records, nil
+	}
+
+	records, err := c.resolver.LookupMX(context.Background(), domain)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Pref != records[j].Pref {
+			return records[i].Pref < records[j].Pref
+		}
+		return records[i].Host < records[j].Host
+	})
+
+	c.mu.Lock()
+	c.records[domain] = records
+	c.mu.Unlock()
+	return records, nil
+}
+
+// DomainRoute describes how mail for one recipient domain would be delivered
+type DomainRoute struct {
+	Domain     string
+	Recipients []string
+	// MX holds the domain's MX records in preference order
+	MX []*net.MX
+	// Host is the server a direct send would connect to first
+	Host string
+	// Err is set when the domain cannot receive mail
+	Err error
+}
+
+// PlanDelivery groups recipients by domain and resolves where each domain's
+// mail would be delivered, in the order the domains first appear
+func PlanDelivery(cache *MXCache, recipients []string) []DomainRoute {
+	var routes []DomainRoute
+	index := make(map[string]int)
+	for _, recipient := range recipients {
+		domain := strings.ToLower(domainOf(recipient))
+		if i, ok := index[domain]; ok {
+			routes[i].Recipients = append(routes[i].Recipients, recipient)
+			continue
+		}
+		index[domain] = len(routes)
+		routes = append(routes, DomainRoute{Domain: domain, Recipients: []string{recipient}})
+	}
+
+	for i := range routes {
+		route := &routes[i]
+		records, err := cache.Lookup(route.Domain)
+		switch {
+		case err != nil:
+			route.Err = fmt.Errorf("failed to lookup MX records for %s: %v", route.Domain, err)
+		case len(records) == 0:
+			// RFC 5321 section 5.1: without MX records the domain itself is the implicit MX
+			route.Host = route.Domain
+		case len(records) == 1 && records[0].Host == ".":
+			// RFC 7505 null MX: the domain does not accept mail
+			route.MX = records
+			route.Err = fmt.Errorf("%s does not accept mail (null MX)", route.Domain)
+		default:
+			route.MX = records
+			route.Host = strings.TrimSuffix(records[0].Host, ".")
+		}
+	}
+	return routes
+}
@@ -0,0 +1,108 @@
+package message
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// maxLineLength is the RFC 5322 limit on a line, excluding the CRLF
+const maxLineLength = 998
+
+// singleHeaders may appear at most once in a message (RFC 5322 section 3.6)
+var singleHeaders = []string{"Date", "From", "Sender", "Reply-To", "To", "Cc", "Bcc", "Message-ID", "In-Reply-To", "References", "Subject"}
+
+// addressHeaders hold address lists that must parse as RFC 5322 addresses
+var addressHeaders = []string{"From", "Sender", "Reply-To", "To", "Cc", "Bcc"}
+
+// CheckRFC5322 checks a built message against RFC 5322: header lines must end
+// in CRLF, be US-ASCII and at most 998 characters, every field needs a valid
+// name, Date and From are required, fields such as Subject appear at most
+// once, the Date must parse and the address fields must hold valid addresses.
+// It returns every violation found.
+func CheckRFC5322(data []byte) []error {
+	var errs []error
+	// Lines net/mail cannot read stop the checks after the line by line ones
+	malformed := false
+	header := data
+	if end := bytes.Index(data, []byte("\r\n\r\n")); end >= 0 {
+		header = data[:end+2]
+	} else {
+		errs = append(errs, fmt.Errorf("no blank line ends the header section"))
+		malformed = true
+	}
+
+	for i, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		n := i + 1
+		line = strings.TrimSuffix(line, "\r\n")
+		if strings.ContainsAny(line, "\r\n") {
+			errs = append(errs, fmt.Errorf("header line %d contains a bare CR or LF", n))
+			malformed = true
+			continue
+		}
+		if len(line) > maxLineLength {
+			errs = append(errs, fmt.Errorf("header line %d is %d characters long, over the limit of %d", n, len(line), maxLineLength))
+		}
+		for _, r := range line {
+			if r > 126 {
+				errs = append(errs, fmt.Errorf("header line %d contains the non-ASCII character %q; encode it as in RFC 2047", n, r))
+				break
+			}
+		}
+		// Folded lines continue the field above
+		if line[0] == ' ' || line[0] == '\t' {
+			if n == 1 {
+				errs = append(errs, fmt.Errorf("header line 1 is a continuation line"))
+				malformed = true
+			}
+			continue
+		}
+		name, _, found := strings.Cut(line, ":")
+		if !found {
+			errs = append(errs, fmt.Errorf("header line %d has no field name: %q", n, line))
+			malformed = true
+			continue
+		}
+		if err := ValidateHeader(name, ""); err != nil {
+			errs = append(errs, fmt.Errorf("header line %d: %v", n, err))
+			malformed = true
+		}
+	}
+	if malformed {
+		return errs
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return append(errs, fmt.Errorf("message does not parse: %v", err))
+	}
+	for _, key := range []string{"Date", "From"} {
+		if len(msg.Header[key]) == 0 {
+			errs = append(errs, fmt.Errorf("required %s header is missing", key))
+		}
+	}
+	for _, key := range singleHeaders {
+		if n := len(msg.Header[textproto.CanonicalMIMEHeaderKey(key)]); n > 1 {
+			errs = append(errs, fmt.Errorf("%s header appears %d times, at most once is allowed", key, n))
+		}
+	}
+	if date := msg.Header.Get("Date"); date != "" {
+		if _, err := mail.ParseDate(date); err != nil {
+			errs = append(errs, fmt.Errorf("invalid Date header %q: %v", date, err))
+		}
+	}
+	for _, key := range addressHeaders {
+		if msg.Header.Get(key) == "" {
+			continue
+		}
+		if _, err := msg.Header.AddressList(key); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s header %q: %v", key, msg.Header.Get(key), err))
+		}
+	}
+	return errs
+}
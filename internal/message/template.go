@@ -2,6 +2,7 @@ package message
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"html/template"
 	"path/filepath"
@@ -17,6 +18,16 @@ type TemplateData struct {
 	Bcc     []string
 	Subject string
 	Data    map[string]interface{}
+	// Inline attachments are added before rendering so templates can reference them with {{cid "name"}}
+	Inline []Attachment
+}
+
+// templateFuncs are available to all templates. They are bound to the message
+// being rendered by Execute; these placeholders only exist for parsing.
+var templateFuncs = template.FuncMap{
+	"cid": func(string) (string, error) {
+		return "", errors.New("cid is only available while rendering a message")
+	},
 }
 
 // Template represents an email template
@@ -33,7 +44,7 @@ func LoadTemplate(subjectTemplate, textTemplate, htmlTemplate string) (*Template
 
 	// Load subject template
 	if subjectTemplate != "" {
-		t.subject, err = template.New(filepath.Base(subjectTemplate)).ParseFiles(subjectTemplate)
+		t.subject, err = template.New(filepath.Base(subjectTemplate)).Funcs(templateFuncs).ParseFiles(subjectTemplate)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse subject template: %v", err)
 		}
@@ -41,7 +52,7 @@ func LoadTemplate(subjectTemplate, textTemplate, htmlTemplate string) (*Template
 
 	// Load text template
 	if textTemplate != "" {
-		t.text, err = template.New(filepath.Base(textTemplate)).ParseFiles(textTemplate)
+		t.text, err = template.New(filepath.Base(textTemplate)).Funcs(templateFuncs).ParseFiles(textTemplate)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse text template: %v", err)
 		}
@@ -49,7 +60,7 @@ func LoadTemplate(subjectTemplate, textTemplate, htmlTemplate string) (*Template
 
 	// Load HTML template
 	if htmlTemplate != "" {
-		t.html, err = template.New(filepath.Base(htmlTemplate)).ParseFiles(htmlTemplate)
+		t.html, err = template.New(filepath.Base(htmlTemplate)).Funcs(templateFuncs).ParseFiles(htmlTemplate)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse HTML template: %v", err)
 		}
@@ -65,7 +76,7 @@ func LoadTemplateFromString(subjectTemplate, textTemplate, htmlTemplate string)
 
 	// Load subject template
 	if subjectTemplate != "" {
-		t.subject, err = template.New("subject").Parse(subjectTemplate)
+		t.subject, err = template.New("subject").Funcs(templateFuncs).Parse(subjectTemplate)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse subject template: %v", err)
 		}
@@ -73,7 +84,7 @@ func LoadTemplateFromString(subjectTemplate, textTemplate, htmlTemplate string)
 
 	// Load text template
 	if textTemplate != "" {
-		t.text, err = template.New("text").Parse(textTemplate)
+		t.text, err = template.New("text").Funcs(templateFuncs).Parse(textTemplate)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse text template: %v", err)
 		}
@@ -81,7 +92,7 @@ func LoadTemplateFromString(subjectTemplate, textTemplate, htmlTemplate string)
 
 	// Load HTML template
 	if htmlTemplate != "" {
-		t.html, err = template.New("html").Parse(htmlTemplate)
+		t.html, err = template.New("html").Funcs(templateFuncs).Parse(htmlTemplate)
 		if err != nil {
 			return nil, fmt.Errorf("failed to parse HTML template: %v", err)
 		}
@@ -96,6 +107,17 @@ func (t *Template) Execute(data *TemplateData) (*Message, error) {
 	msg.Cc = data.Cc
 	msg.Bcc = data.Bcc
 
+	// Add inline attachments first so {{cid "name"}} resolves to their Content-IDs
+	for _, attachment := range data.Inline {
+		msg.AddInline(attachment)
+	}
+	funcs := template.FuncMap{"cid": msg.ContentID}
+	for _, tmpl := range []*template.Template{t.subject, t.text, t.html} {
+		if tmpl != nil {
+			tmpl.Funcs(funcs)
+		}
+	}
+
 	// Render subject
 	if t.subject != nil {
 		var subject bytes.Buffer
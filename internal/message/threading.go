@@ -0,0 +1,58 @@
+package message
+
+import "strings"
+
+// SetInReplyTo sets the In-Reply-To header to the Message-ID of the message
+// being answered, adding the angle brackets if id has none. An empty id
+// removes the header.
+func (m *Message) SetInReplyTo(id string) {
+	m.setHeader("In-Reply-To", msgID(id))
+}
+
+// AddReference appends a Message-ID to the References header, adding the
+// angle brackets if id has none. The IDs are separated by spaces, between
+// which the header is folded when the message is built.
+func (m *Message) AddReference(id string) {
+	id = msgID(id)
+	if id == "" {
+		return
+	}
+	ids := append(strings.Fields(m.header("References")), id)
+	m.setHeader("References", strings.Join(ids, " "))
+}
+
+// msgID returns id trimmed and in angle brackets, or "" for an empty id
+func msgID(id string) string {
+	id = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(id), "<"), ">")
+	if id == "" {
+		return ""
+	}
+	return "<" + id + ">"
+}
+
+// header returns the value of a custom header, matching its name in any case
+func (m *Message) header(name string) string {
+	for key, value := range m.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+// setHeader sets a custom header, replacing one of the same name in any case;
+// an empty value removes it
+func (m *Message) setHeader(name, value string) {
+	for key := range m.Headers {
+		if strings.EqualFold(key, name) {
+			delete(m.Headers, key)
+		}
+	}
+	if value == "" {
+		return
+	}
+	if m.Headers == nil {
+		m.Headers = make(map[string]string)
+	}
+	m.Headers[name] = value
+}
@@ -2,9 +2,10 @@ package message
 
 import (
 	"fmt"
-	"net"
+	"net/mail"
 	"regexp"
 	"strings"
+	"time"
 )
 
 var (
@@ -20,6 +21,55 @@ func ValidateEmail(email string) error {
 	return nil
 }
 
+// disposableDomains are well-known disposable (throwaway) mailbox providers
+var disposableDomains = map[string]bool{
+	"10minutemail.com":  true,
+	"dispostable.com":   true,
+	"getnada.com":       true,
+	"guerrillamail.com": true,
+	"maildrop.cc":       true,
+	"mailinator.com":    true,
+	"sharklasers.com":   true,
+	"temp-mail.org":     true,
+	"throwawaymail.com": true,
+	"trashmail.com":     true,
+	"yopmail.com":       true,
+}
+
+// IsDisposableDomain reports whether domain, or a domain it is under, is a
+// well-known disposable mailbox provider
+func IsDisposableDomain(domain string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for {
+		if disposableDomains[domain] {
+			return true
+		}
+		dot := strings.IndexByte(domain, '.')
+		if dot < 0 {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+}
+
+// NormalizeAddress returns the canonical addr-spec for addr: surrounding
+// whitespace, any display name and angle brackets are removed and the domain
+// is lowercased. The local part keeps its case, as RFC 5321 leaves it to the
+// receiving server.
+func NormalizeAddress(addr string) string {
+	addr = strings.TrimSpace(addr)
+	if strings.HasSuffix(addr, ">") {
+		if open := strings.LastIndex(addr, "<"); open >= 0 {
+			addr = strings.TrimSpace(addr[open+1 : len(addr)-1])
+		}
+	}
+	at := strings.LastIndex(addr, "@")
+	if at < 0 {
+		return addr
+	}
+	return addr[:at+1] + strings.ToLower(addr[at+1:])
+}
+
 // ValidateEmailWithMX performs email validation including MX record lookup
 func ValidateEmailWithMX(email string) error {
 	if err := ValidateEmail(email); err != nil {
@@ -31,7 +81,7 @@ func ValidateEmailWithMX(email string) error {
 	domain := parts[1]
 
 	// Look up MX records
-	mxRecords, err := net.LookupMX(domain)
+	mxRecords, err := DefaultMXCache.Lookup(domain)
 	if err != nil {
 		return fmt.Errorf("failed to lookup MX records for %s: %v", domain, err)
 	}
@@ -59,25 +109,69 @@ func ValidateAddressList(addresses []string, checkMX bool) error {
 	return nil
 }
 
-// ValidateMessage validates all email addresses in a message
-func ValidateMessage(msg *Message, checkMX bool) error {
-	// Validate sender
-	if err := ValidateEmail(msg.From); err != nil {
-		return fmt.Errorf("invalid sender address: %v", err)
+// ValidateHeader checks that a header name and value cannot inject additional
+// headers or break the message structure
+func ValidateHeader(key, value string) error {
+	if key == "" {
+		return fmt.Errorf("header name is empty")
+	}
+	for _, r := range key {
+		// RFC 5322 field names are printable US-ASCII except colon
+		if r < 33 || r > 126 || r == ':' {
+			return fmt.Errorf("invalid character %q in header name %q", r, key)
+		}
 	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("header %s contains a line break", key)
+	}
+	return nil
+}
+
+// dateFormatSample is formatted with a Date layout to check it. An afternoon
+// hour and a zone offset catch layouts that drop AM/PM or the zone.
+var dateFormatSample = time.Date(2024, time.November, 23, 21, 5, 9, 0, time.FixedZone("", -5*60*60))
 
-	// Validate recipients
-	if err := ValidateAddressList(msg.To, checkMX); err != nil {
-		return fmt.Errorf("invalid To address: %v", err)
+// ValidateDateFormat checks that the Go time layout produces dates that parse
+// as RFC 5322 dates and keep the time they stand for, to the minute at least
+func ValidateDateFormat(layout string) error {
+	formatted := dateFormatSample.Format(layout)
+	parsed, err := mail.ParseDate(formatted)
+	if err != nil {
+		return fmt.Errorf("date format %q gives %q, which is not an RFC 5322 date: %v", layout, formatted, err)
+	}
+	// RFC 5322 makes the seconds optional
+	if !parsed.Equal(dateFormatSample) && !parsed.Equal(dateFormatSample.Truncate(time.Minute)) {
+		return fmt.Errorf("date format %q gives %q, which reads as %s", layout, formatted, parsed.Format(time.RFC1123Z))
 	}
+	return nil
+}
 
-	if err := ValidateAddressList(msg.Cc, checkMX); err != nil {
-		return fmt.Errorf("invalid Cc address: %v", err)
+// ValidateMessage validates all email addresses in a message
+func ValidateMessage(msg *Message, checkMX bool) error {
+	if errs := ValidateAddresses(msg.From, msg.To, msg.Cc, msg.Bcc, checkMX); len(errs) > 0 {
+		return errs[0]
 	}
+	return nil
+}
 
-	if err := ValidateAddressList(msg.Bcc, checkMX); err != nil {
-		return fmt.Errorf("invalid Bcc address: %v", err)
+// ValidateAddresses validates the sender and every recipient, returning one
+// error per invalid address rather than stopping at the first
+func ValidateAddresses(from string, to, cc, bcc []string, checkMX bool) []error {
+	var errs []error
+	if err := ValidateEmail(from); err != nil {
+		errs = append(errs, fmt.Errorf("invalid sender address: %v", err))
 	}
 
-	return nil
+	lists := []struct {
+		field     string
+		addresses []string
+	}{{"To", to}, {"Cc", cc}, {"Bcc", bcc}}
+	for _, list := range lists {
+		for _, addr := range list.addresses {
+			if err := ValidateAddressList([]string{addr}, checkMX); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s address: %v", list.field, err))
+			}
+		}
+	}
+	return errs
 }
@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DomainLimiter spaces out sends to each recipient domain so a single
+// receiving domain is not flooded while mail to other domains proceeds
+type DomainLimiter struct {
+	interval time.Duration
+	mu       sync.Mutex
+	// next holds the earliest time each domain may be sent to again
+	next map[string]time.Time
+	now  func() time.Time
+}
+
+// NewDomainLimiter creates a limiter allowing perSecond sends to each domain.
+// A rate of zero or less disables limiting.
+func NewDomainLimiter(perSecond float64) *DomainLimiter {
+	l := &DomainLimiter{
+		next: make(map[string]time.Time),
+		now:  time.Now,
+	}
+	if perSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return l
+}
+
+// Reserve claims the next send slot for domain and returns how long to wait
+// before using it
+func (l *DomainLimiter) Reserve(domain string) time.Duration {
+	if l.interval == 0 {
+		return 0
+	}
+	domain = strings.ToLower(domain)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	slot := l.next[domain]
+	if slot.Before(now) {
+		slot = now
+	}
+	l.next[domain] = slot.Add(l.interval)
+	return slot.Sub(now)
+}
+
+// Wait reserves a slot for every domain and blocks until all of them are
+// due, or until ctx is cancelled
+func (l *DomainLimiter) Wait(ctx context.Context, domains ...string) error {
+	var delay time.Duration
+	for _, domain := range domains {
+		if d := l.Reserve(domain); d > delay {
+			delay = d
+		}
+	}
+	if delay == 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDomainLimiter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	l := NewDomainLimiter(2)
+	l.now = func() time.Time { return now }
+
+	tests := []struct {
+		name   string
+		domain string
+		want   time.Duration
+	}{
+		{"first recipient at domain", "example.com", 0},
+		{"second recipient at same domain", "Example.COM", 500 * time.Millisecond},
+		{"recipient at another domain", "example.org", 0},
+		{"third recipient at same domain", "example.com", time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.Reserve(tt.domain); got != tt.want {
+				t.Errorf("Reserve(%q) = %s, want %s", tt.domain, got, tt.want)
+			}
+		})
+	}
+
+	// Once the interval has passed the domain is free again
+	now = start.Add(2 * time.Second)
+	if got := l.Reserve("example.com"); got != 0 {
+		t.Errorf("Reserve() after idle period = %s, want 0", got)
+	}
+}
+
+func TestDomainLimiterWait(t *testing.T) {
+	l := NewDomainLimiter(20)
+	ctx := context.Background()
+
+	start := time.Now()
+	if err := l.Wait(ctx, "example.com"); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if err := l.Wait(ctx, "example.org"); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 25*time.Millisecond {
+		t.Errorf("sends to different domains waited %s", elapsed)
+	}
+	if err := l.Wait(ctx, "example.com"); err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("second send to the same domain after %s, want it spaced by 50ms", elapsed)
+	}
+
+	// Cancellation interrupts the wait
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.Wait(cancelled, "example.com"); err == nil {
+		t.Error("Wait() with a cancelled context returned nil")
+	}
+
+	// A zero rate never waits
+	if d := NewDomainLimiter(0).Reserve("example.com"); d != 0 {
+		t.Errorf("unlimited Reserve() = %s, want 0", d)
+	}
+}
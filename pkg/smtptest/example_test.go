@@ -0,0 +1,25 @@
+package smtptest_test
+
+import (
+	"fmt"
+	"net/smtp"
+
+	"github.com/asachs/smtp-edc/pkg/smtptest"
+)
+
+func ExampleServer() {
+	srv := smtptest.NewServer(nil)
+	defer srv.Close()
+
+	// The code under test sends to srv.Addr instead of a real server
+	msg := []byte("Subject: Welcome\r\n\r\nHello!\r\n")
+	if err := smtp.SendMail(srv.Addr, nil, "app@example.com", []string{"user@example.com"}, msg); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	for _, m := range srv.Messages() {
+		fmt.Printf("%s -> %v: %q\n", m.From, m.To, m.Data)
+	}
+	// Output: app@example.com -> [user@example.com]: "Subject: Welcome\r\n\r\nHello!\r\n"
+}
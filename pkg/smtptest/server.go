@@ -0,0 +1,479 @@
+// Package smtptest provides a fake SMTP server for testing code that sends
+// mail, in the style of net/http/httptest. The server accepts every message
+// to recipients it is not told to refuse, and records its envelope and
+// content for the test to inspect.
+package smtptest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config sets what the server advertises and requires
+type Config struct {
+	// Hostname is announced in the greeting and EHLO reply (default "smtptest.local")
+	Hostname string
+	// Extensions are advertised in the EHLO reply in addition to those the
+	// server adds itself, e.g. "PIPELINING" or "SIZE 10485760"
+	Extensions []string
+	// Users maps usernames to passwords. When set, AUTH PLAIN and LOGIN are
+	// advertised and MAIL FROM is refused until the client authenticates.
+	Users map[string]string
+	// StartTLS advertises STARTTLS, using TLSConfig or a self-signed
+	// certificate for "localhost" and 127.0.0.1 if TLSConfig is nil
+	StartTLS bool
+	// ImplicitTLS starts TLS as soon as a client connects, as on port 465,
+	// with the same certificate
+	ImplicitTLS bool
+	TLSConfig   *tls.Config
+	// RejectRecipients are refused at RCPT TO with 550, matched case-insensitively
+	RejectRecipients []string
+}
+
+// Message is a message received by the server
+type Message struct {
+	From string
+	// MailParameters are the parameters given after the MAIL FROM address, e.g. "SIZE=1024"
+	MailParameters []string
+	To             []string
+	// RcptParameters are the parameters given after each RCPT TO address, by
+	// recipient, e.g. "NOTIFY=FAILURE"
+	RcptParameters map[string][]string
+	// Data is the content sent after DATA, with dot-stuffing removed and
+	// without the terminating "."
+	Data []byte
+	// Username is the authenticated user, if any
+	Username string
+	// TLS reports whether the message was sent over TLS
+	TLS bool
+}
+
+// Server is a fake SMTP server listening on a local port
+type Server struct {
+	// Addr is the host:port the server listens on
+	Addr     string
+	Listener net.Listener
+	config   Config
+	cert     *x509.Certificate
+
+	mu       sync.Mutex
+	messages []Message
+	conns    map[net.Conn]bool
+	accepted int
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// NewServer starts a server on a random port of 127.0.0.1. A nil config
+// gives a server with no authentication and no TLS. The caller should Close
+// the server when done.
+func NewServer(config *Config) *Server {
+	s := &Server{conns: make(map[net.Conn]bool)}
+	if config != nil {
+		s.config = *config
+	}
+	if s.config.Hostname == "" {
+		s.config.Hostname = "smtptest.local"
+	}
+	if (s.config.StartTLS || s.config.ImplicitTLS) && s.config.TLSConfig == nil {
+		cert, err := selfSignedCertificate()
+		if err != nil {
+			panic(fmt.Sprintf("smtptest: failed to create certificate: %v", err))
+		}
+		s.cert = cert.Leaf
+		s.config.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to listen: %v", err))
+	}
+	s.Addr = ln.Addr().String()
+	if s.config.ImplicitTLS {
+		ln = tls.NewListener(ln, s.config.TLSConfig)
+	}
+	s.Listener = ln
+
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Host returns the address the server listens on, without the port
+func (s *Server) Host() string {
+	return s.Listener.Addr().(*net.TCPAddr).IP.String()
+}
+
+// Port returns the port the server listens on
+func (s *Server) Port() int {
+	return s.Listener.Addr().(*net.TCPAddr).Port
+}
+
+// Certificate returns the self-signed certificate presented for TLS, for
+// clients to trust, or nil if the server does not generate one
+func (s *Server) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+// Messages returns the messages received so far, in the order they were accepted
+func (s *Server) Messages() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Message(nil), s.messages...)
+}
+
+// Connections returns the number of connections accepted so far
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// Close stops the server, closes open connections and waits for them to finish
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	s.Listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// serve accepts connections until the listener is closed
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.Listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.accepted++
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go func() {
+			defer s.wg.Done()
+			(&session{server: s, conn: conn, tls: s.config.ImplicitTLS}).run()
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// session is one client connection
+type session struct {
+	server   *Server
+	conn     net.Conn
+	reader   *bufio.Reader
+	tls      bool
+	username string
+	// msg is the transaction in progress, nil before MAIL FROM
+	msg *Message
+}
+
+// reply writes a response line
+func (s *session) reply(format string, args ...interface{}) {
+	fmt.Fprintf(s.conn, format+"\r\n", args...)
+}
+
+// run answers commands until the client quits or disconnects
+func (s *session) run() {
+	config := s.server.config
+	s.reader = bufio.NewReader(s.conn)
+	s.reply("220 %s ESMTP smtptest", config.Hostname)
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			s.msg = nil
+			s.ehlo()
+		case "HELO":
+			s.msg = nil
+			s.reply("250 %s", config.Hostname)
+		case "STARTTLS":
+			if !config.StartTLS || s.tls {
+				s.reply("502 5.5.1 STARTTLS not available")
+				continue
+			}
+			s.reply("220 2.0.0 Ready to start TLS")
+			tlsConn := tls.Server(s.conn, config.TLSConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			s.conn = tlsConn
+			s.reader = bufio.NewReader(tlsConn)
+			s.tls = true
+			s.msg = nil
+		case "AUTH":
+			s.auth(arg)
+		case "MAIL":
+			s.mail(arg)
+		case "RCPT":
+			s.rcpt(arg)
+		case "DATA":
+			if !s.data() {
+				return
+			}
+		case "RSET":
+			s.msg = nil
+			s.reply("250 2.0.0 OK")
+		case "NOOP":
+			s.reply("250 2.0.0 OK")
+		case "VRFY":
+			s.reply("252 2.5.2 Cannot VRFY user")
+		case "QUIT":
+			s.reply("221 2.0.0 Bye")
+			return
+		default:
+			s.reply("502 5.5.2 Command not recognized")
+		}
+	}
+}
+
+// ehlo replies with the configured and built-in extensions
+func (s *session) ehlo() {
+	config := s.server.config
+	extensions := append([]string{}, config.Extensions...)
+	if config.StartTLS && !s.tls {
+		extensions = append(extensions, "STARTTLS")
+	}
+	if len(config.Users) > 0 {
+		extensions = append(extensions, "AUTH PLAIN LOGIN")
+	}
+	if len(extensions) == 0 {
+		s.reply("250 %s", config.Hostname)
+		return
+	}
+	s.reply("250-%s", config.Hostname)
+	for i, ext := range extensions {
+		sep := "-"
+		if i == len(extensions)-1 {
+			sep = " "
+		}
+		s.reply("250%s%s", sep, ext)
+	}
+}
+
+// auth runs an AUTH PLAIN or LOGIN exchange
+func (s *session) auth(arg string) {
+	if len(s.server.config.Users) == 0 {
+		s.reply("502 5.5.1 AUTH not available")
+		return
+	}
+	if s.username != "" {
+		s.reply("503 5.5.1 Already authenticated")
+		return
+	}
+	mech, initial, _ := strings.Cut(arg, " ")
+
+	var username, password string
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		response := initial
+		if response == "" {
+			var ok bool
+			if response, ok = s.challenge(""); !ok {
+				return
+			}
+		}
+		decoded, err := base64.StdEncoding.DecodeString(response)
+		parts := strings.Split(string(decoded), "\x00")
+		if err != nil || len(parts) != 3 {
+			s.reply("501 5.5.2 Invalid PLAIN response")
+			return
+		}
+		username, password = parts[1], parts[2]
+	case "LOGIN":
+		user, ok := s.challenge("VXNlcm5hbWU6")
+		if !ok {
+			return
+		}
+		pass, ok := s.challenge("UGFzc3dvcmQ6")
+		if !ok {
+			return
+		}
+		u, err1 := base64.StdEncoding.DecodeString(user)
+		p, err2 := base64.StdEncoding.DecodeString(pass)
+		if err1 != nil || err2 != nil {
+			s.reply("501 5.5.2 Invalid LOGIN response")
+			return
+		}
+		username, password = string(u), string(p)
+	default:
+		s.reply("504 5.5.4 Unrecognized authentication type")
+		return
+	}
+
+	if want, ok := s.server.config.Users[username]; !ok || want != password {
+		s.reply("535 5.7.8 Authentication credentials invalid")
+		return
+	}
+	s.username = username
+	s.reply("235 2.7.0 Authentication successful")
+}
+
+// challenge sends a 334 challenge and returns the client's answer; ok is
+// false if the client cancelled the exchange or disconnected
+func (s *session) challenge(text string) (string, bool) {
+	s.reply("334 %s", text)
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return "", false
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "*" {
+		s.reply("501 5.0.0 Authentication cancelled")
+		return "", false
+	}
+	return line, true
+}
+
+// mail starts a transaction
+func (s *session) mail(arg string) {
+	if len(s.server.config.Users) > 0 && s.username == "" {
+		s.reply("530 5.7.0 Authentication required")
+		return
+	}
+	if s.msg != nil {
+		s.reply("503 5.5.1 Nested MAIL command")
+		return
+	}
+	addr, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		s.reply("501 5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	s.msg = &Message{From: addr, MailParameters: params, Username: s.username, TLS: s.tls}
+	s.reply("250 2.1.0 OK")
+}
+
+// rcpt adds a recipient to the transaction
+func (s *session) rcpt(arg string) {
+	if s.msg == nil {
+		s.reply("503 5.5.1 Need MAIL before RCPT")
+		return
+	}
+	addr, params, ok := parsePath(arg, "TO:")
+	if !ok || addr == "" {
+		s.reply("501 5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	for _, rejected := range s.server.config.RejectRecipients {
+		if strings.EqualFold(addr, rejected) {
+			s.reply("550 5.1.1 <%s>: Recipient address rejected", addr)
+			return
+		}
+	}
+	s.msg.To = append(s.msg.To, addr)
+	if len(params) > 0 {
+		if s.msg.RcptParameters == nil {
+			s.msg.RcptParameters = make(map[string][]string)
+		}
+		s.msg.RcptParameters[addr] = params
+	}
+	s.reply("250 2.1.5 OK")
+}
+
+// data reads the message content and records the message. It returns false
+// if the connection was lost.
+func (s *session) data() bool {
+	if s.msg == nil || len(s.msg.To) == 0 {
+		s.reply("503 5.5.1 Need RCPT before DATA")
+		return true
+	}
+	s.reply("354 Start mail input; end with <CRLF>.<CRLF>")
+	var data strings.Builder
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return false
+		}
+		if line == ".\r\n" || line == ".\n" {
+			break
+		}
+		data.WriteString(strings.TrimPrefix(line, "."))
+	}
+
+	s.msg.Data = []byte(data.String())
+	s.server.mu.Lock()
+	s.server.messages = append(s.server.messages, *s.msg)
+	n := len(s.server.messages)
+	s.server.mu.Unlock()
+	s.msg = nil
+	s.reply("250 2.0.0 OK queued as %d", n)
+	return true
+}
+
+// parsePath parses "FROM:<addr> PARAM..." or "TO:<addr> PARAM..."
+func parsePath(arg, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	fields := strings.Fields(strings.TrimSpace(arg[len(prefix):]))
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "<") || !strings.HasSuffix(fields[0], ">") {
+		return "", nil, false
+	}
+	return strings.Trim(fields[0], "<>"), fields[1:], true
+}
+
+// selfSignedCertificate creates a certificate for localhost and 127.0.0.1
+func selfSignedCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "smtptest " + strconv.FormatInt(serial.Int64(), 16)},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
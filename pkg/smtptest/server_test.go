@@ -0,0 +1,138 @@
+package smtptest
+
+import (
+	"crypto/x509"
+	"net/smtp"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/asachs/smtp-edc/internal/client"
+	"github.com/asachs/smtp-edc/internal/message"
+)
+
+func TestServerRecordsMessages(t *testing.T) {
+	srv := NewServer(&Config{Extensions: []string{"PIPELINING", "SIZE 1000000"}})
+	defer srv.Close()
+
+	body := "Subject: Hi\r\n\r\n.leading dot\r\nbye\r\n"
+	if err := smtp.SendMail(srv.Addr, nil, "from@example.com", []string{"a@example.com", "b@example.com"}, []byte(body)); err != nil {
+		t.Fatalf("SendMail() error = %v", err)
+	}
+
+	messages := srv.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Messages() holds %d messages, want 1", len(messages))
+	}
+	got := messages[0]
+	if got.From != "from@example.com" || !reflect.DeepEqual(got.To, []string{"a@example.com", "b@example.com"}) {
+		t.Errorf("envelope = %s -> %v", got.From, got.To)
+	}
+	if string(got.Data) != body {
+		t.Errorf("Data = %q, want %q", got.Data, body)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	srv := NewServer(&Config{Users: map[string]string{"user": "secret"}})
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{name: "wrong password", password: "wrong", wantErr: true},
+		{name: "right password", password: "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := client.NewSMTPClient("localhost", false)
+			c.SetRetryConfig(1, 0)
+			if err := c.Connect(srv.Host(), srv.Port()); err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer c.Close()
+			if err := c.Ehlo(); err != nil {
+				t.Fatalf("Ehlo() error = %v", err)
+			}
+			err := c.Authenticate("login", "user", tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Authenticate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// A message can only be sent once authenticated
+	if err := smtp.SendMail(srv.Addr, nil, "from@example.com", []string{"to@example.com"}, []byte("\r\n")); err == nil {
+		t.Error("SendMail() without AUTH was accepted")
+	}
+	if n := len(srv.Messages()); n != 0 {
+		t.Errorf("Messages() holds %d messages, want none", n)
+	}
+}
+
+func TestServerStartTLS(t *testing.T) {
+	srv := NewServer(&Config{StartTLS: true, Users: map[string]string{"user": "secret"}})
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	c := client.NewSMTPClient("localhost", false)
+	c.SetRetryConfig(1, 0)
+	c.SetRootCAs(pool)
+	if err := c.Connect("localhost", srv.Port()); err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.Ehlo(); err != nil {
+		t.Fatalf("Ehlo() error = %v", err)
+	}
+	if err := c.StartTLS(); err != nil {
+		t.Fatalf("StartTLS() error = %v", err)
+	}
+	if err := c.Ehlo(); err != nil {
+		t.Fatalf("Ehlo() after STARTTLS error = %v", err)
+	}
+	if err := c.Authenticate("plain", "user", "secret"); err != nil {
+		t.Fatalf("Authenticate() error = %v", err)
+	}
+	if err := c.SendMessage(message.NewMessage("from@example.com", []string{"to@example.com"}, "Secure", "Body")); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	messages := srv.Messages()
+	if len(messages) != 1 {
+		t.Fatalf("Messages() holds %d messages, want 1", len(messages))
+	}
+	if got := messages[0]; !got.TLS || got.Username != "user" || !strings.Contains(string(got.Data), "Subject: Secure\r\n") {
+		t.Errorf("message = %+v, want it sent over TLS by user with the subject", got)
+	}
+}
+
+func TestServerImplicitTLS(t *testing.T) {
+	srv := NewServer(&Config{ImplicitTLS: true})
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	c := client.NewSMTPClient("localhost", false)
+	c.SetRetryConfig(1, 0)
+	c.SetRootCAs(pool)
+	if err := c.ConnectTLS("localhost", srv.Port()); err != nil {
+		t.Fatalf("ConnectTLS() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.Ehlo(); err != nil {
+		t.Fatalf("Ehlo() error = %v", err)
+	}
+	if c.Capabilities().StartTLS {
+		t.Error("STARTTLS advertised on a TLS connection")
+	}
+	if err := c.SendMessage(message.NewMessage("from@example.com", []string{"to@example.com"}, "Implicit", "Body")); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if messages := srv.Messages(); len(messages) != 1 || !messages[0].TLS {
+		t.Errorf("Messages() = %+v, want one message sent over TLS", messages)
+	}
+}
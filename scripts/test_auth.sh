@@ -5,7 +5,7 @@ echo "Testing SMTP authentication and TLS functionality..."
 
 # Build the tool
 echo "Building smtp-edc..."
-go build -o smtp-edc cmd/smtp-edc/main.go
+go build -o smtp-edc ./cmd/smtp-edc
 
 # Test PLAIN authentication
 echo "Testing PLAIN authentication..."
@@ -5,7 +5,7 @@ echo "Testing basic SMTP functionality..."
 
 # Build the tool
 echo "Building smtp-edc..."
-go build -o smtp-edc cmd/smtp-edc/main.go
+go build -o smtp-edc ./cmd/smtp-edc
 
 # Test with debug mode
 echo "Testing with debug mode..."